@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/acasajus/menac/db"
+	"github.com/acasajus/menac/ostore"
+	"github.com/acasajus/menac/registry"
+)
+
+const commandUsage = `Usage: menac [flags] <command>
+  ostore reconcile <organization>
+  ostore usage-token <organization>
+  ostore presign get <organization> <store> <user> <object id> <duration>
+  ostore presign put <organization> <store> <user> <group> <type> <duration>
+  ostore migrate --from <store> --to <store> [--workers n] [--rate bytes/s] [--delete-source] [--diff [--verify]] <organization>
+  ostore pack <organization> <store> <user> <group> <directory>
+  ostore unpack <organization> <store> <user> <object id> <directory>
+  ostore cat <organization> <store> <user> <object id> <path in archive>`
+
+// Subcommands run instead of the node. They all need the aerospike cluster
+func runCommand(args []string, d db.DB, presigner *ostore.Presigner, usageKey []byte) error {
+	if d == nil {
+		return errors.New("Commands need -aerospike")
+	}
+	switch {
+	case len(args) == 3 && args[0] == "ostore" && args[1] == "reconcile":
+		usage, err := ostore.ReconcileUsage(d, args[2])
+		if err != nil {
+			return err
+		}
+		for _, u := range usage {
+			fmt.Printf("%s %s: %d bytes, %d objects\n", u.Scope, u.Name, u.Bytes, u.Objects)
+		}
+		return nil
+	case len(args) == 3 && args[0] == "ostore" && args[1] == "usage-token":
+		if len(usageKey) == 0 {
+			return errors.New("Usage tokens need -usage-key")
+		}
+		fmt.Println(ostore.UsageToken(usageKey, args[2]))
+		return nil
+	case len(args) > 2 && args[0] == "ostore" && args[1] == "presign":
+		return presignCommand(args[2:], d, presigner)
+	case len(args) > 2 && args[0] == "ostore" && args[1] == "migrate":
+		return migrateCommand(args[2:], d)
+	case len(args) == 7 && args[0] == "ostore" && args[1] == "pack":
+		return packCommand(args[2:], d)
+	case len(args) == 7 && args[0] == "ostore" && (args[1] == "unpack" || args[1] == "cat"):
+		return unpackCommand(args[1], args[2:], d)
+	}
+	return errors.New(commandUsage)
+}
+
+func presignCommand(args []string, d db.DB, presigner *ostore.Presigner) error {
+	if presigner == nil {
+		return errors.New("Presigning needs -presign-key and -presign-url")
+	}
+	if len(args) < 4 {
+		return errors.New(commandUsage)
+	}
+	ttl, err := time.ParseDuration(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+	o := d.LinkRecordToDB(&registry.Organization{Handle: args[1]}).(*registry.Organization)
+	os, err := ostore.GetObjectStore(o, args[2])
+	if err != nil {
+		return err
+	}
+	var u string
+	switch {
+	case args[0] == "get" && len(args) == 6:
+		p, err := userPrincipal(o, args[3])
+		if err != nil {
+			return err
+		}
+		so, err := os.As(p).GetObject(args[4])
+		if err != nil {
+			return err
+		}
+		u, err = presigner.PresignGet(so, time.Now().Add(ttl), 0, 0)
+	case args[0] == "put" && len(args) == 7:
+		so := os.NewObject()
+		so.User, so.Group, so.Type = args[3], args[4], args[5]
+		if err := checkCanCreate(o, so.User, so.Group); err != nil {
+			return err
+		}
+		fmt.Printf("Object id: %s\n", so.Id)
+		u, err = presigner.PresignPut(so, time.Now().Add(ttl), 0)
+	default:
+		return errors.New(commandUsage)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(u)
+	return nil
+}
+
+// Uploads are presigned on behalf of a user, who has to be able to create
+// objects in the group
+func checkCanCreate(o *registry.Organization, user, group string) error {
+	p, err := userPrincipal(o, user)
+	if err != nil {
+		return err
+	}
+	if _, err := o.GetGroup(group); err != nil {
+		return err
+	}
+	if !p.CanCreate(group) {
+		return ostore.ErrAccessDenied
+	}
+	return nil
+}
+
+func userPrincipal(o *registry.Organization, user string) (*ostore.Principal, error) {
+	if err := o.GetDB().GetRecord([]byte(o.Handle), o); err != nil {
+		return nil, err
+	}
+	return ostore.NewPrincipal(o, user)
+}
+
+func migrateCommand(args []string, d db.DB) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := fs.String("from", "", "Store to move the objects from")
+	to := fs.String("to", "", "Store to move the objects to")
+	workers := fs.Int("workers", ostore.MIGRATE_WORKERS, "Objects migrated concurrently")
+	rate := fs.Int64("rate", 0, "Bytes per second read from the source store. 0 disables the limit")
+	deleteSource := fs.Bool("delete-source", false, "Release the data in the source store once migrated")
+	diff := fs.Bool("diff", false, "Only report pending, missing and mismatched objects")
+	verify := fs.Bool("verify", false, "Read the migrated data back when diffing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || len(*from) == 0 || len(*to) == 0 {
+		return errors.New(commandUsage)
+	}
+	o := d.LinkRecordToDB(&registry.Organization{Handle: fs.Arg(0)}).(*registry.Organization)
+	src, err := ostore.GetObjectStore(o, *from)
+	if err != nil {
+		return err
+	}
+	dst, err := ostore.GetObjectStore(o, *to)
+	if err != nil {
+		return err
+	}
+	m, err := ostore.NewMigration(src, dst)
+	if err != nil {
+		return err
+	}
+	m.Workers, m.Rate, m.DeleteSource, m.Diff, m.Verify = *workers, *rate, *deleteSource, *diff, *verify
+	report, err := m.Run()
+	if report != nil {
+		for _, id := range report.Missing {
+			fmt.Printf("missing %s\n", id)
+		}
+		for _, id := range report.Mismatched {
+			fmt.Printf("mismatched %s\n", id)
+		}
+		for _, e := range report.Errors {
+			fmt.Printf("error: %s\n", e)
+		}
+		fmt.Println(report)
+	}
+	return err
+}
+
+// Store a directory as a tar.gz archive object of the user
+func packCommand(args []string, d db.DB) error {
+	o := d.LinkRecordToDB(&registry.Organization{Handle: args[0]}).(*registry.Organization)
+	os, err := ostore.GetObjectStore(o, args[1])
+	if err != nil {
+		return err
+	}
+	p, err := userPrincipal(o, args[2])
+	if err != nil {
+		return err
+	}
+	so := os.NewObject()
+	so.User, so.Group, so.Type = args[2], args[3], ostore.ARCHIVE_OBJECT_TYPE
+	if err := os.As(p).PutArchive(so, args[4]); err != nil {
+		return err
+	}
+	fmt.Printf("Object id: %s\n", so.Id)
+	return nil
+}
+
+// Extract an archive object into a directory, or write one of its files to
+// the standard output
+func unpackCommand(cmd string, args []string, d db.DB) error {
+	o := d.LinkRecordToDB(&registry.Organization{Handle: args[0]}).(*registry.Organization)
+	p, err := userPrincipal(o, args[2])
+	if err != nil {
+		return err
+	}
+	objects, err := ostore.GetObjectStore(o, args[1])
+	if err != nil {
+		return err
+	}
+	store := objects.As(p)
+	so, err := store.GetObject(args[3])
+	if err != nil {
+		return err
+	}
+	if cmd == "unpack" {
+		return store.ExtractArchive(so, args[4])
+	}
+	r, err := store.OpenArchiveFile(so, args[4])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(os.Stdout, r)
+	return err
+}
@@ -1,127 +1,294 @@
 package coord
 
 import (
+	"errors"
+	"expvar"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 
 	pb "github.com/acasajus/menac/coord/proto"
+	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
-type RaftSender interface {
+const (
+	//Max number of messages waiting to be sent to a peer
+	HUB_QUEUE_SIZE  = 4096
+	HUB_MIN_BACKOFF = 100 * time.Millisecond
+	HUB_MAX_BACKOFF = 10 * time.Second
+	//Metadata key used to tell peers who is on the other side of a stream
+	HUB_PEER_ID_HEADER = "peer-id"
+)
+
+var (
+	hubQueueDepth = expvar.NewMap("coord.hub.queue")
+	hubDropped    = expvar.NewMap("coord.hub.dropped")
+	hubSent       = expvar.NewMap("coord.hub.sent")
+	//Messages dropped because the hub has no way to reach their destination
+	hubUnknown = expvar.NewMap("coord.hub.unknown")
+)
+
+var errStreamClosed = errors.New("Raft stream closed by peer")
+
+// Feedback for raft about the delivery of its messages. raft.Node implements it
+type RaftReporter interface {
+	ReportUnreachable(id uint64)
+	ReportSnapshot(id uint64, status raft.SnapshotStatus)
+}
+
+type HubPeerStats struct {
+	Queued  int
+	Dropped int64
+	Sent    int64
+}
+
+// Sending side of a raft stream
+type stepSender interface {
 	Send(*pb.RaftStep) error
 }
 
-type hubAction struct {
-	add          bool
-	id           uint64
-	client       pb.CoordinateClient
-	serverStream pb.Coordinate_EmitRaftStepServer
+type hubPeer struct {
+	id     uint64
+	key    string
+	client pb.CoordinateClient
+	queue  chan *raftpb.Message
+	done   chan struct{}
+
+	dropped expvar.Int
+	sent    expvar.Int
 }
 
+// Routes raft messages through a bounded queue and stream per peer
 type Hub struct {
-	clientMap    map[uint64]pb.CoordinateClient
-	sendMap      map[uint64]RaftSender
-	sendChan     chan *raftpb.Message
-	actionChan   chan *hubAction
+	self         uint64
+	lock         sync.RWMutex
+	peers        map[uint64]*hubPeer
+	reporter     RaftReporter
 	doneChan     chan struct{}
 	receivedChan chan *raftpb.Message
+	//Unknown destinations already logged
+	unknown map[uint64]bool
 }
 
-func NewHub(receivedChan chan *raftpb.Message) *Hub {
-	h := &Hub{
+func NewHub(self uint64, receivedChan chan *raftpb.Message, reporter RaftReporter) *Hub {
+	return &Hub{
+		self:         self,
 		receivedChan: receivedChan,
-		clientMap:    make(map[uint64]pb.CoordinateClient),
-		sendMap:      make(map[uint64]RaftSender),
-		sendChan:     make(chan *raftpb.Message),
-		actionChan:   make(chan *hubAction),
+		reporter:     reporter,
+		peers:        make(map[uint64]*hubPeer),
 		doneChan:     make(chan struct{}),
+		unknown:      make(map[uint64]bool),
 	}
-	go h.run()
-	return h
 }
 
+// Queue a message for its destination, dropping it if the queue is full
 func (h *Hub) SendMessage(msg *raftpb.Message) {
-	h.sendChan <- msg
+	h.lock.RLock()
+	p, ok := h.peers[msg.To]
+	h.lock.RUnlock()
+	if !ok {
+		h.dropUnknown(msg)
+		return
+	}
+	select {
+	case p.queue <- msg:
+		hubQueueDepth.Add(p.key, 1)
+	default:
+		p.dropped.Add(1)
+		hubDropped.Add(p.key, 1)
+		h.reportFailure(msg)
+	}
+}
+
+func (h *Hub) dropUnknown(msg *raftpb.Message) {
+	hubUnknown.Add(strconv.FormatUint(msg.To, 10), 1)
+	h.lock.Lock()
+	logged := h.unknown[msg.To]
+	h.unknown[msg.To] = true
+	h.lock.Unlock()
+	if !logged {
+		log.Printf("coord: No connection to peer %d, dropping its messages until there is one", msg.To)
+	}
+	h.reportFailure(msg)
+}
+
+func (h *Hub) reportFailure(msg *raftpb.Message) {
+	h.reporter.ReportUnreachable(msg.To)
+	if msg.Type == raftpb.MsgSnap {
+		h.reporter.ReportSnapshot(msg.To, raft.SnapshotFailure)
+	}
 }
 
 func (h *Hub) AddClient(id uint64, c *grpc.ClientConn) {
-	h.actionChan <- &hubAction{
-		add:    true,
-		client: pb.NewCoordinateClient(c),
+	h.addPeer(id, pb.NewCoordinateClient(c))
+}
+
+func newHubPeer(id uint64, client pb.CoordinateClient) *hubPeer {
+	return &hubPeer{
 		id:     id,
+		key:    strconv.FormatUint(id, 10),
+		client: client,
+		queue:  make(chan *raftpb.Message, HUB_QUEUE_SIZE),
+		done:   make(chan struct{}),
+	}
+}
+
+func (h *Hub) addPeer(id uint64, client pb.CoordinateClient) {
+	p := newHubPeer(id, client)
+	h.lock.Lock()
+	if old, ok := h.peers[id]; ok {
+		close(old.done)
+	}
+	h.peers[id] = p
+	delete(h.unknown, id)
+	h.lock.Unlock()
+	go h.runPeer(p)
+}
+
+// Answer a peer the hub has no client for over the stream it opened to us. The returned func releases the stream
+func (h *Hub) AddStream(id uint64, stream stepSender) func() {
+	h.lock.Lock()
+	if _, ok := h.peers[id]; ok || id == 0 || id == h.self {
+		h.lock.Unlock()
+		return func() {}
+	}
+	p := newHubPeer(id, nil)
+	h.peers[id] = p
+	delete(h.unknown, id)
+	h.lock.Unlock()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := h.sendLoop(p, stream, nil); err != nil {
+			h.reporter.ReportUnreachable(id)
+		}
+	}()
+	return func() {
+		h.lock.Lock()
+		if h.peers[id] == p {
+			close(p.done)
+			delete(h.peers, id)
+			hubQueueDepth.Set(p.key, new(expvar.Int))
+		}
+		h.lock.Unlock()
+		<-stopped
 	}
 }
 
 func (h *Hub) Remove(id uint64) {
-	h.actionChan <- &hubAction{
-		add: false,
-		id:  id,
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if p, ok := h.peers[id]; ok {
+		close(p.done)
+		delete(h.peers, id)
+		hubQueueDepth.Set(p.key, new(expvar.Int))
 	}
 }
 
-func (h *Hub) AddServerStream(id uint64, ss pb.Coordinate_EmitRaftStepServer) {
-	h.actionChan <- &hubAction{
-		add:          true,
-		serverStream: ss,
+func (h *Hub) Stop() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	close(h.doneChan)
+	for id, p := range h.peers {
+		close(p.done)
+		delete(h.peers, id)
 	}
 }
 
-func (h *Hub) clientReceive(id uint64, stream pb.Coordinate_EmitRaftStepClient) {
+func (h *Hub) Stats() map[uint64]HubPeerStats {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	stats := make(map[uint64]HubPeerStats, len(h.peers))
+	for id, p := range h.peers {
+		stats[id] = HubPeerStats{
+			Queued:  len(p.queue),
+			Dropped: p.dropped.Value(),
+			Sent:    p.sent.Value(),
+		}
+	}
+	return stats
+}
+
+// Keep a stream open to the peer, reconnecting with exponential backoff
+func (h *Hub) runPeer(p *hubPeer) {
+	backoff := HUB_MIN_BACKOFF
+	md := metadata.Pairs(HUB_PEER_ID_HEADER, strconv.FormatUint(h.self, 10))
 	for {
-		msg, err := stream.Recv()
-		if err != nil {
-			h.Remove(id)
+		ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(context.Background(), md))
+		stream, err := p.client.EmitRaftStep(ctx)
+		if err == nil {
+			backoff = HUB_MIN_BACKOFF
+			recvDone := make(chan struct{})
+			go h.clientReceive(p.id, stream, recvDone)
+			err = h.sendLoop(p, stream, recvDone)
+			stream.CloseSend()
 		}
-		step := &raftpb.Message{}
-		if err := step.Unmarshal(msg.Data); err != nil {
-			log.Printf("Cannot unmarshal raft message: %s", err)
-			continue
+		cancel()
+		if err == nil {
+			return
+		}
+		log.Printf("coord: Stream to peer %d failed: %s. Retrying in %s", p.id, err, backoff)
+		h.reporter.ReportUnreachable(p.id)
+		select {
+		case <-time.After(backoff):
+		case <-p.done:
+			return
+		}
+		if backoff *= 2; backoff > HUB_MAX_BACKOFF {
+			backoff = HUB_MAX_BACKOFF
 		}
-		h.receivedChan <- step
 	}
 }
 
-func (h *Hub) run() {
-	defer close(h.actionChan)
-	defer close(h.sendChan)
+// Send queued messages until the stream fails or the peer is removed
+func (h *Hub) sendLoop(p *hubPeer, stream stepSender, recvDone chan struct{}) error {
 	for {
 		select {
-		case <-h.doneChan:
-			return
-		case msg := <-h.sendChan:
+		case msg := <-p.queue:
+			hubQueueDepth.Add(p.key, -1)
 			data, err := msg.Marshal()
 			if err != nil {
-				//TODO: Find a better solution than panic
-				panic(err)
+				log.Printf("coord: Cannot marshal raft message for %d: %s", p.id, err)
+				continue
 			}
-			step := &pb.RaftStep{data}
-			for id, stream := range h.sendMap {
-				if err = stream.Send(step); err != nil {
-					delete(h.sendMap, id)
-					delete(h.clientMap, id)
-				}
+			if err := stream.Send(&pb.RaftStep{Data: data}); err != nil {
+				h.reportFailure(msg)
+				return err
 			}
-		case action := <-h.actionChan:
-			if action.add {
-				if action.client != nil {
-					stream, err := action.client.EmitRaftStep(context.Background())
-					if err == nil {
-						log.Printf("coord: Cannot create client stream for id %s: %s", action.id, err)
-						continue
-					}
-					h.clientMap[action.id] = action.client
-					h.sendMap[action.id] = stream
-					go h.clientReceive(action.id, stream)
-				}
-				if action.serverStream != nil {
-					h.sendMap[action.id] = action.serverStream
-				}
-			} else {
-				delete(h.sendMap, action.id)
-				delete(h.clientMap, action.id)
+			p.sent.Add(1)
+			hubSent.Add(p.key, 1)
+			if msg.Type == raftpb.MsgSnap {
+				h.reporter.ReportSnapshot(msg.To, raft.SnapshotFinish)
 			}
+		case <-recvDone:
+			return errStreamClosed
+		case <-p.done:
+			return nil
+		}
+	}
+}
+
+func (h *Hub) clientReceive(id uint64, stream pb.Coordinate_EmitRaftStepClient, done chan struct{}) {
+	defer close(done)
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return
+		}
+		step := &raftpb.Message{}
+		if err := step.Unmarshal(msg.Data); err != nil {
+			log.Printf("coord: Cannot unmarshal raft message from %d: %s", id, err)
+			continue
+		}
+		select {
+		case h.receivedChan <- step:
+		case <-h.doneChan:
+			return
 		}
 	}
 }
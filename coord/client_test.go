@@ -0,0 +1,221 @@
+package coord
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/acasajus/menac/coord/proto"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+type fakeReporter struct {
+	lock        sync.Mutex
+	unreachable map[uint64]int
+	snapshots   map[uint64]raft.SnapshotStatus
+}
+
+func newFakeReporter() *fakeReporter {
+	return &fakeReporter{
+		unreachable: make(map[uint64]int),
+		snapshots:   make(map[uint64]raft.SnapshotStatus),
+	}
+}
+
+func (fr *fakeReporter) ReportUnreachable(id uint64) {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	fr.unreachable[id]++
+}
+
+func (fr *fakeReporter) ReportSnapshot(id uint64, status raft.SnapshotStatus) {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	fr.snapshots[id] = status
+}
+
+func (fr *fakeReporter) unreachableCount(id uint64) int {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	return fr.unreachable[id]
+}
+
+func (fr *fakeReporter) snapshotStatus(id uint64) (raft.SnapshotStatus, bool) {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	s, ok := fr.snapshots[id]
+	return s, ok
+}
+
+type fakeStream struct {
+	grpc.ClientStream
+	sent  chan *pb.RaftStep
+	block chan struct{}
+	close chan struct{}
+}
+
+func (fs *fakeStream) Send(m *pb.RaftStep) error {
+	<-fs.block
+	fs.sent <- m
+	return nil
+}
+
+func (fs *fakeStream) Recv() (*pb.RaftStep, error) {
+	<-fs.close
+	return nil, errors.New("closed")
+}
+
+func (fs *fakeStream) CloseSend() error {
+	return nil
+}
+
+type fakeCoordClient struct {
+	pb.CoordinateClient
+	lock    sync.Mutex
+	streams int
+	fail    bool
+	stream  *fakeStream
+}
+
+func (fc *fakeCoordClient) EmitRaftStep(ctx context.Context, opts ...grpc.CallOption) (pb.Coordinate_EmitRaftStepClient, error) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.streams++
+	if fc.fail {
+		return nil, errors.New("unreachable")
+	}
+	return fc.stream, nil
+}
+
+func newFakeStream() *fakeStream {
+	return &fakeStream{
+		sent:  make(chan *pb.RaftStep, HUB_QUEUE_SIZE),
+		block: make(chan struct{}),
+		close: make(chan struct{}),
+	}
+}
+
+func TestHubRouting(t *testing.T) {
+	fr := newFakeReporter()
+	h := NewHub(1, make(chan *raftpb.Message), fr)
+	defer h.Stop()
+	s2, s3 := newFakeStream(), newFakeStream()
+	close(s2.block)
+	h.addPeer(2, &fakeCoordClient{stream: s2})
+	h.addPeer(3, &fakeCoordClient{stream: s3})
+
+	//Peer 3 never sends but must not block peer 2
+	for i := 0; i < HUB_QUEUE_SIZE+10; i++ {
+		h.SendMessage(&raftpb.Message{To: 3})
+	}
+	h.SendMessage(&raftpb.Message{To: 2})
+	select {
+	case <-s2.sent:
+	case <-time.After(time.Second):
+		t.Fatal("Message to peer 2 was not delivered")
+	}
+	select {
+	case <-s3.sent:
+		t.Fatal("Message to peer 3 was sent through a blocked stream")
+	default:
+	}
+	if c := fr.unreachableCount(3); c < 9 {
+		t.Errorf("Dropped messages reported %d times", c)
+	}
+	if st := h.Stats()[3]; st.Dropped < 9 || st.Queued == 0 {
+		t.Errorf("Unexpected stats for peer 3 %+v", st)
+	}
+	if fr.unreachableCount(2) != 0 {
+		t.Error("Peer 2 reported as unreachable")
+	}
+
+	h.SendMessage(&raftpb.Message{To: 4, Type: raftpb.MsgSnap})
+	if fr.unreachableCount(4) != 1 {
+		t.Error("Unknown peer was not reported as unreachable")
+	}
+	if st, ok := fr.snapshotStatus(4); !ok || st != raft.SnapshotFailure {
+		t.Error("Snapshot to unknown peer was not reported as failed")
+	}
+	h.SendMessage(&raftpb.Message{To: 2, Type: raftpb.MsgSnap})
+	<-s2.sent
+	for i := 0; i < 100; i++ {
+		if st, ok := fr.snapshotStatus(2); ok {
+			if st != raft.SnapshotFinish {
+				t.Error("Snapshot was not reported as finished")
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("Snapshot status was not reported")
+}
+
+func TestHubReconnect(t *testing.T) {
+	fr := newFakeReporter()
+	h := NewHub(1, make(chan *raftpb.Message), fr)
+	defer h.Stop()
+	c := &fakeCoordClient{fail: true, stream: newFakeStream()}
+	h.addPeer(2, c)
+	time.Sleep(HUB_MIN_BACKOFF * 2)
+	c.lock.Lock()
+	attempts := c.streams
+	c.fail = false
+	c.lock.Unlock()
+	if attempts < 2 {
+		t.Errorf("Hub did not retry the connection (%d attempts)", attempts)
+	}
+	if fr.unreachableCount(2) == 0 {
+		t.Error("Failed connection was not reported")
+	}
+	close(c.stream.block)
+	h.SendMessage(&raftpb.Message{To: 2})
+	select {
+	case <-c.stream.sent:
+	case <-time.After(HUB_MIN_BACKOFF * 8):
+		t.Fatal("Message was not delivered after reconnecting")
+	}
+}
+
+func TestHubReplyStream(t *testing.T) {
+	fr := newFakeReporter()
+	h := NewHub(1, make(chan *raftpb.Message), fr)
+	defer h.Stop()
+	inbound := newFakeStream()
+	close(inbound.block)
+	remove := h.AddStream(5, inbound)
+	h.SendMessage(&raftpb.Message{To: 5})
+	select {
+	case <-inbound.sent:
+	case <-time.After(time.Second):
+		t.Fatal("Message was not sent back over the inbound stream")
+	}
+	//A client for the peer takes over
+	s5 := newFakeStream()
+	close(s5.block)
+	h.addPeer(5, &fakeCoordClient{stream: s5})
+	remove()
+	h.SendMessage(&raftpb.Message{To: 5})
+	select {
+	case <-s5.sent:
+	case <-time.After(time.Second):
+		t.Fatal("Message was not sent through the client stream")
+	}
+	if len(inbound.sent) != 0 {
+		t.Error("Inbound stream used after a client was added")
+	}
+
+	remove = h.AddStream(6, inbound)
+	remove()
+	before := fr.unreachableCount(6)
+	h.SendMessage(&raftpb.Message{To: 6})
+	if fr.unreachableCount(6) != before+1 {
+		t.Error("Message to a closed inbound stream was not reported")
+	}
+	if v := hubUnknown.Get("6"); v == nil || v.String() == "0" {
+		t.Error("Message to unknown peer was not counted")
+	}
+}
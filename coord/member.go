@@ -0,0 +1,178 @@
+package coord
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	pb "github.com/acasajus/menac/coord/proto"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+const (
+	//Max amount of entries a learner can lag behind the commit index to be promoted
+	PROMOTE_MAX_LAG = 100
+)
+
+var ErrUnknownMember = errors.New("Unknown cluster member")
+var ErrNotLearner = errors.New("Cluster member is not a learner")
+
+type member struct {
+	info *pb.PeerInfo
+	//Learners that asked to never be promoted automatically
+	sticky bool
+}
+
+type members struct {
+	lock    sync.RWMutex
+	peers   map[uint64]*member
+	changed chan struct{}
+}
+
+func newMembers() *members {
+	return &members{
+		peers:   make(map[uint64]*member),
+		changed: make(chan struct{}),
+	}
+}
+
+// Update the membership with a committed conf change. Returns the member if it's new
+func (ms *members) apply(cc raftpb.ConfChange) (*pb.PeerInfo, error) {
+	info := &pb.PeerInfo{Id: cc.NodeID}
+	if len(cc.Context) > 0 {
+		if err := proto.Unmarshal(cc.Context, info); err != nil {
+			return nil, err
+		}
+		info.Id = cc.NodeID
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	defer ms.notify()
+	m, known := ms.peers[cc.NodeID]
+	switch cc.Type {
+	case raftpb.ConfChangeAddLearnerNode:
+		if known {
+			return nil, nil
+		}
+		sticky := info.Learner
+		info.Learner = true
+		ms.peers[cc.NodeID] = &member{info: info, sticky: sticky}
+		return clonePeerInfo(info), nil
+	case raftpb.ConfChangeAddNode:
+		if known {
+			info.Learner = false
+			m.info = info
+			m.sticky = false
+			return nil, nil
+		}
+		info.Learner = false
+		ms.peers[cc.NodeID] = &member{info: info}
+		return clonePeerInfo(info), nil
+	case raftpb.ConfChangeRemoveNode:
+		delete(ms.peers, cc.NodeID)
+	case raftpb.ConfChangeUpdateNode:
+		if known {
+			info.Learner = m.info.Learner
+			m.info = info
+		}
+	}
+	return nil, nil
+}
+
+// Must be called with the lock held
+func (ms *members) notify() {
+	close(ms.changed)
+	ms.changed = make(chan struct{})
+}
+
+func (ms *members) get(id uint64) (*pb.PeerInfo, bool) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	m, ok := ms.peers[id]
+	if !ok {
+		return nil, false
+	}
+	return clonePeerInfo(m.info), true
+}
+
+func (ms *members) list() []*pb.PeerInfo {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	ids := make([]uint64, 0, len(ms.peers))
+	for id := range ms.peers {
+		ids = append(ids, id)
+	}
+	sort.Sort(uint64Slice(ids))
+	peers := make([]*pb.PeerInfo, 0, len(ids))
+	for _, id := range ids {
+		peers = append(peers, clonePeerInfo(ms.peers[id].info))
+	}
+	return peers
+}
+
+// Block until the member is known with the requested voting state or the context is done
+func (ms *members) wait(ctx context.Context, id uint64, learner bool) error {
+	for {
+		ms.lock.RLock()
+		m, ok := ms.peers[id]
+		ready := ok && m.info.Learner == learner
+		changed := ms.changed
+		ms.lock.RUnlock()
+		if ready {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Learners that have caught up with the leader and can become voters
+func (ms *members) promotable(st raft.Status) []uint64 {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	ids := []uint64{}
+	for id, pr := range st.Progress {
+		if !pr.IsLearner {
+			continue
+		}
+		m, ok := ms.peers[id]
+		if !ok || m.sticky {
+			continue
+		}
+		if pr.Match+PROMOTE_MAX_LAG < st.Commit {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Sort(uint64Slice(ids))
+	return ids
+}
+
+func clonePeerInfo(p *pb.PeerInfo) *pb.PeerInfo {
+	c := &pb.PeerInfo{
+		Id:      p.Id,
+		Address: p.Address,
+		Learner: p.Learner,
+		Roles:   append([]string{}, p.Roles...),
+		Version: p.Version,
+	}
+	if p.Metadata != nil {
+		c.Metadata = make(map[string]string, len(p.Metadata))
+		for k, v := range p.Metadata {
+			c.Metadata[k] = v
+		}
+	}
+	return c
+}
+
+type uint64Slice []uint64
+
+func (p uint64Slice) Len() int           { return len(p) }
+func (p uint64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uint64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
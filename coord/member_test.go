@@ -0,0 +1,62 @@
+package coord
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+func TestMembersApply(t *testing.T) {
+	ms := newMembers()
+	tests := []struct {
+		cc raftpb.ConfChange
+
+		wnew     bool
+		wlearner map[uint64]bool
+	}{
+		{raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 1}, true, map[uint64]bool{1: false}},
+		{raftpb.ConfChange{Type: raftpb.ConfChangeAddLearnerNode, NodeID: 2}, true, map[uint64]bool{1: false, 2: true}},
+		{raftpb.ConfChange{Type: raftpb.ConfChangeAddLearnerNode, NodeID: 2}, false, map[uint64]bool{1: false, 2: true}},
+		{raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 2}, false, map[uint64]bool{1: false, 2: false}},
+		{raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: 1}, false, map[uint64]bool{2: false}},
+	}
+	for i, tt := range tests {
+		p, err := ms.apply(tt.cc)
+		if err != nil {
+			t.Fatalf("#%d: err = %s", i, err)
+		}
+		if (p != nil) != tt.wnew {
+			t.Errorf("#%d: new member = %v, want %v", i, p != nil, tt.wnew)
+		}
+		learners := map[uint64]bool{}
+		for _, pi := range ms.list() {
+			learners[pi.Id] = pi.Learner
+		}
+		if !reflect.DeepEqual(learners, tt.wlearner) {
+			t.Errorf("#%d: members = %v, want %v", i, learners, tt.wlearner)
+		}
+	}
+}
+
+func TestMembersPromotable(t *testing.T) {
+	ms := newMembers()
+	for _, id := range []uint64{2, 3, 4} {
+		if _, err := ms.apply(raftpb.ConfChange{Type: raftpb.ConfChangeAddLearnerNode, NodeID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ms.peers[4].sticky = true
+	st := raft.Status{}
+	st.Commit = 1000
+	st.Progress = map[uint64]raft.Progress{
+		1: {Match: 1000},
+		2: {Match: 1000 - PROMOTE_MAX_LAG, IsLearner: true},
+		3: {Match: 1000 - PROMOTE_MAX_LAG - 1, IsLearner: true},
+		4: {Match: 1000, IsLearner: true},
+	}
+	if ids := ms.promotable(st); !reflect.DeepEqual(ids, []uint64{2}) {
+		t.Errorf("Promotable learners = %v, want [2]", ids)
+	}
+}
@@ -1,98 +1,493 @@
 package coord
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/acasajus/menac/coord/proto"
 	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
 )
 
+const (
+	NODE_TICK_INTERVAL = time.Duration(100) * time.Millisecond
+	//Ticks between checks for learners that can be promoted
+	NODE_PROMOTE_TICKS = 10
+)
+
+var ErrStopped = errors.New("Node has been stopped")
+var ErrNoLeader = errors.New("Cluster has no known leader")
+var ErrNoPeers = errors.New("Cluster returned no peers to connect to")
+
 type Node struct {
+	id       uint64
 	storage  *BoltStorage
-	clients  []pb.CoordinateClient
+	hub      *Hub
 	raftNode raft.Node
+	members  *members
+
+	tasker    *TaskRunner
+	applyWait *indexWait
+
+	readLock    sync.Mutex
+	readWaiters map[string]chan uint64
+	readCount   uint64
+
+	leader        uint64
+	leaderContact int64
+	promoting     map[uint64]bool
+
+	clientLock sync.RWMutex
+	clients    map[uint64]pb.CoordinateClient
 
-	tasker      *TaskRunner
 	done        chan struct{}
+	stopOnce    sync.Once
+	errLock     sync.Mutex
+	err         error
 	messageChan chan *raftpb.Message
 }
 
 func (n *Node) generateId() uint64 {
+	return newId()
+}
+
+func newId() uint64 {
 	return uint64(time.Now().Unix() + rand.Int63())
 }
 
-func NewNode(s *BoltStorage, peers []raft.Peer) *Node {
-	return &Node{
-		clients:     make([]pb.CoordinateClient, 0),
-		tasker:      NewTaskRunner(),
+// Id of the node owning the storage, generating it the first time
+func storageNodeId(s *BoltStorage) (uint64, error) {
+	id := s.GetNodeId()
+	if id != 0 {
+		return id, nil
+	}
+	id = newId()
+	if err := s.SetNodeId(id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Start a node. Without peers it restarts from its storage or waits to be registered
+func NewNode(s *BoltStorage, sm StateMachine, peers []raft.Peer) (*Node, error) {
+	n := &Node{
+		storage:     s,
+		clients:     make(map[uint64]pb.CoordinateClient),
+		members:     newMembers(),
+		applyWait:   newIndexWait(),
+		readWaiters: make(map[string]chan uint64),
+		promoting:   make(map[uint64]bool),
 		done:        make(chan struct{}),
 		messageChan: make(chan *raftpb.Message),
 	}
+	id, err := storageNodeId(s)
+	if err != nil {
+		return nil, err
+	}
+	n.id = id
+	n.tasker = NewTaskRunner(n.applyConfChange, sm)
+	c := &raft.Config{
+		ID:              n.id,
+		ElectionTick:    10,
+		HeartbeatTick:   1,
+		Storage:         s,
+		MaxSizePerMsg:   1024 * 1024,
+		MaxInflightMsgs: 256,
+	}
+	if len(peers) > 0 {
+		n.raftNode = raft.StartNode(c, peers)
+	} else {
+		n.raftNode = raft.RestartNode(c)
+	}
+	n.hub = NewHub(n.id, n.messageChan, n.raftNode)
+	go func() {
+		if err := n.run(); err != nil {
+			n.fail(err)
+		}
+	}()
+	return n, nil
+}
+
+// Start the first node of a new cluster with itself as the only voter
+func NewBootstrapNode(s *BoltStorage, sm StateMachine, address string) (*Node, error) {
+	if !s.Empty() {
+		return NewNode(s, sm, nil)
+	}
+	id, err := storageNodeId(s)
+	if err != nil {
+		return nil, err
+	}
+	data, err := proto.Marshal(&pb.PeerInfo{Id: id, Address: address})
+	if err != nil {
+		return nil, err
+	}
+	return NewNode(s, sm, []raft.Peer{{ID: id, Context: data}})
+}
+
+// Join a cluster as a learner through one of its members
+func (n *Node) Join(ctx context.Context, c pb.CoordinateClient, self *pb.PeerInfo) error {
+	list, err := c.Register(ctx, self)
+	if err != nil {
+		return err
+	}
+	connected := 0
+	for _, p := range list.Peers {
+		if p.Id == n.id || len(p.Address) == 0 {
+			continue
+		}
+		n.connectPeer(p)
+		connected++
+	}
+	if connected == 0 {
+		return ErrNoPeers
+	}
+	return nil
+}
+
+func (n *Node) Id() uint64 {
+	return n.id
 }
 
 func (n *Node) GetMessageChan() chan *raftpb.Message {
 	return n.messageChan
 }
 
-func (n *Node) run() {
+func (n *Node) IsLeader() bool {
+	return atomic.LoadUint64(&n.leader) == n.id
+}
+
+func (n *Node) Peers() []*pb.PeerInfo {
+	return n.members.list()
+}
+
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.done)
+		n.hub.Stop()
+		n.raftNode.Stop()
+	})
+}
+
+// Error that stopped the node, if any
+func (n *Node) Err() error {
+	n.errLock.Lock()
+	defer n.errLock.Unlock()
+	return n.err
+}
+
+func (n *Node) fail(err error) {
+	log.Printf("coord: Stopping node %d: %s", n.id, err)
+	n.errLock.Lock()
+	n.err = err
+	n.errLock.Unlock()
+	n.Stop()
+}
+
+// Join a peer to the cluster as a learner to be promoted once caught up
+func (n *Node) AddLearner(ctx context.Context, p *pb.PeerInfo) error {
+	if p.Id == 0 {
+		return errors.New("Peer has no id")
+	}
+	if _, ok := n.members.get(p.Id); ok {
+		return nil
+	}
+	data, err := proto.Marshal(p)
+	if err != nil {
+		return err
+	}
+	cc := raftpb.ConfChange{
+		ID:      n.generateId(),
+		Type:    raftpb.ConfChangeAddLearnerNode,
+		NodeID:  p.Id,
+		Context: data,
+	}
+	if err := n.raftNode.ProposeConfChange(ctx, cc); err != nil {
+		return err
+	}
+	return n.members.wait(ctx, p.Id, true)
+}
+
+// Turn a learner into a voting member
+func (n *Node) Promote(ctx context.Context, id uint64) error {
+	p, ok := n.members.get(id)
+	if !ok {
+		return ErrUnknownMember
+	}
+	if !p.Learner {
+		return ErrNotLearner
+	}
+	p.Learner = false
+	data, err := proto.Marshal(p)
+	if err != nil {
+		return err
+	}
+	cc := raftpb.ConfChange{
+		ID:      n.generateId(),
+		Type:    raftpb.ConfChangeAddNode,
+		NodeID:  id,
+		Context: data,
+	}
+	if err := n.raftNode.ProposeConfChange(ctx, cc); err != nil {
+		return err
+	}
+	return n.members.wait(ctx, id, false)
+}
+
+// Block until the local state is at most maxStaleness behind the leader, or caught up with its read index
+func (n *Node) WaitRead(ctx context.Context, maxStaleness time.Duration) error {
+	if maxStaleness > 0 && n.leaderContactAge() <= maxStaleness {
+		return nil
+	}
+	rctx := make([]byte, 8)
+	binary.BigEndian.PutUint64(rctx, atomic.AddUint64(&n.readCount, 1))
+	c := make(chan uint64, 1)
+	n.readLock.Lock()
+	n.readWaiters[string(rctx)] = c
+	n.readLock.Unlock()
+	defer func() {
+		n.readLock.Lock()
+		delete(n.readWaiters, string(rctx))
+		n.readLock.Unlock()
+	}()
+	if err := n.raftNode.ReadIndex(ctx, rctx); err != nil {
+		return err
+	}
+	select {
+	case index := <-c:
+		return n.applyWait.Wait(ctx, index)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.done:
+		return ErrStopped
+	}
+}
+
+func (n *Node) leaderContactAge() time.Duration {
+	last := atomic.LoadInt64(&n.leaderContact)
+	if last == 0 {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+func (n *Node) touchLeaderContact() {
+	atomic.StoreInt64(&n.leaderContact, time.Now().UnixNano())
+}
+
+func (n *Node) applyConfChange(cc raftpb.ConfChange) error {
+	n.raftNode.ApplyConfChange(cc)
+	p, err := n.members.apply(cc)
+	if err != nil {
+		return err
+	}
+	if p != nil && p.Id != n.id && len(p.Address) > 0 {
+		go n.connectPeer(p)
+	}
+	return nil
+}
+
+func (n *Node) connectPeer(p *pb.PeerInfo) {
+	n.clientLock.RLock()
+	_, connected := n.clients[p.Id]
+	n.clientLock.RUnlock()
+	if connected {
+		return
+	}
+	conn, err := grpc.Dial(p.Address)
+	if err != nil {
+		log.Printf("coord: Cannot connect to peer %d at %s: %s", p.Id, p.Address, err)
+		return
+	}
+	n.hub.AddClient(p.Id, conn)
+	n.clientLock.Lock()
+	n.clients[p.Id] = pb.NewCoordinateClient(conn)
+	n.clientLock.Unlock()
+}
+
+func (n *Node) leaderClient() (pb.CoordinateClient, error) {
+	lead := atomic.LoadUint64(&n.leader)
+	if lead == raft.None {
+		return nil, ErrNoLeader
+	}
+	n.clientLock.RLock()
+	defer n.clientLock.RUnlock()
+	c, ok := n.clients[lead]
+	if !ok {
+		return nil, ErrUnknownMember
+	}
+	return c, nil
+}
+
+// Replicate a command through the cluster. Retrying with the same request id does not apply it twice
+func (n *Node) Propose(ctx context.Context, cmd *pb.Command) *Future {
+	return n.propose(ctx, cmd, true)
+}
+
+func (n *Node) propose(ctx context.Context, cmd *pb.Command, forward bool) *Future {
+	if cmd.RequestId == 0 {
+		cmd.RequestId = n.generateId()
+	}
+	f, pending := n.tasker.proposals.register(cmd.RequestId)
+	if !pending {
+		return f
+	}
+	go func() {
+		select {
+		case <-f.Done():
+		case <-ctx.Done():
+			n.tasker.proposals.cancel(cmd.RequestId, f, ctx.Err())
+		case <-n.done:
+			n.tasker.proposals.cancel(cmd.RequestId, f, ErrStopped)
+		}
+	}()
+	if forward && !n.IsLeader() {
+		if c, err := n.leaderClient(); err == nil {
+			go n.forwardProposal(ctx, c, cmd, f)
+			return f
+		}
+	}
+	data, err := proto.Marshal(cmd)
+	if err != nil {
+		n.tasker.proposals.cancel(cmd.RequestId, f, err)
+		return f
+	}
+	go func() {
+		if err := n.raftNode.Propose(ctx, data); err != nil {
+			n.tasker.proposals.cancel(cmd.RequestId, f, err)
+		}
+	}()
+	return f
+}
+
+func (n *Node) forwardProposal(ctx context.Context, c pb.CoordinateClient, cmd *pb.Command, f *Future) {
+	res, err := c.Propose(ctx, cmd)
+	switch {
+	case err != nil:
+		n.tasker.proposals.cancel(cmd.RequestId, f, err)
+	case len(res.Error) > 0:
+		n.tasker.proposals.cancel(cmd.RequestId, f, errors.New(res.Error))
+	default:
+		n.tasker.proposals.resolve(cmd.RequestId, f, res.Data)
+	}
+}
+
+func (n *Node) promoteLearners() {
+	if !n.IsLeader() {
+		return
+	}
+	for _, id := range n.members.promotable(n.raftNode.Status()) {
+		if n.promoting[id] {
+			continue
+		}
+		n.promoting[id] = true
+		go func(id uint64) {
+			ctx, cancel := context.WithTimeout(context.Background(), NODE_TICK_INTERVAL*NODE_PROMOTE_TICKS)
+			defer cancel()
+			if err := n.Promote(ctx, id); err != nil {
+				log.Printf("coord: Cannot promote learner %d: %s", id, err)
+			} else {
+				log.Printf("coord: Promoted learner %d to voter", id)
+			}
+		}(id)
+	}
+}
+
+func (n *Node) processReadStates(rss []raft.ReadState) {
+	n.readLock.Lock()
+	defer n.readLock.Unlock()
+	for _, rs := range rss {
+		if c, ok := n.readWaiters[string(rs.RequestCtx)]; ok {
+			c <- rs.Index
+		}
+	}
+}
+
+func (n *Node) run() error {
 	//FOLLOW: https://sourcegraph.com/github.com/coreos/etcd@32105e6ed063ad0fba8077b3a446ef3cf476c17c/.tree/etcdserver/raft.go#selected=72
-	ticker := time.Tick(time.Duration(100) * time.Millisecond)
+	ticker := time.Tick(NODE_TICK_INTERVAL)
+	ticks := 0
 	for {
 		select {
 		case <-ticker:
 			n.raftNode.Tick()
+			if n.IsLeader() {
+				n.touchLeaderContact()
+			}
+			if ticks++; ticks%NODE_PROMOTE_TICKS == 0 {
+				for id := range n.promoting {
+					delete(n.promoting, id)
+				}
+				n.promoteLearners()
+			}
 		case step := <-n.messageChan:
+			if step.From != raft.None && step.From == atomic.LoadUint64(&n.leader) {
+				n.touchLeaderContact()
+			}
 			n.raftNode.Step(context.Background(), *step)
 		case rd := <-n.raftNode.Ready():
 			if rd.SoftState != nil {
+				atomic.StoreUint64(&n.leader, rd.Lead)
 				if rd.RaftState == raft.StateLeader {
 					log.Println("I'm now the leader of the cluster")
 				}
 			}
+			if len(rd.ReadStates) > 0 {
+				n.processReadStates(rd.ReadStates)
+			}
 			//TOOD: Apply snapshot if there's any + committed entries
 			t := Task{
 				entries:  rd.CommittedEntries,
 				snapshot: rd.Snapshot,
-				done:     make(chan error),
+				done:     make(chan error, 1),
 			}
 			//Execute task or exit if we've go the we're finished msg
 			select {
 			case n.tasker.todo <- t:
 			case <-n.done:
-				return
+				return nil
 			}
 			//Store stuff in the DB
 			if !raft.IsEmptySnap(rd.Snapshot) {
 				if err := n.storage.ApplySnapshot(rd.Snapshot); err != nil {
-					log.Fatalln("coord: Cannot apply snapshot: %s", err)
+					return fmt.Errorf("Cannot apply snapshot: %s", err)
 				}
 				log.Printf("coord: applied incoming snapshot at index %d", rd.Snapshot.Metadata.Index)
 			}
 			if !raft.IsEmptyHardState(rd.HardState) {
 				if err := n.storage.SetHardState(rd.HardState); err != nil {
-					log.Fatalln("coord: Cannot save hard state: %s", err)
+					return fmt.Errorf("Cannot save hard state: %s", err)
 				}
 			}
 			if err := n.storage.Append(rd.Entries); err != nil {
-				log.Fatalln("coord: Cannot save entries: %s", err)
+				return fmt.Errorf("Cannot save entries: %s", err)
 			}
 
 			//Send messages to known peers
-			for _, m := range rd.Messages {
-				m = m
-				//TOOD: Send the message to everyone registered in the hub
-				//n.hub.SendMessage(m)
+			for i := range rd.Messages {
+				n.hub.SendMessage(&rd.Messages[i])
 			}
 
 			//Wait until tasker has finished processing
-			<-t.done
+			if err := <-t.done; err != nil {
+				return fmt.Errorf("Cannot apply committed entries: %s", err)
+			}
+			if l := len(rd.CommittedEntries); l > 0 {
+				n.applyWait.Trigger(rd.CommittedEntries[l-1].Index)
+			} else if !raft.IsEmptySnap(rd.Snapshot) {
+				n.applyWait.Trigger(rd.Snapshot.Metadata.Index)
+			}
 			n.raftNode.Advance()
 		case <-n.done:
-			return
+			return nil
 		}
 	}
 }
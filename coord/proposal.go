@@ -0,0 +1,172 @@
+package coord
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	pb "github.com/acasajus/menac/coord/proto"
+)
+
+const (
+	//Number of applied request ids remembered to deduplicate retried proposals
+	PROPOSAL_DEDUP_WINDOW = 10000
+)
+
+var ErrUnknownCommand = errors.New("Unknown command type")
+
+// Applies committed commands in log order. It must be deterministic
+type StateMachine interface {
+	Apply(cmd *pb.Command) ([]byte, error)
+}
+
+type CommandHandler func(data []byte) ([]byte, error)
+
+// StateMachine that dispatches commands to handlers by type
+type CommandMux struct {
+	lock     sync.RWMutex
+	handlers map[string]CommandHandler
+}
+
+func NewCommandMux() *CommandMux {
+	return &CommandMux{handlers: make(map[string]CommandHandler)}
+}
+
+func (cm *CommandMux) Handle(cmdType string, h CommandHandler) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if _, ok := cm.handlers[cmdType]; ok {
+		panic(fmt.Sprintf("coord: Handler for command %s already registered", cmdType))
+	}
+	cm.handlers[cmdType] = h
+}
+
+func (cm *CommandMux) Apply(cmd *pb.Command) ([]byte, error) {
+	cm.lock.RLock()
+	h, ok := cm.handlers[cmd.Type]
+	cm.lock.RUnlock()
+	if !ok {
+		return nil, ErrUnknownCommand
+	}
+	return h(cmd.Data)
+}
+
+// Result of a proposal, resolved once applied or failed
+type Future struct {
+	once   sync.Once
+	done   chan struct{}
+	result []byte
+	err    error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) resolve(result []byte, err error) {
+	f.once.Do(func() {
+		f.result = result
+		f.err = err
+		close(f.done)
+	})
+}
+
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Block until the future resolves
+func (f *Future) Result() ([]byte, error) {
+	<-f.done
+	return f.result, f.err
+}
+
+type proposalResult struct {
+	result []byte
+	err    error
+}
+
+type proposals struct {
+	lock    sync.Mutex
+	pending map[uint64][]*Future
+	applied map[uint64]*proposalResult
+	order   []uint64
+}
+
+func newProposals() *proposals {
+	return &proposals{
+		pending: make(map[uint64][]*Future),
+		applied: make(map[uint64]*proposalResult),
+		order:   make([]uint64, 0, PROPOSAL_DEDUP_WINDOW),
+	}
+}
+
+// Get a future for a request id. It is already resolved if the request was applied
+func (ps *proposals) register(id uint64) (*Future, bool) {
+	f := newFuture()
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if r, ok := ps.applied[id]; ok {
+		f.resolve(r.result, r.err)
+		return f, false
+	}
+	ps.pending[id] = append(ps.pending[id], f)
+	return f, true
+}
+
+// Resolve a future before its command has been applied
+func (ps *proposals) cancel(id uint64, f *Future, err error) {
+	ps.resolveWith(id, f, nil, err)
+}
+
+// Resolve a future with the result given by a remote leader
+func (ps *proposals) resolve(id uint64, f *Future, result []byte) {
+	ps.resolveWith(id, f, result, nil)
+}
+
+func (ps *proposals) resolveWith(id uint64, f *Future, result []byte, err error) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	fs := ps.pending[id]
+	for i, pf := range fs {
+		if pf == f {
+			fs = append(fs[:i], fs[i+1:]...)
+			break
+		}
+	}
+	if len(fs) == 0 {
+		delete(ps.pending, id)
+	} else {
+		ps.pending[id] = fs
+	}
+	f.resolve(result, err)
+}
+
+// Apply a command through the state machine unless it has already been applied
+func (ps *proposals) apply(sm StateMachine, cmd *pb.Command) {
+	ps.lock.Lock()
+	r, ok := ps.applied[cmd.RequestId]
+	ps.lock.Unlock()
+	if !ok {
+		r = &proposalResult{}
+		if sm == nil {
+			r.err = ErrUnknownCommand
+		} else {
+			r.result, r.err = sm.Apply(cmd)
+		}
+	}
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if !ok {
+		if len(ps.order) == PROPOSAL_DEDUP_WINDOW {
+			delete(ps.applied, ps.order[0])
+			ps.order = ps.order[1:]
+		}
+		ps.applied[cmd.RequestId] = r
+		ps.order = append(ps.order, cmd.RequestId)
+	}
+	for _, f := range ps.pending[cmd.RequestId] {
+		f.resolve(r.result, r.err)
+	}
+	delete(ps.pending, cmd.RequestId)
+}
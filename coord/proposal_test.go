@@ -0,0 +1,86 @@
+package coord
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	pb "github.com/acasajus/menac/coord/proto"
+)
+
+func TestProposalsDedup(t *testing.T) {
+	mux := NewCommandMux()
+	applied := 0
+	mux.Handle("count", func(data []byte) ([]byte, error) {
+		applied++
+		return data, nil
+	})
+	mux.Handle("fail", func(data []byte) ([]byte, error) {
+		return nil, errors.New("failed")
+	})
+	ps := newProposals()
+
+	f, pending := ps.register(1)
+	if !pending {
+		t.Fatal("New request should be pending")
+	}
+	cmd := &pb.Command{RequestId: 1, Type: "count", Data: []byte("data")}
+	ps.apply(mux, cmd)
+	ps.apply(mux, cmd)
+	if applied != 1 {
+		t.Errorf("Command was applied %d times", applied)
+	}
+	if res, err := f.Result(); err != nil || !bytes.Equal(res, cmd.Data) {
+		t.Errorf("Unexpected result %s (%v)", res, err)
+	}
+	//Retried proposal gets the old result
+	f, pending = ps.register(1)
+	if pending {
+		t.Fatal("Applied request should not be pending")
+	}
+	if res, err := f.Result(); err != nil || !bytes.Equal(res, cmd.Data) {
+		t.Errorf("Unexpected result for retry %s (%v)", res, err)
+	}
+
+	f, _ = ps.register(2)
+	ps.apply(mux, &pb.Command{RequestId: 2, Type: "fail"})
+	if _, err := f.Result(); err == nil || err.Error() != "failed" {
+		t.Errorf("Unexpected error %v", err)
+	}
+	f, _ = ps.register(3)
+	ps.apply(mux, &pb.Command{RequestId: 3, Type: "unknown"})
+	if _, err := f.Result(); err != ErrUnknownCommand {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestProposalsCancel(t *testing.T) {
+	ps := newProposals()
+	f1, _ := ps.register(1)
+	f2, _ := ps.register(1)
+	ps.cancel(1, f1, ErrStopped)
+	if _, err := f1.Result(); err != ErrStopped {
+		t.Errorf("Unexpected error %v", err)
+	}
+	ps.apply(NewCommandMux(), &pb.Command{RequestId: 1, Type: "unknown"})
+	if _, err := f2.Result(); err != ErrUnknownCommand {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(ps.pending) != 0 {
+		t.Errorf("There are still %d pending proposals", len(ps.pending))
+	}
+}
+
+func TestProposalsDedupWindow(t *testing.T) {
+	ps := newProposals()
+	mux := NewCommandMux()
+	for i := uint64(1); i <= PROPOSAL_DEDUP_WINDOW+1; i++ {
+		ps.apply(mux, &pb.Command{RequestId: i})
+	}
+	if len(ps.applied) != PROPOSAL_DEDUP_WINDOW {
+		t.Errorf("Remembering %d requests vs expected %d", len(ps.applied), PROPOSAL_DEDUP_WINDOW)
+	}
+	if _, ok := ps.applied[1]; ok {
+		t.Error("Oldest request should have been forgotten")
+	}
+}
@@ -1,96 +1,541 @@
-// Code generated by protoc-gen-go.
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
 // source: coord/proto/coord.proto
-// DO NOT EDIT!
 
-/*
-Package coord is a generated protocol buffer package.
-
-It is generated from these files:
-	coord/proto/coord.proto
-
-It has these top-level messages:
-	PeerInfo
-	PeerInfoList
-	RaftStep
-	ProcessRaftResponse
-*/
 package coord
 
-import proto "github.com/golang/protobuf/proto"
-
 import (
-	context "golang.org/x/net/context"
+	context "context"
 	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
 )
 
-// Reference imports to suppress errors if they are not otherwise used.
-var _ context.Context
-var _ grpc.ClientConn
-
-// Reference imports to suppress errors if they are not otherwise used.
-var _ = proto.Marshal
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
 
 type PeerInfo struct {
-	Id      uint64 `protobuf:"varint,1,opt" json:"Id,omitempty"`
-	Address string `protobuf:"bytes,2,opt" json:"Address,omitempty"`
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Id      uint64                 `protobuf:"varint,1,opt,name=Id,proto3" json:"Id,omitempty"`
+	Address string                 `protobuf:"bytes,2,opt,name=Address,proto3" json:"Address,omitempty"`
+	//Learner peers replicate the log but never vote
+	Learner bool `protobuf:"varint,3,opt,name=Learner,proto3" json:"Learner,omitempty"`
+	//Roles served by the peer (web, matcher, ...)
+	Roles         []string          `protobuf:"bytes,4,rep,name=Roles,proto3" json:"Roles,omitempty"`
+	Version       string            `protobuf:"bytes,5,opt,name=Version,proto3" json:"Version,omitempty"`
+	Metadata      map[string]string `protobuf:"bytes,6,rep,name=Metadata,proto3" json:"Metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PeerInfo) Reset() {
+	*x = PeerInfo{}
+	mi := &file_coord_proto_coord_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PeerInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PeerInfo) ProtoMessage() {}
+
+func (x *PeerInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_coord_proto_coord_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PeerInfo.ProtoReflect.Descriptor instead.
+func (*PeerInfo) Descriptor() ([]byte, []int) {
+	return file_coord_proto_coord_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *PeerInfo) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *PeerInfo) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+func (x *PeerInfo) GetLearner() bool {
+	if x != nil {
+		return x.Learner
+	}
+	return false
+}
+
+func (x *PeerInfo) GetRoles() []string {
+	if x != nil {
+		return x.Roles
+	}
+	return nil
 }
 
-func (m *PeerInfo) Reset()         { *m = PeerInfo{} }
-func (m *PeerInfo) String() string { return proto.CompactTextString(m) }
-func (*PeerInfo) ProtoMessage()    {}
+func (x *PeerInfo) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *PeerInfo) GetMetadata() map[string]string {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+type ServiceLease struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Peer  *PeerInfo              `protobuf:"bytes,1,opt,name=Peer,proto3" json:"Peer,omitempty"`
+	//Unix time in nanoseconds when the lease expires
+	Expires       int64 `protobuf:"varint,2,opt,name=Expires,proto3" json:"Expires,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ServiceLease) Reset() {
+	*x = ServiceLease{}
+	mi := &file_coord_proto_coord_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ServiceLease) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ServiceLease) ProtoMessage() {}
+
+func (x *ServiceLease) ProtoReflect() protoreflect.Message {
+	mi := &file_coord_proto_coord_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ServiceLease.ProtoReflect.Descriptor instead.
+func (*ServiceLease) Descriptor() ([]byte, []int) {
+	return file_coord_proto_coord_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ServiceLease) GetPeer() *PeerInfo {
+	if x != nil {
+		return x.Peer
+	}
+	return nil
+}
+
+func (x *ServiceLease) GetExpires() int64 {
+	if x != nil {
+		return x.Expires
+	}
+	return 0
+}
 
 type PeerInfoList struct {
-	Peers []*PeerInfo `protobuf:"bytes,1,rep,name=peers" json:"peers,omitempty"`
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Peers         []*PeerInfo            `protobuf:"bytes,1,rep,name=peers,proto3" json:"peers,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
-func (m *PeerInfoList) Reset()         { *m = PeerInfoList{} }
-func (m *PeerInfoList) String() string { return proto.CompactTextString(m) }
-func (*PeerInfoList) ProtoMessage()    {}
+func (x *PeerInfoList) Reset() {
+	*x = PeerInfoList{}
+	mi := &file_coord_proto_coord_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
 
-func (m *PeerInfoList) GetPeers() []*PeerInfo {
-	if m != nil {
-		return m.Peers
+func (x *PeerInfoList) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PeerInfoList) ProtoMessage() {}
+
+func (x *PeerInfoList) ProtoReflect() protoreflect.Message {
+	mi := &file_coord_proto_coord_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PeerInfoList.ProtoReflect.Descriptor instead.
+func (*PeerInfoList) Descriptor() ([]byte, []int) {
+	return file_coord_proto_coord_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *PeerInfoList) GetPeers() []*PeerInfo {
+	if x != nil {
+		return x.Peers
 	}
 	return nil
 }
 
 type RaftStep struct {
-	Data []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Data          []byte                 `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RaftStep) Reset() {
+	*x = RaftStep{}
+	mi := &file_coord_proto_coord_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RaftStep) String() string {
+	return protoimpl.X.MessageStringOf(x)
 }
 
-func (m *RaftStep) Reset()         { *m = RaftStep{} }
-func (m *RaftStep) String() string { return proto.CompactTextString(m) }
-func (*RaftStep) ProtoMessage()    {}
+func (*RaftStep) ProtoMessage() {}
+
+func (x *RaftStep) ProtoReflect() protoreflect.Message {
+	mi := &file_coord_proto_coord_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RaftStep.ProtoReflect.Descriptor instead.
+func (*RaftStep) Descriptor() ([]byte, []int) {
+	return file_coord_proto_coord_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *RaftStep) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
 
 type ProcessRaftResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProcessRaftResponse) Reset() {
+	*x = ProcessRaftResponse{}
+	mi := &file_coord_proto_coord_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
 }
 
-func (m *ProcessRaftResponse) Reset()         { *m = ProcessRaftResponse{} }
-func (m *ProcessRaftResponse) String() string { return proto.CompactTextString(m) }
-func (*ProcessRaftResponse) ProtoMessage()    {}
+func (x *ProcessRaftResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProcessRaftResponse) ProtoMessage() {}
+
+func (x *ProcessRaftResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_coord_proto_coord_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProcessRaftResponse.ProtoReflect.Descriptor instead.
+func (*ProcessRaftResponse) Descriptor() ([]byte, []int) {
+	return file_coord_proto_coord_proto_rawDescGZIP(), []int{4}
+}
+
+type Command struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	//Used to deduplicate retried proposals
+	RequestId     uint64 `protobuf:"varint,1,opt,name=RequestId,proto3" json:"RequestId,omitempty"`
+	Type          string `protobuf:"bytes,2,opt,name=Type,proto3" json:"Type,omitempty"`
+	Data          []byte `protobuf:"bytes,3,opt,name=Data,proto3" json:"Data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Command) Reset() {
+	*x = Command{}
+	mi := &file_coord_proto_coord_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
 
-func init() {
+func (x *Command) String() string {
+	return protoimpl.X.MessageStringOf(x)
 }
 
-// Client API for Coordinate service
+func (*Command) ProtoMessage() {}
 
+func (x *Command) ProtoReflect() protoreflect.Message {
+	mi := &file_coord_proto_coord_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Command.ProtoReflect.Descriptor instead.
+func (*Command) Descriptor() ([]byte, []int) {
+	return file_coord_proto_coord_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Command) GetRequestId() uint64 {
+	if x != nil {
+		return x.RequestId
+	}
+	return 0
+}
+
+func (x *Command) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Command) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type ProposeResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Data          []byte                 `protobuf:"bytes,1,opt,name=Data,proto3" json:"Data,omitempty"`
+	Error         string                 `protobuf:"bytes,2,opt,name=Error,proto3" json:"Error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProposeResult) Reset() {
+	*x = ProposeResult{}
+	mi := &file_coord_proto_coord_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProposeResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProposeResult) ProtoMessage() {}
+
+func (x *ProposeResult) ProtoReflect() protoreflect.Message {
+	mi := &file_coord_proto_coord_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProposeResult.ProtoReflect.Descriptor instead.
+func (*ProposeResult) Descriptor() ([]byte, []int) {
+	return file_coord_proto_coord_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ProposeResult) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *ProposeResult) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+var File_coord_proto_coord_proto protoreflect.FileDescriptor
+
+const file_coord_proto_coord_proto_rawDesc = "" +
+	"\n" +
+	"\x17coord/proto/coord.proto\x12\x05coord\"\xf6\x01\n" +
+	"\bPeerInfo\x12\x0e\n" +
+	"\x02Id\x18\x01 \x01(\x04R\x02Id\x12\x18\n" +
+	"\aAddress\x18\x02 \x01(\tR\aAddress\x12\x18\n" +
+	"\aLearner\x18\x03 \x01(\bR\aLearner\x12\x14\n" +
+	"\x05Roles\x18\x04 \x03(\tR\x05Roles\x12\x18\n" +
+	"\aVersion\x18\x05 \x01(\tR\aVersion\x129\n" +
+	"\bMetadata\x18\x06 \x03(\v2\x1d.coord.PeerInfo.MetadataEntryR\bMetadata\x1a;\n" +
+	"\rMetadataEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"M\n" +
+	"\fServiceLease\x12#\n" +
+	"\x04Peer\x18\x01 \x01(\v2\x0f.coord.PeerInfoR\x04Peer\x12\x18\n" +
+	"\aExpires\x18\x02 \x01(\x03R\aExpires\"5\n" +
+	"\fPeerInfoList\x12%\n" +
+	"\x05peers\x18\x01 \x03(\v2\x0f.coord.PeerInfoR\x05peers\"\x1e\n" +
+	"\bRaftStep\x12\x12\n" +
+	"\x04data\x18\x01 \x01(\fR\x04data\"\x15\n" +
+	"\x13ProcessRaftResponse\"O\n" +
+	"\aCommand\x12\x1c\n" +
+	"\tRequestId\x18\x01 \x01(\x04R\tRequestId\x12\x12\n" +
+	"\x04Type\x18\x02 \x01(\tR\x04Type\x12\x12\n" +
+	"\x04Data\x18\x03 \x01(\fR\x04Data\"9\n" +
+	"\rProposeResult\x12\x12\n" +
+	"\x04Data\x18\x01 \x01(\fR\x04Data\x12\x14\n" +
+	"\x05Error\x18\x02 \x01(\tR\x05Error2\xde\x01\n" +
+	"\n" +
+	"Coordinate\x126\n" +
+	"\fEmitRaftStep\x12\x0f.coord.RaftStep\x1a\x0f.coord.RaftStep\"\x00(\x010\x01\x122\n" +
+	"\bRegister\x12\x0f.coord.PeerInfo\x1a\x13.coord.PeerInfoList\"\x00\x121\n" +
+	"\aPromote\x12\x0f.coord.PeerInfo\x1a\x13.coord.PeerInfoList\"\x00\x121\n" +
+	"\aPropose\x12\x0e.coord.Command\x1a\x14.coord.ProposeResult\"\x00B-Z+github.com/acasajus/menac/coord/proto;coordb\x06proto3"
+
+var (
+	file_coord_proto_coord_proto_rawDescOnce sync.Once
+	file_coord_proto_coord_proto_rawDescData []byte
+)
+
+func file_coord_proto_coord_proto_rawDescGZIP() []byte {
+	file_coord_proto_coord_proto_rawDescOnce.Do(func() {
+		file_coord_proto_coord_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_coord_proto_coord_proto_rawDesc), len(file_coord_proto_coord_proto_rawDesc)))
+	})
+	return file_coord_proto_coord_proto_rawDescData
+}
+
+var file_coord_proto_coord_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_coord_proto_coord_proto_goTypes = []any{
+	(*PeerInfo)(nil),            // 0: coord.PeerInfo
+	(*ServiceLease)(nil),        // 1: coord.ServiceLease
+	(*PeerInfoList)(nil),        // 2: coord.PeerInfoList
+	(*RaftStep)(nil),            // 3: coord.RaftStep
+	(*ProcessRaftResponse)(nil), // 4: coord.ProcessRaftResponse
+	(*Command)(nil),             // 5: coord.Command
+	(*ProposeResult)(nil),       // 6: coord.ProposeResult
+	nil,                         // 7: coord.PeerInfo.MetadataEntry
+}
+var file_coord_proto_coord_proto_depIdxs = []int32{
+	7, // 0: coord.PeerInfo.Metadata:type_name -> coord.PeerInfo.MetadataEntry
+	0, // 1: coord.ServiceLease.Peer:type_name -> coord.PeerInfo
+	0, // 2: coord.PeerInfoList.peers:type_name -> coord.PeerInfo
+	3, // 3: coord.Coordinate.EmitRaftStep:input_type -> coord.RaftStep
+	0, // 4: coord.Coordinate.Register:input_type -> coord.PeerInfo
+	0, // 5: coord.Coordinate.Promote:input_type -> coord.PeerInfo
+	5, // 6: coord.Coordinate.Propose:input_type -> coord.Command
+	3, // 7: coord.Coordinate.EmitRaftStep:output_type -> coord.RaftStep
+	2, // 8: coord.Coordinate.Register:output_type -> coord.PeerInfoList
+	2, // 9: coord.Coordinate.Promote:output_type -> coord.PeerInfoList
+	6, // 10: coord.Coordinate.Propose:output_type -> coord.ProposeResult
+	7, // [7:11] is the sub-list for method output_type
+	3, // [3:7] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_coord_proto_coord_proto_init() }
+func file_coord_proto_coord_proto_init() {
+	if File_coord_proto_coord_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_coord_proto_coord_proto_rawDesc), len(file_coord_proto_coord_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_coord_proto_coord_proto_goTypes,
+		DependencyIndexes: file_coord_proto_coord_proto_depIdxs,
+		MessageInfos:      file_coord_proto_coord_proto_msgTypes,
+	}.Build()
+	File_coord_proto_coord_proto = out.File
+	file_coord_proto_coord_proto_goTypes = nil
+	file_coord_proto_coord_proto_depIdxs = nil
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// CoordinateClient is the client API for Coordinate service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
 type CoordinateClient interface {
-	// Process a raft step
+	//Process a raft step
 	EmitRaftStep(ctx context.Context, opts ...grpc.CallOption) (Coordinate_EmitRaftStepClient, error)
-	// Register into the cluster and get a list of peers
+	//Register into the cluster and get a list of peers
 	Register(ctx context.Context, in *PeerInfo, opts ...grpc.CallOption) (*PeerInfoList, error)
+	//Promote a learner into a voting member of the cluster
+	Promote(ctx context.Context, in *PeerInfo, opts ...grpc.CallOption) (*PeerInfoList, error)
+	//Propose a command to the leader and wait for its result
+	Propose(ctx context.Context, in *Command, opts ...grpc.CallOption) (*ProposeResult, error)
 }
 
 type coordinateClient struct {
-	cc *grpc.ClientConn
+	cc grpc.ClientConnInterface
 }
 
-func NewCoordinateClient(cc *grpc.ClientConn) CoordinateClient {
+func NewCoordinateClient(cc grpc.ClientConnInterface) CoordinateClient {
 	return &coordinateClient{cc}
 }
 
 func (c *coordinateClient) EmitRaftStep(ctx context.Context, opts ...grpc.CallOption) (Coordinate_EmitRaftStepClient, error) {
-	stream, err := grpc.NewClientStream(ctx, &_Coordinate_serviceDesc.Streams[0], c.cc, "/coord.Coordinate/EmitRaftStep", opts...)
+	stream, err := c.cc.NewStream(ctx, &_Coordinate_serviceDesc.Streams[0], "/coord.Coordinate/EmitRaftStep", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -109,12 +554,12 @@ type coordinateEmitRaftStepClient struct {
 }
 
 func (x *coordinateEmitRaftStepClient) Send(m *RaftStep) error {
-	return x.ClientStream.SendProto(m)
+	return x.ClientStream.SendMsg(m)
 }
 
 func (x *coordinateEmitRaftStepClient) Recv() (*RaftStep, error) {
 	m := new(RaftStep)
-	if err := x.ClientStream.RecvProto(m); err != nil {
+	if err := x.ClientStream.RecvMsg(m); err != nil {
 		return nil, err
 	}
 	return m, nil
@@ -122,20 +567,58 @@ func (x *coordinateEmitRaftStepClient) Recv() (*RaftStep, error) {
 
 func (c *coordinateClient) Register(ctx context.Context, in *PeerInfo, opts ...grpc.CallOption) (*PeerInfoList, error) {
 	out := new(PeerInfoList)
-	err := grpc.Invoke(ctx, "/coord.Coordinate/Register", in, out, c.cc, opts...)
+	err := c.cc.Invoke(ctx, "/coord.Coordinate/Register", in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-// Server API for Coordinate service
+func (c *coordinateClient) Promote(ctx context.Context, in *PeerInfo, opts ...grpc.CallOption) (*PeerInfoList, error) {
+	out := new(PeerInfoList)
+	err := c.cc.Invoke(ctx, "/coord.Coordinate/Promote", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
 
+func (c *coordinateClient) Propose(ctx context.Context, in *Command, opts ...grpc.CallOption) (*ProposeResult, error) {
+	out := new(ProposeResult)
+	err := c.cc.Invoke(ctx, "/coord.Coordinate/Propose", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CoordinateServer is the server API for Coordinate service.
 type CoordinateServer interface {
-	// Process a raft step
+	//Process a raft step
 	EmitRaftStep(Coordinate_EmitRaftStepServer) error
-	// Register into the cluster and get a list of peers
+	//Register into the cluster and get a list of peers
 	Register(context.Context, *PeerInfo) (*PeerInfoList, error)
+	//Promote a learner into a voting member of the cluster
+	Promote(context.Context, *PeerInfo) (*PeerInfoList, error)
+	//Propose a command to the leader and wait for its result
+	Propose(context.Context, *Command) (*ProposeResult, error)
+}
+
+// UnimplementedCoordinateServer can be embedded to have forward compatible implementations.
+type UnimplementedCoordinateServer struct {
+}
+
+func (*UnimplementedCoordinateServer) EmitRaftStep(Coordinate_EmitRaftStepServer) error {
+	return status.Errorf(codes.Unimplemented, "method EmitRaftStep not implemented")
+}
+func (*UnimplementedCoordinateServer) Register(context.Context, *PeerInfo) (*PeerInfoList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Register not implemented")
+}
+func (*UnimplementedCoordinateServer) Promote(context.Context, *PeerInfo) (*PeerInfoList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Promote not implemented")
+}
+func (*UnimplementedCoordinateServer) Propose(context.Context, *Command) (*ProposeResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Propose not implemented")
 }
 
 func RegisterCoordinateServer(s *grpc.Server, srv CoordinateServer) {
@@ -157,27 +640,69 @@ type coordinateEmitRaftStepServer struct {
 }
 
 func (x *coordinateEmitRaftStepServer) Send(m *RaftStep) error {
-	return x.ServerStream.SendProto(m)
+	return x.ServerStream.SendMsg(m)
 }
 
 func (x *coordinateEmitRaftStepServer) Recv() (*RaftStep, error) {
 	m := new(RaftStep)
-	if err := x.ServerStream.RecvProto(m); err != nil {
+	if err := x.ServerStream.RecvMsg(m); err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
-func _Coordinate_Register_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+func _Coordinate_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(PeerInfo)
-	if err := proto.Unmarshal(buf, in); err != nil {
+	if err := dec(in); err != nil {
 		return nil, err
 	}
-	out, err := srv.(CoordinateServer).Register(ctx, in)
-	if err != nil {
+	if interceptor == nil {
+		return srv.(CoordinateServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/coord.Coordinate/Register",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CoordinateServer).Register(ctx, req.(*PeerInfo))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Coordinate_Promote_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PeerInfo)
+	if err := dec(in); err != nil {
 		return nil, err
 	}
-	return out, nil
+	if interceptor == nil {
+		return srv.(CoordinateServer).Promote(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/coord.Coordinate/Promote",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CoordinateServer).Promote(ctx, req.(*PeerInfo))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Coordinate_Propose_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Command)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CoordinateServer).Propose(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/coord.Coordinate/Propose",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CoordinateServer).Propose(ctx, req.(*Command))
+	}
+	return interceptor(ctx, in, info, handler)
 }
 
 var _Coordinate_serviceDesc = grpc.ServiceDesc{
@@ -188,6 +713,14 @@ var _Coordinate_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Register",
 			Handler:    _Coordinate_Register_Handler,
 		},
+		{
+			MethodName: "Promote",
+			Handler:    _Coordinate_Promote_Handler,
+		},
+		{
+			MethodName: "Propose",
+			Handler:    _Coordinate_Propose_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -197,4 +730,5 @@ var _Coordinate_serviceDesc = grpc.ServiceDesc{
 			ClientStreams: true,
 		},
 	},
+	Metadata: "coord/proto/coord.proto",
 }
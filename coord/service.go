@@ -3,6 +3,7 @@ package coord
 import (
 	"io"
 	"log"
+	"strconv"
 
 	pb "github.com/acasajus/menac/coord/proto"
 	"github.com/coreos/etcd/raft/raftpb"
@@ -16,27 +17,33 @@ type peerEmitFunc struct {
 	stream pb.Coordinate_EmitRaftStepServer
 }
 
-func RegisterServer(s *grpc.Server) {
+func RegisterServer(s *grpc.Server, n *Node) {
 	c := &coordSvc{}
-	c.Initialize()
+	c.Initialize(n)
 	pb.RegisterCoordinateServer(s, c)
 }
 
 type coordSvc struct {
 	messageChan chan *raftpb.Message
 	hub         *Hub
+	node        *Node
 }
 
-func (si *coordSvc) Initialize() {
-
+func (si *coordSvc) Initialize(n *Node) {
+	si.node = n
+	si.messageChan = n.GetMessageChan()
+	si.hub = n.hub
 }
 
 func (si *coordSvc) EmitRaftStep(stream pb.Coordinate_EmitRaftStepServer) error {
-	header, _ := metadata.FromContext(stream.Context())
-	header = header
-	id := uint64(0)
-	//TODO: Add peer to raft
-	si.hub.AddServerStream(id, stream)
+	//Answer over this stream until the hub has its own one to the peer
+	var id uint64
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		if v := md.Get(HUB_PEER_ID_HEADER); len(v) > 0 {
+			id, _ = strconv.ParseUint(v[0], 10, 64)
+		}
+	}
+	defer si.hub.AddStream(id, stream)()
 	for {
 		msg, err := stream.Recv()
 		switch err {
@@ -49,13 +56,40 @@ func (si *coordSvc) EmitRaftStep(stream pb.Coordinate_EmitRaftStepServer) error
 		}
 		step := &raftpb.Message{}
 		if err := step.Unmarshal(msg.Data); err != nil {
-			log.Printf("Cannot unmarshal step %s", err)
+			log.Printf("coord: Cannot unmarshal step from %d: %s", id, err)
 			continue
 		}
 		si.messageChan <- step
 	}
 }
 
+// New peers always join as learners
 func (ci *coordSvc) Register(c context.Context, p *pb.PeerInfo) (*pb.PeerInfoList, error) {
-	return &pb.PeerInfoList{}, nil
+	if err := ci.node.AddLearner(c, p); err != nil {
+		return nil, err
+	}
+	return &pb.PeerInfoList{Peers: ci.node.Peers()}, nil
+}
+
+func (ci *coordSvc) Promote(c context.Context, p *pb.PeerInfo) (*pb.PeerInfoList, error) {
+	if err := ci.node.Promote(c, p.Id); err != nil {
+		return nil, err
+	}
+	return &pb.PeerInfoList{Peers: ci.node.Peers()}, nil
+}
+
+// Proposals forwarded by followers are not forwarded again to avoid loops
+func (ci *coordSvc) Propose(c context.Context, cmd *pb.Command) (*pb.ProposeResult, error) {
+	f := ci.node.propose(c, cmd, false)
+	select {
+	case <-f.Done():
+	case <-c.Done():
+		ci.node.tasker.proposals.cancel(cmd.RequestId, f, c.Err())
+		return nil, c.Err()
+	}
+	data, err := f.Result()
+	if err != nil {
+		return &pb.ProposeResult{Error: err.Error()}, nil
+	}
+	return &pb.ProposeResult{Data: data}, nil
 }
@@ -0,0 +1,325 @@
+package coord
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/acasajus/menac/coord/proto"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+const (
+	SVC_CMD_REGISTER   = "svc.register"
+	SVC_CMD_HEARTBEAT  = "svc.heartbeat"
+	SVC_CMD_DEREGISTER = "svc.deregister"
+	SVC_CMD_EXPIRE     = "svc.expire"
+
+	//How often the leader looks for expired leases
+	SVC_REAP_INTERVAL = time.Second
+)
+
+var ErrNoProposer = errors.New("Service registry is not attached to a node")
+var ErrNotRegistered = errors.New("Service instance is not registered")
+
+type Proposer interface {
+	Propose(context.Context, *pb.Command) *Future
+	IsLeader() bool
+}
+
+type serviceWatch struct {
+	role string
+	c    chan []*pb.PeerInfo
+}
+
+// Cluster wide registry of the roles served by each node, kept in the replicated log
+type ServiceRegistry struct {
+	lock      sync.RWMutex
+	instances map[uint64]*pb.ServiceLease
+	watches   map[*serviceWatch]bool
+
+	proposer  Proposer
+	announced map[uint64]chan struct{}
+	stop      chan struct{}
+}
+
+func NewServiceRegistry(mux *CommandMux) *ServiceRegistry {
+	sr := &ServiceRegistry{
+		instances: make(map[uint64]*pb.ServiceLease),
+		watches:   make(map[*serviceWatch]bool),
+		announced: make(map[uint64]chan struct{}),
+		stop:      make(chan struct{}),
+	}
+	mux.Handle(SVC_CMD_REGISTER, sr.applyRegister)
+	mux.Handle(SVC_CMD_HEARTBEAT, sr.applyHeartbeat)
+	mux.Handle(SVC_CMD_DEREGISTER, sr.applyDeregister)
+	mux.Handle(SVC_CMD_EXPIRE, sr.applyExpire)
+	return sr
+}
+
+// Attach the registry to the node that will replicate its changes
+func (sr *ServiceRegistry) Attach(p Proposer) {
+	sr.lock.Lock()
+	sr.proposer = p
+	sr.lock.Unlock()
+	go sr.reap()
+}
+
+func (sr *ServiceRegistry) Stop() {
+	close(sr.stop)
+}
+
+func (sr *ServiceRegistry) propose(ctx context.Context, cmdType string, lease *pb.ServiceLease) error {
+	sr.lock.RLock()
+	p := sr.proposer
+	sr.lock.RUnlock()
+	if p == nil {
+		return ErrNoProposer
+	}
+	data, err := proto.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	_, err = p.Propose(ctx, &pb.Command{Type: cmdType, Data: data}).Result()
+	return err
+}
+
+// Register an instance and keep renewing its lease until Withdraw is called
+func (sr *ServiceRegistry) Announce(ctx context.Context, info *pb.PeerInfo, ttl time.Duration) error {
+	lease := &pb.ServiceLease{Peer: info, Expires: time.Now().Add(ttl).UnixNano()}
+	if err := sr.propose(ctx, SVC_CMD_REGISTER, lease); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	sr.lock.Lock()
+	if old, ok := sr.announced[info.Id]; ok {
+		close(old)
+	}
+	sr.announced[info.Id] = done
+	sr.lock.Unlock()
+	go sr.heartbeat(info, ttl, done)
+	return nil
+}
+
+// Renew the lease periodically, registering again if it expired
+func (sr *ServiceRegistry) heartbeat(info *pb.PeerInfo, ttl time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), ttl/3)
+			expires := time.Now().Add(ttl).UnixNano()
+			err := sr.propose(ctx, SVC_CMD_HEARTBEAT, &pb.ServiceLease{Peer: &pb.PeerInfo{Id: info.Id}, Expires: expires})
+			if err != nil && err.Error() == ErrNotRegistered.Error() {
+				err = sr.propose(ctx, SVC_CMD_REGISTER, &pb.ServiceLease{Peer: info, Expires: expires})
+			}
+			if err != nil {
+				log.Printf("coord: Cannot renew lease for service instance %d: %s", info.Id, err)
+			}
+			cancel()
+		case <-done:
+			return
+		case <-sr.stop:
+			return
+		}
+	}
+}
+
+// Stop renewing the lease of an instance and remove it from the registry
+func (sr *ServiceRegistry) Withdraw(ctx context.Context, id uint64) error {
+	sr.lock.Lock()
+	if done, ok := sr.announced[id]; ok {
+		close(done)
+		delete(sr.announced, id)
+	}
+	sr.lock.Unlock()
+	return sr.propose(ctx, SVC_CMD_DEREGISTER, &pb.ServiceLease{Peer: &pb.PeerInfo{Id: id}})
+}
+
+func (sr *ServiceRegistry) reap() {
+	ticker := time.NewTicker(SVC_REAP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sr.lock.RLock()
+			p := sr.proposer
+			sr.lock.RUnlock()
+			if !p.IsLeader() {
+				continue
+			}
+			for _, lease := range sr.expired(time.Now()) {
+				ctx, cancel := context.WithTimeout(context.Background(), SVC_REAP_INTERVAL)
+				if err := sr.propose(ctx, SVC_CMD_EXPIRE, lease); err != nil {
+					log.Printf("coord: Cannot expire service instance %d: %s", lease.Peer.Id, err)
+				}
+				cancel()
+			}
+		case <-sr.stop:
+			return
+		}
+	}
+}
+
+func (sr *ServiceRegistry) expired(now time.Time) []*pb.ServiceLease {
+	sr.lock.RLock()
+	defer sr.lock.RUnlock()
+	leases := []*pb.ServiceLease{}
+	for id, lease := range sr.instances {
+		if lease.Expires <= now.UnixNano() {
+			leases = append(leases, &pb.ServiceLease{Peer: &pb.PeerInfo{Id: id}, Expires: lease.Expires})
+		}
+	}
+	return leases
+}
+
+// Instances serving a role with a valid lease. An empty role matches all
+func (sr *ServiceRegistry) Healthy(role string) []*pb.PeerInfo {
+	sr.lock.RLock()
+	defer sr.lock.RUnlock()
+	return sr.healthy(role, time.Now())
+}
+
+// Must be called with the lock held
+func (sr *ServiceRegistry) healthy(role string, now time.Time) []*pb.PeerInfo {
+	ids := make([]uint64, 0, len(sr.instances))
+	for id, lease := range sr.instances {
+		if lease.Expires <= now.UnixNano() || !hasRole(lease.Peer, role) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Sort(uint64Slice(ids))
+	peers := make([]*pb.PeerInfo, 0, len(ids))
+	for _, id := range ids {
+		peers = append(peers, clonePeerInfo(sr.instances[id].Peer))
+	}
+	return peers
+}
+
+func hasRole(p *pb.PeerInfo, role string) bool {
+	if len(role) == 0 {
+		return true
+	}
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the healthy instances of a role every time they change. Call the returned func to stop
+func (sr *ServiceRegistry) Watch(role string) (<-chan []*pb.PeerInfo, func()) {
+	w := &serviceWatch{role: role, c: make(chan []*pb.PeerInfo, 1)}
+	sr.lock.Lock()
+	sr.watches[w] = true
+	w.c <- sr.healthy(role, time.Now())
+	sr.lock.Unlock()
+	return w.c, func() {
+		sr.lock.Lock()
+		defer sr.lock.Unlock()
+		if sr.watches[w] {
+			delete(sr.watches, w)
+			close(w.c)
+		}
+	}
+}
+
+// Must be called with the lock held
+func (sr *ServiceRegistry) notify(changed *pb.PeerInfo) {
+	now := time.Now()
+	for w := range sr.watches {
+		if !hasRole(changed, w.role) {
+			continue
+		}
+		peers := sr.healthy(w.role, now)
+		select {
+		case <-w.c:
+		default:
+		}
+		w.c <- peers
+	}
+}
+
+func unmarshalLease(data []byte) (*pb.ServiceLease, error) {
+	lease := &pb.ServiceLease{}
+	if err := proto.Unmarshal(data, lease); err != nil {
+		return nil, err
+	}
+	if lease.Peer == nil || lease.Peer.Id == 0 {
+		return nil, errors.New("Service lease without instance id")
+	}
+	return lease, nil
+}
+
+func (sr *ServiceRegistry) applyRegister(data []byte) ([]byte, error) {
+	lease, err := unmarshalLease(data)
+	if err != nil {
+		return nil, err
+	}
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	sr.instances[lease.Peer.Id] = lease
+	sr.notify(lease.Peer)
+	return nil, nil
+}
+
+func (sr *ServiceRegistry) applyHeartbeat(data []byte) ([]byte, error) {
+	lease, err := unmarshalLease(data)
+	if err != nil {
+		return nil, err
+	}
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	current, ok := sr.instances[lease.Peer.Id]
+	if !ok {
+		return nil, ErrNotRegistered
+	}
+	if lease.Expires > current.Expires {
+		//A lease renewed after expiring makes the instance healthy again
+		expired := current.Expires <= time.Now().UnixNano()
+		current.Expires = lease.Expires
+		if expired {
+			sr.notify(current.Peer)
+		}
+	}
+	return nil, nil
+}
+
+func (sr *ServiceRegistry) applyDeregister(data []byte) ([]byte, error) {
+	lease, err := unmarshalLease(data)
+	if err != nil {
+		return nil, err
+	}
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	current, ok := sr.instances[lease.Peer.Id]
+	if !ok {
+		return nil, ErrNotRegistered
+	}
+	delete(sr.instances, lease.Peer.Id)
+	sr.notify(current.Peer)
+	return nil, nil
+}
+
+// Expire an instance unless its lease was renewed meanwhile
+func (sr *ServiceRegistry) applyExpire(data []byte) ([]byte, error) {
+	lease, err := unmarshalLease(data)
+	if err != nil {
+		return nil, err
+	}
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	current, ok := sr.instances[lease.Peer.Id]
+	if !ok || current.Expires != lease.Expires {
+		return nil, nil
+	}
+	delete(sr.instances, lease.Peer.Id)
+	sr.notify(current.Peer)
+	return nil, nil
+}
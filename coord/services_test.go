@@ -0,0 +1,146 @@
+package coord
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/acasajus/menac/coord/proto"
+	"golang.org/x/net/context"
+)
+
+type directProposer struct {
+	ps  *proposals
+	mux *CommandMux
+	id  uint64
+}
+
+func (dp *directProposer) Propose(ctx context.Context, cmd *pb.Command) *Future {
+	dp.id++
+	cmd.RequestId = dp.id
+	f, _ := dp.ps.register(cmd.RequestId)
+	dp.ps.apply(dp.mux, cmd)
+	return f
+}
+
+func (dp *directProposer) IsLeader() bool {
+	return false
+}
+
+func newTestServiceRegistry() *ServiceRegistry {
+	mux := NewCommandMux()
+	sr := NewServiceRegistry(mux)
+	sr.Attach(&directProposer{ps: newProposals(), mux: mux})
+	return sr
+}
+
+func peerIds(peers []*pb.PeerInfo) []uint64 {
+	ids := []uint64{}
+	for _, p := range peers {
+		ids = append(ids, p.Id)
+	}
+	return ids
+}
+
+func TestServiceRegistryAnnounce(t *testing.T) {
+	sr := newTestServiceRegistry()
+	defer sr.Stop()
+	ctx := context.Background()
+	if err := sr.Announce(ctx, &pb.PeerInfo{Id: 1, Roles: []string{"web"}, Version: "1"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := sr.Announce(ctx, &pb.PeerInfo{Id: 2, Roles: []string{"web", "matcher"}}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ids := peerIds(sr.Healthy("web")); len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("Unexpected web instances %v", ids)
+	}
+	if ids := peerIds(sr.Healthy("matcher")); len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("Unexpected matcher instances %v", ids)
+	}
+	if err := sr.Withdraw(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if ids := peerIds(sr.Healthy("matcher")); len(ids) != 0 {
+		t.Errorf("Withdrawn instance is still there %v", ids)
+	}
+	if err := sr.Withdraw(ctx, 2); err != ErrNotRegistered {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestServiceRegistryExpire(t *testing.T) {
+	sr := newTestServiceRegistry()
+	defer sr.Stop()
+	ctx := context.Background()
+	if err := sr.Announce(ctx, &pb.PeerInfo{Id: 1, Roles: []string{"web"}}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(2 * time.Hour)
+	if ids := peerIds(sr.healthy("web", later)); len(ids) != 0 {
+		t.Errorf("Expired instance is healthy %v", ids)
+	}
+	expired := sr.expired(later)
+	if len(expired) != 1 {
+		t.Fatalf("Expected one expired lease and got %d", len(expired))
+	}
+	//A renewal after the leader decided to expire the lease wins
+	if err := sr.propose(ctx, SVC_CMD_HEARTBEAT, &pb.ServiceLease{Peer: &pb.PeerInfo{Id: 1}, Expires: later.Add(time.Hour).UnixNano()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sr.propose(ctx, SVC_CMD_EXPIRE, expired[0]); err != nil {
+		t.Fatal(err)
+	}
+	if ids := peerIds(sr.healthy("web", later)); len(ids) != 1 {
+		t.Errorf("Renewed instance was expired %v", ids)
+	}
+	expired = sr.expired(later.Add(2 * time.Hour))
+	if err := sr.propose(ctx, SVC_CMD_EXPIRE, expired[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(sr.instances) != 0 {
+		t.Errorf("Expired instance was not removed")
+	}
+}
+
+func TestServiceRegistryWatch(t *testing.T) {
+	sr := newTestServiceRegistry()
+	defer sr.Stop()
+	ctx := context.Background()
+	c, stop := sr.Watch("web")
+	if peers := <-c; len(peers) != 0 {
+		t.Errorf("Unexpected initial instances %v", peerIds(peers))
+	}
+	sr.Announce(ctx, &pb.PeerInfo{Id: 1, Roles: []string{"matcher"}}, time.Hour)
+	select {
+	case peers := <-c:
+		t.Errorf("Got notified of a change in another role %v", peerIds(peers))
+	default:
+	}
+	sr.Announce(ctx, &pb.PeerInfo{Id: 2, Roles: []string{"web"}}, time.Hour)
+	sr.Announce(ctx, &pb.PeerInfo{Id: 3, Roles: []string{"web"}}, time.Hour)
+	if ids := peerIds(<-c); len(ids) != 2 {
+		t.Errorf("Watch did not get the latest instances %v", ids)
+	}
+	//An expired lease renewed before it is removed is healthy again
+	lease := &pb.ServiceLease{Peer: &pb.PeerInfo{Id: 4, Roles: []string{"web"}}, Expires: time.Now().Add(-time.Hour).UnixNano()}
+	if err := sr.propose(ctx, SVC_CMD_REGISTER, lease); err != nil {
+		t.Fatal(err)
+	}
+	<-c
+	lease.Expires = time.Now().Add(time.Hour).UnixNano()
+	if err := sr.propose(ctx, SVC_CMD_HEARTBEAT, lease); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case peers := <-c:
+		if ids := peerIds(peers); len(ids) != 3 {
+			t.Errorf("Renewed instance is missing %v", ids)
+		}
+	default:
+		t.Error("Watch was not notified of the renewed instance")
+	}
+	stop()
+	if _, open := <-c; open {
+		t.Error("Watch channel is still open")
+	}
+}
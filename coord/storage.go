@@ -8,6 +8,7 @@ import (
 	"log"
 
 	"github.com/boltdb/bolt"
+	"github.com/coreos/etcd/raft"
 	pb "github.com/coreos/etcd/raft/raftpb"
 )
 
@@ -68,27 +69,7 @@ func (b *BoltStorage) bucketRead(do func(*bolt.Bucket) error) error {
 }
 
 func (b *BoltStorage) getIndexes() (uint64, uint64) {
-	var first, last uint64
-	b.bucketRead(func(u *bolt.Bucket) error {
-		d := u.Get([]byte("first-index"))
-		if d != nil {
-			a, c := binary.Uvarint(d)
-			if c <= 0 {
-				panic("first index has an invalid value on the store")
-			}
-			first = a
-		}
-		d = u.Get([]byte("last-index"))
-		if d != nil {
-			a, c := binary.Uvarint(d)
-			if c <= 0 {
-				panic("last index has an invalid value on the store")
-			}
-			last = a
-		}
-		return nil
-	})
-	return first, last
+	return b.getUInt64("first"), b.getUInt64("last")
 }
 
 func (b *BoltStorage) getUInt64(name string) uint64 {
@@ -128,6 +109,12 @@ func (b *BoltStorage) LastIndex() (uint64, error) {
 	return b.getUInt64("last"), nil
 }
 
+// Whether no raft state has been stored yet
+func (b *BoltStorage) Empty() bool {
+	last, _ := b.LastIndex()
+	return last == 0 && raft.IsEmptyHardState(*b.getHardState())
+}
+
 func (b *BoltStorage) InitialState() (pb.HardState, pb.ConfState, error) {
 	hs := b.getHardState()
 	snap, err := b.Snapshot()
@@ -135,7 +122,7 @@ func (b *BoltStorage) InitialState() (pb.HardState, pb.ConfState, error) {
 }
 
 func (b *BoltStorage) getHardState() *pb.HardState {
-	var hs *pb.HardState
+	hs := &pb.HardState{}
 	b.bucketRead(func(u *bolt.Bucket) error {
 		if data := u.Get([]byte("hardstate")); data == nil {
 			return errors.New("")
@@ -340,7 +327,7 @@ func (b *BoltStorage) getEntry(index uint64) (pb.Entry, error) {
 	})
 }
 
-func (b *BoltStorage) Entries(lo, hi uint64) ([]pb.Entry, error) {
+func (b *BoltStorage) Entries(lo, hi, maxSize uint64) ([]pb.Entry, error) {
 	first, last := b.getIndexes()
 	if lo < first {
 		return nil, ErrCompacted
@@ -349,12 +336,18 @@ func (b *BoltStorage) Entries(lo, hi uint64) ([]pb.Entry, error) {
 	if hi > last+1 {
 		return nil, fmt.Errorf("entries's hi(%d) is out of bound lastindex(%d)", hi, last)
 	}
-	entries := make([]pb.Entry, 0, hi-1-lo)
+	entries := make([]pb.Entry, 0, hi-lo)
+	var size uint64
 	for i := lo; i <= last && i < hi; i++ {
 		e, err := b.getEntry(i)
 		if err != nil {
 			return entries, err
 		}
+		//Always return at least one entry
+		size += uint64(e.Size())
+		if len(entries) > 0 && size > maxSize {
+			break
+		}
 		entries = append(entries, e)
 	}
 	return entries, nil
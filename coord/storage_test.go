@@ -2,6 +2,7 @@ package coord
 
 import (
 	"io/ioutil"
+	"math"
 	"os"
 	"reflect"
 	"testing"
@@ -119,7 +120,7 @@ func TestStorageAppend(t *testing.T) {
 			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
 		}
 		l, _ := b.LastIndex()
-		out, err := b.Entries(ents[0].Index, l+1)
+		out, err := b.Entries(ents[0].Index, l+1, math.MaxUint64)
 		if err != nil {
 			t.Fatalf("#%d: err = %s", i, err)
 		}
@@ -190,7 +191,7 @@ func TestStorageCompact(t *testing.T) {
 		}
 		f, _ := b.FirstIndex()
 		l, _ := b.LastIndex()
-		out, err := b.Entries(f, l+1)
+		out, err := b.Entries(f, l+1, math.MaxUint64)
 		if err != nil {
 			t.Fatalf("#%d: err = %s", i, err)
 		}
@@ -236,3 +237,40 @@ func TestStorageTerm(t *testing.T) {
 		}
 	}
 }
+
+func TestStorageEntries(t *testing.T) {
+	b := createStorage()
+	defer deleteStorage(b)
+	ents := []pb.Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4}, {Index: 5, Term: 5}, {Index: 6, Term: 6}}
+	tests := []struct {
+		lo, hi, maxsize uint64
+
+		werr     error
+		wentries []pb.Entry
+	}{
+		{2, 6, math.MaxUint64, ErrCompacted, nil},
+		{4, 7, math.MaxUint64, nil, []pb.Entry{{Index: 4, Term: 4}, {Index: 5, Term: 5}, {Index: 6, Term: 6}}},
+		// even if maxsize is zero, the first entry should be returned
+		{4, 7, 0, nil, []pb.Entry{{Index: 4, Term: 4}}},
+		// limit to 2
+		{4, 7, uint64(ents[1].Size() + ents[2].Size()), nil, []pb.Entry{{Index: 4, Term: 4}, {Index: 5, Term: 5}}},
+		{4, 7, uint64(ents[1].Size() + ents[2].Size() + ents[3].Size()/2), nil, []pb.Entry{{Index: 4, Term: 4}, {Index: 5, Term: 5}}},
+		{4, 7, uint64(ents[1].Size() + ents[2].Size() + ents[3].Size()), nil, []pb.Entry{{Index: 4, Term: 4}, {Index: 5, Term: 5}, {Index: 6, Term: 6}}},
+	}
+
+	for i, tt := range tests {
+		if err := b.forceEntries(ents); err != nil {
+			t.Fatalf("#%d: err = %s", i, err)
+		}
+		out, err := b.Entries(tt.lo, tt.hi, tt.maxsize)
+		if err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+		if len(out) == 0 && len(tt.wentries) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(out, tt.wentries) {
+			t.Errorf("#%d: entries = %v, want %v", i, out, tt.wentries)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package coord
 
-import "github.com/coreos/etcd/raft/raftpb"
+import (
+	pb "github.com/acasajus/menac/coord/proto"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/golang/protobuf/proto"
+)
 
 type Task struct {
 	entries  []raftpb.Entry
@@ -11,23 +15,56 @@ type Task struct {
 type TaskRunner struct {
 	todo chan Task
 	stop chan struct{}
+
+	confChange func(raftpb.ConfChange) error
+	sm         StateMachine
+	proposals  *proposals
 }
 
-func NewTaskRunner() *TaskRunner {
+func NewTaskRunner(confChange func(raftpb.ConfChange) error, sm StateMachine) *TaskRunner {
 	tr := &TaskRunner{
-		todo: make(chan Task),
-		stop: make(chan struct{}),
+		todo:       make(chan Task),
+		stop:       make(chan struct{}),
+		confChange: confChange,
+		sm:         sm,
+		proposals:  newProposals(),
 	}
 	go tr.run()
 	return tr
 }
 
+func (tr *TaskRunner) apply(task Task) error {
+	for _, e := range task.entries {
+		switch e.Type {
+		case raftpb.EntryConfChange:
+			var cc raftpb.ConfChange
+			if err := cc.Unmarshal(e.Data); err != nil {
+				return err
+			}
+			if err := tr.confChange(cc); err != nil {
+				return err
+			}
+		case raftpb.EntryNormal:
+			//Leaders append an empty entry when elected
+			if len(e.Data) == 0 {
+				continue
+			}
+			cmd := &pb.Command{}
+			if err := proto.Unmarshal(e.Data, cmd); err != nil {
+				return err
+			}
+			tr.proposals.apply(tr.sm, cmd)
+		}
+	}
+	return nil
+}
+
 func (tr *TaskRunner) run() {
 	for {
 		select {
 		case task := <-tr.todo:
 			//TODO: FOLLOW: https://sourcegraph.com/github.com/coreos/etcd@32105e6ed063ad0fba8077b3a446ef3cf476c17c/.tree/etcdserver/server.go#startline=353&endline=353
-			task.done <- nil
+			task.done <- tr.apply(task)
 		case <-tr.stop:
 			return
 		}
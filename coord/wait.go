@@ -0,0 +1,60 @@
+package coord
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+type indexWait struct {
+	lock    sync.Mutex
+	applied uint64
+	waiters map[uint64][]chan struct{}
+}
+
+func newIndexWait() *indexWait {
+	return &indexWait{waiters: make(map[uint64][]chan struct{})}
+}
+
+func (w *indexWait) Applied() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.applied
+}
+
+// Mark all indexes up to i as applied and wake up whoever was waiting for them
+func (w *indexWait) Trigger(i uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if i <= w.applied {
+		return
+	}
+	w.applied = i
+	for wi, chans := range w.waiters {
+		if wi > i {
+			continue
+		}
+		for _, c := range chans {
+			close(c)
+		}
+		delete(w.waiters, wi)
+	}
+}
+
+// Block until index i has been applied or the context is done
+func (w *indexWait) Wait(ctx context.Context, i uint64) error {
+	w.lock.Lock()
+	if i <= w.applied {
+		w.lock.Unlock()
+		return nil
+	}
+	c := make(chan struct{})
+	w.waiters[i] = append(w.waiters[i], c)
+	w.lock.Unlock()
+	select {
+	case <-c:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,38 @@
+package coord
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestIndexWait(t *testing.T) {
+	w := newIndexWait()
+	w.Trigger(3)
+	if err := w.Wait(context.Background(), 2); err != nil {
+		t.Fatalf("Already applied index should not block: %s", err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- w.Wait(context.Background(), 5)
+	}()
+	w.Trigger(4)
+	select {
+	case <-done:
+		t.Fatal("Wait returned before index was applied")
+	case <-time.After(10 * time.Millisecond):
+	}
+	w.Trigger(6)
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if w.Applied() != 6 {
+		t.Errorf("Applied index is %d vs expected 6", w.Applied())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := w.Wait(ctx, 10); err != context.Canceled {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
@@ -63,6 +63,8 @@ func (d *db) CreateNewRecord(r RecordObject) error {
 	if err := r.Validate(); err != nil {
 		return err
 	}
+	r.setCreatedAt(time.Now())
+	r.setUpdatedAt(r.GetCreatedAt())
 	pk, bins, err := structToData(r)
 	if err != nil {
 		return err
@@ -71,8 +73,6 @@ func (d *db) CreateNewRecord(r RecordObject) error {
 	if err != nil {
 		return err
 	}
-	r.setCreatedAt(time.Now())
-	r.setUpdatedAt(r.GetCreatedAt())
 	wPolicy := as.NewWritePolicy(r.GetGeneration(), r.GetExpiration())
 	wPolicy.RecordExistsAction = as.CREATE_ONLY
 	if err := d.client.PutBins(wPolicy, key, bins...); err != nil {
@@ -193,12 +193,13 @@ func (d *db) ScanRecords(r RecordObject) chan ChanRecord {
 				if !open {
 					return
 				}
-				if err := recordToStruct(record, r); err != nil {
+				nr := newRecordLike(r)
+				if err := recordToStruct(record, nr); err != nil {
 					ifc <- ChanRecord{Error: err}
 					return
 				}
-				r.setDB(d)
-				ifc <- ChanRecord{Record: r}
+				nr.setDB(d)
+				ifc <- ChanRecord{Record: nr}
 			// do something
 			case err := <-recordSet.Errors:
 				if err != nil {
@@ -268,12 +269,13 @@ func (d *db) Search(r RecordObject, indexName string, value string) chan ChanRec
 				if !open {
 					return
 				}
-				if err := recordToStruct(record, r); err != nil {
+				nr := newRecordLike(r)
+				if err := recordToStruct(record, nr); err != nil {
 					ifc <- ChanRecord{Error: err}
 					return
 				}
-				r.setDB(d)
-				ifc <- ChanRecord{Record: r}
+				nr.setDB(d)
+				ifc <- ChanRecord{Record: nr}
 			// do something
 			case err := <-recordSet.Errors:
 				if err != nil {
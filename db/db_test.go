@@ -3,6 +3,7 @@ package db
 import (
 	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -127,6 +128,80 @@ func TestReplaceRecord(t *testing.T) {
 	}
 }
 
+func TestRecordTimes(t *testing.T) {
+	d := getDB()
+	r := NewSTS()
+	r.ChangeData()
+	if err := d.CreateNewRecord(r); err != nil {
+		t.Fatalf("Could not create new record: %s", err)
+	}
+	rb := &SomeTestStruct{}
+	if err := d.GetRecord([]byte(r.Id), rb); err != nil {
+		t.Fatalf("Could not retrieve record: %s", err)
+	}
+	if rb.GetCreatedAt().IsZero() || rb.GetCreatedAt().Unix() != r.GetCreatedAt().Unix() {
+		t.Errorf("Created at mismatch %s vs %s", rb.GetCreatedAt(), r.GetCreatedAt())
+	}
+	if rb.GetUpdatedAt().Unix() != r.GetUpdatedAt().Unix() {
+		t.Errorf("Updated at mismatch %s vs %s", rb.GetUpdatedAt(), r.GetUpdatedAt())
+	}
+	time.Sleep(1100 * time.Millisecond)
+	rb.ChangeData()
+	if err := d.ReplaceRecord(rb); err != nil {
+		t.Fatalf("Could not replace record: %s", err)
+	}
+	if err := d.GetRecord([]byte(r.Id), rb); err != nil {
+		t.Fatalf("Could not retrieve record: %s", err)
+	}
+	if rb.GetCreatedAt().Unix() != r.GetCreatedAt().Unix() {
+		t.Errorf("Created at changed %s vs %s", rb.GetCreatedAt(), r.GetCreatedAt())
+	}
+	if !rb.GetUpdatedAt().After(rb.GetCreatedAt()) {
+		t.Errorf("Updated at %s is not after created at %s", rb.GetUpdatedAt(), rb.GetCreatedAt())
+	}
+}
+
+type CollectionsTestStruct struct {
+	Record
+
+	Id       string `db:"pk"`
+	Size     int64
+	Names    []string
+	Sizes    []int64
+	Metadata map[string]string
+	Counts   map[string][]int
+}
+
+func (cts *CollectionsTestStruct) Validate() error {
+	return nil
+}
+
+func TestRecordCollections(t *testing.T) {
+	d := getDB()
+	r := &CollectionsTestStruct{
+		Id:       "deleteme:" + time.Now().Format(time.RFC3339Nano),
+		Size:     3,
+		Names:    []string{"a", "b"},
+		Sizes:    []int64{1, 2},
+		Metadata: map[string]string{"K": "v"},
+		Counts:   map[string][]int{"a": {1, 2}},
+	}
+	r.SetExpiration(int32(5))
+	if err := d.CreateNewRecord(r); err != nil {
+		t.Fatalf("Could not create new record: %s", err)
+	}
+	rb := &CollectionsTestStruct{}
+	if err := d.GetRecord([]byte(r.Id), rb); err != nil {
+		t.Fatalf("Could not retrieve record: %s", err)
+	}
+	if rb.Size != r.Size || !reflect.DeepEqual(rb.Names, r.Names) || !reflect.DeepEqual(rb.Sizes, r.Sizes) {
+		t.Errorf("Scalars or lists differ %+v vs %+v", rb, r)
+	}
+	if !reflect.DeepEqual(rb.Metadata, r.Metadata) || !reflect.DeepEqual(rb.Counts, r.Counts) {
+		t.Errorf("Maps differ %+v vs %+v", rb, r)
+	}
+}
+
 func TestScan(t *testing.T) {
 	d := getDB()
 	r := NewSTS()
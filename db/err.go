@@ -24,3 +24,17 @@ func IsErrIndexExists(err error) bool {
 	ae, ok := err.(ast.AerospikeError)
 	return ok && ae.ResultCode() == ast.INDEX_FOUND
 }
+
+func IsErrNotFound(err error) bool {
+	if err == ERR_NO_EXIST {
+		return true
+	}
+	ae, ok := err.(ast.AerospikeError)
+	return ok && ae.ResultCode() == ast.KEY_NOT_FOUND_ERROR
+}
+
+// The record was modified since it was read
+func IsErrGeneration(err error) bool {
+	ae, ok := err.(ast.AerospikeError)
+	return ok && ae.ResultCode() == ast.GENERATION_ERROR
+}
@@ -17,6 +17,16 @@ func structName(s recordData) string {
 	return t.Name()
 }
 
+// Empty record of the same type as r. Scans and searches fill a new one for
+// every result so the receivers don't share a struct
+func newRecordLike(r RecordObject) RecordObject {
+	t := reflect.TypeOf(r)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return reflect.New(t).Interface().(RecordObject)
+}
+
 func structGetPK(s recordData) ([]byte, error) {
 	pk := s.GetPrimaryKey()
 	if pk != nil {
@@ -148,7 +158,7 @@ func recordToStruct(r *as.Record, s recordData) error {
 		if err != nil {
 			return err
 		}
-		s.setCreatedAt(t)
+		s.setUpdatedAt(t)
 	}
 	for i := 0; i < st.NumField(); i++ {
 		field := st.Field(i)
@@ -169,18 +179,12 @@ func recordToStruct(r *as.Record, s recordData) error {
 				continue
 			}
 			switch v.Kind() {
-			case reflect.Array, reflect.Slice:
-				switch v.Interface().(type) {
-				case []byte:
-					v.SetBytes(b.([]byte))
-				default:
-					bSlice := b.([]interface{})
-					slice := reflect.MakeSlice(field.Type, 0, len(bSlice))
-					for _, bp := range bSlice {
-						slice = reflect.Append(slice, reflect.ValueOf(bp))
-					}
-					v.Set(slice)
+			case reflect.Int, reflect.Int32, reflect.Int64, reflect.Slice, reflect.Map:
+				bv, err := binValue(b, v.Type())
+				if err != nil {
+					return err
 				}
+				v.Set(bv)
 			default:
 				switch v.Interface().(type) {
 				case time.Time:
@@ -198,6 +202,55 @@ func recordToStruct(r *as.Record, s recordData) error {
 	return nil
 }
 
+// Convert what the client returns for a bin to t. Integers always come back
+// as int, lists as []interface{} and maps as map[interface{}]interface{}
+func binValue(b interface{}, t reflect.Type) (reflect.Value, error) {
+	if b == nil {
+		return reflect.Zero(t), nil
+	}
+	bv := reflect.ValueOf(b)
+	if bv.Type().AssignableTo(t) {
+		return bv, nil
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if bv.Kind() == reflect.Int {
+			return bv.Convert(t), nil
+		}
+	case reflect.Slice:
+		if bv.Kind() != reflect.Slice {
+			break
+		}
+		slice := reflect.MakeSlice(t, 0, bv.Len())
+		for i := 0; i < bv.Len(); i++ {
+			ev, err := binValue(bv.Index(i).Interface(), t.Elem())
+			if err != nil {
+				return bv, err
+			}
+			slice = reflect.Append(slice, ev)
+		}
+		return slice, nil
+	case reflect.Map:
+		if bv.Kind() != reflect.Map {
+			break
+		}
+		m := reflect.MakeMapWithSize(t, bv.Len())
+		for _, k := range bv.MapKeys() {
+			kv, err := binValue(k.Interface(), t.Key())
+			if err != nil {
+				return bv, err
+			}
+			ev, err := binValue(bv.MapIndex(k).Interface(), t.Elem())
+			if err != nil {
+				return bv, err
+			}
+			m.SetMapIndex(kv, ev)
+		}
+		return m, nil
+	}
+	return bv, ERR_DATA_TYPE_MISMATCH
+}
+
 func structIndexes(s recordData) []string {
 	st := reflect.TypeOf(s)
 	sv := reflect.ValueOf(s)
@@ -0,0 +1,432 @@
+package ostore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/acasajus/menac/db"
+	"github.com/acasajus/menac/registry"
+)
+
+type Permission int
+
+const (
+	PERM_READ Permission = 1 << iota
+	PERM_WRITE
+	PERM_DELETE
+	PERM_NONE Permission = 0
+	PERM_ALL             = PERM_READ | PERM_WRITE | PERM_DELETE
+
+	//Properties of registry groups widening what their members can do
+	PROP_GROUP_WRITE = "ostore:group-write"
+	//Members read every object of the organization
+	PROP_ORG_READ = "ostore:read"
+	//Members can do anything with every object of the organization
+	PROP_ORG_ADMIN = "ostore:admin"
+
+	//Who an ACL grant is for. Public grants are for anyone, even anonymous
+	//clients, and can only give read access
+	GRANT_USER   = "user"
+	GRANT_GROUP  = "group"
+	GRANT_PUBLIC = "public"
+	//ACL entry of public-read objects
+	GRANT_PUBLIC_READ = GRANT_PUBLIC + ":r"
+)
+
+var (
+	ErrAccessDenied = errors.New("Access denied")
+	ErrInvalidGrant = errors.New("Invalid ACL grant")
+)
+
+var permissionLetters = []struct {
+	perm   Permission
+	letter byte
+}{{PERM_READ, 'r'}, {PERM_WRITE, 'w'}, {PERM_DELETE, 'd'}}
+
+// Parse permissions written as letters: r for read, w for write and d for
+// delete
+func ParsePermission(s string) (Permission, error) {
+	perm := PERM_NONE
+	for i := 0; i < len(s); i++ {
+		found := false
+		for _, pl := range permissionLetters {
+			if s[i] == pl.letter {
+				perm |= pl.perm
+				found = true
+			}
+		}
+		if !found {
+			return PERM_NONE, fmt.Errorf("Unknown permission %q", s[i])
+		}
+	}
+	return perm, nil
+}
+
+func (p Permission) String() string {
+	s := []byte{}
+	for _, pl := range permissionLetters {
+		if p&pl.perm != 0 {
+			s = append(s, pl.letter)
+		}
+	}
+	return string(s)
+}
+
+// Permissions granted on top of the registry ones: user:<handle>:<perms>, group:<name>:<perms> or public:r
+type Grant struct {
+	Kind       string
+	Name       string
+	Permission Permission
+}
+
+func ParseGrant(s string) (*Grant, error) {
+	first, last := strings.Index(s, ":"), strings.LastIndex(s, ":")
+	if first < 0 {
+		return nil, ErrInvalidGrant
+	}
+	g := &Grant{Kind: s[:first]}
+	if first < last {
+		g.Name = s[first+1 : last]
+	}
+	perm, err := ParsePermission(s[last+1:])
+	if err != nil {
+		return nil, ErrInvalidGrant
+	}
+	g.Permission = perm
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *Grant) Validate() error {
+	switch g.Kind {
+	case GRANT_USER, GRANT_GROUP:
+		if len(g.Name) == 0 {
+			return ErrInvalidGrant
+		}
+	case GRANT_PUBLIC:
+		if len(g.Name) > 0 || g.Permission != PERM_READ {
+			return errors.New("Public grants can only read")
+		}
+	default:
+		return ErrInvalidGrant
+	}
+	if g.Permission == PERM_NONE || g.Permission&^PERM_ALL != 0 {
+		return ErrInvalidGrant
+	}
+	return nil
+}
+
+func (g *Grant) String() string {
+	if g.Kind == GRANT_PUBLIC {
+		return g.Kind + ":" + g.Permission.String()
+	}
+	return fmt.Sprintf("%s:%s:%s", g.Kind, g.Name, g.Permission)
+}
+
+// Parsed ACL of the object. Entries that do not parse are skipped, Validate
+// keeps them out of stored objects
+func (so *StoredObject) Grants() []*Grant {
+	grants := []*Grant{}
+	for _, s := range so.ACL {
+		if g, err := ParseGrant(s); err == nil {
+			grants = append(grants, g)
+		}
+	}
+	return grants
+}
+
+// Add a grant to the ACL, replacing the one for the same user or group
+func (so *StoredObject) Grant(g *Grant) error {
+	if err := g.Validate(); err != nil {
+		return err
+	}
+	so.Revoke(g.Kind, g.Name)
+	so.ACL = append(so.ACL, g.String())
+	return nil
+}
+
+// Remove the grant of a user or group from the ACL
+func (so *StoredObject) Revoke(kind, name string) {
+	acl := []string{}
+	for _, s := range so.ACL {
+		if g, err := ParseGrant(s); err == nil && g.Kind == kind && g.Name == name {
+			continue
+		}
+		acl = append(acl, s)
+	}
+	so.ACL = acl
+}
+
+func (so *StoredObject) PublicRead() bool {
+	for _, g := range so.Grants() {
+		if g.Kind == GRANT_PUBLIC {
+			return true
+		}
+	}
+	return false
+}
+
+// Someone accessing objects, with the permissions the registry and the ACLs give them
+type Principal struct {
+	Organization string
+	User         string
+	//Groups the user is a member of
+	Groups []string
+
+	//Permissions on every object of the organization
+	org Permission
+	//Permissions on the objects of each group of the user
+	groups map[string]Permission
+}
+
+var Anonymous = &Principal{}
+
+// Principal of a user of the organization, built from its groups
+func NewPrincipal(o *registry.Organization, user string) (*Principal, error) {
+	if len(user) == 0 {
+		return nil, errors.New("Empty user")
+	}
+	p := &Principal{Organization: o.Handle, User: user, groups: map[string]Permission{}}
+	for _, name := range o.Groups {
+		g, err := o.GetGroup(name)
+		if err != nil {
+			if db.IsErrNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if !containsName(g.Users, user) {
+			continue
+		}
+		p.Groups = append(p.Groups, name)
+		perm := PERM_READ
+		if containsName(g.Properties, PROP_GROUP_WRITE) {
+			perm = PERM_ALL
+		}
+		p.groups[name] = perm
+		if containsName(g.Properties, PROP_ORG_READ) {
+			p.org |= PERM_READ
+		}
+		if containsName(g.Properties, PROP_ORG_ADMIN) {
+			p.org = PERM_ALL
+		}
+	}
+	return p, nil
+}
+
+// Whether the principal can do anything with every object of its organization
+func (p *Principal) Admin() bool {
+	return p.org == PERM_ALL
+}
+
+// Whether the principal can create objects in the group
+func (p *Principal) CanCreate(group string) bool {
+	_, member := p.groups[group]
+	return member || p.Admin()
+}
+
+func (p *Principal) Permissions(so *StoredObject) Permission {
+	perm := PERM_NONE
+	local := len(p.User) > 0 && so.Organization == p.Organization
+	for _, g := range so.Grants() {
+		switch {
+		case g.Kind == GRANT_PUBLIC,
+			local && g.Kind == GRANT_USER && g.Name == p.User,
+			local && g.Kind == GRANT_GROUP && containsName(p.Groups, g.Name):
+			perm |= g.Permission
+		}
+	}
+	if !local {
+		return perm
+	}
+	if so.User == p.User {
+		return PERM_ALL
+	}
+	return perm | p.org | p.groups[so.Group]
+}
+
+// Fails with ErrAccessDenied unless the principal has all of perm on the object
+func (p *Principal) Check(so *StoredObject, perm Permission) error {
+	if p.Permissions(so)&perm != perm {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+// Whether the principal can change the ACL of the object
+func (p *Principal) Owns(so *StoredObject) bool {
+	if so.Organization != p.Organization || len(p.User) == 0 {
+		return false
+	}
+	return so.User == p.User || p.Admin()
+}
+
+// Replace the ACL of a stored object
+func (os *ObjectStore) SetACL(so *StoredObject, acl []string) error {
+	for _, s := range acl {
+		if _, err := ParseGrant(s); err != nil {
+			return err
+		}
+	}
+	return updateRecord(so, func() error {
+		so.ACL = acl
+		return nil
+	})
+}
+
+// Object store operations checked against the permissions of a principal
+type CheckedStore struct {
+	os *ObjectStore
+	p  *Principal
+}
+
+func (os *ObjectStore) As(p *Principal) *CheckedStore {
+	return &CheckedStore{os, p}
+}
+
+func (cs *CheckedStore) Principal() *Principal {
+	return cs.p
+}
+
+// New objects belong to the principal, unless it is an admin, and go to one
+// of its groups
+func (cs *CheckedStore) checkCreate(so *StoredObject) error {
+	if so.Organization != cs.p.Organization || !cs.p.CanCreate(so.Group) {
+		return ErrAccessDenied
+	}
+	if so.User != cs.p.User && !cs.p.Admin() {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+func (cs *CheckedStore) PutObject(so *StoredObject, data io.Reader, length int64) error {
+	if err := cs.checkCreate(so); err != nil {
+		return err
+	}
+	return cs.os.PutObject(so, data, length)
+}
+
+func (cs *CheckedStore) PutArchive(so *StoredObject, dir string) error {
+	if err := cs.checkCreate(so); err != nil {
+		return err
+	}
+	return cs.os.PutArchive(so, dir)
+}
+
+func (cs *CheckedStore) GetObject(id string) (*StoredObject, error) {
+	so, err := cs.os.GetObject(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.p.Check(so, PERM_READ); err != nil {
+		return nil, err
+	}
+	return so, nil
+}
+
+func (cs *CheckedStore) DeleteObject(so *StoredObject) error {
+	if err := cs.p.Check(so, PERM_DELETE); err != nil {
+		return err
+	}
+	return cs.os.DeleteObject(so)
+}
+
+func (cs *CheckedStore) ExtractArchive(so *StoredObject, dir string) error {
+	if err := cs.p.Check(so, PERM_READ); err != nil {
+		return err
+	}
+	return cs.os.ExtractArchive(so, dir)
+}
+
+func (cs *CheckedStore) OpenArchiveFile(so *StoredObject, name string) (io.ReadCloser, error) {
+	if err := cs.p.Check(so, PERM_READ); err != nil {
+		return nil, err
+	}
+	return cs.os.OpenArchiveFile(so, name)
+}
+
+// Naming an object needs read access to it, and replacing what the name
+// points to needs write access to the current object
+func (cs *CheckedStore) SetName(name string, so *StoredObject) ([]*StoredObject, error) {
+	if err := cs.p.Check(so, PERM_READ); err != nil {
+		return nil, err
+	}
+	if err := cs.checkNamed(name, PERM_WRITE); err != nil {
+		return nil, err
+	}
+	return cs.os.SetName(name, so)
+}
+
+func (cs *CheckedStore) Resolve(name string) (*StoredObject, error) {
+	so, err := cs.os.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.p.Check(so, PERM_READ); err != nil {
+		return nil, err
+	}
+	return so, nil
+}
+
+func (cs *CheckedStore) Unname(name string) ([]*StoredObject, error) {
+	if err := cs.checkNamed(name, PERM_DELETE); err != nil {
+		return nil, err
+	}
+	return cs.os.Unname(name)
+}
+
+// Removing a version needs delete access to its object. Removing a delete
+// marker brings back the version before it, so it needs write access to it
+func (cs *CheckedStore) DeleteVersion(name string, version int64) ([]*StoredObject, error) {
+	versions, err := cs.os.Versions(name)
+	if err != nil {
+		return nil, err
+	}
+	perm := PERM_NONE
+	for _, v := range versions {
+		switch {
+		case v.Version > version:
+			continue
+		case v.Version == version && v.DeleteMarker():
+			perm = PERM_WRITE
+			continue
+		case v.Version == version:
+			perm = PERM_DELETE
+		case perm == PERM_NONE || v.DeleteMarker():
+			continue
+		}
+		if err := cs.checkId(v.ObjectId, perm); err != nil {
+			return nil, err
+		}
+		break
+	}
+	return cs.os.DeleteVersion(name, version)
+}
+
+// Check the object the name points to, if any
+func (cs *CheckedStore) checkNamed(name string, perm Permission) error {
+	n, err := cs.os.getName(name)
+	if err == ErrNotExists {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n.Deleted() {
+		return nil
+	}
+	return cs.checkId(n.ObjectId, perm)
+}
+
+func (cs *CheckedStore) checkId(id string, perm Permission) error {
+	so, err := cs.os.namedObject(&ObjectName{ObjectId: id})
+	if err != nil || so == nil {
+		return err
+	}
+	return cs.p.Check(so, perm)
+}
@@ -0,0 +1,119 @@
+package ostore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseGrant(t *testing.T) {
+	for i, c := range []struct {
+		s     string
+		grant *Grant
+	}{
+		{"user:alice:rw", &Grant{GRANT_USER, "alice", PERM_READ | PERM_WRITE}},
+		{"group:dev:rwd", &Grant{GRANT_GROUP, "dev", PERM_ALL}},
+		{"user:a:b:d", &Grant{GRANT_USER, "a:b", PERM_DELETE}},
+		{GRANT_PUBLIC_READ, &Grant{GRANT_PUBLIC, "", PERM_READ}},
+		{"public:rw", nil},
+		{"user::r", nil},
+		{"user:alice:", nil},
+		{"user:alice:x", nil},
+		{"robot:alice:r", nil},
+		{"alice", nil},
+	} {
+		g, err := ParseGrant(c.s)
+		if c.grant == nil {
+			if err == nil {
+				t.Errorf("#%d: Invalid grant %q was parsed as %+v", i, c.s, g)
+			}
+			continue
+		}
+		if err != nil || *g != *c.grant {
+			t.Errorf("#%d: Unexpected grant %+v %v", i, g, err)
+			continue
+		}
+		if g.String() != c.s {
+			t.Errorf("#%d: Grant is written as %q", i, g)
+		}
+	}
+}
+
+func TestPrincipalPermissions(t *testing.T) {
+	so := &StoredObject{Organization: "org", User: "owner", Group: "dev"}
+	so.Grant(&Grant{GRANT_USER, "guest", PERM_READ})
+	so.Grant(&Grant{GRANT_GROUP, "ops", PERM_DELETE})
+	for i, c := range []struct {
+		p    *Principal
+		perm Permission
+	}{
+		{&Principal{Organization: "org", User: "owner"}, PERM_ALL},
+		{&Principal{Organization: "org", User: "dev", Groups: []string{"dev"}, groups: map[string]Permission{"dev": PERM_READ}}, PERM_READ},
+		{&Principal{Organization: "org", User: "writer", Groups: []string{"dev"}, groups: map[string]Permission{"dev": PERM_ALL}}, PERM_ALL},
+		{&Principal{Organization: "org", User: "guest"}, PERM_READ},
+		{&Principal{Organization: "org", User: "op", Groups: []string{"ops"}, groups: map[string]Permission{"ops": PERM_READ}}, PERM_DELETE},
+		{&Principal{Organization: "org", User: "auditor", org: PERM_READ}, PERM_READ},
+		{&Principal{Organization: "org", User: "admin", org: PERM_ALL}, PERM_ALL},
+		{&Principal{Organization: "other", User: "owner", org: PERM_ALL}, PERM_NONE},
+		{Anonymous, PERM_NONE},
+	} {
+		if perm := c.p.Permissions(so); perm != c.perm {
+			t.Errorf("#%d: %s got %q instead of %q", i, c.p.User, perm, c.perm)
+		}
+	}
+	so.Grant(&Grant{GRANT_USER, "guest", PERM_WRITE})
+	so.ACL = append(so.ACL, GRANT_PUBLIC_READ)
+	if len(so.ACL) != 3 || !so.PublicRead() {
+		t.Errorf("Unexpected ACL %v", so.ACL)
+	}
+	if err := Anonymous.Check(so, PERM_READ); err != nil {
+		t.Errorf("Anonymous cannot read a public object: %v", err)
+	}
+	if err := (&Principal{Organization: "org", User: "guest"}).Check(so, PERM_ALL); err != ErrAccessDenied {
+		t.Errorf("Unexpected check %v", err)
+	}
+}
+
+func TestCheckedStore(t *testing.T) {
+	if err := RegisterIndexes(getDB()); err != nil {
+		t.Fatal(err)
+	}
+	os := getDummyStore()
+	owner := &Principal{Organization: os.Organization, User: "user", Groups: []string{"group"}, groups: map[string]Permission{"group": PERM_READ}}
+	member := &Principal{Organization: os.Organization, User: "member", Groups: []string{"group"}, groups: map[string]Permission{"group": PERM_READ}}
+	stranger := &Principal{Organization: os.Organization, User: "stranger"}
+	data := []byte("checked")
+	so := newDummyObject(os, data)
+	if err := os.As(member).PutObject(so, bytes.NewReader(data), int64(len(data))); err != ErrAccessDenied {
+		t.Errorf("Object was created for another user: %v", err)
+	}
+	if err := os.As(owner).PutObject(so, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.As(stranger).GetObject(so.Id); err != ErrAccessDenied {
+		t.Errorf("Stranger got the object: %v", err)
+	}
+	if _, err := os.As(stranger).SetName("name", so); err != ErrAccessDenied {
+		t.Errorf("Stranger named the object: %v", err)
+	}
+	if _, err := os.As(owner).SetName("name", so); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.As(member).Resolve("name"); err != nil {
+		t.Errorf("Member cannot resolve the name: %v", err)
+	}
+	if _, err := os.As(member).Unname("name"); err != ErrAccessDenied {
+		t.Errorf("Member deleted the name: %v", err)
+	}
+	if _, err := os.As(member).DeleteVersion("name", 1); err != ErrAccessDenied {
+		t.Errorf("Member deleted a version: %v", err)
+	}
+	if err := os.As(member).DeleteObject(so); err != ErrAccessDenied {
+		t.Errorf("Member deleted the object: %v", err)
+	}
+	if _, err := os.As(stranger).OpenArchiveFile(so, "file"); err != ErrAccessDenied {
+		t.Errorf("Stranger read the archive: %v", err)
+	}
+	if err := os.As(owner).DeleteObject(so); err != nil {
+		t.Errorf("Owner cannot delete the object: %v", err)
+	}
+}
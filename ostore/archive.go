@@ -0,0 +1,587 @@
+package ostore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ARCHIVE_TAR_GZ = "tar.gz"
+	ARCHIVE_ZIP    = "zip"
+	//Type of the objects packed from directories by the command line
+	ARCHIVE_OBJECT_TYPE = "archive"
+	//Metadata of archive objects with their format and their manifest as JSON
+	META_ARCHIVE          = "Ostore-Archive"
+	META_ARCHIVE_MANIFEST = "Ostore-Archive-Manifest"
+	//Longest symlink target read from a zip archive
+	ARCHIVE_MAX_LINK = 4096
+)
+
+var (
+	ErrNotArchive       = errors.New("Object is not an archive")
+	ErrNotInArchive     = errors.New("File is not in the archive")
+	ErrUnsafePath       = errors.New("Archive entry points outside of the directory it is extracted to")
+	ErrUnsupportedEntry = errors.New("Archive entry is not a file, a directory or a symlink")
+)
+
+// File, directory or symlink in an archive
+type ArchiveEntry struct {
+	//Slash separated and relative to the archive root
+	Path string
+	//Permission bits plus os.ModeDir or os.ModeSymlink
+	Mode os.FileMode
+	Size int64  `json:",omitempty"`
+	Hash string `json:",omitempty"`
+	Link string `json:",omitempty"`
+	//Gzip member of a tar.gz archive holding the entry, so it can be read
+	//without the ones before it
+	Offset int64 `json:",omitempty"`
+	Length int64 `json:",omitempty"`
+}
+
+// What a packed archive holds, in the order it holds it. It is the index used
+// to fetch single files from tar.gz archives
+type ArchiveManifest struct {
+	Format  string
+	Entries []*ArchiveEntry
+}
+
+func (m *ArchiveManifest) Entry(name string) *ArchiveEntry {
+	for _, e := range m.Entries {
+		if e.Path == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// Manifest kept in the metadata of archives packed by PutArchive. Fails with
+// ErrNotArchive for any other object
+func (so *StoredObject) ArchiveManifest() (*ArchiveManifest, error) {
+	data, ok := so.Metadata[META_ARCHIVE_MANIFEST]
+	if !ok {
+		return nil, ErrNotArchive
+	}
+	m := &ArchiveManifest{}
+	if err := json.Unmarshal([]byte(data), m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Writer whose destination changes, so a single tar stream is split in gzip
+// members
+type switchWriter struct {
+	w io.Writer
+}
+
+func (sw *switchWriter) Write(p []byte) (int, error) {
+	return sw.w.Write(p)
+}
+
+// Write the directory as a reproducible tar.gz with one gzip member per entry
+func PackDir(dir string, w io.Writer) (*ArchiveManifest, error) {
+	cw := &countingWriter{w: w}
+	sw := &switchWriter{}
+	tw := tar.NewWriter(sw)
+	m := &ArchiveManifest{Format: ARCHIVE_TAR_GZ}
+	//Members have a zero time and no name, like the headers
+	member := func(write func() error) (int64, error) {
+		start := cw.n
+		gz := gzip.NewWriter(cw)
+		sw.w = gz
+		if err := write(); err != nil {
+			return 0, err
+		}
+		if err := gz.Close(); err != nil {
+			return 0, err
+		}
+		return cw.n - start, nil
+	}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		e := &ArchiveEntry{Path: filepath.ToSlash(rel), Offset: cw.n}
+		hdr := &tar.Header{Name: e.Path, ModTime: time.Unix(0, 0)}
+		switch {
+		case fi.IsDir():
+			hdr.Typeflag, hdr.Name, hdr.Mode = tar.TypeDir, hdr.Name+"/", 0755
+			e.Mode = os.ModeDir | 0755
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			hdr.Typeflag, hdr.Linkname, hdr.Mode = tar.TypeSymlink, link, 0777
+			e.Mode, e.Link = os.ModeSymlink|0777, link
+		case fi.Mode().IsRegular():
+			hdr.Typeflag, hdr.Size, hdr.Mode = tar.TypeReg, fi.Size(), 0644
+			if fi.Mode()&0111 != 0 {
+				hdr.Mode = 0755
+			}
+			e.Mode, e.Size = os.FileMode(hdr.Mode), fi.Size()
+		default:
+			return nil
+		}
+		e.Length, err = member(func() error {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				if e.Hash, err = copyFile(tw, p, hdr.Size); err != nil {
+					return err
+				}
+			}
+			return tw.Flush()
+		})
+		if err != nil {
+			return err
+		}
+		m.Entries = append(m.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	//The end of archive marker goes in a member of its own
+	if _, err := member(tw.Close); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Copy size bytes of the file and return their hash. Fails with
+// ErrLengthMismatch if the file changed size
+func copyFile(w io.Writer, name string, size int64) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hr := NewHashReader(f)
+	if _, err := io.CopyN(w, hr, size); err != nil {
+		if err == io.EOF {
+			return "", ErrLengthMismatch
+		}
+		return "", err
+	}
+	return hr.Hash(DEFAULT_HASH), nil
+}
+
+// Archive packed to a temporary file, ready to be uploaded
+type packedArchive struct {
+	*os.File
+	size     int64
+	hash     string
+	manifest *ArchiveManifest
+}
+
+func packArchive(dir string) (*packedArchive, error) {
+	f, err := ioutil.TempFile("", "ostore-archive-")
+	if err != nil {
+		return nil, err
+	}
+	a := &packedArchive{File: f}
+	h, err := newHash(DEFAULT_HASH)
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	if a.manifest, err = PackDir(dir, io.MultiWriter(f, h)); err != nil {
+		a.Close()
+		return nil, err
+	}
+	a.hash = FormatHash(DEFAULT_HASH, h.Sum(nil))
+	if a.size, err = f.Seek(0, io.SeekCurrent); err != nil {
+		a.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *packedArchive) Close() error {
+	a.File.Close()
+	return os.Remove(a.File.Name())
+}
+
+// Pack the directory and store it as the object, with the format and the
+// manifest in its metadata. The hash of the object is set from the packed data
+func (os *ObjectStore) PutArchive(so *StoredObject, dir string) error {
+	a, err := packArchive(dir)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	manifest, err := json.Marshal(a.manifest)
+	if err != nil {
+		return err
+	}
+	so.Hash = a.hash
+	if so.Metadata == nil {
+		so.Metadata = map[string]string{}
+	}
+	so.Metadata[META_ARCHIVE] = ARCHIVE_TAR_GZ
+	so.Metadata[META_ARCHIVE_MANIFEST] = string(manifest)
+	return os.PutObject(so, a, a.size)
+}
+
+// Extract a tar.gz or zip archive object into dir, refusing anything that would land outside of it
+func (os *ObjectStore) ExtractArchive(so *StoredObject, dir string) error {
+	st, err := os.Open()
+	if err != nil {
+		return err
+	}
+	return extractArchive(st, so, dir)
+}
+
+// Read one file of the archive object, fetching only the part of it holding the file when possible
+func (os *ObjectStore) OpenArchiveFile(so *StoredObject, name string) (io.ReadCloser, error) {
+	st, err := os.Open()
+	if err != nil {
+		return nil, err
+	}
+	return openArchiveFile(st, so, name)
+}
+
+// Format of the archive, from its metadata or its first bytes
+func archiveFormat(r ObjectReader, so *StoredObject) (string, error) {
+	if f, ok := so.Metadata[META_ARCHIVE]; ok {
+		return f, nil
+	}
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(r, magic)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", ErrNotArchive
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	switch {
+	case n == 4 && (bytes.Equal(magic, []byte("PK\x03\x04")) || bytes.Equal(magic, []byte("PK\x05\x06"))):
+		return ARCHIVE_ZIP, nil
+	case n >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		return ARCHIVE_TAR_GZ, nil
+	}
+	return "", ErrNotArchive
+}
+
+// ReaderAt over an object reader, for zip archives which are read from their
+// end. Reads where the last one stopped do not seek
+type objectReaderAt struct {
+	lock sync.Mutex
+	r    ObjectReader
+	pos  int64
+}
+
+func (ra *objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+	if off != ra.pos {
+		if _, err := ra.r.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		ra.pos = off
+	}
+	n, err := io.ReadFull(ra.r, p)
+	ra.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func openZip(r ObjectReader) (*zip.Reader, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(&objectReaderAt{r: r, pos: size}, size)
+	if err != nil {
+		return nil, ErrNotArchive
+	}
+	return zr, nil
+}
+
+// Reader of an archive entry that verifies its hash at the end and closes the
+// archive with it
+type archiveFileReader struct {
+	r    io.Reader
+	hr   *HashReader
+	hash string
+	c    []io.Closer
+}
+
+func (ar *archiveFileReader) Read(p []byte) (int, error) {
+	n, err := ar.r.Read(p)
+	if err == io.EOF && ar.hr != nil && len(ar.hash) > 0 {
+		if verr := ar.hr.Verify(ar.hash); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+func (ar *archiveFileReader) Close() error {
+	var err error
+	for _, c := range ar.c {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func openArchiveFile(st Store, so *StoredObject, name string) (io.ReadCloser, error) {
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	r, err := st.Open(so)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := openEntry(r, so, name)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+func openEntry(r ObjectReader, so *StoredObject, name string) (io.ReadCloser, error) {
+	format, err := archiveFormat(r, so)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case ARCHIVE_ZIP:
+		zr, err := openZip(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if f.Name != name || !f.Mode().IsRegular() {
+				continue
+			}
+			fr, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			return &archiveFileReader{r: fr, c: []io.Closer{fr, r}}, nil
+		}
+		return nil, ErrNotInArchive
+	case ARCHIVE_TAR_GZ:
+		start, length := int64(0), int64(-1)
+		m, err := so.ArchiveManifest()
+		if err == nil {
+			e := m.Entry(name)
+			if e == nil || !e.Mode.IsRegular() {
+				return nil, ErrNotInArchive
+			}
+			start, length = e.Offset, e.Length
+			if _, err := r.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+		var data io.Reader = r
+		if length >= 0 {
+			data = io.LimitReader(r, length)
+		}
+		gz, err := gzip.NewReader(data)
+		if err != nil {
+			return nil, err
+		}
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil, ErrNotInArchive
+			}
+			if err != nil {
+				return nil, err
+			}
+			if path.Clean(hdr.Name) != name || hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			ar := &archiveFileReader{hr: NewHashReader(tr), c: []io.Closer{gz, r}}
+			ar.r = ar.hr
+			if m != nil {
+				ar.hash = m.Entry(name).Hash
+			}
+			return ar, nil
+		}
+	}
+	return nil, ErrNotArchive
+}
+
+func extractArchive(st Store, so *StoredObject, dir string) error {
+	r, err := st.Open(so)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	format, err := archiveFormat(r, so)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case ARCHIVE_ZIP:
+		zr, err := openZip(r)
+		if err != nil {
+			return err
+		}
+		for _, f := range zr.File {
+			if err := extractZipFile(dir, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ARCHIVE_TAR_GZ:
+		m, _ := so.ArchiveManifest()
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := extractTarEntry(dir, hdr, tr, m); err != nil {
+				return err
+			}
+		}
+	}
+	return ErrNotArchive
+}
+
+func extractTarEntry(dir string, hdr *tar.Header, data io.Reader, m *ArchiveManifest) error {
+	mode := os.FileMode(hdr.Mode).Perm()
+	switch {
+	case hdr.Typeflag == tar.TypeXGlobalHeader:
+		return nil
+	case hdr.Typeflag == tar.TypeDir:
+		return extractEntry(dir, hdr.Name, mode|os.ModeDir, "", nil, "")
+	case hdr.Typeflag == tar.TypeSymlink:
+		return extractEntry(dir, hdr.Name, mode|os.ModeSymlink, hdr.Linkname, nil, "")
+	case hdr.Typeflag == tar.TypeReg:
+		hash := ""
+		if m != nil {
+			if e := m.Entry(path.Clean(hdr.Name)); e != nil {
+				hash = e.Hash
+			}
+		}
+		return extractEntry(dir, hdr.Name, mode, "", data, hash)
+	}
+	return ErrUnsupportedEntry
+}
+
+func extractZipFile(dir string, f *zip.File) error {
+	mode := f.Mode()
+	if mode.IsDir() || strings.HasSuffix(f.Name, "/") {
+		return extractEntry(dir, f.Name, mode.Perm()|os.ModeDir, "", nil, "")
+	}
+	if mode&os.ModeSymlink == 0 && !mode.IsRegular() {
+		return ErrUnsupportedEntry
+	}
+	fr, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	if mode&os.ModeSymlink != 0 {
+		//Zip archives keep the target of a symlink as its data
+		link, err := ioutil.ReadAll(io.LimitReader(fr, ARCHIVE_MAX_LINK))
+		if err != nil {
+			return err
+		}
+		return extractEntry(dir, f.Name, mode, string(link), nil, "")
+	}
+	return extractEntry(dir, f.Name, mode.Perm(), "", fr, "")
+}
+
+// Path under dir of an entry, failing with ErrUnsafePath if it is not under it
+func entryPath(dir, name string) (string, error) {
+	name = path.Clean(name)
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, "\\") {
+		return "", ErrUnsafePath
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+// Symlinks may only point down the tree. A link going up could be resolved
+// through another link and end up outside of the directory
+func checkLink(link string) error {
+	if len(link) == 0 || path.IsAbs(link) || strings.Contains(link, "\\") {
+		return ErrUnsafePath
+	}
+	for _, part := range strings.Split(link, "/") {
+		if part == ".." {
+			return ErrUnsafePath
+		}
+	}
+	return nil
+}
+
+// Create a directory, symlink or file under dir. File data is checked against
+// hash if there is one
+func extractEntry(dir, name string, mode os.FileMode, link string, data io.Reader, hash string) error {
+	p, err := entryPath(dir, name)
+	if err != nil {
+		return err
+	}
+	if p == filepath.Clean(dir) {
+		return nil
+	}
+	//Owners can always go through what they extract
+	if mode.IsDir() {
+		return os.MkdirAll(p, mode.Perm()|0700)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if mode&os.ModeSymlink != 0 {
+		if err := checkLink(link); err != nil {
+			return err
+		}
+		return os.Symlink(link, p)
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hr := NewHashReader(data)
+	if _, err := io.Copy(f, hr); err != nil {
+		return err
+	}
+	if len(hash) > 0 {
+		if err := hr.Verify(hash); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
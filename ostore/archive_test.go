@@ -0,0 +1,336 @@
+package ostore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var archiveFiles = map[string]string{
+	"a.txt":         "first file",
+	"bin/run":       "#!/bin/sh\necho run\n",
+	"data/x/y.json": "{\"y\": true}",
+	"empty":         "",
+}
+
+func makeArchiveDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "archivetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range archiveFiles {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(dir, "bin", "run"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("x/y.json", filepath.Join(dir, "data", "link")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Store the data in a MemStore as an object with the metadata
+func putArchiveObject(t *testing.T, st Store, data []byte, meta map[string]string) *StoredObject {
+	h := sha512.Sum512(data)
+	so := &StoredObject{Type: ARCHIVE_OBJECT_TYPE, Hash: hex.EncodeToString(h[:]), Metadata: meta}
+	if err := st.Put(so, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	return so
+}
+
+func packedObject(t *testing.T, st Store, dir string) *StoredObject {
+	buf := &bytes.Buffer{}
+	m, err := PackDir(dir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return putArchiveObject(t, st, buf.Bytes(), map[string]string{META_ARCHIVE: ARCHIVE_TAR_GZ, META_ARCHIVE_MANIFEST: string(manifest)})
+}
+
+func TestPackDir(t *testing.T) {
+	dir := makeArchiveDir(t)
+	defer os.RemoveAll(dir)
+	first := &bytes.Buffer{}
+	m, err := PackDir(dir, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Times and the modes of the owner do not change the archive
+	if err := os.Chtimes(filepath.Join(dir, "a.txt"), time.Now(), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "a.txt"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	second := &bytes.Buffer{}
+	if _, err := PackDir(dir, second); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Errorf("Packing the same tree twice gave different archives")
+	}
+	paths := []string{}
+	for _, e := range m.Entries {
+		paths = append(paths, e.Path)
+	}
+	expected := []string{"a.txt", "bin", "bin/run", "data", "data/link", "data/x", "data/x/y.json", "empty"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Manifest has %v instead of %v", paths, expected)
+	}
+	if e := m.Entry("bin/run"); e == nil || e.Mode != 0755 {
+		t.Errorf("Executable entry is %+v", e)
+	}
+	if e := m.Entry("data/link"); e == nil || e.Link != "x/y.json" {
+		t.Errorf("Symlink entry is %+v", e)
+	}
+	//Any gzip and tar reader reads the whole archive
+	gz, err := gzip.NewReader(bytes.NewReader(first.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	found := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			data, _ := ioutil.ReadAll(tr)
+			found[hdr.Name] = string(data)
+		}
+	}
+	if !reflect.DeepEqual(found, archiveFiles) {
+		t.Errorf("Archive holds %v instead of %v", found, archiveFiles)
+	}
+}
+
+func checkExtracted(t *testing.T, dir string) {
+	for name, data := range archiveFiles {
+		got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("Cannot read extracted %s: %s", name, err)
+		} else if string(got) != data {
+			t.Errorf("Extracted %s holds %q instead of %q", name, got, data)
+		}
+	}
+}
+
+func TestArchiveExtractAndFetch(t *testing.T) {
+	src := makeArchiveDir(t)
+	defer os.RemoveAll(src)
+	st := NewMemStore()
+	indexed := packedObject(t, st, src)
+	//Without the manifest tar archives are scanned
+	plain := &StoredObject{Type: indexed.Type, Hash: indexed.Hash}
+	for i, so := range []*StoredObject{indexed, plain} {
+		dst, err := ioutil.TempDir("", "archivetest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+		if err := extractArchive(st, so, dst); err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		checkExtracted(t, dst)
+		if fi, err := os.Stat(filepath.Join(dst, "bin", "run")); err != nil || fi.Mode().Perm()&0100 == 0 {
+			t.Errorf("#%d: Executable lost its mode: %v %v", i, fi, err)
+		}
+		if link, err := os.Readlink(filepath.Join(dst, "data", "link")); err != nil || link != "x/y.json" {
+			t.Errorf("#%d: Symlink points to %q: %v", i, link, err)
+		}
+		//Extracting again does not overwrite anything
+		if err := extractArchive(st, so, dst); err == nil {
+			t.Errorf("#%d: Extracting over existing files succeeded", i)
+		}
+		for name, data := range archiveFiles {
+			r, err := openArchiveFile(st, so, name)
+			if err != nil {
+				t.Errorf("#%d: Cannot open %s: %s", i, name, err)
+				continue
+			}
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || string(got) != data {
+				t.Errorf("#%d: Read %q from %s instead of %q: %v", i, got, name, data, err)
+			}
+		}
+		for _, name := range []string{"missing", "data", "data/link"} {
+			if _, err := openArchiveFile(st, so, name); err != ErrNotInArchive {
+				t.Errorf("#%d: Opening %s returned %v instead of ErrNotInArchive", i, name, err)
+			}
+		}
+	}
+}
+
+// Store that counts the bytes read from it
+type countingStore struct {
+	Store
+	read int64
+}
+
+type countingObjectReader struct {
+	ObjectReader
+	cs *countingStore
+}
+
+func (r *countingObjectReader) Read(p []byte) (int, error) {
+	n, err := r.ObjectReader.Read(p)
+	r.cs.read += int64(n)
+	return n, err
+}
+
+func (cs *countingStore) Open(so *StoredObject) (ObjectReader, error) {
+	r, err := cs.Store.Open(so)
+	if err != nil {
+		return nil, err
+	}
+	return &countingObjectReader{r, cs}, nil
+}
+
+func TestArchiveFetchReadsEntryOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archivetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//Random data does not compress
+	big := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(big)
+	if err := ioutil.WriteFile(filepath.Join(dir, "big"), big, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "small"), []byte("small"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cs := &countingStore{Store: NewMemStore()}
+	so := packedObject(t, cs, dir)
+	r, err := openArchiveFile(cs, so, "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "small" {
+		t.Fatalf("Read %q: %v", data, err)
+	}
+	if cs.read > 4096 {
+		t.Errorf("Read %d bytes of the archive to fetch a small file", cs.read)
+	}
+}
+
+func TestZipArchive(t *testing.T) {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for name, data := range archiveFiles {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	if _, err := zw.Create("dir/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	st := NewMemStore()
+	so := putArchiveObject(t, st, buf.Bytes(), nil)
+	dst, err := ioutil.TempDir("", "archivetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	if err := extractArchive(st, so, dst); err != nil {
+		t.Fatal(err)
+	}
+	checkExtracted(t, dst)
+	if fi, err := os.Stat(filepath.Join(dst, "dir")); err != nil || !fi.IsDir() {
+		t.Errorf("Directory was not extracted: %v", err)
+	}
+	r, err := openArchiveFile(st, so, "data/x/y.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, err := ioutil.ReadAll(r); err != nil || string(data) != archiveFiles["data/x/y.json"] {
+		t.Errorf("Read %q: %v", data, err)
+	}
+	if _, err := openArchiveFile(st, so, "missing"); err != ErrNotInArchive {
+		t.Errorf("Opening a missing file returned %v instead of ErrNotInArchive", err)
+	}
+	notArchive := putArchiveObject(t, st, []byte("not an archive"), nil)
+	if err := extractArchive(st, notArchive, dst); err != ErrNotArchive {
+		t.Errorf("Extracting plain data returned %v instead of ErrNotArchive", err)
+	}
+}
+
+func TestExtractUnsafeArchive(t *testing.T) {
+	for i, tt := range []struct {
+		hdr *tar.Header
+		err error
+	}{
+		{&tar.Header{Name: "../evil", Typeflag: tar.TypeReg}, ErrUnsafePath},
+		{&tar.Header{Name: "a/../../evil", Typeflag: tar.TypeReg}, ErrUnsafePath},
+		{&tar.Header{Name: "/evil", Typeflag: tar.TypeReg}, ErrUnsafePath},
+		{&tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "../outside"}, ErrUnsafePath},
+		{&tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "a/../../outside"}, ErrUnsafePath},
+		{&tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "/etc"}, ErrUnsafePath},
+		{&tar.Header{Name: "evil", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"}, ErrUnsupportedEntry},
+		{&tar.Header{Name: "evil", Typeflag: tar.TypeChar}, ErrUnsupportedEntry},
+	} {
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		tw := tar.NewWriter(gz)
+		tt.hdr.Mode = 0644
+		if err := tw.WriteHeader(tt.hdr); err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		tw.Close()
+		gz.Close()
+		st := NewMemStore()
+		so := putArchiveObject(t, st, buf.Bytes(), nil)
+		root, err := ioutil.TempDir("", "archivetest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		dst := filepath.Join(root, "a", "b")
+		if err := extractArchive(st, so, dst); err != tt.err {
+			t.Errorf("#%d: Extracting returned %v instead of %v", i, err, tt.err)
+		}
+		for _, p := range []string{filepath.Join(root, "a", "evil"), filepath.Join(root, "evil")} {
+			if _, err := os.Lstat(p); err == nil {
+				t.Errorf("#%d: %s was written", i, p)
+			}
+		}
+	}
+}
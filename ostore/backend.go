@@ -0,0 +1,277 @@
+package ostore
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+type ConfigField struct {
+	Name     string
+	Required bool
+	//Value used when the field is not defined
+	Default string
+}
+
+type BackendFactory func(config map[string]string) (Store, error)
+
+// Factory of stores built on top of other stores of the same organization
+type LogicalBackendFactory func(os *ObjectStore, config map[string]string) (Store, error)
+
+type backend struct {
+	name    string
+	schema  []ConfigField
+	factory BackendFactory
+	logical LogicalBackendFactory
+}
+
+var (
+	backendsLock sync.RWMutex
+	backends     = make(map[string]*backend)
+)
+
+// Make a store type available to ObjectStore records
+func RegisterBackend(storeType string, schema []ConfigField, factory BackendFactory) {
+	if factory == nil {
+		panic("ostore: Register backend factory is nil")
+	}
+	registerBackend(&backend{name: storeType, schema: schema, factory: factory})
+}
+
+// Make a store type whose factory gets the ObjectStore record being opened
+func RegisterLogicalBackend(storeType string, schema []ConfigField, factory LogicalBackendFactory) {
+	if factory == nil {
+		panic("ostore: Register backend factory is nil")
+	}
+	registerBackend(&backend{name: storeType, schema: schema, logical: factory})
+}
+
+func registerBackend(b *backend) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	if _, dup := backends[b.name]; dup {
+		panic("ostore: Register called twice for backend " + b.name)
+	}
+	backends[b.name] = b
+}
+
+func Backends() []string {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getBackend(storeType string) (*backend, error) {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	b, ok := backends[storeType]
+	if !ok {
+		return nil, fmt.Errorf("Unknown store type %s", storeType)
+	}
+	return b, nil
+}
+
+// Check the config against the schema and return a copy with defaults applied
+func (b *backend) validate(config map[string]string) (map[string]string, error) {
+	known := make(map[string]bool, len(b.schema))
+	out := make(map[string]string, len(b.schema))
+	for _, f := range b.schema {
+		known[f.Name] = true
+		v, ok := config[f.Name]
+		switch {
+		case ok && len(v) > 0:
+			out[f.Name] = v
+		case len(f.Default) > 0:
+			out[f.Name] = f.Default
+		case f.Required:
+			return nil, fmt.Errorf("Missing %s for %s store", f.Name, b.name)
+		}
+	}
+	for k := range config {
+		if !known[k] {
+			return nil, fmt.Errorf("Unknown option %s for %s store", k, b.name)
+		}
+	}
+	return out, nil
+}
+
+func checkCache(cache CacheOptions, transform TransformOptions) error {
+	if cache.Enabled() && len(transform.Key) > 0 {
+		return fmt.Errorf("Encrypted stores cannot have a %s, the cache keeps the decrypted data", STORE_CACHE_DIR)
+	}
+	return nil
+}
+
+// Compression and encryption are only available for backends, not logical stores
+func (b *backend) checkTransform(transform TransformOptions) error {
+	if !transform.Enabled() {
+		return nil
+	}
+	if b.logical != nil {
+		return fmt.Errorf("Compression and encryption are not available for %s stores", b.name)
+	}
+	_, err := NewTransformStore(nil, transform)
+	return err
+}
+
+// Multipart uploads bypass the TransformStore, so transformed stores refuse them
+func checkMultipart(st Store) error {
+	if _, ok := uncached(st).(*TransformStore); ok {
+		return ErrTransformMultipart
+	}
+	if _, ok := unwrap(st).(MultipartStore); !ok {
+		return ErrNoMultipart
+	}
+	return nil
+}
+
+// Take out the options handled by TransformStore
+func splitTransformOptions(config map[string]string) (map[string]string, TransformOptions) {
+	opts := TransformOptions{Compression: config[STORE_COMPRESSION], Key: config[STORE_ENCRYPTION_KEY]}
+	if _, ok := config[STORE_COMPRESSION]; !ok {
+		if _, ok := config[STORE_ENCRYPTION_KEY]; !ok {
+			return config, opts
+		}
+	}
+	out := make(map[string]string, len(config))
+	for k, v := range config {
+		if k != STORE_COMPRESSION && k != STORE_ENCRYPTION_KEY {
+			out[k] = v
+		}
+	}
+	return out, opts
+}
+
+type cachedStore struct {
+	storeType string
+	config    map[string]string
+	transform TransformOptions
+	cache     CacheOptions
+	store     Store
+}
+
+var (
+	storeCacheLock sync.Mutex
+	storeCache     = make(map[string]*cachedStore)
+)
+
+func sameConfig(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Stores holding resources are closed once they leave the cache
+func closeStore(c *cachedStore) {
+	if cl, ok := c.store.(io.Closer); ok {
+		cl.Close()
+	}
+}
+
+func openStore(os *ObjectStore) (Store, error) {
+	b, err := getBackend(os.Type)
+	if err != nil {
+		return nil, err
+	}
+	config, transform := splitTransformOptions(os.Config)
+	if err := b.checkTransform(transform); err != nil {
+		return nil, err
+	}
+	config, cache, err := splitCacheOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCache(cache, transform); err != nil {
+		return nil, err
+	}
+	config, err = b.validate(config)
+	if err != nil {
+		return nil, err
+	}
+	key := string(os.GetPrimaryKey())
+	current := func(c *cachedStore) bool {
+		return c.storeType == os.Type && c.transform == transform && c.cache == cache && sameConfig(c.config, config)
+	}
+	storeCacheLock.Lock()
+	c, cached := storeCache[key]
+	storeCacheLock.Unlock()
+	if cached && current(c) {
+		return c.store, nil
+	}
+	//Factories may dial remote services, other stores are not held up
+	st, err := buildStore(b, os, key, config, transform, cache)
+	if err != nil {
+		return nil, err
+	}
+	built := &cachedStore{os.Type, config, transform, cache, st}
+	storeCacheLock.Lock()
+	defer storeCacheLock.Unlock()
+	if c, cached := storeCache[key]; cached {
+		if current(c) {
+			//Built by a concurrent open meanwhile
+			closeStore(built)
+			return c.store, nil
+		}
+		closeStore(c)
+	}
+	storeCache[key] = built
+	return st, nil
+}
+
+// Create the backend and wrap it as the options say
+func buildStore(b *backend, os *ObjectStore, key string, config map[string]string, transform TransformOptions, cache CacheOptions) (Store, error) {
+	var st Store
+	var err error
+	if b.logical != nil {
+		st, err = b.logical(os, config)
+	} else {
+		st, err = b.factory(config)
+		if tm := getTransferManager(); err == nil && tm != nil {
+			st = NewTransferStore(st, tm, os.Organization, key)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if transform.Enabled() {
+		if st, err = NewTransformStore(st, transform); err != nil {
+			return nil, err
+		}
+	}
+	if cache.Enabled() {
+		//Stores may share the directory, each one gets its own subdirectory
+		opts := cache
+		opts.Dir = filepath.Join(cache.Dir, os.Organization, os.Name)
+		cs, err := NewCacheStore(st, opts)
+		if err != nil {
+			if cl, ok := st.(io.Closer); ok {
+				cl.Close()
+			}
+			return nil, err
+		}
+		st = cs
+	}
+	return st, nil
+}
+
+func forgetStore(key string) {
+	storeCacheLock.Lock()
+	defer storeCacheLock.Unlock()
+	if c, ok := storeCache[key]; ok {
+		closeStore(c)
+		delete(storeCache, key)
+	}
+}
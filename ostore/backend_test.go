@@ -0,0 +1,219 @@
+package ostore
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type nullStore struct {
+	config map[string]string
+}
+
+func (ns *nullStore) Put(*StoredObject, io.Reader, int64) error   { return nil }
+func (ns *nullStore) Get(*StoredObject, io.Writer) error          { return ErrNotExists }
+func (ns *nullStore) Open(*StoredObject) (ObjectReader, error)    { return nil, ErrNotExists }
+func (ns *nullStore) Stat(*StoredObject) (*ObjectInfo, error)     { return nil, ErrNotExists }
+func (ns *nullStore) List(string, string, int) (*ListPage, error) { return &ListPage{}, nil }
+func (ns *nullStore) Delete(*StoredObject) error                  { return ErrNotExists }
+
+func init() {
+	RegisterBackend("null", []ConfigField{
+		{Name: "required", Required: true},
+		{Name: "optional", Default: "default"},
+	}, func(c map[string]string) (Store, error) {
+		return &nullStore{c}, nil
+	})
+	RegisterBackend("slow", nil, func(c map[string]string) (Store, error) {
+		<-slowFactory
+		return &nullStore{c}, nil
+	})
+}
+
+// Closed by the test to let the slow factory return
+var slowFactory chan struct{}
+
+func TestRegisterBackendTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering a backend twice did not panic")
+		}
+	}()
+	RegisterBackend("null", nil, func(c map[string]string) (Store, error) { return nil, nil })
+}
+
+func TestBackends(t *testing.T) {
+	found := map[string]bool{}
+	for _, name := range Backends() {
+		found[name] = true
+	}
+	for _, name := range []string{STORE_TYPE_FS, STORE_TYPE_S3, STORE_TYPE_SWIFT, STORE_TYPE_REPLICATED, "null"} {
+		if !found[name] {
+			t.Errorf("Backend %s is not registered", name)
+		}
+	}
+}
+
+func TestObjectStoreOpen(t *testing.T) {
+	tests := []struct {
+		storeType string
+		config    map[string]string
+
+		werr bool
+	}{
+		{"unknown", nil, true},
+		{"null", nil, true},
+		{"null", map[string]string{"required": "a", "bogus": "b"}, true},
+		{"null", map[string]string{"required": "a"}, false},
+		{"null", map[string]string{"required": "a", STORE_COMPRESSION: "bogus"}, true},
+		{"null", map[string]string{"required": "a", STORE_COMPRESSION: COMPRESSION_GZIP}, false},
+		{STORE_TYPE_REPLICATED, nil, true},
+		{STORE_TYPE_REPLICATED, map[string]string{REPLICATED_PRIMARY: "a", REPLICATED_REPLICAS: "b, c"}, false},
+		{STORE_TYPE_REPLICATED, map[string]string{REPLICATED_PRIMARY: "a", REPLICATED_REPLICAS: "b,a"}, true},
+		{STORE_TYPE_REPLICATED, map[string]string{REPLICATED_PRIMARY: "open"}, true},
+		{STORE_TYPE_REPLICATED, map[string]string{REPLICATED_PRIMARY: "a", STORE_COMPRESSION: COMPRESSION_GZIP}, true},
+		{STORE_TYPE_REPLICATED, map[string]string{REPLICATED_PRIMARY: "a", REPLICATED_TIER_STORE: "s3", REPLICATED_TIER_DAYS: "30"}, false},
+		{STORE_TYPE_REPLICATED, map[string]string{REPLICATED_PRIMARY: "a", REPLICATED_TIER_STORE: "s3"}, true},
+		{STORE_TYPE_REPLICATED, map[string]string{REPLICATED_PRIMARY: "a", REPLICATED_TIER_STORE: "s3", REPLICATED_TIER_DAYS: "-1"}, true},
+	}
+	for i, tt := range tests {
+		so := &ObjectStore{Organization: "org", Name: "open", Type: tt.storeType, Config: tt.config}
+		_, err := so.Open()
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+	}
+
+	so := &ObjectStore{Organization: "org", Name: "cached", Type: "null", Config: map[string]string{"required": "a"}}
+	st, err := so.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := st.(*nullStore).config["optional"]; v != "default" {
+		t.Errorf("Default was not applied: %s", v)
+	}
+	if st2, _ := so.Open(); st2 != st {
+		t.Error("Store was not cached")
+	}
+	so.Config[STORE_ENCRYPTION_KEY] = hex.EncodeToString(make([]byte, GCM_KEY_SIZE))
+	if st2, _ := so.Open(); st2 == st {
+		t.Error("Store was not reinitialized after enabling encryption")
+	} else if _, ok := st2.(*TransformStore); !ok {
+		t.Errorf("Store with encryption is a %T", st2)
+	}
+	delete(so.Config, STORE_ENCRYPTION_KEY)
+	so.Config["optional"] = "other"
+	if st2, _ := so.Open(); st2 == st {
+		t.Error("Store was not reinitialized after changing the config")
+	}
+	other := &ObjectStore{Organization: "org2", Name: "cached", Type: "null", Config: map[string]string{"required": "a"}}
+	if st2, _ := other.Open(); st2 == st {
+		t.Error("Store is shared between organizations")
+	}
+}
+
+func TestObjectStoreOpenFS(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "fsopentest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	so := &ObjectStore{Organization: "org", Name: "fs", Type: STORE_TYPE_FS, Config: map[string]string{FS_ROOT_PATH: tmpDir}}
+	st, err := so.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := st.(*FSStore); !ok {
+		t.Errorf("Unexpected store type %T", st)
+	}
+	if _, err := so.multipartStore(); err != nil {
+		t.Errorf("FS store does not take multipart uploads: %v", err)
+	}
+	so.Config[STORE_COMPRESSION] = COMPRESSION_GZIP
+	if _, err := so.multipartStore(); err != ErrTransformMultipart {
+		t.Errorf("Compressed store took multipart uploads: %v", err)
+	}
+	delete(so.Config, STORE_COMPRESSION)
+	so.Config[FS_ROOT_PATH] = "relative"
+	if _, err := so.Open(); err == nil {
+		t.Error("Could open FS store with relative path")
+	}
+}
+
+func TestObjectStoreOpenCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachedbackendtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		config map[string]string
+
+		werr bool
+	}{
+		{map[string]string{"required": "a", STORE_CACHE_DIR: dir}, false},
+		{map[string]string{"required": "a", STORE_CACHE_DIR: dir, STORE_CACHE_SIZE: "1024", STORE_COMPRESSION: COMPRESSION_GZIP}, false},
+		{map[string]string{"required": "a", STORE_CACHE_DIR: dir, STORE_CACHE_SIZE: "big"}, true},
+		{map[string]string{"required": "a", STORE_CACHE_DIR: dir, STORE_ENCRYPTION_KEY: hex.EncodeToString(make([]byte, GCM_KEY_SIZE))}, true},
+	}
+	for i, tt := range tests {
+		so := &ObjectStore{Organization: "org", Name: "cache", Type: "null", Config: tt.config}
+		if err := so.Validate(); (err != nil) != tt.werr {
+			t.Errorf("#%d: Validate err = %v, want error %v", i, err, tt.werr)
+		}
+		st, err := so.Open()
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+		if err != nil {
+			continue
+		}
+		if cs, ok := st.(*CacheStore); !ok {
+			t.Errorf("#%d: Store with a cache is a %T", i, st)
+		} else if cs.dir != filepath.Join(dir, "org", "cache") {
+			t.Errorf("#%d: Cache is kept in %s", i, cs.dir)
+		}
+	}
+}
+
+func TestOpenStoreSlowFactory(t *testing.T) {
+	slowFactory = make(chan struct{})
+	opened := make(chan Store, 2)
+	slow := &ObjectStore{Organization: "org", Name: "slow", Type: "slow"}
+	forgetStore(string(slow.GetPrimaryKey()))
+	for i := 0; i < 2; i++ {
+		go func() {
+			st, err := slow.Open()
+			if err != nil {
+				t.Error(err)
+			}
+			opened <- st
+		}()
+	}
+	//Other stores open while the factory blocks
+	done := make(chan error)
+	go func() {
+		_, err := (&ObjectStore{Organization: "org", Name: "fast", Type: "null", Config: map[string]string{"required": "a"}}).Open()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Opening a store waited for another store's factory")
+	}
+	close(slowFactory)
+	//Concurrent opens end up with the same store
+	if a, b := <-opened, <-opened; a != b {
+		t.Error("Concurrent opens returned different stores")
+	}
+	if st, _ := slow.Open(); st == nil {
+		t.Error("Store was not cached")
+	}
+}
@@ -0,0 +1,150 @@
+package ostore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/acasajus/menac/db"
+)
+
+const (
+	//Attempts to update a reference count before giving up
+	BLOB_CAS_RETRIES = 16
+)
+
+var ErrBlobContention = errors.New("Too many concurrent updates to the blob reference count")
+
+// Reference count of the data stored for a type and hash in a store. Any
+// number of StoredObject records can point to the same blob
+type Blob struct {
+	db.Record
+
+	Organization string
+	StoreName    string
+	Type         string
+	Hash         string `db:"indexed"`
+	Size         int64
+	Refs         int64
+	//Last time the scrubber read the data back and found it intact
+	Verified time.Time
+}
+
+func (b *Blob) GetPrimaryKey() []byte {
+	return []byte(fmt.Sprintf("%s:%s:%s", b.Organization, b.StoreName, b.getPath()))
+}
+
+func (b *Blob) Validate() error {
+	if len(b.Organization) == 0 {
+		return errors.New("Empty organization handle")
+	}
+	if len(b.StoreName) == 0 {
+		return errors.New("Empty store name")
+	}
+	if len(b.Hash) == 0 {
+		return errors.New("Empty hash")
+	}
+	if b.Refs < 0 {
+		return errors.New("Negative reference count")
+	}
+	return nil
+}
+
+func (b *Blob) getPath() string {
+	return fmt.Sprintf("%s/%s", b.Type, b.Hash)
+}
+
+func (os *ObjectStore) blobFor(so *StoredObject) *Blob {
+	return os.GetDB().LinkRecordToDB(&Blob{
+		Organization: os.Organization,
+		StoreName:    os.Name,
+		Type:         so.Type,
+		Hash:         so.Hash,
+	}).(*Blob)
+}
+
+// Read the record, apply fn and write it back. Concurrent updates are
+// detected with the record generation and retried
+func updateRecord(r db.RecordObject, fn func() error) error {
+	for i := 0; i < BLOB_CAS_RETRIES; i++ {
+		if err := r.GetDB().GetRecord(r.GetPrimaryKey(), r); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		err := r.GetDB().ReplaceRecord(r)
+		if err == nil {
+			return nil
+		}
+		if !db.IsErrGeneration(err) {
+			return err
+		}
+	}
+	return ErrBlobContention
+}
+
+// Like updateRecord, but a missing record is created after applying fn to its
+// initial state, which reset sets
+func upsertRecord(r db.RecordObject, reset func(), fn func() error) error {
+	for i := 0; i < BLOB_CAS_RETRIES; i++ {
+		err := updateRecord(r, fn)
+		if !db.IsErrNotFound(err) {
+			return err
+		}
+		reset()
+		if err := fn(); err != nil {
+			return err
+		}
+		err = r.GetDB().CreateNewRecord(r)
+		if err == nil || !db.IsErrDuplicateKey(err) {
+			return err
+		}
+	}
+	return ErrBlobContention
+}
+
+func (b *Blob) update(fn func(*Blob) error) error {
+	return updateRecord(b, func() error { return fn(b) })
+}
+
+// Add a reference to the blob if it exists
+func (b *Blob) acquire(length int64) (bool, error) {
+	err := b.update(func(b *Blob) error {
+		if b.Size != length {
+			return ErrLengthMismatch
+		}
+		b.Refs++
+		return nil
+	})
+	if db.IsErrNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Drop a reference. Returns true if it was the last one and the blob record
+// has been removed, so the data has to be deleted from the store
+func (b *Blob) release() (bool, error) {
+	err := b.update(func(b *Blob) error {
+		if b.Refs > 0 {
+			b.Refs--
+		}
+		return nil
+	})
+	if err != nil {
+		if db.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if b.Refs > 0 {
+		return false, nil
+	}
+	//Only succeeds if nobody acquired the blob since it dropped to zero
+	deleted, err := b.GetDB().DeleteRecord(b)
+	if err != nil && db.IsErrGeneration(err) {
+		return false, nil
+	}
+	return deleted, err
+}
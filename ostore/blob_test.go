@@ -0,0 +1,105 @@
+package ostore
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/acasajus/menac/db"
+	"github.com/acasajus/menac/registry"
+)
+
+var gdb db.DB
+
+func getDB() db.DB {
+	if gdb == nil {
+		d, err := db.NewTestDB("127.0.0.1", 3000)
+		if err != nil {
+			panic(err)
+		}
+		gdb = d
+	}
+	return gdb
+}
+
+func getDummyStore() *ObjectStore {
+	o := registry.NewOrg(getDB())
+	o.Handle = "dummyorg:" + time.Now().Format(time.RFC3339Nano)
+	if err := o.Create(); err != nil {
+		panic(err)
+	}
+	os := NewObjectStore(o)
+	os.Name = "mem"
+	os.Type = STORE_TYPE_MEM
+	return os
+}
+
+type failReader struct{}
+
+func (fr failReader) Read([]byte) (int, error) {
+	return 0, errors.New("Data should not have been read")
+}
+
+func newDummyObject(os *ObjectStore, data []byte) *StoredObject {
+	h := sha512.Sum512(data)
+	so := os.NewObject()
+	so.User = "user"
+	so.Group = "group"
+	so.Type = "test"
+	so.Hash = hex.EncodeToString(h[:])
+	return so
+}
+
+func TestPutObjectDedup(t *testing.T) {
+	os := getDummyStore()
+	st, err := os.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("some shared sandbox")
+	first := newDummyObject(os, data)
+	if err := os.PutObject(first, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Cannot put object: %s", err)
+	}
+	//Knowing the hash is not enough to reference the blob
+	forged := bytes.Repeat([]byte("x"), len(data))
+	if err := os.PutObject(newDummyObject(os, data), bytes.NewReader(forged), int64(len(forged))); err != ErrHashMismatch {
+		t.Errorf("Put with other data returned %v", err)
+	}
+	second := newDummyObject(os, data)
+	if err := os.PutObject(second, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Cannot put object with existing blob: %s", err)
+	}
+	if first.Id == second.Id {
+		t.Error("Objects share the same id")
+	}
+	if err := os.PutObject(newDummyObject(os, data), failReader{}, int64(len(data))+1); err != ErrLengthMismatch {
+		t.Errorf("Put with a different length returned %v", err)
+	}
+	blob := os.blobFor(first)
+	if err := getDB().GetRecord(blob.GetPrimaryKey(), blob); err != nil {
+		t.Fatal(err)
+	}
+	if blob.Refs != 2 {
+		t.Errorf("Blob has %d references instead of 2", blob.Refs)
+	}
+
+	if err := os.DeleteObject(first); err != nil {
+		t.Fatalf("Cannot delete object: %s", err)
+	}
+	if _, err := st.Stat(first); err != nil {
+		t.Errorf("Blob was deleted while still referenced: %v", err)
+	}
+	if _, err := os.GetObject(second.Id); err != nil {
+		t.Errorf("Cannot get remaining object: %s", err)
+	}
+	if err := os.DeleteObject(second); err != nil {
+		t.Fatalf("Cannot delete object: %s", err)
+	}
+	if _, err := st.Stat(second); err != ErrNotExists {
+		t.Errorf("Blob was not deleted with the last reference: %v", err)
+	}
+}
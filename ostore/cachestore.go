@@ -0,0 +1,416 @@
+package ostore
+
+import (
+	"container/list"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//Store config options handled by the cache instead of the backend
+	STORE_CACHE_DIR  = "cache_dir"
+	STORE_CACHE_SIZE = "cache_size"
+
+	CACHE_DEFAULT_SIZE = 10 * 1024 * 1024 * 1024
+	//Prefix of the files being filled. Leftovers are removed on start
+	CACHE_FILL_PREFIX = ".fill-"
+)
+
+var errCacheBypass = errors.New("Blob does not fit in the cache")
+
+var cacheStats = expvar.NewMap("ostore.cache")
+
+type CacheOptions struct {
+	//Local directory. Empty disables the cache
+	Dir string
+	//Bytes kept before evicting the least recently used blobs
+	Size int64
+}
+
+func (co CacheOptions) Enabled() bool {
+	return len(co.Dir) > 0
+}
+
+// Take out the options handled by CacheStore. Those are accepted by every
+// backend
+func splitCacheOptions(config map[string]string) (map[string]string, CacheOptions, error) {
+	opts := CacheOptions{Dir: config[STORE_CACHE_DIR], Size: CACHE_DEFAULT_SIZE}
+	_, hasDir := config[STORE_CACHE_DIR]
+	size, hasSize := config[STORE_CACHE_SIZE]
+	if !hasDir && !hasSize {
+		return config, opts, nil
+	}
+	if hasSize {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, opts, fmt.Errorf("Invalid %s %s", STORE_CACHE_SIZE, size)
+		}
+		opts.Size = n
+	}
+	out := make(map[string]string, len(config))
+	for k, v := range config {
+		if k != STORE_CACHE_DIR && k != STORE_CACHE_SIZE {
+			out[k] = v
+		}
+	}
+	return out, opts, nil
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+	//Entries found on disk at start are verified the first time they are read
+	verified bool
+}
+
+// Fill in progress. Concurrent misses of the same blob wait for it
+type cacheFill struct {
+	done chan struct{}
+	err  error
+}
+
+// Read-through cache of the blobs of a store in a local directory, evicting the least recently used
+type CacheStore struct {
+	inner Store
+	dir   string
+	size  int64
+
+	lock    sync.Mutex
+	used    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	fills   map[string]*cacheFill
+}
+
+type cacheReader struct {
+	*os.File
+	info *ObjectInfo
+}
+
+func (r *cacheReader) Info() *ObjectInfo {
+	return r.info
+}
+
+// Blobs already in the directory are kept, in the order of their last use
+func NewCacheStore(inner Store, opts CacheOptions) (*CacheStore, error) {
+	if !opts.Enabled() {
+		return nil, errors.New("Empty cache directory")
+	}
+	if opts.Size <= 0 {
+		opts.Size = CACHE_DEFAULT_SIZE
+	}
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+	cs := &CacheStore{
+		inner:   inner,
+		dir:     opts.Dir,
+		size:    opts.Size,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		fills:   map[string]*cacheFill{},
+	}
+	if err := cs.load(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+type cachedFile struct {
+	key     string
+	size    int64
+	modTime time.Time
+}
+
+type cachedFileSlice []cachedFile
+
+func (s cachedFileSlice) Len() int           { return len(s) }
+func (s cachedFileSlice) Less(i, j int) bool { return s[i].modTime.Before(s[j].modTime) }
+func (s cachedFileSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (cs *CacheStore) load() error {
+	files := cachedFileSlice{}
+	err := filepath.Walk(cs.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), CACHE_FILL_PREFIX) {
+			return os.Remove(path)
+		}
+		rel, err := filepath.Rel(cs.dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, cachedFile{filepath.ToSlash(rel), info.Size(), info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Sort(files)
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	for _, f := range files {
+		cs.entries[f.key] = cs.lru.PushFront(&cacheEntry{key: f.key, size: f.size})
+		cs.used += f.size
+	}
+	cs.evict()
+	return nil
+}
+
+func (cs *CacheStore) path(key string) string {
+	return filepath.Join(cs.dir, filepath.FromSlash(key))
+}
+
+// Drop the least recently used blobs until the cache fits. Needs the lock
+func (cs *CacheStore) evict() {
+	for cs.used > cs.size && cs.lru.Len() > 0 {
+		cs.remove(cs.lru.Back().Value.(*cacheEntry).key)
+		cacheStats.Add("evictions", 1)
+	}
+}
+
+// Needs the lock
+func (cs *CacheStore) remove(key string) {
+	el, ok := cs.entries[key]
+	if !ok {
+		return
+	}
+	e := el.Value.(*cacheEntry)
+	cs.lru.Remove(el)
+	delete(cs.entries, key)
+	cs.used -= e.size
+	//Readers that have the file open keep reading it
+	os.Remove(cs.path(key))
+}
+
+func (cs *CacheStore) add(key string, size int64) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if el, ok := cs.entries[key]; ok {
+		//The file was replaced by the new copy
+		cs.used -= el.Value.(*cacheEntry).size
+		cs.lru.Remove(el)
+	}
+	cs.entries[key] = cs.lru.PushFront(&cacheEntry{key: key, size: size, verified: true})
+	cs.used += size
+	cs.evict()
+}
+
+// Open the cached copy and mark it as used. Copies that have not been verified
+// since the cache started are checked against the hash first
+func (cs *CacheStore) openCached(so *StoredObject) (ObjectReader, error) {
+	key := so.getPath()
+	cs.lock.Lock()
+	el, ok := cs.entries[key]
+	if !ok {
+		cs.lock.Unlock()
+		return nil, ErrNotExists
+	}
+	cs.lru.MoveToFront(el)
+	verified := el.Value.(*cacheEntry).verified
+	cs.lock.Unlock()
+	f, err := os.Open(cs.path(key))
+	if err != nil {
+		cs.drop(key)
+		return nil, ErrNotExists
+	}
+	now := time.Now()
+	//Keeps the order of use when the cache is loaded again
+	os.Chtimes(f.Name(), now, now)
+	if !verified {
+		if err := cs.verify(f, so); err != nil {
+			f.Close()
+			cs.drop(key)
+			cacheStats.Add("corrupt", 1)
+			return nil, ErrNotExists
+		}
+		cs.lock.Lock()
+		if el, ok := cs.entries[key]; ok {
+			el.Value.(*cacheEntry).verified = true
+		}
+		cs.lock.Unlock()
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &cacheReader{f, &ObjectInfo{Size: info.Size(), ModTime: info.ModTime()}}, nil
+}
+
+func (cs *CacheStore) verify(f *os.File, so *StoredObject) error {
+	hr, err := NewVerifyingHashReader(f, so.Hash)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, hr); err != nil {
+		return err
+	}
+	if err := hr.Verify(so.Hash); err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+func (cs *CacheStore) drop(key string) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.remove(key)
+}
+
+// Download the blob into the cache. Only the first of concurrent misses
+// downloads it, the rest wait for the result
+func (cs *CacheStore) fill(so *StoredObject) error {
+	key := so.getPath()
+	cs.lock.Lock()
+	if f, ok := cs.fills[key]; ok {
+		cs.lock.Unlock()
+		cacheStats.Add("shared_fills", 1)
+		<-f.done
+		return f.err
+	}
+	f := &cacheFill{done: make(chan struct{})}
+	cs.fills[key] = f
+	cs.lock.Unlock()
+
+	f.err = cs.download(so)
+	cs.lock.Lock()
+	delete(cs.fills, key)
+	cs.lock.Unlock()
+	close(f.done)
+	return f.err
+}
+
+func (cs *CacheStore) download(so *StoredObject) error {
+	cacheStats.Add("fills", 1)
+	r, err := cs.inner.Open(so)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if info := r.Info(); info != nil && info.Size > cs.size {
+		return errCacheBypass
+	}
+	path := cs.path(so.getPath())
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), CACHE_FILL_PREFIX)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hr, err := NewVerifyingHashReader(r, so.Hash)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	_, err = io.Copy(tmp, hr)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := hr.Verify(so.Hash); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	cs.add(so.getPath(), hr.Size())
+	cacheStats.Add("bytes_filled", hr.Size())
+	return nil
+}
+
+func (cs *CacheStore) Open(so *StoredObject) (ObjectReader, error) {
+	if r, err := cs.openCached(so); err != ErrNotExists {
+		if err == nil {
+			cacheStats.Add("hits", 1)
+		}
+		return r, err
+	}
+	cacheStats.Add("misses", 1)
+	err := cs.fill(so)
+	if err == errCacheBypass {
+		return cs.inner.Open(so)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r, err := cs.openCached(so)
+	if err == ErrNotExists {
+		//Evicted right after being filled
+		return cs.inner.Open(so)
+	}
+	return r, err
+}
+
+func (cs *CacheStore) Get(so *StoredObject, data io.Writer) error {
+	r, err := cs.Open(so)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(data, r)
+	return err
+}
+
+// Stats come from the store, or from the cached copy if the store fails
+func (cs *CacheStore) Stat(so *StoredObject) (*ObjectInfo, error) {
+	info, err := cs.inner.Stat(so)
+	if err == nil || err == ErrNotExists {
+		return info, err
+	}
+	cs.lock.Lock()
+	_, ok := cs.entries[so.getPath()]
+	cs.lock.Unlock()
+	if !ok {
+		return nil, err
+	}
+	fi, serr := os.Stat(cs.path(so.getPath()))
+	if serr != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (cs *CacheStore) Put(so *StoredObject, data io.Reader, length int64) error {
+	return cs.inner.Put(so, data, length)
+}
+
+func (cs *CacheStore) List(prefix, cursor string, limit int) (*ListPage, error) {
+	return cs.inner.List(prefix, cursor, limit)
+}
+
+func (cs *CacheStore) Delete(so *StoredObject) error {
+	cs.drop(so.getPath())
+	return cs.inner.Delete(so)
+}
+
+func (cs *CacheStore) Close() error {
+	if cl, ok := cs.inner.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+// The store under the cache. Maintenance tasks have to see the real data
+func uncached(st Store) Store {
+	if cs, ok := st.(*CacheStore); ok {
+		return cs.inner
+	}
+	return st
+}
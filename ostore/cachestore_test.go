@@ -0,0 +1,206 @@
+package ostore_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/acasajus/menac/ostore"
+	"github.com/acasajus/menac/ostore/storetest"
+)
+
+func tempCacheDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cachestoretest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCacheStore(t *testing.T) {
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+	st, err := ostore.NewCacheStore(ostore.NewMemStore(), ostore.CacheOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storetest.RunStoreTests(t, "CacheStore", st)
+}
+
+var errUpstreamDown = errors.New("Upstream is down")
+
+// Store that counts the blobs read from it and can fail or hand out bad data
+type upstreamStore struct {
+	ostore.Store
+	lock    sync.Mutex
+	opens   int
+	down    bool
+	corrupt bool
+}
+
+type corruptReader struct {
+	ostore.ObjectReader
+}
+
+func (r corruptReader) Read(p []byte) (int, error) {
+	n, err := r.ObjectReader.Read(p)
+	if n > 0 {
+		p[0] ^= 0xff
+	}
+	return n, err
+}
+
+func (us *upstreamStore) Open(so *ostore.StoredObject) (ostore.ObjectReader, error) {
+	us.lock.Lock()
+	down, corrupt := us.down, us.corrupt
+	if !down {
+		us.opens++
+	}
+	us.lock.Unlock()
+	if down {
+		return nil, errUpstreamDown
+	}
+	//Gives concurrent misses time to pile up
+	time.Sleep(20 * time.Millisecond)
+	r, err := us.Store.Open(so)
+	if err != nil || !corrupt {
+		return r, err
+	}
+	return corruptReader{r}, nil
+}
+
+func (us *upstreamStore) Stat(so *ostore.StoredObject) (*ostore.ObjectInfo, error) {
+	us.lock.Lock()
+	down := us.down
+	us.lock.Unlock()
+	if down {
+		return nil, errUpstreamDown
+	}
+	return us.Store.Stat(so)
+}
+
+func (us *upstreamStore) set(down, corrupt bool) int {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+	us.down, us.corrupt = down, corrupt
+	return us.opens
+}
+
+func TestCacheStoreReadThrough(t *testing.T) {
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+	up := &upstreamStore{Store: ostore.NewMemStore()}
+	cs, err := ostore.NewCacheStore(up, ostore.CacheOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	so, data := storetest.NewTestObject(4096)
+	if err := cs.Put(so, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	up.set(false, true)
+	if err := cs.Get(so, &bytes.Buffer{}); err != ostore.ErrHashMismatch {
+		t.Errorf("Fill with bad data returned %v", err)
+	}
+	opens := up.set(false, false)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := &bytes.Buffer{}
+			if err := cs.Get(so, buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+				t.Errorf("#%d: Unexpected read %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := up.set(true, false) - opens; n != 1 {
+		t.Errorf("Concurrent misses read the blob %d times", n)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := cs.Get(so, buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Cached blob was not served with the upstream down: %v", err)
+	}
+	if info, err := cs.Stat(so); err != nil || info.Size != int64(len(data)) {
+		t.Errorf("Unexpected stat with the upstream down %+v %v", info, err)
+	}
+
+	//A copy found on disk is verified before it is served
+	path := filepath.Join(dir, filepath.FromSlash(so.Type+"/"+so.Hash))
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte{0}, len(data)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := ostore.NewCacheStore(up, ostore.CacheOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.Get(so, &bytes.Buffer{}); err != errUpstreamDown {
+		t.Errorf("Corrupt cached copy with the upstream down returned %v", err)
+	}
+	up.set(false, false)
+	buf.Reset()
+	if err := reloaded.Get(so, buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Corrupt cached copy was not filled again: %v", err)
+	}
+
+	if err := reloaded.Delete(so); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Deleted blob is still cached: %v", err)
+	}
+}
+
+func TestCacheStoreEviction(t *testing.T) {
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+	up := &upstreamStore{Store: ostore.NewMemStore()}
+	cs, err := ostore.NewCacheStore(up, ostore.CacheOptions{Dir: dir, Size: 250})
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs := []*ostore.StoredObject{}
+	for i := 0; i < 3; i++ {
+		so, data := storetest.NewTestObject(100)
+		if err := cs.Put(so, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, so)
+	}
+	big, data := storetest.NewTestObject(300)
+	if err := cs.Put(big, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 1, 0, 2} {
+		if err := cs.Get(objs[i], &bytes.Buffer{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//The last read evicted the least recently used, which is the second one
+	opens := up.set(false, false)
+	for i, expected := range []int{0, 0, 1} {
+		if err := cs.Get(objs[[]int{0, 2, 1}[i]], &bytes.Buffer{}); err != nil {
+			t.Fatal(err)
+		}
+		if n := up.set(false, false) - opens; n != expected {
+			t.Errorf("#%d: Read %d blobs from upstream instead of %d", i, n, expected)
+		}
+	}
+	//Blobs over the cache size are streamed from upstream
+	buf := &bytes.Buffer{}
+	if err := cs.Get(big, buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Unexpected read of a blob bigger than the cache: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, big.Type, big.Hash)); !os.IsNotExist(err) {
+		t.Errorf("Blob bigger than the cache was cached: %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+package ostore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_CREATE = "ostore:create"
+	EVENT_DELETE = "ostore:delete"
+	//Objects removed by the GC once expired, and versions dropped by retention
+	EVENT_EXPIRE = "ostore:expire"
+
+	//Headers of webhook deliveries. The signature is the hex HMAC-SHA256 of
+	//the timestamp, a dot and the body, prefixed with "sha256="
+	WEBHOOK_EVENT_HEADER     = "X-Menac-Event"
+	WEBHOOK_TIMESTAMP_HEADER = "X-Menac-Timestamp"
+	WEBHOOK_SIGNATURE_HEADER = "X-Menac-Signature"
+	WEBHOOK_RETRIES          = 5
+	WEBHOOK_BACKOFF          = time.Second
+	WEBHOOK_TIMEOUT          = 10 * time.Second
+	//Events waiting to be delivered by each webhook. More are dropped
+	WEBHOOK_QUEUE = 1024
+	//How old a delivery can be for VerifyWebhook to accept it
+	WEBHOOK_MAX_AGE = 5 * time.Minute
+)
+
+var (
+	ErrBadWebhookSignature = errors.New("Webhook signature does not match")
+	ErrStaleEvent          = errors.New("Webhook timestamp is too old")
+)
+
+var eventStats = expvar.NewMap("ostore.events")
+
+// Something that happened to an object. Events are published by the node
+// doing the change once it is done
+type Event struct {
+	Kind         string
+	Time         time.Time
+	Organization string
+	StoreName    string
+	ObjectId     string
+	User         string
+	Group        string
+	Type         string
+	Hash         string
+	Size         int64
+	Metadata     map[string]string
+}
+
+func newEvent(kind string, so *StoredObject) *Event {
+	e := &Event{
+		Kind:         kind,
+		Time:         time.Now(),
+		Organization: so.Organization,
+		StoreName:    so.StoreName,
+		ObjectId:     so.Id,
+		User:         so.User,
+		Group:        so.Group,
+		Type:         so.Type,
+		Hash:         so.Hash,
+		Size:         so.Size,
+		Metadata:     map[string]string{},
+	}
+	for k, v := range so.Metadata {
+		e.Metadata[k] = v
+	}
+	return e
+}
+
+// Events a subscription wants. Empty fields match everything
+type EventFilter struct {
+	Kinds        []string
+	Organization string
+	StoreName    string
+	Types        []string
+	//Keys that have to be present. An empty value matches any value
+	Metadata map[string]string
+}
+
+func (f *EventFilter) Match(e *Event) bool {
+	if len(f.Kinds) > 0 && !containsName(f.Kinds, e.Kind) {
+		return false
+	}
+	if len(f.Types) > 0 && !containsName(f.Types, e.Type) {
+		return false
+	}
+	for _, v := range [][2]string{
+		{f.Organization, e.Organization},
+		{f.StoreName, e.StoreName},
+	} {
+		if len(v[0]) > 0 && v[0] != v[1] {
+			return false
+		}
+	}
+	for k, v := range f.Metadata {
+		ev, ok := e.Metadata[k]
+		if !ok || (len(v) > 0 && v != ev) {
+			return false
+		}
+	}
+	return true
+}
+
+// Receives the events of its subscriptions. Notify is called while the object
+// is being changed, so it must not block
+type Subscriber interface {
+	Notify(e *Event)
+}
+
+type Subscription struct {
+	Filter     EventFilter
+	Subscriber Subscriber
+}
+
+var (
+	subscriptionsLock sync.RWMutex
+	subscriptions     []*Subscription
+)
+
+// Send the events matching the filter to the subscriber until unsubscribed
+func Subscribe(f EventFilter, s Subscriber) *Subscription {
+	sub := &Subscription{f, s}
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+	subscriptions = append(subscriptions, sub)
+	return sub
+}
+
+func Unsubscribe(sub *Subscription) {
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+	subs := []*Subscription{}
+	for _, s := range subscriptions {
+		if s != sub {
+			subs = append(subs, s)
+		}
+	}
+	subscriptions = subs
+}
+
+func publish(kind string, so *StoredObject) {
+	subscriptionsLock.RLock()
+	defer subscriptionsLock.RUnlock()
+	if len(subscriptions) == 0 {
+		return
+	}
+	e := newEvent(kind, so)
+	eventStats.Add(kind, 1)
+	for _, sub := range subscriptions {
+		if sub.Filter.Match(e) {
+			sub.Subscriber.Notify(e)
+		}
+	}
+}
+
+// Subscriber handing events to a channel. Events that do not fit in its
+// buffer are dropped
+type ChannelSubscriber struct {
+	C chan *Event
+}
+
+func NewChannelSubscriber(size int) *ChannelSubscriber {
+	return &ChannelSubscriber{make(chan *Event, size)}
+}
+
+func (cs *ChannelSubscriber) Notify(e *Event) {
+	select {
+	case cs.C <- e:
+	default:
+		eventStats.Add("dropped", 1)
+	}
+}
+
+// Subscriber posting signed JSON events to a URL, retrying with backoff
+type WebhookSubscriber struct {
+	URL     string
+	Key     []byte
+	Retries int
+	Backoff time.Duration
+	Client  *http.Client
+
+	queue chan *Event
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewWebhookSubscriber(url string, key []byte) *WebhookSubscriber {
+	ws := &WebhookSubscriber{
+		URL:     url,
+		Key:     key,
+		Retries: WEBHOOK_RETRIES,
+		Backoff: WEBHOOK_BACKOFF,
+		Client:  &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		queue:   make(chan *Event, WEBHOOK_QUEUE),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go ws.loop()
+	return ws
+}
+
+func (ws *WebhookSubscriber) Notify(e *Event) {
+	select {
+	case ws.queue <- e:
+	default:
+		eventStats.Add("dropped", 1)
+		log.Printf("ostore: Webhook queue for %s is full, dropping %s of %s", ws.URL, e.Kind, e.ObjectId)
+	}
+}
+
+// Stop delivering. Queued events are dropped
+func (ws *WebhookSubscriber) Close() error {
+	close(ws.stop)
+	<-ws.done
+	return nil
+}
+
+func (ws *WebhookSubscriber) loop() {
+	defer close(ws.done)
+	for {
+		select {
+		case <-ws.stop:
+			return
+		case e := <-ws.queue:
+			if err := ws.deliver(e); err != nil {
+				eventStats.Add("failed", 1)
+				log.Printf("ostore: Cannot deliver %s of %s to %s: %s", e.Kind, e.ObjectId, ws.URL, err)
+				continue
+			}
+			eventStats.Add("delivered", 1)
+		}
+	}
+}
+
+// Whether a failed delivery is worth retrying
+type deliveryError struct {
+	err   error
+	retry bool
+}
+
+func (ws *WebhookSubscriber) deliver(e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	backoff := ws.Backoff
+	for attempt := 0; ; attempt++ {
+		derr := ws.post(e.Kind, body)
+		if derr == nil {
+			return nil
+		}
+		if !derr.retry || attempt >= ws.Retries {
+			return derr.err
+		}
+		eventStats.Add("retried", 1)
+		select {
+		case <-ws.stop:
+			return derr.err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (ws *WebhookSubscriber) post(kind string, body []byte) *deliveryError {
+	req, err := http.NewRequest("POST", ws.URL, bytes.NewReader(body))
+	if err != nil {
+		return &deliveryError{err, false}
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_EVENT_HEADER, kind)
+	req.Header.Set(WEBHOOK_TIMESTAMP_HEADER, ts)
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, SignWebhook(ws.Key, ts, body))
+	resp, err := ws.Client.Do(req)
+	if err != nil {
+		return &deliveryError{err, true}
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return &deliveryError{fmt.Errorf("Webhook answered %s", resp.Status), retry}
+}
+
+func SignWebhook(key []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check the signature of a webhook delivery as a receiver. Deliveries older
+// than WEBHOOK_MAX_AGE are refused so they cannot be replayed
+func VerifyWebhook(key []byte, h http.Header, body []byte, now time.Time) error {
+	ts := h.Get(WEBHOOK_TIMESTAMP_HEADER)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrBadWebhookSignature
+	}
+	if age := now.Sub(time.Unix(sec, 0)); age > WEBHOOK_MAX_AGE || age < -WEBHOOK_MAX_AGE {
+		return ErrStaleEvent
+	}
+	expected := SignWebhook(key, ts, body)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(h.Get(WEBHOOK_SIGNATURE_HEADER))) != 1 {
+		return ErrBadWebhookSignature
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package ostore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventFilter(t *testing.T) {
+	e := &Event{
+		Kind:         EVENT_CREATE,
+		Organization: "org",
+		StoreName:    "store",
+		Type:         "output",
+		Metadata:     map[string]string{"Job": "1", "Stage": "final"},
+	}
+	for i, tt := range []struct {
+		filter EventFilter
+		match  bool
+	}{
+		{EventFilter{}, true},
+		{EventFilter{Kinds: []string{EVENT_DELETE, EVENT_CREATE}}, true},
+		{EventFilter{Kinds: []string{EVENT_EXPIRE}}, false},
+		{EventFilter{Organization: "org", StoreName: "store"}, true},
+		{EventFilter{StoreName: "other"}, false},
+		{EventFilter{Types: []string{"output"}}, true},
+		{EventFilter{Types: []string{"input"}}, false},
+		{EventFilter{Metadata: map[string]string{"Job": ""}}, true},
+		{EventFilter{Metadata: map[string]string{"Job": "1", "Stage": "final"}}, true},
+		{EventFilter{Metadata: map[string]string{"Stage": "draft"}}, false},
+		{EventFilter{Metadata: map[string]string{"Missing": ""}}, false},
+	} {
+		if m := tt.filter.Match(e); m != tt.match {
+			t.Errorf("#%d: Filter %+v matched %v instead of %v", i, tt.filter, m, tt.match)
+		}
+	}
+}
+
+func TestChannelSubscriber(t *testing.T) {
+	outputs := NewChannelSubscriber(1)
+	all := NewChannelSubscriber(10)
+	subs := []*Subscription{
+		Subscribe(EventFilter{Types: []string{"output"}}, outputs),
+		Subscribe(EventFilter{}, all),
+	}
+	defer func() {
+		for _, sub := range subs {
+			Unsubscribe(sub)
+		}
+	}()
+	so := &StoredObject{Id: "a", Organization: "org", StoreName: "store", Type: "output", Hash: "h", Size: 3, Metadata: map[string]string{"K": "v"}}
+	publish(EVENT_CREATE, so)
+	publish(EVENT_DELETE, &StoredObject{Id: "b", Type: "input"})
+	//The buffer is full, this one is dropped
+	publish(EVENT_EXPIRE, so)
+	so.Metadata["K"] = "changed"
+	e := <-outputs.C
+	if e.Kind != EVENT_CREATE || e.ObjectId != "a" || e.Hash != "h" || e.Size != 3 || e.Metadata["K"] != "v" {
+		t.Errorf("Received %+v", e)
+	}
+	select {
+	case e := <-outputs.C:
+		t.Errorf("Received %+v beyond the buffer or the filter", e)
+	default:
+	}
+	if len(all.C) != 3 {
+		t.Errorf("Unfiltered subscriber received %d events instead of 3", len(all.C))
+	}
+	Unsubscribe(subs[1])
+	publish(EVENT_CREATE, so)
+	if len(all.C) != 3 {
+		t.Errorf("Unsubscribed subscriber received events")
+	}
+}
+
+func TestWebhookSubscriber(t *testing.T) {
+	key := []byte("secret")
+	lock := sync.Mutex{}
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK, http.StatusBadRequest}
+	received := make(chan *Event, 10)
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := VerifyWebhook(key, r.Header, body, time.Now()); err != nil {
+			t.Errorf("Delivery does not verify: %s", err)
+		}
+		lock.Lock()
+		status := statuses[attempts%len(statuses)]
+		attempts++
+		lock.Unlock()
+		if status == http.StatusOK {
+			e := &Event{}
+			if err := json.Unmarshal(body, e); err != nil {
+				t.Error(err)
+			}
+			received <- e
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	ws := NewWebhookSubscriber(srv.URL, key)
+	ws.Backoff = time.Millisecond
+	defer ws.Close()
+	//Retried until accepted
+	ws.Notify(newEvent(EVENT_CREATE, &StoredObject{Id: "a", Type: "output", Metadata: map[string]string{"K": "v"}}))
+	select {
+	case e := <-received:
+		if e.Kind != EVENT_CREATE || e.ObjectId != "a" || e.Metadata["K"] != "v" {
+			t.Errorf("Received %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event was not delivered")
+	}
+	//Client errors are not retried
+	ws.Notify(newEvent(EVENT_DELETE, &StoredObject{Id: "b"}))
+	ws.Notify(newEvent(EVENT_DELETE, &StoredObject{Id: "c"}))
+	select {
+	case e := <-received:
+		if e.ObjectId != "c" {
+			t.Errorf("Received %s instead of c", e.ObjectId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event was not delivered")
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	key, body, now := []byte("secret"), []byte("{}"), time.Now()
+	ts := strconv.FormatInt(now.Unix(), 10)
+	old := strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)
+	for i, tt := range []struct {
+		ts  string
+		sig string
+		err error
+	}{
+		{ts, SignWebhook(key, ts, body), nil},
+		{ts, SignWebhook([]byte("other"), ts, body), ErrBadWebhookSignature},
+		{ts, SignWebhook(key, ts, []byte("{ }")), ErrBadWebhookSignature},
+		{old, SignWebhook(key, old, body), ErrStaleEvent},
+		{"", SignWebhook(key, "", body), ErrBadWebhookSignature},
+	} {
+		h := http.Header{}
+		h.Set(WEBHOOK_TIMESTAMP_HEADER, tt.ts)
+		h.Set(WEBHOOK_SIGNATURE_HEADER, tt.sig)
+		if err := VerifyWebhook(key, h, body, now); err != tt.err {
+			t.Errorf("#%d: Verifying returned %v instead of %v", i, err, tt.err)
+		}
+	}
+}
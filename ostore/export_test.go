@@ -0,0 +1,7 @@
+package ostore
+
+// Helpers for the external tests
+
+func (s *S3Store) DelBucket() error {
+	return s.bucket.DelBucket()
+}
@@ -3,8 +3,12 @@ package ostore
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 type FSStore struct {
@@ -13,8 +17,20 @@ type FSStore struct {
 
 const (
 	FS_ROOT_PATH = "root_path"
+	//Staging area for multipart uploads. Hidden so listings skip it
+	FS_UPLOADS_DIR = ".uploads"
+	FS_PART_PREFIX = "part-"
 )
 
+func init() {
+	RegisterBackend(STORE_TYPE_FS, []ConfigField{
+		{Name: FS_ROOT_PATH, Required: true},
+	}, func(c map[string]string) (Store, error) {
+		fs := &FSStore{}
+		return fs, fs.Initialize(c)
+	})
+}
+
 func (fs *FSStore) Initialize(c map[string]string) error {
 	fs.rootPath = c[FS_ROOT_PATH]
 	if !filepath.IsAbs(fs.rootPath) {
@@ -34,37 +50,46 @@ func (fs *FSStore) getPath(so *StoredObject) string {
 	return filepath.Join(fs.rootPath, fmt.Sprintf("%s/%s/%s/%s", so.Type, so.Hash[:2], so.Hash[2:4], so.Hash))
 }
 
+// Data is written to a temporary file that is linked into place once it has
+// been verified, so concurrent puts of the same object can't mix their data
 func (fs *FSStore) Put(so *StoredObject, data io.Reader, length int64) error {
 	path := fs.getPath(so)
 	_, err := os.Stat(path)
 	if err == nil {
 		return ErrAlreadyExists
 	}
-	if err.(*os.PathError).Err.Error() != "no such file or directory" {
+	if !os.IsNotExist(err) {
 		return err
 	}
 	parentDir := filepath.Dir(path)
 	if err := os.MkdirAll(parentDir, 0700); err != nil {
 		return err
 	}
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	f, err := ioutil.TempFile(parentDir, ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	hr, err := NewVerifyingHashReader(data, so.dataHash())
 	if err != nil {
 		return err
 	}
-	hr := NewHashReader(data)
 	written, err := io.Copy(f, hr)
 	f.Close()
 	if err != nil {
-		os.Remove(path)
 		return err
 	}
 	if written != length {
-		os.Remove(path)
-		return fmt.Errorf("Reader length (%d) and defined length differ (%d)", written, length)
+		return ErrLengthMismatch
+	}
+	if err := hr.Verify(so.dataHash()); err != nil {
+		return err
 	}
-	if hr.HexDigest() != so.Hash {
-		os.Remove(path)
-		return ErrHashMismatch
+	if err := os.Link(f.Name(), path); err != nil {
+		if os.IsExist(err) {
+			return ErrAlreadyExists
+		}
+		return err
 	}
 	return nil
 }
@@ -73,19 +98,261 @@ func (fs *FSStore) Get(so *StoredObject, data io.Writer) error {
 	path := fs.getPath(so)
 	f, err := os.Open(path)
 	if err != nil {
-		if err.(*os.PathError).Err.Error() == "no such file or directory" {
+		if os.IsNotExist(err) {
 			return ErrNotExists
 		}
 		return err
 	}
+	defer f.Close()
 	_, err = io.Copy(data, f)
 	return err
 }
 
+type fsReader struct {
+	*os.File
+	info *ObjectInfo
+}
+
+func (r *fsReader) Info() *ObjectInfo {
+	return r.info
+}
+
+// The filesystem keeps no metadata so it is always nil
+func (fs *FSStore) Open(so *StoredObject) (ObjectReader, error) {
+	f, err := os.Open(fs.getPath(so))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotExists
+		}
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fsReader{f, &ObjectInfo{Size: fi.Size(), ModTime: fi.ModTime()}}, nil
+}
+
+func (fs *FSStore) Stat(so *StoredObject) (*ObjectInfo, error) {
+	fi, err := os.Stat(fs.getPath(so))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotExists
+		}
+		return nil, err
+	}
+	return &ObjectInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Sorted entries of a directory. A directory removed in the meantime is empty
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Objects live in type/xx/yy/hash. Hidden entries are temporary files
+func (fs *FSStore) List(prefix, cursor string, limit int) (*ListPage, error) {
+	page := &ListPage{Objects: []ListEntry{}}
+	names, err := readDirNames(fs.rootPath)
+	if err != nil {
+		return nil, err
+	}
+	types := []string{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, ".") {
+			types = append(types, name+"/")
+		}
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		if len(page.Next) > 0 {
+			break
+		}
+		if !listMayContain(t, prefix, cursor) {
+			continue
+		}
+		typ := t[:len(t)-1]
+		if err := fs.listLevel(page, filepath.Join(fs.rootPath, typ), typ, "", prefix, cursor, listLimit(limit)); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+func (fs *FSStore) listLevel(page *ListPage, dir, typ, hashPrefix, prefix, cursor string, limit int) error {
+	names, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if len(page.Next) > 0 {
+			return nil
+		}
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		//Two levels of directories with two chars of the hash each
+		if len(hashPrefix) < 4 {
+			if !listMayContain(typ+"/"+hashPrefix+name, prefix, cursor) {
+				continue
+			}
+			if err := fs.listLevel(page, filepath.Join(dir, name), typ, hashPrefix+name, prefix, cursor, limit); err != nil {
+				return err
+			}
+			continue
+		}
+		key := typ + "/" + name
+		if !listIncludes(key, prefix, cursor) {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		page.Objects = append(page.Objects, ListEntry{Type: typ, Hash: name, Size: fi.Size(), ModTime: fi.ModTime()})
+		if len(page.Objects) == limit {
+			page.Next = key
+		}
+	}
+	return nil
+}
+
 func (fs *FSStore) Delete(so *StoredObject) error {
 	err := os.Remove(fs.getPath(so))
-	if err != nil && err.(*os.PathError).Err.Error() == "no such file or directory" {
+	if err != nil && os.IsNotExist(err) {
 		return ErrNotExists
 	}
 	return err
-}
\ No newline at end of file
+}
+
+func (fs *FSStore) uploadDir(uploadId string) (string, error) {
+	dir := filepath.Join(fs.rootPath, FS_UPLOADS_DIR, uploadId)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrUnknownUpload
+		}
+		return "", err
+	}
+	return dir, nil
+}
+
+// Parts are kept as files in a directory per upload
+func (fs *FSStore) InitiateUpload(so *StoredObject) (string, error) {
+	id := newObjectId()
+	return id, os.MkdirAll(filepath.Join(fs.rootPath, FS_UPLOADS_DIR, id), 0700)
+}
+
+func (fs *FSStore) UploadPart(so *StoredObject, uploadId string, n int, data io.Reader, length int64) error {
+	if err := checkPartNumber(n); err != nil {
+		return err
+	}
+	dir, err := fs.uploadDir(uploadId)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".part-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	written, err := io.Copy(f, data)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if written != length {
+		return ErrLengthMismatch
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, fmt.Sprintf("%s%05d", FS_PART_PREFIX, n)))
+}
+
+func (fs *FSStore) ListParts(so *StoredObject, uploadId string) ([]UploadPart, error) {
+	dir, err := fs.uploadDir(uploadId)
+	if err != nil {
+		return nil, err
+	}
+	names, err := readDirNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	parts := []UploadPart{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, FS_PART_PREFIX) {
+			continue
+		}
+		n, err := strconv.Atoi(name[len(FS_PART_PREFIX):])
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, UploadPart{N: n, Size: fi.Size()})
+	}
+	return parts, nil
+}
+
+func (fs *FSStore) OpenPart(so *StoredObject, uploadId string, n int) (io.ReadCloser, error) {
+	dir, err := fs.uploadDir(uploadId)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(dir, fmt.Sprintf("%s%05d", FS_PART_PREFIX, n)))
+	if os.IsNotExist(err) {
+		return nil, ErrInvalidPart
+	}
+	return f, err
+}
+
+// The parts are concatenated through Put so the object gets the same checks
+func (fs *FSStore) CompleteUpload(so *StoredObject, uploadId string, length int64) error {
+	dir, err := fs.uploadDir(uploadId)
+	if err != nil {
+		return err
+	}
+	parts, err := fs.ListParts(so, uploadId)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return ErrNoParts
+	}
+	readers := make([]io.Reader, 0, len(parts))
+	for _, p := range parts {
+		f, err := os.Open(filepath.Join(dir, fmt.Sprintf("%s%05d", FS_PART_PREFIX, p.N)))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	if err := fs.Put(so, io.MultiReader(readers...), length); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (fs *FSStore) AbortUpload(so *StoredObject, uploadId string) error {
+	dir, err := fs.uploadDir(uploadId)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
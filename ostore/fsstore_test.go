@@ -1,20 +1,23 @@
-package ostore
+package ostore_test
 
 import (
 	"io/ioutil"
 	"os"
 	"testing"
+
+	"github.com/acasajus/menac/ostore"
+	"github.com/acasajus/menac/ostore/storetest"
 )
 
-func TestFSStoreGetPutDelete(t *testing.T) {
+func TestFSStore(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "fsstoragetest")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(tmpDir)
-	st := &FSStore{}
-	if err := st.Initialize(map[string]string{FS_ROOT_PATH: tmpDir}); err != nil {
-		t.Fatal("Unexpected error: %s", err)
+	st := &ostore.FSStore{}
+	if err := st.Initialize(map[string]string{ostore.FS_ROOT_PATH: tmpDir}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
 	}
-	runTestStoreGetPutDelete("FSStore", st, t)
+	storetest.RunStoreTests(t, "FSStore", st)
 }
@@ -0,0 +1,314 @@
+package ostore
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/acasajus/menac/db"
+)
+
+const (
+	GC_INTERVAL = time.Hour
+	//Blobs without record younger than this may still be being uploaded
+	GC_ORPHAN_GRACE = 24 * time.Hour
+	GC_LIST_LIMIT   = 1000
+)
+
+var gcStats = expvar.NewMap("ostore.gc")
+
+// Only the node that answers true runs the collection. coord.Node implements it
+type Leadership interface {
+	IsLeader() bool
+}
+
+// What a collection did, or would have done in dry run mode, on a store
+type GCReport struct {
+	Store  string
+	DryRun bool
+	//Ids of the expired objects
+	Expired []string
+	//Blob keys with no record or no references
+	Orphans []string
+	//Ids of the objects whose blob is not in the store
+	Missing []string
+	//Ids of the abandoned uploads
+	Uploads []string
+	//Name versions past the retention of the store, as name@version
+	Versions []string
+	//Copies made and blobs moved off the primary by replicated stores
+	Replicated []string
+	Tiered     []string
+	Errors     []string
+}
+
+func (r *GCReport) String() string {
+	return fmt.Sprintf("%s: %d expired, %d orphans, %d missing, %d uploads, %d versions, %d replicated, %d tiered, %d errors (dry run %v)",
+		r.Store, len(r.Expired), len(r.Orphans), len(r.Missing), len(r.Uploads), len(r.Versions), len(r.Replicated), len(r.Tiered), len(r.Errors), r.DryRun)
+}
+
+func (r *GCReport) addError(format string, args ...interface{}) {
+	gcStats.Add("errors", 1)
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// Periodically removes expired objects and blobs nobody references, and looks
+// for objects whose blob has gone missing
+type GC struct {
+	db       db.DB
+	leader   Leadership
+	Interval time.Duration
+	Grace    time.Duration
+	//Age after which unfinished uploads are aborted
+	UploadExpiry time.Duration
+	DryRun       bool
+
+	lock       sync.Mutex
+	lastReport []*GCReport
+	stop       chan struct{}
+}
+
+// Leader may be nil if there is a single node running the collector
+func NewGC(d db.DB, leader Leadership) *GC {
+	return &GC{
+		db:           d,
+		leader:       leader,
+		Interval:     GC_INTERVAL,
+		Grace:        GC_ORPHAN_GRACE,
+		UploadExpiry: UPLOAD_EXPIRY,
+		stop:         make(chan struct{}),
+	}
+}
+
+func (gc *GC) Start() {
+	go gc.loop()
+}
+
+func (gc *GC) Stop() {
+	close(gc.stop)
+}
+
+func (gc *GC) loop() {
+	ticker := time.NewTicker(gc.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if gc.leader != nil && !gc.leader.IsLeader() {
+				continue
+			}
+			reports, err := gc.Run()
+			if err != nil {
+				log.Printf("ostore: GC failed: %s", err)
+				continue
+			}
+			for _, r := range reports {
+				log.Printf("ostore: GC %s", r)
+			}
+		case <-gc.stop:
+			return
+		}
+	}
+}
+
+// Reports of the last run
+func (gc *GC) LastReport() []*GCReport {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	return gc.lastReport
+}
+
+func (gc *GC) stores() ([]*ObjectStore, error) {
+	stores := []*ObjectStore{}
+	for sr := range gc.db.ScanRecords(&ObjectStore{}) {
+		if sr.Error != nil {
+			return nil, sr.Error
+		}
+		os, ok := sr.Record.(*ObjectStore)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected struct type came out of the pipe %#v", sr.Record))
+		}
+		stores = append(stores, os)
+	}
+	return stores, nil
+}
+
+// Primary keys of the stores used by replicated stores. Their blobs have no
+// records of their own, so they are never orphans
+func replicaMembers(stores []*ObjectStore) map[string]bool {
+	members := map[string]bool{}
+	for _, os := range stores {
+		if os.Type != STORE_TYPE_REPLICATED {
+			continue
+		}
+		names := append(splitNames(os.Config[REPLICATED_REPLICAS]), os.Config[REPLICATED_PRIMARY], os.Config[REPLICATED_TIER_STORE])
+		for _, name := range names {
+			members[fmt.Sprintf("%s:%s", os.Organization, name)] = true
+		}
+	}
+	return members
+}
+
+// Collect all the stores once
+func (gc *GC) Run() ([]*GCReport, error) {
+	gcStats.Add("runs", 1)
+	stores, err := gc.stores()
+	if err != nil {
+		return nil, err
+	}
+	members := replicaMembers(stores)
+	reports := []*GCReport{}
+	for _, os := range stores {
+		reports = append(reports, gc.runStore(os, time.Now(), members[string(os.GetPrimaryKey())]))
+	}
+	gc.lock.Lock()
+	gc.lastReport = reports
+	gc.lock.Unlock()
+	return reports, nil
+}
+
+func (gc *GC) RunStore(os *ObjectStore, now time.Time) *GCReport {
+	stores, err := gc.stores()
+	if err != nil {
+		report := &GCReport{Store: string(os.GetPrimaryKey()), DryRun: gc.DryRun}
+		report.addError("Cannot list stores: %s", err)
+		return report
+	}
+	return gc.runStore(os, now, replicaMembers(stores)[string(os.GetPrimaryKey())])
+}
+
+func (gc *GC) runStore(os *ObjectStore, now time.Time, member bool) *GCReport {
+	report := &GCReport{Store: string(os.GetPrimaryKey()), DryRun: gc.DryRun}
+	st, err := os.Open()
+	if err != nil {
+		report.addError("Cannot open store: %s", err)
+		return report
+	}
+	gc.collectExpired(os, now, report)
+	uploads, err := os.ExpireUploads(now.Add(-gc.UploadExpiry), gc.DryRun)
+	if err != nil {
+		report.addError("Cannot expire uploads: %s", err)
+	}
+	gcStats.Add("uploads", int64(len(uploads)))
+	report.Uploads = uploads
+	versions, err := os.ExpireVersions(now, gc.DryRun)
+	if err != nil {
+		report.addError("Cannot expire versions: %s", err)
+	}
+	gcStats.Add("versions", int64(len(versions)))
+	report.Versions = versions
+	if rs, ok := uncached(st).(*ReplicatedStore); ok {
+		r := rs.Repair(now, gc.DryRun)
+		report.Replicated = r.Replicated
+		report.Tiered = r.Tiered
+		for _, e := range r.Errors {
+			report.addError("%s", e)
+		}
+	}
+	if !member {
+		gc.collectOrphans(os, st, now, report)
+	}
+	gc.findMissing(os, st, report)
+	return report
+}
+
+func (gc *GC) collectExpired(os *ObjectStore, now time.Time, report *GCReport) {
+	expired, err := os.Objects(ObjectQuery{ExpiresBefore: now})
+	if err != nil {
+		report.addError("Cannot query expired objects: %s", err)
+		return
+	}
+	for _, so := range expired {
+		if !gc.DryRun {
+			if err := os.deleteObject(so, EVENT_EXPIRE); err != nil {
+				report.addError("Cannot delete expired object %s: %s", so.Id, err)
+				continue
+			}
+		}
+		gcStats.Add("expired", 1)
+		report.Expired = append(report.Expired, so.Id)
+	}
+}
+
+// Blobs in the backend without a record, or whose record has no references
+// left, are removed once they are older than the grace period
+func (gc *GC) collectOrphans(os *ObjectStore, st Store, now time.Time, report *GCReport) {
+	cursor := ""
+	for {
+		page, err := st.List("", cursor, GC_LIST_LIMIT)
+		if err != nil {
+			report.addError("Cannot list blobs: %s", err)
+			return
+		}
+		for _, e := range page.Objects {
+			if now.Sub(e.ModTime) < gc.Grace || e.Type == SCRUB_QUARANTINE_TYPE {
+				continue
+			}
+			blob := os.GetDB().LinkRecordToDB(&Blob{Organization: os.Organization, StoreName: os.Name, Type: e.Type, Hash: e.Hash}).(*Blob)
+			err := os.GetDB().GetRecord(blob.GetPrimaryKey(), blob)
+			switch {
+			case err == nil && blob.Refs > 0:
+				continue
+			case err != nil && !db.IsErrNotFound(err):
+				report.addError("Cannot get blob %s: %s", e.Key(), err)
+				continue
+			}
+			if !gc.DryRun {
+				if err := gc.removeOrphan(st, blob, err == nil); err != nil {
+					report.addError("Cannot remove orphan blob %s: %s", e.Key(), err)
+					continue
+				}
+			}
+			gcStats.Add("orphans", 1)
+			report.Orphans = append(report.Orphans, e.Key())
+		}
+		if cursor = page.Next; len(cursor) == 0 {
+			return
+		}
+	}
+}
+
+func (gc *GC) removeOrphan(st Store, blob *Blob, hasRecord bool) error {
+	if hasRecord {
+		//Fails if the blob was referenced again since it was read
+		if _, err := blob.GetDB().DeleteRecord(blob); err != nil {
+			return err
+		}
+	}
+	err := st.Delete(&StoredObject{Type: blob.Type, Hash: blob.Hash})
+	if err == ErrNotExists {
+		return nil
+	}
+	return err
+}
+
+// Missing blobs can't be fixed here, they are only reported
+func (gc *GC) findMissing(os *ObjectStore, st Store, report *GCReport) {
+	checked := map[string]bool{}
+	err := (&ObjectQuery{Organization: os.Organization, StoreName: os.Name}).Each(os.GetDB(), func(so *StoredObject) error {
+		exists, ok := checked[so.getPath()]
+		if !ok {
+			_, err := st.Stat(so)
+			switch err {
+			case nil:
+				exists = true
+			case ErrNotExists:
+				exists = false
+			default:
+				report.addError("Cannot stat blob of %s: %s", so.Id, err)
+				return nil
+			}
+			checked[so.getPath()] = exists
+		}
+		if !exists {
+			gcStats.Add("missing", 1)
+			report.Missing = append(report.Missing, so.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		report.addError("Cannot query objects: %s", err)
+	}
+}
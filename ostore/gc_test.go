@@ -0,0 +1,74 @@
+package ostore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestGCRunStore(t *testing.T) {
+	if err := RegisterIndexes(getDB()); err != nil {
+		t.Fatal(err)
+	}
+	os := getDummyStore()
+	st, err := os.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(data string) *StoredObject {
+		so := newDummyObject(os, []byte(data))
+		if err := os.PutObject(so, bytes.NewReader([]byte(data)), int64(len(data))); err != nil {
+			t.Fatalf("Cannot put object: %s", err)
+		}
+		return so
+	}
+	expired := newDummyObject(os, []byte("expired"))
+	expired.Expiration = time.Now().Add(-time.Minute)
+	if err := os.PutObject(expired, bytes.NewReader([]byte("expired")), 7); err != nil {
+		t.Fatal(err)
+	}
+	kept := put("kept")
+	missing := put("missing")
+	if err := st.Delete(missing); err != nil {
+		t.Fatal(err)
+	}
+	orphan := newDummyObject(os, []byte("orphan"))
+	if err := st.Put(orphan, bytes.NewReader([]byte("orphan")), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	gc := NewGC(getDB(), nil)
+	gc.Grace = 0
+	for _, dryRun := range []bool{true, false} {
+		gc.DryRun = dryRun
+		r := gc.RunStore(os, time.Now())
+		if len(r.Errors) > 0 {
+			t.Errorf("[dry run %v] Unexpected errors %v", dryRun, r.Errors)
+		}
+		if len(r.Expired) != 1 || r.Expired[0] != expired.Id {
+			t.Errorf("[dry run %v] Unexpected expired objects %v", dryRun, r.Expired)
+		}
+		if len(r.Orphans) != 1 || r.Orphans[0] != orphan.getPath() {
+			t.Errorf("[dry run %v] Unexpected orphans %v", dryRun, r.Orphans)
+		}
+		if len(r.Missing) != 1 || r.Missing[0] != missing.Id {
+			t.Errorf("[dry run %v] Unexpected missing objects %v", dryRun, r.Missing)
+		}
+		_, err := st.Stat(orphan)
+		if dryRun && err != nil {
+			t.Errorf("Dry run removed the orphan blob: %v", err)
+		}
+		if !dryRun && err != ErrNotExists {
+			t.Errorf("Orphan blob was not removed: %v", err)
+		}
+	}
+	if _, err := os.GetObject(expired.Id); err == nil {
+		t.Error("Expired object was not deleted")
+	}
+	if _, err := st.Stat(expired); err != ErrNotExists {
+		t.Errorf("Blob of the expired object was not deleted: %v", err)
+	}
+	if _, err := st.Stat(kept); err != nil {
+		t.Errorf("Referenced blob was removed: %v", err)
+	}
+}
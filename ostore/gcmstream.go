@@ -0,0 +1,181 @@
+package ostore
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	//Plaintext bytes sealed together
+	GCM_CHUNK_SIZE  = 64 * 1024
+	GCM_PREFIX_SIZE = 7
+	GCM_KEY_SIZE    = 32
+)
+
+var ErrCorruptData = errors.New("Stored data is corrupt or was tampered with")
+
+// The nonce of each chunk is a random prefix, the chunk counter and a flag
+// marking the last chunk, so chunks can't be reordered, dropped or truncated
+func gcmNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, GCM_PREFIX_SIZE+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[GCM_PREFIX_SIZE:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(size int) []byte {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Encrypt a data key with the organization key
+func wrapKey(orgKey, dataKey []byte) ([]byte, error) {
+	aead, err := newGCM(orgKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := randomBytes(aead.NonceSize())
+	return aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+func unwrapKey(orgKey, wrapped []byte) ([]byte, error) {
+	aead, err := newGCM(orgKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrCorruptData
+	}
+	key, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrCorruptData
+	}
+	return key, nil
+}
+
+type gcmWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func newGCMWriter(w io.Writer, key, prefix []byte) (*gcmWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, GCM_CHUNK_SIZE)}, nil
+}
+
+func (gw *gcmWriter) seal(last bool) error {
+	out := gw.aead.Seal(nil, gcmNonce(gw.prefix, gw.counter, last), gw.buf, nil)
+	gw.counter++
+	gw.buf = gw.buf[:0]
+	_, err := gw.w.Write(out)
+	return err
+}
+
+func (gw *gcmWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		//A full chunk is only sealed once we know it is not the last one
+		if len(gw.buf) == GCM_CHUNK_SIZE {
+			if err := gw.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(gw.buf[len(gw.buf):GCM_CHUNK_SIZE], p)
+		gw.buf = gw.buf[:len(gw.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Seal the last chunk. It does not close the underlying writer
+func (gw *gcmWriter) Close() error {
+	return gw.seal(true)
+}
+
+type gcmReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	chunk   []byte
+	plain   []byte
+	done    bool
+}
+
+func newGCMReader(r io.Reader, key, prefix []byte) (*gcmReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		prefix: prefix,
+		chunk:  make([]byte, GCM_CHUNK_SIZE+aead.Overhead()),
+	}, nil
+}
+
+func (gr *gcmReader) next() error {
+	n, err := io.ReadFull(gr.r, gr.chunk)
+	last := false
+	switch err {
+	case nil:
+		_, err := gr.r.Peek(1)
+		last = err == io.EOF
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		//The last chunk is always there, even if empty
+		return ErrCorruptData
+	default:
+		return err
+	}
+	plain, err := gr.aead.Open(gr.plain[:0], gcmNonce(gr.prefix, gr.counter, last), gr.chunk[:n], nil)
+	if err != nil {
+		return ErrCorruptData
+	}
+	gr.plain = plain
+	gr.counter++
+	gr.done = last
+	return nil
+}
+
+func (gr *gcmReader) Read(p []byte) (int, error) {
+	for len(gr.plain) == 0 {
+		if gr.done {
+			return 0, io.EOF
+		}
+		if err := gr.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, gr.plain)
+	gr.plain = gr.plain[n:]
+	return n, nil
+}
@@ -0,0 +1,62 @@
+package ostore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestGCMStream(t *testing.T) {
+	key := randomBytes(GCM_KEY_SIZE)
+	prefix := randomBytes(GCM_PREFIX_SIZE)
+	for _, size := range []int{0, 10, GCM_CHUNK_SIZE, 2*GCM_CHUNK_SIZE + 1} {
+		data := randomBytes(size)
+		out := &bytes.Buffer{}
+		w, err := newGCMWriter(out, key, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		w.Close()
+		sealed := out.Bytes()
+
+		r, _ := newGCMReader(bytes.NewReader(sealed), key, prefix)
+		plain, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(plain, data) {
+			t.Errorf("[%d] Cannot read sealed data back: %v", size, err)
+		}
+
+		flipped := append([]byte{}, sealed...)
+		flipped[len(flipped)-1] ^= 1
+		tests := [][]byte{
+			flipped,
+			sealed[:len(sealed)-1],
+			[]byte{},
+		}
+		//Dropping whole chunks must be detected too
+		if size > GCM_CHUNK_SIZE {
+			tests = append(tests, sealed[:GCM_CHUNK_SIZE+16])
+		}
+		for i, tampered := range tests {
+			r, _ := newGCMReader(bytes.NewReader(tampered), key, prefix)
+			if _, err := ioutil.ReadAll(r); err != ErrCorruptData {
+				t.Errorf("[%d] #%d: Tampered data returned %v", size, i, err)
+			}
+		}
+	}
+}
+
+func TestWrapKey(t *testing.T) {
+	orgKey := randomBytes(GCM_KEY_SIZE)
+	dataKey := randomBytes(GCM_KEY_SIZE)
+	wrapped, err := wrapKey(orgKey, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := unwrapKey(orgKey, wrapped); err != nil || !bytes.Equal(key, dataKey) {
+		t.Errorf("Cannot unwrap key: %v", err)
+	}
+	if _, err := unwrapKey(randomBytes(GCM_KEY_SIZE), wrapped); err != ErrCorruptData {
+		t.Errorf("Unwrapping with another key returned %v", err)
+	}
+}
@@ -1,39 +1,223 @@
 package ostore
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"hash"
 	"io"
+	"strings"
+	"sync"
+
+	"lukechampine.com/blake3"
+)
+
+const (
+	HASH_SHA512 = "sha512"
+	HASH_SHA256 = "sha256"
+	HASH_MD5    = "md5"
+	HASH_BLAKE3 = "blake3"
+	//Algorithm assumed for hashes without prefix. Every object stored before
+	//hashes had prefixes is a bare SHA-512 hex digest
+	DEFAULT_HASH = HASH_SHA512
+	//Separates the algorithm from the hex digest as in "sha256:..."
+	HASH_SEPARATOR = ":"
 )
 
+var (
+	ErrUnknownHashAlgorithm = errors.New("Unknown hash algorithm")
+	ErrMalformedHash        = errors.New("Hash is not an hex digest of the expected length")
+	ErrHashNotComputed      = errors.New("Hash algorithm was not computed by the reader")
+)
+
+var (
+	hashAlgorithmsMutex sync.RWMutex
+	hashAlgorithms      = map[string]func() hash.Hash{
+		HASH_SHA512: sha512.New,
+		HASH_SHA256: sha256.New,
+		HASH_MD5:    md5.New,
+		HASH_BLAKE3: func() hash.Hash { return blake3.New(32, nil) },
+	}
+)
+
+// Make an algorithm available for prefixed hashes. Registering an existing
+// name replaces it
+func RegisterHashAlgorithm(name string, fn func() hash.Hash) {
+	hashAlgorithmsMutex.Lock()
+	defer hashAlgorithmsMutex.Unlock()
+	hashAlgorithms[strings.ToLower(name)] = fn
+}
+
+func newHash(alg string) (hash.Hash, error) {
+	hashAlgorithmsMutex.RLock()
+	defer hashAlgorithmsMutex.RUnlock()
+	fn, ok := hashAlgorithms[alg]
+	if !ok {
+		return nil, ErrUnknownHashAlgorithm
+	}
+	return fn(), nil
+}
+
+// Split a hash in algorithm and lower case hex digest. Hashes without prefix
+// are SHA-512
+func ParseHash(s string) (string, string, error) {
+	alg, digest := DEFAULT_HASH, s
+	if i := strings.Index(s, HASH_SEPARATOR); i > -1 {
+		alg, digest = strings.ToLower(s[:i]), s[i+len(HASH_SEPARATOR):]
+	}
+	h, err := newHash(alg)
+	if err != nil {
+		return "", "", err
+	}
+	digest = strings.ToLower(digest)
+	if raw, err := hex.DecodeString(digest); err != nil || len(raw) != h.Size() {
+		return "", "", ErrMalformedHash
+	}
+	return alg, digest, nil
+}
+
+// Format a digest the way it is stored. SHA-512 hashes are kept without
+// prefix so they match the blobs and paths of existing objects
+func FormatHash(alg string, digest []byte) string {
+	if alg == DEFAULT_HASH {
+		return hex.EncodeToString(digest)
+	}
+	return alg + HASH_SEPARATOR + hex.EncodeToString(digest)
+}
+
+// Canonical form of a hash so equal digests always compare equal
+func NormalizeHash(s string) (string, error) {
+	alg, digest, err := ParseHash(s)
+	if err != nil {
+		return "", err
+	}
+	if alg == DEFAULT_HASH {
+		return digest, nil
+	}
+	return alg + HASH_SEPARATOR + digest, nil
+}
+
+// Reader that computes one or more digests of the data going through it in a
+// single pass. The first algorithm is the one Digest and HexDigest return
 type HashReader struct {
-	h hash.Hash
-	r io.Reader
+	algs   []string
+	hashes map[string]hash.Hash
+	w      io.Writer
+	r      io.Reader
+	size   int64
 }
 
+// Reader computing only SHA-512
 func NewHashReader(r io.Reader) *HashReader {
-	return &HashReader{sha512.New(), r}
+	hr, _ := NewMultiHashReader(r, DEFAULT_HASH)
+	return hr
+}
+
+// Reader computing every given algorithm. Repeated algorithms are computed
+// once
+func NewMultiHashReader(r io.Reader, algs ...string) (*HashReader, error) {
+	if len(algs) == 0 {
+		algs = []string{DEFAULT_HASH}
+	}
+	hr := &HashReader{r: r, hashes: map[string]hash.Hash{}}
+	ws := []io.Writer{}
+	for _, alg := range algs {
+		alg = strings.ToLower(alg)
+		if _, ok := hr.hashes[alg]; ok {
+			continue
+		}
+		h, err := newHash(alg)
+		if err != nil {
+			return nil, err
+		}
+		hr.algs = append(hr.algs, alg)
+		hr.hashes[alg] = h
+		ws = append(ws, h)
+	}
+	hr.w = io.MultiWriter(ws...)
+	return hr, nil
+}
+
+// Reader computing SHA-512 plus the algorithms of the declared hashes so it
+// can verify all of them afterwards
+func NewVerifyingHashReader(r io.Reader, declared ...string) (*HashReader, error) {
+	algs := []string{DEFAULT_HASH}
+	for _, d := range declared {
+		alg, _, err := ParseHash(d)
+		if err != nil {
+			return nil, err
+		}
+		algs = append(algs, alg)
+	}
+	return NewMultiHashReader(r, algs...)
 }
 
 func (hr *HashReader) Read(p []byte) (int, error) {
 	n, err := hr.r.Read(p)
-	if err != nil {
-		return n, err
-	}
-	wn := 0
-	tn := 0
-	for wn, err = hr.h.Write(p[:n]); err != nil && wn < n; {
-		tn, err = hr.h.Write(p[wn:n])
-		wn += tn
+	if n > 0 {
+		//hash.Hash never returns an error on write
+		hr.w.Write(p[:n])
+		hr.size += int64(n)
 	}
 	return n, err
 }
 
 func (hr *HashReader) Digest() []byte {
-	return hr.h.Sum(nil)
+	return hr.Sum(hr.algs[0])
 }
 
 func (hr *HashReader) HexDigest() string {
 	return hex.EncodeToString(hr.Digest())
 }
+
+// Digest for the algorithm or nil if the reader does not compute it
+func (hr *HashReader) Sum(alg string) []byte {
+	h, ok := hr.hashes[strings.ToLower(alg)]
+	if !ok {
+		return nil
+	}
+	return h.Sum(nil)
+}
+
+// Digest for the algorithm in stored form or an empty string if the reader
+// does not compute it
+func (hr *HashReader) Hash(alg string) string {
+	alg = strings.ToLower(alg)
+	sum := hr.Sum(alg)
+	if sum == nil {
+		return ""
+	}
+	return FormatHash(alg, sum)
+}
+
+// Algorithms computed by the reader
+func (hr *HashReader) Algorithms() []string {
+	return append([]string{}, hr.algs...)
+}
+
+// Check the data read so far against every declared hash. Fails with
+// ErrHashMismatch if any of them differs
+func (hr *HashReader) Verify(declared ...string) error {
+	for _, d := range declared {
+		alg, digest, err := ParseHash(d)
+		if err != nil {
+			return err
+		}
+		sum := hr.Sum(alg)
+		if sum == nil {
+			return ErrHashNotComputed
+		}
+		if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum)), []byte(digest)) != 1 {
+			return ErrHashMismatch
+		}
+	}
+	return nil
+}
+
+// Number of bytes read so far
+func (hr *HashReader) Size() int64 {
+	return hr.size
+}
@@ -2,6 +2,12 @@ package ostore
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
 	"testing"
 )
 
@@ -48,3 +54,70 @@ func TestHashReader(t *testing.T) {
 		t.Error("Unexpected hash digest result: %s vs expected %s", hr.HexDigest(), HASH_EXPECTED)
 	}
 }
+
+func TestMultiHashReader(t *testing.T) {
+	hr, err := NewMultiHashReader(bytes.NewBufferString(HASH_TEST_DATA), HASH_SHA256, HASH_SHA512, HASH_MD5, HASH_BLAKE3, HASH_SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, hr); err != nil {
+		t.Fatal(err)
+	}
+	if algs := hr.Algorithms(); len(algs) != 4 || algs[0] != HASH_SHA256 {
+		t.Errorf("Unexpected algorithms %v", algs)
+	}
+	sha256Sum := sha256.Sum256([]byte(HASH_TEST_DATA))
+	md5Sum := md5.Sum([]byte(HASH_TEST_DATA))
+	if hr.HexDigest() != hex.EncodeToString(sha256Sum[:]) {
+		t.Errorf("Digest does not come from the first algorithm: %s", hr.HexDigest())
+	}
+	if hr.Hash(HASH_SHA512) != HASH_EXPECTED {
+		t.Errorf("SHA-512 hashes must not have a prefix: %s", hr.Hash(HASH_SHA512))
+	}
+	if hr.Hash(HASH_MD5) != "md5:"+hex.EncodeToString(md5Sum[:]) {
+		t.Errorf("Unexpected MD5 hash %s", hr.Hash(HASH_MD5))
+	}
+	if len(hr.Sum(HASH_BLAKE3)) != 32 {
+		t.Errorf("Unexpected BLAKE3 digest %x", hr.Sum(HASH_BLAKE3))
+	}
+	if err := hr.Verify(HASH_EXPECTED, "SHA256:"+strings.ToUpper(hex.EncodeToString(sha256Sum[:])), hr.Hash(HASH_MD5)); err != nil {
+		t.Errorf("Cannot verify declared hashes: %s", err)
+	}
+	if err := hr.Verify(HASH_EXPECTED, "md5:"+strings.Repeat("0", 32)); err != ErrHashMismatch {
+		t.Errorf("Wrong MD5 returned %v", err)
+	}
+	if _, err := NewMultiHashReader(nil, "crc32"); err != ErrUnknownHashAlgorithm {
+		t.Errorf("Unknown algorithm returned %v", err)
+	}
+	if hr, _ := NewMultiHashReader(nil, HASH_MD5); hr.Verify(HASH_EXPECTED) != ErrHashNotComputed {
+		t.Errorf("Verifying an algorithm that was not computed must fail")
+	}
+}
+
+func TestParseHash(t *testing.T) {
+	for i, c := range []struct {
+		hash   string
+		alg    string
+		digest string
+		err    error
+	}{
+		{HASH_EXPECTED, HASH_SHA512, HASH_EXPECTED, nil},
+		{"sha512:" + strings.ToUpper(HASH_EXPECTED), HASH_SHA512, HASH_EXPECTED, nil},
+		{"MD5:D41D8CD98F00B204E9800998ECF8427E", HASH_MD5, "d41d8cd98f00b204e9800998ecf8427e", nil},
+		{"sha256:d41d8cd98f00b204e9800998ecf8427e", "", "", ErrMalformedHash},
+		{"md5:zz1d8cd98f00b204e9800998ecf8427e", "", "", ErrMalformedHash},
+		{"abc", "", "", ErrMalformedHash},
+		{"whirlpool:abc", "", "", ErrUnknownHashAlgorithm},
+	} {
+		alg, digest, err := ParseHash(c.hash)
+		if err != c.err || alg != c.alg || digest != c.digest {
+			t.Errorf("#%d: Unexpected result %q %q %v", i, alg, digest, err)
+		}
+	}
+	if h, _ := NormalizeHash("sha512:" + strings.ToUpper(HASH_EXPECTED)); h != HASH_EXPECTED {
+		t.Errorf("SHA-512 hashes must normalize to bare digests: %s", h)
+	}
+	if h, _ := NormalizeHash("MD5:D41D8CD98F00B204E9800998ECF8427E"); h != "md5:d41d8cd98f00b204e9800998ecf8427e" {
+		t.Errorf("Unexpected normalized hash %s", h)
+	}
+}
@@ -0,0 +1,263 @@
+package ostore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store that keeps objects in memory. Meant for tests and single node setups
+type MemStore struct {
+	lock    sync.RWMutex
+	objects map[string]*memObject
+	//Objects being written. They count as existing for Put but not for Get
+	pending map[string]bool
+	uploads map[string]map[int][]byte
+}
+
+type memObject struct {
+	data []byte
+	info ObjectInfo
+}
+
+func init() {
+	RegisterBackend(STORE_TYPE_MEM, nil, func(c map[string]string) (Store, error) {
+		return NewMemStore(), nil
+	})
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		objects: make(map[string]*memObject),
+		pending: make(map[string]bool),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (ms *MemStore) Put(so *StoredObject, data io.Reader, length int64) error {
+	path := so.getPath()
+	ms.lock.Lock()
+	_, exists := ms.objects[path]
+	if exists || ms.pending[path] {
+		ms.lock.Unlock()
+		return ErrAlreadyExists
+	}
+	ms.pending[path] = true
+	ms.lock.Unlock()
+	defer func() {
+		ms.lock.Lock()
+		delete(ms.pending, path)
+		ms.lock.Unlock()
+	}()
+
+	buf := &bytes.Buffer{}
+	hr, err := NewVerifyingHashReader(data, so.dataHash())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(buf, hr); err != nil {
+		return err
+	}
+	if hr.Size() != length {
+		return ErrLengthMismatch
+	}
+	if err := hr.Verify(so.dataHash()); err != nil {
+		return err
+	}
+	ms.lock.Lock()
+	ms.objects[path] = &memObject{
+		data: buf.Bytes(),
+		info: ObjectInfo{Size: int64(buf.Len()), ModTime: time.Now(), Metadata: copyMetadata(so.Metadata)},
+	}
+	ms.lock.Unlock()
+	return nil
+}
+
+func copyMetadata(md map[string]string) map[string]string {
+	if md == nil {
+		return nil
+	}
+	out := make(map[string]string, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+	return out
+}
+
+func (ms *MemStore) get(so *StoredObject) (*memObject, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	obj, ok := ms.objects[so.getPath()]
+	if !ok {
+		return nil, ErrNotExists
+	}
+	return obj, nil
+}
+
+func (ms *MemStore) Get(so *StoredObject, data io.Writer) error {
+	obj, err := ms.get(so)
+	if err != nil {
+		return err
+	}
+	_, err = data.Write(obj.data)
+	return err
+}
+
+type memReader struct {
+	*bytes.Reader
+	info *ObjectInfo
+}
+
+func (r *memReader) Info() *ObjectInfo {
+	return r.info
+}
+
+func (r *memReader) Close() error {
+	return nil
+}
+
+func (ms *MemStore) Open(so *StoredObject) (ObjectReader, error) {
+	obj, err := ms.get(so)
+	if err != nil {
+		return nil, err
+	}
+	info := obj.info
+	info.Metadata = copyMetadata(info.Metadata)
+	return &memReader{bytes.NewReader(obj.data), &info}, nil
+}
+
+func (ms *MemStore) Stat(so *StoredObject) (*ObjectInfo, error) {
+	obj, err := ms.get(so)
+	if err != nil {
+		return nil, err
+	}
+	info := obj.info
+	info.Metadata = copyMetadata(info.Metadata)
+	return &info, nil
+}
+
+func (ms *MemStore) List(prefix, cursor string, limit int) (*ListPage, error) {
+	limit = listLimit(limit)
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	keys := []string{}
+	for key := range ms.objects {
+		if listIncludes(key, prefix, cursor) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	page := &ListPage{Objects: []ListEntry{}}
+	for _, key := range keys {
+		typ, hash, _ := parseObjectKey(key)
+		info := ms.objects[key].info
+		page.Objects = append(page.Objects, ListEntry{Type: typ, Hash: hash, Size: info.Size, ModTime: info.ModTime})
+		if len(page.Objects) == limit {
+			page.Next = key
+			break
+		}
+	}
+	return page, nil
+}
+
+func (ms *MemStore) Delete(so *StoredObject) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	path := so.getPath()
+	if _, ok := ms.objects[path]; !ok {
+		return ErrNotExists
+	}
+	delete(ms.objects, path)
+	return nil
+}
+
+func (ms *MemStore) InitiateUpload(so *StoredObject) (string, error) {
+	id := newObjectId()
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.uploads[id] = make(map[int][]byte)
+	return id, nil
+}
+
+func (ms *MemStore) UploadPart(so *StoredObject, uploadId string, n int, data io.Reader, length int64) error {
+	if err := checkPartNumber(n); err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	if _, err := io.Copy(buf, data); err != nil {
+		return err
+	}
+	if int64(buf.Len()) != length {
+		return ErrLengthMismatch
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	parts, ok := ms.uploads[uploadId]
+	if !ok {
+		return ErrUnknownUpload
+	}
+	parts[n] = buf.Bytes()
+	return nil
+}
+
+func (ms *MemStore) ListParts(so *StoredObject, uploadId string) ([]UploadPart, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	parts, ok := ms.uploads[uploadId]
+	if !ok {
+		return nil, ErrUnknownUpload
+	}
+	list := make([]UploadPart, 0, len(parts))
+	for n, data := range parts {
+		list = append(list, UploadPart{N: n, Size: int64(len(data))})
+	}
+	sort.Sort(uploadPartSlice(list))
+	return list, nil
+}
+
+func (ms *MemStore) OpenPart(so *StoredObject, uploadId string, n int) (io.ReadCloser, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	parts, ok := ms.uploads[uploadId]
+	if !ok {
+		return nil, ErrUnknownUpload
+	}
+	data, ok := parts[n]
+	if !ok {
+		return nil, ErrInvalidPart
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (ms *MemStore) CompleteUpload(so *StoredObject, uploadId string, length int64) error {
+	parts, err := ms.ListParts(so, uploadId)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return ErrNoParts
+	}
+	readers := make([]io.Reader, 0, len(parts))
+	ms.lock.RLock()
+	for _, p := range parts {
+		readers = append(readers, bytes.NewReader(ms.uploads[uploadId][p.N]))
+	}
+	ms.lock.RUnlock()
+	if err := ms.Put(so, io.MultiReader(readers...), length); err != nil {
+		return err
+	}
+	return ms.AbortUpload(so, uploadId)
+}
+
+func (ms *MemStore) AbortUpload(so *StoredObject, uploadId string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, ok := ms.uploads[uploadId]; !ok {
+		return ErrUnknownUpload
+	}
+	delete(ms.uploads, uploadId)
+	return nil
+}
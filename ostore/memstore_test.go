@@ -0,0 +1,29 @@
+package ostore_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/acasajus/menac/ostore"
+	"github.com/acasajus/menac/ostore/storetest"
+)
+
+func TestMemStore(t *testing.T) {
+	storetest.RunStoreTests(t, "MemStore", ostore.NewMemStore())
+}
+
+func TestMemStoreMetadata(t *testing.T) {
+	st := ostore.NewMemStore()
+	so, data := storetest.NewTestObject(16)
+	if err := st.Put(so, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	so.Metadata["Test"] = "changed"
+	info, err := st.Stat(so)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := info.Metadata["Test"]; v != "true" {
+		t.Errorf("Stored metadata is %q instead of %q", v, "true")
+	}
+}
@@ -0,0 +1,455 @@
+package ostore
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/acasajus/menac/db"
+)
+
+const (
+	MIGRATE_WORKERS = 4
+	//Objects migrated between checkpoint writes
+	MIGRATE_CHECKPOINT_EVERY = 100
+	MIGRATE_NAMES_LIMIT      = 1000
+	//Metadata of migrated objects whose blob in the source store is still
+	//referenced. It holds the source store name
+	META_MIGRATED_FROM = "Ostore-Migrated-From"
+)
+
+var (
+	ErrSameStore  = errors.New("Cannot migrate a store to itself")
+	ErrOtherOrg   = errors.New("Stores belong to different organizations")
+	ErrNotInStore = errors.New("Object is not in the source store anymore")
+)
+
+var migrateStats = expvar.NewMap("ostore.migrate")
+
+// Progress of the migration between two stores, kept so an interrupted run
+// can resume with its totals
+type MigrationCheckpoint struct {
+	db.Record
+
+	Organization string
+	From         string
+	To           string
+	Migrated     int64
+	Bytes        int64
+	//Ids of the objects that failed in the last run. They are retried
+	Failed   []string
+	Started  time.Time
+	Finished time.Time
+}
+
+func (c *MigrationCheckpoint) GetPrimaryKey() []byte {
+	return []byte(fmt.Sprintf("%s:%s:%s", c.Organization, c.From, c.To))
+}
+
+func (c *MigrationCheckpoint) Validate() error {
+	if len(c.Organization) == 0 {
+		return errors.New("Empty organization handle")
+	}
+	if len(c.From) == 0 || len(c.To) == 0 {
+		return errors.New("Empty store name")
+	}
+	return nil
+}
+
+// What a migration did, or what a diff found
+type MigrationReport struct {
+	From string
+	To   string
+	Diff bool
+	//Objects moved by this run and the bytes copied for them. Blobs already in
+	//the destination are referenced without copying
+	Migrated int64
+	Bytes    int64
+	//Source blobs of earlier runs released
+	Released int64
+	//Objects still in the source store
+	Pending int64
+	//Ids of the objects whose blob is not in the destination
+	Missing []string
+	//Ids of the objects whose blob in the destination does not match its hash
+	Mismatched []string
+	Names      int64
+	Errors     []string
+
+	lock sync.Mutex
+}
+
+func (r *MigrationReport) String() string {
+	return fmt.Sprintf("%s -> %s: %d migrated (%d bytes), %d released, %d names, %d pending, %d missing, %d mismatched, %d errors (diff %v)",
+		r.From, r.To, r.Migrated, r.Bytes, r.Released, r.Names, r.Pending, len(r.Missing), len(r.Mismatched), len(r.Errors), r.Diff)
+}
+
+func (r *MigrationReport) addError(format string, args ...interface{}) {
+	migrateStats.Add("errors", 1)
+	r.lock.Lock()
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+	r.lock.Unlock()
+}
+
+// Moves every object of a store to another store of the same organization
+type Migration struct {
+	from, to *ObjectStore
+	Workers  int
+	//Bytes per second read from the source, 0 disables the limit
+	Rate int64
+	//Release the blobs in the source store. Otherwise they stay referenced
+	//until a later run with DeleteSource or until the object is deleted
+	DeleteSource bool
+	//Only compare the stores. Verify reads the destination data back
+	Diff   bool
+	Verify bool
+}
+
+func NewMigration(from, to *ObjectStore) (*Migration, error) {
+	if from.Organization != to.Organization {
+		return nil, ErrOtherOrg
+	}
+	if from.Name == to.Name {
+		return nil, ErrSameStore
+	}
+	return &Migration{from: from, to: to, Workers: MIGRATE_WORKERS}, nil
+}
+
+// Store of the same organization
+func (os *ObjectStore) sibling(name string) (*ObjectStore, error) {
+	other := &ObjectStore{Organization: os.Organization, Name: name}
+	if err := os.GetDB().GetRecord(other.GetPrimaryKey(), other); err != nil {
+		return nil, err
+	}
+	return other, nil
+}
+
+func (m *Migration) checkpoint() (*MigrationCheckpoint, error) {
+	c := m.from.GetDB().LinkRecordToDB(&MigrationCheckpoint{
+		Organization: m.from.Organization,
+		From:         m.from.Name,
+		To:           m.to.Name,
+	}).(*MigrationCheckpoint)
+	err := c.GetDB().GetRecord(c.GetPrimaryKey(), c)
+	switch {
+	case err == nil:
+		c.Failed = nil
+		c.Finished = time.Time{}
+		return c, c.GetDB().ReplaceRecord(c)
+	case db.IsErrNotFound(err):
+		c.Started = time.Now()
+		return c, c.GetDB().CreateNewRecord(c)
+	}
+	return nil, err
+}
+
+// Last checkpoint of the migration between two stores
+func GetMigrationCheckpoint(from, to *ObjectStore) (*MigrationCheckpoint, error) {
+	c := &MigrationCheckpoint{Organization: from.Organization, From: from.Name, To: to.Name}
+	if err := from.GetDB().GetRecord(c.GetPrimaryKey(), c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Migrate the objects, or compare the stores if Diff is set
+func (m *Migration) Run() (*MigrationReport, error) {
+	report := &MigrationReport{From: m.from.Name, To: m.to.Name, Diff: m.Diff}
+	src, err := m.from.Open()
+	if err != nil {
+		return nil, err
+	}
+	dst, err := m.to.Open()
+	if err != nil {
+		return nil, err
+	}
+	t := newThrottle(m.Rate)
+	if m.Diff {
+		m.diff(dst, t, report)
+		return report, nil
+	}
+	migrateStats.Add("runs", 1)
+	c, err := m.checkpoint()
+	if err != nil {
+		return nil, err
+	}
+	if m.DeleteSource {
+		m.releaseSources(report)
+	}
+	var failed []string
+	var failedLock sync.Mutex
+	var cerr error
+	var done int64
+	m.each(&ObjectQuery{StoreName: m.from.Name}, report, func(so *StoredObject) {
+		n, err := m.migrate(so, src, t)
+		if err != nil {
+			report.addError("Cannot migrate %s: %s", so.Id, err)
+			failedLock.Lock()
+			failed = append(failed, so.Id)
+			failedLock.Unlock()
+			return
+		}
+		migrateStats.Add("objects", 1)
+		migrateStats.Add("bytes", n)
+		report.lock.Lock()
+		defer report.lock.Unlock()
+		report.Migrated++
+		report.Bytes += n
+		c.Migrated++
+		c.Bytes += n
+		if done++; done%MIGRATE_CHECKPOINT_EVERY == 0 && cerr == nil {
+			cerr = c.GetDB().ReplaceRecord(c)
+		}
+	})
+	m.migrateNames(report)
+	if cerr != nil {
+		return report, cerr
+	}
+	c.Failed = failed
+	c.Finished = time.Now()
+	return report, c.GetDB().ReplaceRecord(c)
+}
+
+// Call fn for every object matching the query from the workers
+func (m *Migration) each(q *ObjectQuery, report *MigrationReport, fn func(*StoredObject)) {
+	q.Organization = m.from.Organization
+	workers := m.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	objs := make(chan *StoredObject)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for so := range objs {
+				fn(so)
+			}
+		}()
+	}
+	err := q.Each(m.from.GetDB(), func(so *StoredObject) error {
+		objs <- so
+		return nil
+	})
+	close(objs)
+	wg.Wait()
+	if err != nil {
+		report.addError("Cannot query objects: %s", err)
+	}
+}
+
+// Copy the blob if the destination does not have it yet and switch the
+// record. Returns the bytes copied
+func (m *Migration) migrate(so *StoredObject, src Store, t *throttle) (int64, error) {
+	blob := m.to.blobFor(so)
+	acquired, err := blob.acquire(so.Size)
+	if err != nil {
+		return 0, err
+	}
+	copied := int64(0)
+	if !acquired {
+		r, err := src.Open(so)
+		if err != nil {
+			return 0, err
+		}
+		//Put verifies the data against the object hash
+		err = m.to.storeBlob(blob, so.User, &throttledReader{r, t}, so.Size)
+		r.Close()
+		if err != nil {
+			return 0, err
+		}
+		copied = so.Size
+	}
+	earlier, err := m.switchStore(so)
+	if err != nil {
+		m.to.releaseBlob(blob)
+		return 0, err
+	}
+	if len(earlier) > 0 {
+		if err := m.to.releaseSourceBlob(so, earlier); err != nil {
+			return copied, err
+		}
+	}
+	if m.DeleteSource {
+		if err := m.from.releaseBlob(m.from.blobFor(so)); err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// Point the record to the destination store, returning the store whose reference has to be released
+func (m *Migration) switchStore(so *StoredObject) (string, error) {
+	//How the destination keeps the blob, which may differ from the source
+	annotated := &StoredObject{Type: so.Type, Hash: so.Hash}
+	if err := m.to.annotate(annotated); err != nil {
+		return "", err
+	}
+	earlier := ""
+	err := updateRecord(so, func() error {
+		earlier = ""
+		if so.StoreName != m.from.Name {
+			return ErrNotInStore
+		}
+		if so.Metadata == nil {
+			so.Metadata = map[string]string{}
+		}
+		for _, k := range []string{META_COMPRESSION, META_ENCRYPTION} {
+			delete(so.Metadata, k)
+		}
+		for k, v := range annotated.Metadata {
+			so.Metadata[k] = v
+		}
+		if !m.DeleteSource {
+			earlier = so.Metadata[META_MIGRATED_FROM]
+			so.Metadata[META_MIGRATED_FROM] = m.from.Name
+		}
+		so.StoreName = m.to.Name
+		return nil
+	})
+	return earlier, err
+}
+
+// Drop the source blob references kept by earlier runs. The mark is removed
+// first so a failure can only leak a reference, never release it twice
+func (m *Migration) releaseSources(report *MigrationReport) {
+	q := &ObjectQuery{StoreName: m.to.Name, Metadata: map[string]string{META_MIGRATED_FROM: m.from.Name}}
+	m.each(q, report, func(so *StoredObject) {
+		if err := m.to.releaseMigrationSource(so); err != nil {
+			report.addError("Cannot release source blob of %s: %s", so.Id, err)
+			return
+		}
+		report.lock.Lock()
+		report.Released++
+		report.lock.Unlock()
+	})
+}
+
+func (os *ObjectStore) releaseMigrationSource(so *StoredObject) error {
+	from := ""
+	err := updateRecord(so, func() error {
+		from = so.Metadata[META_MIGRATED_FROM]
+		delete(so.Metadata, META_MIGRATED_FROM)
+		return nil
+	})
+	if err != nil || len(from) == 0 {
+		return err
+	}
+	return os.releaseSourceBlob(so, from)
+}
+
+func (os *ObjectStore) releaseSourceBlob(so *StoredObject, from string) error {
+	src, err := os.sibling(from)
+	if err != nil {
+		return err
+	}
+	return src.releaseBlob(src.blobFor(so))
+}
+
+// Move the names pointing to migrated objects along with their versions
+func (m *Migration) migrateNames(report *MigrationReport) {
+	cursor := ""
+	for {
+		//Deleted names still have versions to move
+		page, err := m.from.names("", cursor, MIGRATE_NAMES_LIMIT, true)
+		if err != nil {
+			report.addError("Cannot list names: %s", err)
+			return
+		}
+		for _, n := range page.Names {
+			if err := m.migrateName(n); err != nil {
+				report.addError("Cannot migrate name %s: %s", n.Name, err)
+				continue
+			}
+			report.Names++
+		}
+		if cursor = page.Next; len(cursor) == 0 {
+			return
+		}
+	}
+}
+
+func (m *Migration) migrateName(n *ObjectName) error {
+	versions, err := m.from.Versions(n.Name)
+	if err != nil {
+		return err
+	}
+	ids := []string{n.ObjectId}
+	for _, v := range versions {
+		ids = append(ids, v.ObjectId)
+	}
+	for _, id := range ids {
+		if len(id) == 0 {
+			continue
+		}
+		//Fails if not migrated yet
+		if _, err := m.to.GetObject(id); err != nil {
+			return err
+		}
+	}
+	dst := m.to.nameFor(n.Name)
+	err = upsertRecord(dst, func() { dst.ObjectId, dst.Version = "", 0 }, func() error {
+		if (len(dst.ObjectId) > 0 || dst.Version > 0) && (dst.ObjectId != n.ObjectId || dst.Version != n.Version) {
+			return fmt.Errorf("Already points to %s", dst.ObjectId)
+		}
+		dst.ObjectId, dst.Version = n.ObjectId, n.Version
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		moved := m.to.versionFor(n.Name, v.Version)
+		moved.ObjectId, moved.Created = v.ObjectId, v.Created
+		//Already there if a previous run stopped halfway
+		if err := m.to.GetDB().CreateNewRecord(moved); err != nil && !db.IsErrDuplicateKey(err) {
+			return err
+		}
+		if _, err := m.from.GetDB().DeleteRecord(v); err != nil {
+			return err
+		}
+	}
+	_, err = m.from.GetDB().DeleteRecord(n)
+	return err
+}
+
+// Objects still in the source are pending. Those in the destination are
+// checked to have their blob, read back and verified if Verify is set
+func (m *Migration) diff(dst Store, t *throttle, report *MigrationReport) {
+	m.each(&ObjectQuery{StoreName: m.from.Name}, report, func(so *StoredObject) {
+		report.lock.Lock()
+		report.Pending++
+		report.lock.Unlock()
+	})
+	m.each(&ObjectQuery{StoreName: m.to.Name}, report, func(so *StoredObject) {
+		err := m.checkObject(dst, so, t)
+		report.lock.Lock()
+		defer report.lock.Unlock()
+		switch {
+		case err == nil:
+		case err == ErrNotExists:
+			report.Missing = append(report.Missing, so.Id)
+		case isCorruption(err):
+			report.Mismatched = append(report.Mismatched, so.Id)
+		default:
+			report.Errors = append(report.Errors, fmt.Sprintf("Cannot check %s: %s", so.Id, err))
+		}
+	})
+}
+
+func (m *Migration) checkObject(st Store, so *StoredObject, t *throttle) error {
+	if m.Verify {
+		return verifyBlob(st, &Blob{Type: so.Type, Hash: so.Hash, Size: so.Size}, t)
+	}
+	info, err := st.Stat(so)
+	if err != nil {
+		return err
+	}
+	if info.Size != so.Size {
+		return ErrLengthMismatch
+	}
+	return nil
+}
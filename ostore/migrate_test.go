@@ -0,0 +1,180 @@
+package ostore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNewMigration(t *testing.T) {
+	a := &ObjectStore{Organization: "org", Name: "a"}
+	if _, err := NewMigration(a, &ObjectStore{Organization: "org", Name: "a"}); err != ErrSameStore {
+		t.Errorf("Migrating a store to itself returned %v", err)
+	}
+	if _, err := NewMigration(a, &ObjectStore{Organization: "other", Name: "b"}); err != ErrOtherOrg {
+		t.Errorf("Migrating to another organization returned %v", err)
+	}
+	if m, err := NewMigration(a, &ObjectStore{Organization: "org", Name: "b"}); err != nil || m.Workers != MIGRATE_WORKERS {
+		t.Errorf("Unexpected migration %+v %v", m, err)
+	}
+}
+
+func TestMigration(t *testing.T) {
+	if err := RegisterIndexes(getDB()); err != nil {
+		t.Fatal(err)
+	}
+	from := getDummyStore()
+	if err := from.Create(); err != nil {
+		t.Fatal(err)
+	}
+	to := getDB().LinkRecordToDB(&ObjectStore{Organization: from.Organization, Name: "mem2", Type: STORE_TYPE_MEM}).(*ObjectStore)
+	if err := to.Create(); err != nil {
+		t.Fatal(err)
+	}
+	src, err := from.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := to.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := [][]byte{[]byte("migrated sandbox"), []byte("shared sandbox")}
+	objs := []*StoredObject{}
+	for _, d := range data {
+		so := newDummyObject(from, d)
+		if err := from.PutObject(so, bytes.NewReader(d), int64(len(d))); err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, so)
+	}
+	if _, err := from.SetName("named", objs[0]); err != nil {
+		t.Fatal(err)
+	}
+	//The destination already has the second blob so it is not copied
+	shared := newDummyObject(to, data[1])
+	if err := to.PutObject(shared, bytes.NewReader(data[1]), int64(len(data[1]))); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMigration(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Diff = true
+	if r, err := m.Run(); err != nil || r.Pending != 2 || len(r.Missing) != 0 {
+		t.Errorf("Unexpected diff before migrating %s %v", r, err)
+	}
+
+	m.Diff = false
+	r, err := m.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Migrated != 2 || r.Bytes != int64(len(data[0])) || r.Names != 1 || len(r.Errors) > 0 {
+		t.Errorf("Unexpected migration %s %v", r, r.Errors)
+	}
+	for i, so := range objs {
+		if _, err := from.GetObject(so.Id); err != ErrNotExists {
+			t.Errorf("#%d: Object is still in the source store: %v", i, err)
+		}
+		moved, err := to.GetObject(so.Id)
+		if err != nil {
+			t.Fatalf("#%d: Cannot get migrated object: %s", i, err)
+		}
+		if moved.Metadata[META_MIGRATED_FROM] != from.Name {
+			t.Errorf("#%d: Migrated object is not marked %v", i, moved.Metadata)
+		}
+		buf := &bytes.Buffer{}
+		if err := dst.Get(moved, buf); err != nil || !bytes.Equal(buf.Bytes(), data[i]) {
+			t.Errorf("#%d: Unexpected migrated data %q %v", i, buf, err)
+		}
+		if _, err := src.Stat(so); err != nil {
+			t.Errorf("#%d: Source data was deleted: %v", i, err)
+		}
+	}
+	if so, err := to.Resolve("named"); err != nil || so.Id != objs[0].Id {
+		t.Errorf("Name was not migrated: %v %v", so, err)
+	}
+	if _, err := from.Resolve("named"); err != ErrNotExists {
+		t.Errorf("Name is still in the source store: %v", err)
+	}
+	if r, err := m.Run(); err != nil || r.Migrated != 0 {
+		t.Errorf("Resumed migration moved objects again: %s %v", r, err)
+	}
+	if c, err := GetMigrationCheckpoint(from, to); err != nil || c.Migrated != 2 || c.Finished.IsZero() {
+		t.Errorf("Unexpected checkpoint %+v %v", c, err)
+	}
+
+	corruptMemBlob(t, dst, objs[0])
+	m.Diff, m.Verify = true, true
+	if r, err := m.Run(); err != nil || r.Pending != 0 || len(r.Mismatched) != 1 || r.Mismatched[0] != objs[0].Id {
+		t.Errorf("Unexpected verification %s %v", r, err)
+	}
+
+	m.Diff, m.Verify, m.DeleteSource = false, false, true
+	if r, err := m.Run(); err != nil || r.Released != 2 {
+		t.Errorf("Unexpected source release %s %v", r, err)
+	}
+	for i, so := range objs {
+		if _, err := src.Stat(so); err != ErrNotExists {
+			t.Errorf("#%d: Source data was not deleted: %v", i, err)
+		}
+		moved, err := to.GetObject(so.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := moved.Metadata[META_MIGRATED_FROM]; ok {
+			t.Errorf("#%d: Released object is still marked", i)
+		}
+	}
+}
+
+func TestMigrationChain(t *testing.T) {
+	if err := RegisterIndexes(getDB()); err != nil {
+		t.Fatal(err)
+	}
+	a := getDummyStore()
+	if err := a.Create(); err != nil {
+		t.Fatal(err)
+	}
+	stores := []*ObjectStore{a}
+	for _, name := range []string{"mem2", "mem3"} {
+		os := getDB().LinkRecordToDB(&ObjectStore{Organization: a.Organization, Name: name, Type: STORE_TYPE_MEM}).(*ObjectStore)
+		if err := os.Create(); err != nil {
+			t.Fatal(err)
+		}
+		stores = append(stores, os)
+	}
+	data := []byte("twice migrated sandbox")
+	so := newDummyObject(a, data)
+	if err := a.PutObject(so, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		m, err := NewMigration(stores[i], stores[i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r, err := m.Run(); err != nil || r.Migrated != 1 {
+			t.Fatalf("#%d: Unexpected migration %s %v", i, r, err)
+		}
+	}
+	moved, err := stores[2].GetObject(so.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Metadata[META_MIGRATED_FROM] != stores[1].Name {
+		t.Errorf("Unexpected mark %v", moved.Metadata)
+	}
+	//Only the last source keeps its reference
+	for i, st := range stores[:2] {
+		blob := st.blobFor(so)
+		err := getDB().GetRecord(blob.GetPrimaryKey(), blob)
+		switch {
+		case i == 0 && err == nil:
+			t.Errorf("First source still references the blob %+v", blob)
+		case i == 1 && (err != nil || blob.Refs != 1):
+			t.Errorf("Last source does not reference the blob %+v %v", blob, err)
+		}
+	}
+}
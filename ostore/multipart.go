@@ -0,0 +1,348 @@
+package ostore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/acasajus/menac/db"
+)
+
+const (
+	UPLOAD_MAX_PARTS = 10000
+	//Uploads not completed after this long are aborted by the GC
+	UPLOAD_EXPIRY = 7 * 24 * time.Hour
+)
+
+var (
+	ErrUnknownUpload = errors.New("Upload does not exist")
+	ErrInvalidPart   = errors.New("Invalid part number")
+	ErrNoParts       = errors.New("Upload has no parts")
+	ErrNoMultipart   = errors.New("Store does not support multipart uploads")
+	//The backend assembles the parts, so they cannot be compressed or encrypted
+	ErrTransformMultipart = errors.New("Multipart uploads are not available for compressed or encrypted stores")
+	ErrUploadCompleted    = errors.New("Upload is already completed")
+	ErrUnverifiedParts    = errors.New("Store cannot read back the parts to check them against the stored blob")
+)
+
+type UploadPart struct {
+	N    int
+	Size int64
+}
+
+type uploadPartSlice []UploadPart
+
+func (p uploadPartSlice) Len() int           { return len(p) }
+func (p uploadPartSlice) Less(i, j int) bool { return p[i].N < p[j].N }
+func (p uploadPartSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Stores that can receive an object in parts numbered from 1 to UPLOAD_MAX_PARTS
+type MultipartStore interface {
+	InitiateUpload(so *StoredObject) (string, error)
+	UploadPart(so *StoredObject, uploadId string, n int, data io.Reader, length int64) error
+	ListParts(so *StoredObject, uploadId string) ([]UploadPart, error)
+	CompleteUpload(so *StoredObject, uploadId string, length int64) error
+	AbortUpload(so *StoredObject, uploadId string) error
+}
+
+// Multipart stores that can read back an uploaded part
+type partOpener interface {
+	OpenPart(so *StoredObject, uploadId string, n int) (io.ReadCloser, error)
+}
+
+func checkPartNumber(n int) error {
+	if n < 1 || n > UPLOAD_MAX_PARTS {
+		return ErrInvalidPart
+	}
+	return nil
+}
+
+// Upload of an object in progress. It keeps the fields of the object that
+// will be created once it completes
+type Upload struct {
+	db.Record
+
+	Id           string
+	Organization string `db:"indexed"`
+	StoreName    string
+	//Id of the upload in the backend
+	BackendId string
+
+	ObjectId   string
+	User       string
+	Group      string
+	Type       string
+	Hash       string
+	Length     int64
+	Expiration time.Time
+	Metadata   map[string]string
+
+	store     *ObjectStore
+	completed *StoredObject
+}
+
+func (u *Upload) GetPrimaryKey() []byte {
+	return []byte(fmt.Sprintf("%s:%s", u.Organization, u.Id))
+}
+
+func (u *Upload) Validate() error {
+	if len(u.Organization) == 0 {
+		return errors.New("Empty organization handle")
+	}
+	if len(u.Id) == 0 {
+		return errors.New("Empty upload id")
+	}
+	if len(u.StoreName) == 0 {
+		return errors.New("Empty store name")
+	}
+	if len(u.Hash) == 0 {
+		return errors.New("Empty hash")
+	}
+	return nil
+}
+
+func (u *Upload) object() *StoredObject {
+	so := u.store.NewObject()
+	so.Id = u.ObjectId
+	so.User = u.User
+	so.Group = u.Group
+	so.Type = u.Type
+	so.Hash = u.Hash
+	so.Expiration = u.Expiration
+	so.Metadata = u.Metadata
+	return so
+}
+
+func (os *ObjectStore) multipartStore() (MultipartStore, error) {
+	st, err := os.Open()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMultipart(st); err != nil {
+		return nil, err
+	}
+	//Parts still go through the transfer manager
+	return uncached(st).(MultipartStore), nil
+}
+
+// Start uploading an object in parts. Quotas are checked here but only
+// reserved when the upload completes
+func (os *ObjectStore) InitiateUpload(so *StoredObject, length int64) (*Upload, error) {
+	if err := so.Validate(); err != nil {
+		return nil, err
+	}
+	so.Hash, _ = NormalizeHash(so.Hash)
+	res, err := os.reserveQuota(so, length)
+	if err != nil {
+		return nil, err
+	}
+	u := os.GetDB().LinkRecordToDB(&Upload{
+		Id:           newObjectId(),
+		Organization: os.Organization,
+		StoreName:    os.Name,
+		ObjectId:     so.Id,
+		User:         so.User,
+		Group:        so.Group,
+		Type:         so.Type,
+		Hash:         so.Hash,
+		Length:       length,
+		Expiration:   so.Expiration,
+		Metadata:     so.Metadata,
+		store:        os,
+	}).(*Upload)
+	if err := res.release(); err != nil {
+		return nil, err
+	}
+	ms, err := os.multipartStore()
+	if err != nil {
+		return nil, err
+	}
+	if u.BackendId, err = ms.InitiateUpload(so); err != nil {
+		return nil, err
+	}
+	if err := os.GetDB().CreateNewRecord(u); err != nil {
+		ms.AbortUpload(so, u.BackendId)
+		return nil, err
+	}
+	return u, nil
+}
+
+func (os *ObjectStore) GetUpload(id string) (*Upload, error) {
+	u := &Upload{Organization: os.Organization, Id: id}
+	if err := os.GetDB().GetRecord(u.GetPrimaryKey(), u); err != nil {
+		if db.IsErrNotFound(err) {
+			return nil, ErrUnknownUpload
+		}
+		return nil, err
+	}
+	if u.StoreName != os.Name {
+		return nil, ErrUnknownUpload
+	}
+	u.store = os
+	return u, nil
+}
+
+// Whether the object has been created
+func (u *Upload) Completed() bool {
+	return u.completed != nil
+}
+
+func (u *Upload) UploadPart(n int, data io.Reader, length int64) error {
+	if u.completed != nil {
+		return ErrUploadCompleted
+	}
+	if err := checkPartNumber(n); err != nil {
+		return err
+	}
+	ms, err := u.store.multipartStore()
+	if err != nil {
+		return err
+	}
+	return ms.UploadPart(u.object(), u.BackendId, n, data, length)
+}
+
+// Parts already uploaded, sorted by number. Used to resume an upload
+func (u *Upload) Parts() ([]UploadPart, error) {
+	if u.completed != nil {
+		return []UploadPart{}, nil
+	}
+	ms, err := u.store.multipartStore()
+	if err != nil {
+		return nil, err
+	}
+	parts, err := ms.ListParts(u.object(), u.BackendId)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(uploadPartSlice(parts))
+	return parts, nil
+}
+
+// Assemble the parts and create the object, checking them against the blob if it is already stored
+func (u *Upload) Complete() (*StoredObject, error) {
+	if u.completed != nil {
+		return u.completed, nil
+	}
+	ms, err := u.store.multipartStore()
+	if err != nil {
+		return nil, err
+	}
+	so := u.object()
+	res, err := u.store.reserveQuota(so, u.Length)
+	if err != nil {
+		return nil, err
+	}
+	blob := u.store.blobFor(so)
+	acquired, err := blob.acquire(u.Length)
+	if err != nil {
+		res.release()
+		return nil, err
+	}
+	if acquired {
+		if err := u.verifyParts(ms, so); err != nil {
+			u.store.releaseBlob(blob)
+			res.release()
+			return nil, err
+		}
+		ms.AbortUpload(so, u.BackendId)
+	} else {
+		err := ms.CompleteUpload(so, u.BackendId, u.Length)
+		if err != nil && err != ErrAlreadyExists {
+			res.release()
+			return nil, err
+		}
+		if err == ErrAlreadyExists {
+			if err := u.verifyParts(ms, so); err != nil {
+				res.release()
+				return nil, err
+			}
+			ms.AbortUpload(so, u.BackendId)
+		}
+		if err := u.store.createBlob(blob, u.Length); err != nil {
+			res.release()
+			return nil, err
+		}
+	}
+	so.Size = u.Length
+	if err := so.Create(); err != nil {
+		u.store.releaseBlob(blob)
+		res.release()
+		return nil, err
+	}
+	u.GetDB().DeleteRecord(u)
+	u.completed = so
+	publish(EVENT_CREATE, so)
+	res.commitCreated(so)
+	return so, nil
+}
+
+// Check the uploaded parts are the data of the stored blob
+func (u *Upload) verifyParts(ms MultipartStore, so *StoredObject) error {
+	po, ok := ms.(partOpener)
+	if !ok {
+		return ErrUnverifiedParts
+	}
+	parts, err := ms.ListParts(so, u.BackendId)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return ErrNoParts
+	}
+	sort.Sort(uploadPartSlice(parts))
+	readers := make([]io.Reader, 0, len(parts))
+	for _, p := range parts {
+		r, err := po.OpenPart(so, u.BackendId, p.N)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		readers = append(readers, r)
+	}
+	return verifyUpload(io.MultiReader(readers...), so.Hash, u.Length)
+}
+
+func (u *Upload) Abort() error {
+	if u.completed != nil {
+		return ErrUploadCompleted
+	}
+	ms, err := u.store.multipartStore()
+	if err != nil {
+		return err
+	}
+	if err := ms.AbortUpload(u.object(), u.BackendId); err != nil && err != ErrUnknownUpload {
+		return err
+	}
+	_, err = u.GetDB().DeleteRecord(u)
+	return err
+}
+
+// Abort the uploads of this store started before the given time
+func (os *ObjectStore) ExpireUploads(before time.Time, dryRun bool) ([]string, error) {
+	expired := []*Upload{}
+	for sr := range os.GetDB().Search(&Upload{}, "Organization", os.Organization) {
+		if sr.Error != nil {
+			return nil, sr.Error
+		}
+		u, ok := sr.Record.(*Upload)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected struct type came out of the pipe %#v", sr.Record))
+		}
+		if u.StoreName == os.Name && u.GetCreatedAt().Before(before) {
+			u.store = os
+			expired = append(expired, u)
+		}
+	}
+	ids := []string{}
+	for _, u := range expired {
+		if !dryRun {
+			if err := u.Abort(); err != nil {
+				return ids, err
+			}
+		}
+		ids = append(ids, u.Id)
+	}
+	return ids, nil
+}
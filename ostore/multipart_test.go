@@ -0,0 +1,92 @@
+package ostore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestUploadComplete(t *testing.T) {
+	os := getDummyStore()
+	data := []byte("first part,second part")
+	so := newDummyObject(os, data)
+	u, err := os.InitiateUpload(so, int64(len(data)))
+	if err != nil {
+		t.Fatalf("Cannot initiate upload: %s", err)
+	}
+	if u.Completed() {
+		t.Fatal("New blob upload was completed right away")
+	}
+	if err := u.UploadPart(2, bytes.NewReader(data[11:]), int64(len(data[11:]))); err != nil {
+		t.Fatal(err)
+	}
+	//Resume from another handle
+	u, err = os.GetUpload(u.Id)
+	if err != nil {
+		t.Fatalf("Cannot get upload: %s", err)
+	}
+	if parts, err := u.Parts(); err != nil || len(parts) != 1 || parts[0].N != 2 {
+		t.Errorf("Unexpected parts %v (%v)", parts, err)
+	}
+	if err := u.UploadPart(1, bytes.NewReader(data[:11]), 11); err != nil {
+		t.Fatal(err)
+	}
+	done, err := u.Complete()
+	if err != nil {
+		t.Fatalf("Cannot complete upload: %s", err)
+	}
+	if done.Id != so.Id || done.Size != int64(len(data)) {
+		t.Errorf("Unexpected object %+v", done)
+	}
+	if _, err := os.GetUpload(u.Id); err != ErrUnknownUpload {
+		t.Errorf("Completed upload still exists: %v", err)
+	}
+
+	//Parts of a stored blob are checked against it
+	other := newDummyObject(os, data)
+	u, err = os.InitiateUpload(other, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Completed() {
+		t.Fatal("Upload of a stored blob was completed without any data")
+	}
+	forged := bytes.Repeat([]byte("x"), len(data))
+	if err := u.UploadPart(1, bytes.NewReader(forged), int64(len(forged))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Complete(); err != ErrHashMismatch {
+		t.Errorf("Completing with other data returned %v", err)
+	}
+	if err := u.UploadPart(1, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Complete(); err != nil {
+		t.Fatalf("Cannot complete upload of a stored blob: %s", err)
+	}
+	if _, err := os.GetObject(other.Id); err != nil {
+		t.Errorf("Object of completed upload was not created: %s", err)
+	}
+}
+
+func TestExpireUploads(t *testing.T) {
+	if err := RegisterIndexes(getDB()); err != nil {
+		t.Fatal(err)
+	}
+	os := getDummyStore()
+	so := newDummyObject(os, []byte("abandoned"))
+	u, err := os.InitiateUpload(so, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := os.ExpireUploads(time.Now().Add(-time.Hour), false); err != nil || len(ids) != 0 {
+		t.Errorf("Expired recent uploads %v (%v)", ids, err)
+	}
+	ids, err := os.ExpireUploads(time.Now().Add(time.Hour), false)
+	if err != nil || len(ids) != 1 || ids[0] != u.Id {
+		t.Errorf("Unexpected expired uploads %v (%v)", ids, err)
+	}
+	if _, err := os.GetUpload(u.Id); err != ErrUnknownUpload {
+		t.Errorf("Expired upload still exists: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package ostore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/acasajus/menac/db"
+)
+
+// Name under which an object can be found in its store. An empty ObjectId means it was deleted
+type ObjectName struct {
+	db.Record
+
+	Organization string `db:"indexed"`
+	StoreName    string
+	Name         string
+	ObjectId     string `db:"indexed"`
+	//Number of the last version created. Names created before versioning
+	//start at 0 without a version record
+	Version int64
+}
+
+func (n *ObjectName) GetPrimaryKey() []byte {
+	return []byte(fmt.Sprintf("%s:%s:%s", n.Organization, n.StoreName, n.Name))
+}
+
+func (n *ObjectName) Validate() error {
+	if len(n.Organization) == 0 {
+		return errors.New("Empty organization handle")
+	}
+	if len(n.StoreName) == 0 {
+		return errors.New("Empty store name")
+	}
+	if len(n.Name) == 0 {
+		return errors.New("Empty name")
+	}
+	return nil
+}
+
+func (n *ObjectName) Deleted() bool {
+	return len(n.ObjectId) == 0
+}
+
+// One page of names sorted alphabetically. Pass Next as cursor to get the
+// following one. It is empty on the last page
+type NamePage struct {
+	Names []*ObjectName
+	Next  string
+}
+
+type objectNameSlice []*ObjectName
+
+func (s objectNameSlice) Len() int           { return len(s) }
+func (s objectNameSlice) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s objectNameSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (os *ObjectStore) nameFor(name string) *ObjectName {
+	return os.GetDB().LinkRecordToDB(&ObjectName{
+		Organization: os.Organization,
+		StoreName:    os.Name,
+		Name:         name,
+	}).(*ObjectName)
+}
+
+func (os *ObjectStore) getName(name string) (*ObjectName, error) {
+	n := os.nameFor(name)
+	if err := os.GetDB().GetRecord(n.GetPrimaryKey(), n); err != nil {
+		if db.IsErrNotFound(err) {
+			return nil, ErrNotExists
+		}
+		return nil, err
+	}
+	return n, nil
+}
+
+// The object a name points to, or nil if it is gone
+func (os *ObjectStore) namedObject(n *ObjectName) (*StoredObject, error) {
+	so, err := os.GetObject(n.ObjectId)
+	if err != nil {
+		if db.IsErrNotFound(err) || err == ErrNotExists {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return so, nil
+}
+
+// Point a name to an object. Returns the objects no longer referenced by any kept version
+func (os *ObjectStore) SetName(name string, so *StoredObject) ([]*StoredObject, error) {
+	if so.StoreName != os.Name {
+		return nil, errors.New("Object belongs to another store")
+	}
+	return os.newVersion(name, so.Id)
+}
+
+// Object a name points to. Fails with ErrNotExists if the name or the object
+// do not exist or the name was deleted
+func (os *ObjectStore) Resolve(name string) (*StoredObject, error) {
+	n, err := os.getName(name)
+	if err != nil {
+		return nil, err
+	}
+	if n.Deleted() {
+		return nil, ErrNotExists
+	}
+	so, err := os.namedObject(n)
+	if err != nil {
+		return nil, err
+	}
+	if so == nil {
+		return nil, ErrNotExists
+	}
+	return so, nil
+}
+
+// Delete a name by adding a delete marker as its new version
+func (os *ObjectStore) Unname(name string) ([]*StoredObject, error) {
+	n, err := os.getName(name)
+	if err != nil {
+		return nil, err
+	}
+	if n.Deleted() {
+		return nil, ErrNotExists
+	}
+	return os.newVersion(name, "")
+}
+
+// Names starting with prefix and after cursor, sorted. Deleted names are
+// skipped
+func (os *ObjectStore) Names(prefix, cursor string, limit int) (*NamePage, error) {
+	return os.names(prefix, cursor, limit, false)
+}
+
+func (os *ObjectStore) names(prefix, cursor string, limit int, deleted bool) (*NamePage, error) {
+	limit = listLimit(limit)
+	names := []*ObjectName{}
+	for sr := range os.GetDB().Search(&ObjectName{}, "Organization", os.Organization) {
+		if sr.Error != nil {
+			return nil, sr.Error
+		}
+		n, ok := sr.Record.(*ObjectName)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected struct type came out of the pipe %#v", sr.Record))
+		}
+		if n.Deleted() && !deleted {
+			continue
+		}
+		if n.StoreName == os.Name && strings.HasPrefix(n.Name, prefix) && n.Name > cursor {
+			names = append(names, n)
+		}
+	}
+	sort.Sort(objectNameSlice(names))
+	page := &NamePage{Names: names}
+	if len(names) > limit {
+		page.Names = names[:limit]
+		page.Next = names[limit-1].Name
+	}
+	return page, nil
+}
@@ -2,14 +2,19 @@ package ostore
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 
 	"github.com/acasajus/menac/db"
 	"github.com/acasajus/menac/registry"
 )
 
 const (
-	STORE_TYPE_SWIFT = iota
-	STORE_TYPE_S3    = iota
+	STORE_TYPE_SWIFT = "swift"
+	STORE_TYPE_S3    = "s3"
+	STORE_TYPE_FS    = "fs"
+	STORE_TYPE_MEM   = "mem"
 )
 
 type ObjectStore struct {
@@ -17,12 +22,29 @@ type ObjectStore struct {
 
 	Organization string
 	Name         string
-	Type         int
-	data         map[string]string
+	Type         string
+	Config       map[string]string
+	//Versions kept per name, the current one included. 0 keeps only the
+	//current one and VERSIONS_UNLIMITED keeps them all
+	MaxVersions int64
+	//Days a replaced version is kept. 0 keeps it until MaxVersions drops it
+	VersionDays int64
 }
 
 func NewObjectStore(o *registry.Organization) *ObjectStore {
-	return o.GetDB().LinkRecordToDB(&ObjectStore{}).(*ObjectStore)
+	return o.GetDB().LinkRecordToDB(&ObjectStore{Organization: o.Handle}).(*ObjectStore)
+}
+
+func GetObjectStore(o *registry.Organization, name string) (*ObjectStore, error) {
+	os := &ObjectStore{Organization: o.Handle, Name: name}
+	if err := o.GetDB().GetRecord(os.GetPrimaryKey(), os); err != nil {
+		return nil, err
+	}
+	return os, nil
+}
+
+func (so *ObjectStore) GetPrimaryKey() []byte {
+	return []byte(fmt.Sprintf("%s:%s", so.Organization, so.Name))
 }
 
 func (so *ObjectStore) Create() error {
@@ -30,7 +52,11 @@ func (so *ObjectStore) Create() error {
 }
 
 func (so *ObjectStore) Store() error {
-	return so.GetDB().ReplaceRecord(so)
+	if err := so.GetDB().ReplaceRecord(so); err != nil {
+		return err
+	}
+	forgetStore(string(so.GetPrimaryKey()))
+	return nil
 }
 
 func (so *ObjectStore) Validate() error {
@@ -40,13 +66,226 @@ func (so *ObjectStore) Validate() error {
 	if len(so.Name) == 0 {
 		return errors.New("Empty store name")
 	}
-	return nil
+	if so.MaxVersions < VERSIONS_UNLIMITED {
+		return errors.New("Invalid number of versions")
+	}
+	if so.VersionDays < 0 {
+		return errors.New("Invalid days to keep versions")
+	}
+	b, err := getBackend(so.Type)
+	if err != nil {
+		return err
+	}
+	config, transform := splitTransformOptions(so.Config)
+	if err := b.checkTransform(transform); err != nil {
+		return err
+	}
+	config, cache, err := splitCacheOptions(config)
+	if err != nil {
+		return err
+	}
+	if err := checkCache(cache, transform); err != nil {
+		return err
+	}
+	_, err = b.validate(config)
+	return err
+}
+
+// Get an initialized backend for this store. Backends are shared by all the
+// records of the same organization and store name
+func (so *ObjectStore) Open() (Store, error) {
+	if err := so.Validate(); err != nil {
+		return nil, err
+	}
+	return openStore(so)
 }
 
 func (os *ObjectStore) NewObject() *StoredObject {
 	return os.GetDB().LinkRecordToDB(&StoredObject{
+		Id:           newObjectId(),
 		Organization: os.Organization,
 		StoreName:    os.Name,
 		store:        os,
 	}).(*StoredObject)
-}
\ No newline at end of file
+}
+
+func (os *ObjectStore) GetObject(id string) (*StoredObject, error) {
+	so := &StoredObject{Organization: os.Organization, Id: id}
+	if err := os.GetDB().GetRecord(so.GetPrimaryKey(), so); err != nil {
+		return nil, err
+	}
+	if so.StoreName != os.Name {
+		return nil, ErrNotExists
+	}
+	so.store = os
+	return so, nil
+}
+
+// Create the object record and reference its blob, checking the quotas first
+func (os *ObjectStore) PutObject(so *StoredObject, data io.Reader, length int64) error {
+	if err := so.Validate(); err != nil {
+		return err
+	}
+	so.Hash, _ = NormalizeHash(so.Hash)
+	res, err := os.reserveQuota(so, length)
+	if err != nil {
+		return err
+	}
+	blob := os.blobFor(so)
+	acquired, err := blob.acquire(length)
+	if err != nil {
+		res.release()
+		return err
+	}
+	if acquired {
+		if err := verifyUpload(data, so.Hash, length); err != nil {
+			os.releaseBlob(blob)
+			res.release()
+			return err
+		}
+	} else if err := os.storeBlob(blob, so.User, data, length); err != nil {
+		res.release()
+		return err
+	}
+	so.Size = length
+	if err := os.annotate(so); err != nil {
+		os.releaseBlob(blob)
+		res.release()
+		return err
+	}
+	if err := so.Create(); err != nil {
+		os.releaseBlob(blob)
+		res.release()
+		return err
+	}
+	publish(EVENT_CREATE, so)
+	res.commitCreated(so)
+	return nil
+}
+
+// Record in the object how the store keeps its blob. The blob header is read
+// since it may have been stored with different settings
+func (os *ObjectStore) annotate(so *StoredObject) error {
+	st, err := os.Open()
+	if err != nil {
+		return err
+	}
+	ts, ok := uncached(st).(*TransformStore)
+	if !ok {
+		return nil
+	}
+	info, err := ts.Stat(so)
+	if err != nil {
+		return err
+	}
+	for _, k := range []string{META_COMPRESSION, META_ENCRYPTION} {
+		v, ok := info.Metadata[k]
+		if !ok {
+			continue
+		}
+		if so.Metadata == nil {
+			so.Metadata = map[string]string{}
+		}
+		so.Metadata[k] = v
+	}
+	return nil
+}
+
+// Upload the data and create the blob record with one reference
+func (os *ObjectStore) storeBlob(blob *Blob, user string, data io.Reader, length int64) error {
+	st, err := os.Open()
+	if err != nil {
+		return err
+	}
+	hr, err := NewVerifyingHashReader(data, blob.Hash)
+	if err != nil {
+		return err
+	}
+	so := &StoredObject{Type: blob.Type, Hash: blob.Hash, User: user}
+	switch err := st.Put(so, hr, length); err {
+	case nil:
+	case ErrAlreadyExists:
+		//Backends may refuse before reading anything
+		if err := drainVerify(hr, blob.Hash, length); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	return os.createBlob(blob, length)
+}
+
+// Read the whole upload and check it is the data of a stored blob
+func verifyUpload(data io.Reader, hash string, length int64) error {
+	hr, err := NewVerifyingHashReader(data, hash)
+	if err != nil {
+		return err
+	}
+	return drainVerify(hr, hash, length)
+}
+
+// Read what is left and check the hash and length of all the data read
+func drainVerify(hr *HashReader, hash string, length int64) error {
+	if _, err := io.Copy(ioutil.Discard, hr); err != nil {
+		return err
+	}
+	if hr.Size() != length {
+		return ErrLengthMismatch
+	}
+	return hr.Verify(hash)
+}
+
+// Create the record of a blob that has just been stored with one reference
+func (os *ObjectStore) createBlob(blob *Blob, length int64) error {
+	blob.Size = length
+	blob.Refs = 1
+	err := blob.GetDB().CreateNewRecord(blob)
+	if err == nil || !db.IsErrDuplicateKey(err) {
+		return err
+	}
+	acquired, err := blob.acquire(length)
+	if err == nil && !acquired {
+		return ErrBlobContention
+	}
+	return err
+}
+
+// Drop the reference and delete the data if it was the last one
+func (os *ObjectStore) releaseBlob(blob *Blob) error {
+	last, err := blob.release()
+	if err != nil || !last {
+		return err
+	}
+	st, err := os.Open()
+	if err != nil {
+		return err
+	}
+	err = st.Delete(&StoredObject{Type: blob.Type, Hash: blob.Hash})
+	if err == ErrNotExists {
+		return nil
+	}
+	return err
+}
+
+// Remove the object record and its reference to the blob, and to the blob in
+// the store it was migrated from if the migration kept it
+func (os *ObjectStore) DeleteObject(so *StoredObject) error {
+	return os.deleteObject(so, EVENT_DELETE)
+}
+
+// Delete the object publishing an event of the kind
+func (os *ObjectStore) deleteObject(so *StoredObject, kind string) error {
+	if _, err := os.GetDB().DeleteRecord(so); err != nil {
+		return err
+	}
+	publish(kind, so)
+	if err := os.releaseUsage(so); err != nil {
+		return err
+	}
+	if from, ok := so.Metadata[META_MIGRATED_FROM]; ok {
+		if err := os.releaseSourceBlob(so, from); err != nil {
+			return err
+		}
+	}
+	return os.releaseBlob(os.blobFor(so))
+}
@@ -0,0 +1,424 @@
+package ostore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/acasajus/menac/db"
+)
+
+const (
+	//Longest a presigned URL can be valid for
+	PRESIGN_MAX_EXPIRY = 7 * 24 * time.Hour
+	PRESIGN_GET        = "GET"
+	PRESIGN_PUT        = "PUT"
+)
+
+var (
+	ErrNoSignedURL      = errors.New("Store cannot sign URLs")
+	ErrBadSignature     = errors.New("Invalid URL signature")
+	ErrURLExpired       = errors.New("URL has expired")
+	ErrExpiryTooLong    = errors.New("Expiration is too far in the future")
+	ErrInvalidByteRange = errors.New("Invalid byte range")
+)
+
+// Stores that can hand out URLs to download an object straight from the
+// backend. Fails with ErrNoSignedURL if the store is not set up for it
+type URLSigner interface {
+	SignedURL(so *StoredObject, expires time.Time) (string, error)
+}
+
+// What a presigned URL allows to do with one object
+type PresignedOp struct {
+	Method       string
+	Organization string
+	StoreName    string
+	ObjectId     string
+	Expires      time.Time
+	//Downloads only serve Length bytes from Offset. Length 0 serves up to the
+	//end of the object
+	Offset int64
+	Length int64
+	//Uploads create the object with these fields, and accept at most MaxSize
+	//bytes if it is not 0
+	User    string
+	Group   string
+	Type    string
+	MaxSize int64
+}
+
+func (op *PresignedOp) Validate() error {
+	switch op.Method {
+	case PRESIGN_GET:
+		if op.Offset < 0 || op.Length < 0 {
+			return ErrInvalidByteRange
+		}
+	case PRESIGN_PUT:
+		if len(op.User) == 0 || len(op.Group) == 0 {
+			return errors.New("Uploads need a user and a group")
+		}
+		if op.MaxSize < 0 {
+			return errors.New("Invalid maximum size")
+		}
+	default:
+		return fmt.Errorf("Cannot presign %s", op.Method)
+	}
+	if len(op.Organization) == 0 || len(op.StoreName) == 0 || len(op.ObjectId) == 0 {
+		return errors.New("Presigned URLs need an object")
+	}
+	return nil
+}
+
+// Everything the signature covers
+func (op *PresignedOp) canonical() string {
+	return strings.Join([]string{
+		op.Method,
+		op.Organization,
+		op.StoreName,
+		op.ObjectId,
+		strconv.FormatInt(op.Expires.Unix(), 10),
+		strconv.FormatInt(op.Offset, 10),
+		strconv.FormatInt(op.Length, 10),
+		op.User,
+		op.Group,
+		op.Type,
+		strconv.FormatInt(op.MaxSize, 10),
+	}, "\n")
+}
+
+// Issues and serves HMAC signed URLs to download or upload a single object
+type Presigner struct {
+	db  db.DB
+	key []byte
+	//Where the handler is served, with the path prefix it is mounted at
+	baseURL *url.URL
+	//Uploads are spooled here to hash them. Empty uses the default
+	//temporary directory
+	TempDir string
+}
+
+func NewPresigner(d db.DB, key []byte, baseURL string) (*Presigner, error) {
+	if len(key) == 0 {
+		return nil, errors.New("Empty presign key")
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &Presigner{db: d, key: key, baseURL: u}, nil
+}
+
+func (p *Presigner) sign(op *PresignedOp) string {
+	m := hmac.New(sha256.New, p.key)
+	io.WriteString(m, op.canonical())
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func checkExpiry(expires, now time.Time) error {
+	if !expires.After(now) {
+		return ErrURLExpired
+	}
+	if expires.Sub(now) > PRESIGN_MAX_EXPIRY {
+		return ErrExpiryTooLong
+	}
+	return nil
+}
+
+// Build the URL of a signed operation
+func (p *Presigner) Sign(op *PresignedOp) (string, error) {
+	if err := op.Validate(); err != nil {
+		return "", err
+	}
+	if err := checkExpiry(op.Expires, time.Now()); err != nil {
+		return "", err
+	}
+	u := *p.baseURL
+	u.Path += strings.Join([]string{op.Organization, op.StoreName, op.ObjectId}, "/")
+	q := url.Values{}
+	q.Set("op", op.Method)
+	q.Set("expires", strconv.FormatInt(op.Expires.Unix(), 10))
+	for k, v := range map[string]int64{"offset": op.Offset, "length": op.Length, "max": op.MaxSize} {
+		if v != 0 {
+			q.Set(k, strconv.FormatInt(v, 10))
+		}
+	}
+	for k, v := range map[string]string{"user": op.User, "group": op.Group, "type": op.Type} {
+		if len(v) > 0 {
+			q.Set(k, v)
+		}
+	}
+	q.Set("signature", p.sign(op))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// URL to download length bytes from offset of an object, or all of it if both are 0
+func (p *Presigner) PresignGet(so *StoredObject, expires time.Time, offset, length int64) (string, error) {
+	if offset == 0 && length == 0 && so.store != nil {
+		if err := checkExpiry(expires, time.Now()); err != nil {
+			return "", err
+		}
+		st, err := so.store.Open()
+		if err != nil {
+			return "", err
+		}
+		if signer, ok := unwrap(st).(URLSigner); ok {
+			u, err := signer.SignedURL(so, expires)
+			if err != ErrNoSignedURL {
+				return u, err
+			}
+		}
+	}
+	return p.Sign(&PresignedOp{
+		Method:       PRESIGN_GET,
+		Organization: so.Organization,
+		StoreName:    so.StoreName,
+		ObjectId:     so.Id,
+		Expires:      expires,
+		Offset:       offset,
+		Length:       length,
+	})
+}
+
+// URL to upload the data of an object that does not exist yet
+func (p *Presigner) PresignPut(so *StoredObject, expires time.Time, maxSize int64) (string, error) {
+	return p.Sign(&PresignedOp{
+		Method:       PRESIGN_PUT,
+		Organization: so.Organization,
+		StoreName:    so.StoreName,
+		ObjectId:     so.Id,
+		Expires:      expires,
+		User:         so.User,
+		Group:        so.Group,
+		Type:         so.Type,
+		MaxSize:      maxSize,
+	})
+}
+
+func parseInt64(q url.Values, key string) (int64, error) {
+	v := q.Get(key)
+	if len(v) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// Organization, store and object id in the path of a request
+func (p *Presigner) objectPath(r *http.Request) ([]string, bool) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, p.baseURL.Path), "/")
+	return parts, len(parts) == 3
+}
+
+// Operation a request was signed for. Fails with ErrBadSignature if anything
+// in it was changed
+func (p *Presigner) verify(r *http.Request, now time.Time) (*PresignedOp, error) {
+	parts, ok := p.objectPath(r)
+	if !ok {
+		return nil, ErrBadSignature
+	}
+	q := r.URL.Query()
+	op := &PresignedOp{
+		Method:       q.Get("op"),
+		Organization: parts[0],
+		StoreName:    parts[1],
+		ObjectId:     parts[2],
+		User:         q.Get("user"),
+		Group:        q.Get("group"),
+		Type:         q.Get("type"),
+	}
+	expires, err := parseInt64(q, "expires")
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+	op.Expires = time.Unix(expires, 0)
+	for k, v := range map[string]*int64{"offset": &op.Offset, "length": &op.Length, "max": &op.MaxSize} {
+		if *v, err = parseInt64(q, k); err != nil {
+			return nil, ErrBadSignature
+		}
+	}
+	if !hmac.Equal([]byte(p.sign(op)), []byte(q.Get("signature"))) {
+		return nil, ErrBadSignature
+	}
+	if !op.Expires.After(now) {
+		return nil, ErrURLExpired
+	}
+	return op, nil
+}
+
+// URL to download a public-read object. It needs no signature and does not
+// expire, but stops working if the object stops being public
+func (p *Presigner) PublicURL(so *StoredObject) (string, error) {
+	if !so.PublicRead() {
+		return "", ErrAccessDenied
+	}
+	u := *p.baseURL
+	u.Path += strings.Join([]string{so.Organization, so.StoreName, so.Id}, "/")
+	return u.String(), nil
+}
+
+// Public-read objects are served to requests without signature
+func (p *Presigner) publicOp(r *http.Request) (*PresignedOp, bool) {
+	if r.URL.Query().Get("signature") != "" || (r.Method != "GET" && r.Method != "HEAD") {
+		return nil, false
+	}
+	parts, ok := p.objectPath(r)
+	if !ok {
+		return nil, false
+	}
+	return &PresignedOp{Method: PRESIGN_GET, Organization: parts[0], StoreName: parts[1], ObjectId: parts[2]}, true
+}
+
+func (p *Presigner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	op, public := p.publicOp(r)
+	if !public {
+		var err error
+		if op, err = p.verify(r, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	method := r.Method
+	if method == "HEAD" {
+		method = PRESIGN_GET
+	}
+	if method != op.Method {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	so := &ObjectStore{Organization: op.Organization, Name: op.StoreName}
+	if err := p.db.GetRecord(so.GetPrimaryKey(), so); err != nil {
+		if db.IsErrNotFound(err) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if op.Method == PRESIGN_GET {
+		p.serveGet(w, r, so, op, public)
+	} else {
+		p.servePut(w, r, so, op)
+	}
+}
+
+func (p *Presigner) serveGet(w http.ResponseWriter, r *http.Request, os *ObjectStore, op *PresignedOp, public bool) {
+	obj, err := os.GetObject(op.ObjectId)
+	if err != nil {
+		if db.IsErrNotFound(err) || err == ErrNotExists {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if public && Anonymous.Check(obj, PERM_READ) != nil {
+		http.Error(w, ErrAccessDenied.Error(), http.StatusForbidden)
+		return
+	}
+	st, err := os.Open()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := st.Open(obj)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer data.Close()
+	length := obj.Size - op.Offset
+	if op.Length > 0 && op.Length < length {
+		length = op.Length
+	}
+	if length < 0 {
+		http.Error(w, ErrInvalidByteRange.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", "\""+obj.Hash+"\"")
+	//Ranges asked by the client are relative to the signed one
+	http.ServeContent(w, r, "", obj.GetCreatedAt(), io.NewSectionReader(readerAt{data}, op.Offset, length))
+}
+
+// Adapts an ObjectReader to the io.ReaderAt a SectionReader needs. Reads are
+// sequential in practice so seeking is cheap
+type readerAt struct {
+	r ObjectReader
+}
+
+func (ra readerAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := ra.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(ra.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (p *Presigner) servePut(w http.ResponseWriter, r *http.Request, so *ObjectStore, op *PresignedOp) {
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length required", http.StatusLengthRequired)
+		return
+	}
+	if op.MaxSize > 0 && r.ContentLength > op.MaxSize {
+		http.Error(w, "Upload is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if _, err := so.GetObject(op.ObjectId); err == nil {
+		http.Error(w, "Object already exists", http.StatusConflict)
+		return
+	}
+	tmp, err := ioutil.TempFile(p.TempDir, "ostore-presigned-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hr := NewHashReader(io.LimitReader(r.Body, r.ContentLength))
+	if _, err := io.Copy(tmp, hr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if hr.Size() != r.ContentLength {
+		http.Error(w, ErrLengthMismatch.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	obj := so.NewObject()
+	obj.Id = op.ObjectId
+	obj.User = op.User
+	obj.Group = op.Group
+	obj.Type = op.Type
+	obj.Hash = hr.HexDigest()
+	switch err := so.PutObject(obj, tmp, hr.Size()); {
+	case err == ErrQuotaExceeded:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case db.IsErrDuplicateKey(err):
+		http.Error(w, "Object already exists", http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.Header().Set("ETag", "\""+obj.Hash+"\"")
+		w.WriteHeader(http.StatusCreated)
+	}
+}
@@ -0,0 +1,162 @@
+package ostore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPresignVerify(t *testing.T) {
+	p, err := NewPresigner(nil, []byte("key"), "https://menac.example/presigned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := &PresignedOp{
+		Method:       PRESIGN_GET,
+		Organization: "org",
+		StoreName:    "store",
+		ObjectId:     "id",
+		Expires:      time.Now().Add(time.Hour).Truncate(time.Second),
+		Offset:       10,
+		Length:       20,
+	}
+	signed, err := p.Sign(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signed, "https://menac.example/presigned/org/store/id?") {
+		t.Errorf("Unexpected URL %s", signed)
+	}
+	got, err := p.verify(httptest.NewRequest("GET", signed, nil), time.Now())
+	if err != nil {
+		t.Fatalf("Signed URL was rejected: %s", err)
+	}
+	if *got != *op {
+		t.Errorf("Verified operation differs: %+v %+v", got, op)
+	}
+	if _, err := p.verify(httptest.NewRequest("GET", signed, nil), op.Expires); err != ErrURLExpired {
+		t.Errorf("Expired URL returned %v", err)
+	}
+	for i, tamper := range []func(u *url.URL){
+		func(u *url.URL) { u.Path = strings.Replace(u.Path, "/id", "/other", 1) },
+		func(u *url.URL) { q := u.Query(); q.Set("length", "0"); u.RawQuery = q.Encode() },
+		func(u *url.URL) { q := u.Query(); q.Set("op", PRESIGN_PUT); u.RawQuery = q.Encode() },
+		func(u *url.URL) { q := u.Query(); q.Set("expires", "99999999999"); u.RawQuery = q.Encode() },
+	} {
+		u, _ := url.Parse(signed)
+		tamper(u)
+		if _, err := p.verify(httptest.NewRequest("GET", u.String(), nil), time.Now()); err != ErrBadSignature {
+			t.Errorf("#%d: Tampered URL returned %v", i, err)
+		}
+	}
+	other, _ := NewPresigner(nil, []byte("other key"), "https://menac.example/presigned")
+	if _, err := other.verify(httptest.NewRequest("GET", signed, nil), time.Now()); err != ErrBadSignature {
+		t.Errorf("URL signed with another key returned %v", err)
+	}
+	op.Expires = time.Now().Add(PRESIGN_MAX_EXPIRY + time.Hour)
+	if _, err := p.Sign(op); err != ErrExpiryTooLong {
+		t.Errorf("Signing beyond the maximum expiry returned %v", err)
+	}
+}
+
+func TestPresignedURLs(t *testing.T) {
+	os := getDummyStore()
+	if err := os.Create(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPresigner(getDB(), []byte("key"), "http://menac.example/presigned/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method, target string, body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(method, target, bytes.NewReader(body)))
+		return w
+	}
+
+	data := []byte("presigned sandbox data")
+	so := os.NewObject()
+	so.User, so.Group, so.Type = "user", "group", "test"
+	put, err := p.PresignPut(so, time.Now().Add(time.Hour), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serve("PUT", put, append(data, '!')); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Upload over the limit got %d", w.Code)
+	}
+	if w := serve("GET", put, nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Download with an upload URL got %d", w.Code)
+	}
+	if w := serve("PUT", put, data); w.Code != http.StatusCreated {
+		t.Fatalf("Cannot upload: %d %s", w.Code, w.Body)
+	}
+	if w := serve("PUT", put, data); w.Code != http.StatusConflict {
+		t.Errorf("Upload URL was used twice: %d", w.Code)
+	}
+	stored, err := os.GetObject(so.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.User != "user" || stored.Size != int64(len(data)) {
+		t.Errorf("Unexpected object %+v", stored)
+	}
+
+	//Memory stores cannot sign URLs so downloads are served by menac
+	get, err := p.PresignGet(stored, time.Now().Add(time.Hour), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serve("GET", get, nil); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Errorf("Unexpected download %d %q", w.Code, w.Body)
+	}
+	get, err = p.PresignGet(stored, time.Now().Add(time.Hour), 10, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serve("GET", get, nil); w.Body.String() != "sandbox" {
+		t.Errorf("Unexpected limited download %d %q", w.Code, w.Body)
+	}
+	if w := serve("PUT", get, data); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Upload with a download URL got %d", w.Code)
+	}
+}
+
+type signingStore struct {
+	*MemStore
+}
+
+func (ss signingStore) SignedURL(so *StoredObject, expires time.Time) (string, error) {
+	return "https://backend.example/" + so.getPath(), nil
+}
+
+func TestUnwrapSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "presigntest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tm := NewTransferManager(TransferLimits{Concurrency: 1})
+	cs, err := NewCacheStore(NewTransferStore(signingStore{NewMemStore()}, tm, "org", "mem"), CacheOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Store(cs).(URLSigner); ok {
+		t.Fatal("Cache store signs URLs itself")
+	}
+	signer, ok := unwrap(cs).(URLSigner)
+	if !ok {
+		t.Fatal("Backend signer is hidden by the cache")
+	}
+	if u, err := signer.SignedURL(&StoredObject{Type: "t", Hash: "h"}, time.Now()); err != nil || !strings.HasPrefix(u, "https://backend.example/") {
+		t.Errorf("Unexpected signed URL %s %v", u, err)
+	}
+	if _, ok := unwrap(cs).(MultipartStore); !ok {
+		t.Error("Backend multipart is hidden by the cache")
+	}
+}
@@ -0,0 +1,137 @@
+package ostore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/acasajus/menac/db"
+)
+
+var ErrStopQuery = errors.New("Query stopped")
+
+// Filter over StoredObject records. Empty fields match everything
+type ObjectQuery struct {
+	Organization string
+	StoreName    string
+	User         string
+	Group        string
+	Type         string
+	//Keys that have to be present. An empty value matches any value
+	Metadata map[string]string
+	//Only objects with an expiration before/after these times
+	ExpiresBefore time.Time
+	ExpiresAfter  time.Time
+}
+
+func (q *ObjectQuery) Validate() error {
+	if len(q.Organization) == 0 {
+		return errors.New("Empty organization handle")
+	}
+	return nil
+}
+
+// Index and value used to look up the candidates
+func (q *ObjectQuery) index() (string, string) {
+	switch {
+	case len(q.User) > 0:
+		return "User", q.User
+	case len(q.Group) > 0:
+		return "Group", q.Group
+	case len(q.Type) > 0:
+		return "Type", q.Type
+	}
+	return "Organization", q.Organization
+}
+
+func (q *ObjectQuery) Match(so *StoredObject) bool {
+	if so.Organization != q.Organization {
+		return false
+	}
+	for _, f := range [][2]string{
+		{q.StoreName, so.StoreName},
+		{q.User, so.User},
+		{q.Group, so.Group},
+		{q.Type, so.Type},
+	} {
+		if len(f[0]) > 0 && f[0] != f[1] {
+			return false
+		}
+	}
+	for k, v := range q.Metadata {
+		sv, ok := so.Metadata[k]
+		if !ok || (len(v) > 0 && v != sv) {
+			return false
+		}
+	}
+	if !q.ExpiresBefore.IsZero() && (so.Expiration.IsZero() || !so.Expiration.Before(q.ExpiresBefore)) {
+		return false
+	}
+	if !q.ExpiresAfter.IsZero() && !so.Expiration.After(q.ExpiresAfter) {
+		return false
+	}
+	return true
+}
+
+// Call fn for every record matching the query. Returning ErrStopQuery from fn
+// ends the iteration without error
+func (q *ObjectQuery) Each(d db.DB, fn func(*StoredObject) error) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	index, value := q.index()
+	results := d.Search(&StoredObject{}, index, value)
+	//Drain the results so the search goroutine can finish
+	defer func() {
+		for range results {
+		}
+	}()
+	for sr := range results {
+		if sr.Error != nil {
+			return sr.Error
+		}
+		so, ok := sr.Record.(*StoredObject)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected struct type came out of the pipe %#v", sr.Record))
+		}
+		if !q.Match(so) {
+			continue
+		}
+		if err := fn(so); err != nil {
+			if err == ErrStopQuery {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *ObjectQuery) Find(d db.DB) ([]*StoredObject, error) {
+	objs := make([]*StoredObject, 0)
+	err := q.Each(d, func(so *StoredObject) error {
+		objs = append(objs, so)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objs, nil
+}
+
+// Create the indexes used by the queries. Safe to call on every start
+func RegisterIndexes(d db.DB) error {
+	for _, r := range []db.RecordObject{&StoredObject{}, &BlobLocations{}, &Usage{}, &ObjectName{}, &ObjectVersion{}, &Upload{}} {
+		if err := d.RegisterIndexes(r); err != nil && !db.IsErrIndexExists(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query the objects kept in this store
+func (os *ObjectStore) Objects(q ObjectQuery) ([]*StoredObject, error) {
+	q.Organization = os.Organization
+	q.StoreName = os.Name
+	return q.Find(os.GetDB())
+}
@@ -0,0 +1,67 @@
+package ostore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestObjectQueryMatch(t *testing.T) {
+	now := time.Now()
+	so := &StoredObject{
+		Organization: "org",
+		StoreName:    "store",
+		User:         "user",
+		Group:        "group",
+		Type:         "sandbox",
+		Expiration:   now,
+		Metadata:     map[string]string{"job": "1"},
+	}
+	tests := []struct {
+		q ObjectQuery
+
+		wmatch bool
+	}{
+		{ObjectQuery{Organization: "org"}, true},
+		{ObjectQuery{Organization: "other"}, false},
+		{ObjectQuery{Organization: "org", StoreName: "store", User: "user", Group: "group", Type: "sandbox"}, true},
+		{ObjectQuery{Organization: "org", User: "other"}, false},
+		{ObjectQuery{Organization: "org", Group: "other"}, false},
+		{ObjectQuery{Organization: "org", Type: "other"}, false},
+		{ObjectQuery{Organization: "org", Metadata: map[string]string{"job": ""}}, true},
+		{ObjectQuery{Organization: "org", Metadata: map[string]string{"job": "1"}}, true},
+		{ObjectQuery{Organization: "org", Metadata: map[string]string{"job": "2"}}, false},
+		{ObjectQuery{Organization: "org", Metadata: map[string]string{"missing": ""}}, false},
+		{ObjectQuery{Organization: "org", ExpiresBefore: now.Add(time.Second)}, true},
+		{ObjectQuery{Organization: "org", ExpiresBefore: now}, false},
+		{ObjectQuery{Organization: "org", ExpiresAfter: now.Add(-time.Second)}, true},
+		{ObjectQuery{Organization: "org", ExpiresAfter: now}, false},
+	}
+	for i, tt := range tests {
+		if m := tt.q.Match(so); m != tt.wmatch {
+			t.Errorf("#%d: match = %v, want %v", i, m, tt.wmatch)
+		}
+	}
+	//Objects that never expire
+	q := ObjectQuery{Organization: "org", ExpiresBefore: now}
+	if q.Match(&StoredObject{Organization: "org"}) {
+		t.Error("Object without expiration matched ExpiresBefore")
+	}
+}
+
+func TestObjectQueryIndex(t *testing.T) {
+	tests := []struct {
+		q ObjectQuery
+
+		windex string
+	}{
+		{ObjectQuery{Organization: "org"}, "Organization"},
+		{ObjectQuery{Organization: "org", Type: "t"}, "Type"},
+		{ObjectQuery{Organization: "org", Type: "t", Group: "g"}, "Group"},
+		{ObjectQuery{Organization: "org", Type: "t", Group: "g", User: "u"}, "User"},
+	}
+	for i, tt := range tests {
+		if index, _ := tt.q.index(); index != tt.windex {
+			t.Errorf("#%d: index = %s, want %s", i, index, tt.windex)
+		}
+	}
+}
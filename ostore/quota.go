@@ -0,0 +1,400 @@
+package ostore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/acasajus/menac/db"
+	"github.com/acasajus/menac/registry"
+)
+
+const (
+	//Levels at which usage is accounted and quotas apply
+	USAGE_ORG   = "org"
+	USAGE_GROUP = "group"
+	USAGE_USER  = "user"
+
+	//Attempts to commit the reservation of an object already created
+	QUOTA_COMMIT_RETRIES = 3
+	QUOTA_COMMIT_BACKOFF = 100 * time.Millisecond
+)
+
+var ErrQuotaExceeded = errors.New("Storage quota exceeded")
+
+// Bytes and objects kept by an organization, group or user
+type Usage struct {
+	db.Record
+
+	Organization string `db:"indexed"`
+	Scope        string
+	Name         string
+	Bytes        int64
+	Objects      int64
+	//Held by puts in progress
+	ReservedBytes   int64
+	ReservedObjects int64
+}
+
+func (u *Usage) GetPrimaryKey() []byte {
+	return []byte(fmt.Sprintf("%s:%s:%s", u.Organization, u.Scope, u.Name))
+}
+
+func (u *Usage) Validate() error {
+	if len(u.Organization) == 0 {
+		return errors.New("Empty organization handle")
+	}
+	switch u.Scope {
+	case USAGE_ORG, USAGE_GROUP, USAGE_USER:
+	default:
+		return fmt.Errorf("Unknown usage scope %s", u.Scope)
+	}
+	if len(u.Name) == 0 {
+		return errors.New("Empty name")
+	}
+	return nil
+}
+
+func (u *Usage) reset() {
+	u.Bytes, u.Objects, u.ReservedBytes, u.ReservedObjects = 0, 0, 0, 0
+}
+
+// Counters never go below zero
+func (u *Usage) add(bytes, objects, reservedBytes, reservedObjects int64) {
+	clamp := func(v *int64, d int64) {
+		if *v += d; *v < 0 {
+			*v = 0
+		}
+	}
+	clamp(&u.Bytes, bytes)
+	clamp(&u.Objects, objects)
+	clamp(&u.ReservedBytes, reservedBytes)
+	clamp(&u.ReservedObjects, reservedObjects)
+}
+
+func newUsage(d db.DB, org, scope, name string) *Usage {
+	return d.LinkRecordToDB(&Usage{Organization: org, Scope: scope, Name: name}).(*Usage)
+}
+
+func getUsage(d db.DB, org, scope, name string) (*Usage, error) {
+	u := newUsage(d, org, scope, name)
+	if err := u.Validate(); err != nil {
+		return nil, err
+	}
+	if err := d.GetRecord(u.GetPrimaryKey(), u); err != nil && !db.IsErrNotFound(err) {
+		return nil, err
+	}
+	return u, nil
+}
+
+func orgUsage(d db.DB, org string) ([]*Usage, error) {
+	usage := []*Usage{}
+	for sr := range d.Search(&Usage{}, "Organization", org) {
+		if sr.Error != nil {
+			return nil, sr.Error
+		}
+		u, ok := sr.Record.(*Usage)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected struct type came out of the pipe %#v", sr.Record))
+		}
+		usage = append(usage, u)
+	}
+	sort.Sort(usageSlice(usage))
+	return usage, nil
+}
+
+// Usage of the organization, or of one of its groups or users
+func GetUsage(o *registry.Organization, scope, name string) (*Usage, error) {
+	return getUsage(o.GetDB(), o.Handle, scope, name)
+}
+
+// Usage of the organization and all its groups and users
+func OrgUsage(o *registry.Organization) ([]*Usage, error) {
+	return orgUsage(o.GetDB(), o.Handle)
+}
+
+type usageSlice []*Usage
+
+func (s usageSlice) Len() int      { return len(s) }
+func (s usageSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s usageSlice) Less(i, j int) bool {
+	if s[i].Scope != s[j].Scope {
+		return s[i].Scope < s[j].Scope
+	}
+	return s[i].Name < s[j].Name
+}
+
+// Quota kept in the registry. Groups and users without a record have none
+func getQuota(d db.DB, org, scope, name string) (registry.Quota, error) {
+	var r interface {
+		db.RecordObject
+		GetQuota() registry.Quota
+	}
+	switch scope {
+	case USAGE_ORG:
+		r = &registry.Organization{Handle: org}
+	case USAGE_GROUP:
+		r = &registry.Group{Organization: org, Name: name}
+	case USAGE_USER:
+		r = &registry.User{Organization: org, Handle: name}
+	default:
+		return registry.Quota{}, fmt.Errorf("Unknown usage scope %s", scope)
+	}
+	//The organization key comes from its pk tag
+	pk := r.GetPrimaryKey()
+	if pk == nil {
+		pk = []byte(org)
+	}
+	if err := d.GetRecord(pk, r); err != nil {
+		if db.IsErrNotFound(err) {
+			return registry.Quota{}, nil
+		}
+		return registry.Quota{}, err
+	}
+	return r.GetQuota(), nil
+}
+
+// Levels an object is accounted in
+func usageLevels(so *StoredObject) [][2]string {
+	return [][2]string{{USAGE_ORG, so.Organization}, {USAGE_GROUP, so.Group}, {USAGE_USER, so.User}}
+}
+
+// Bytes and an object held against every level until the put ends
+type quotaReservation struct {
+	usages []*Usage
+	bytes  int64
+}
+
+// Reserve room for an object at every level or none
+func (os *ObjectStore) reserveQuota(so *StoredObject, length int64) (*quotaReservation, error) {
+	res := &quotaReservation{bytes: length}
+	for _, level := range usageLevels(so) {
+		q, err := getQuota(os.GetDB(), so.Organization, level[0], level[1])
+		if err != nil {
+			res.release()
+			return nil, err
+		}
+		u := newUsage(os.GetDB(), so.Organization, level[0], level[1])
+		err = upsertRecord(u, u.reset, func() error {
+			if !q.Allows(u.Bytes+u.ReservedBytes, u.Objects+u.ReservedObjects, length, 1) {
+				return ErrQuotaExceeded
+			}
+			u.add(0, 0, length, 1)
+			return nil
+		})
+		if err != nil {
+			res.release()
+			return nil, err
+		}
+		res.usages = append(res.usages, u)
+	}
+	return res, nil
+}
+
+// Turn the reservation into usage once the object exists
+func (res *quotaReservation) commit() error {
+	for len(res.usages) > 0 {
+		u := res.usages[0]
+		err := upsertRecord(u, u.reset, func() error {
+			u.add(res.bytes, 1, -res.bytes, -1)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		res.usages = res.usages[1:]
+	}
+	return nil
+}
+
+// Commit the reservation of a created object, retrying with backoff
+func (res *quotaReservation) commitCreated(so *StoredObject) {
+	backoff := QUOTA_COMMIT_BACKOFF
+	for attempt := 1; ; attempt++ {
+		err := res.commit()
+		if err == nil {
+			return
+		}
+		if attempt >= QUOTA_COMMIT_RETRIES {
+			log.Printf("ostore: Cannot commit usage of %s in %s, reconcile the usage of the organization: %s", so.Id, so.Organization, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (res *quotaReservation) release() error {
+	var last error
+	for _, u := range res.usages {
+		err := updateRecord(u, func() error {
+			u.add(0, 0, -res.bytes, -1)
+			return nil
+		})
+		if err != nil && !db.IsErrNotFound(err) {
+			last = err
+		}
+	}
+	return last
+}
+
+// Take a deleted object out of the usage of every level
+func (os *ObjectStore) releaseUsage(so *StoredObject) error {
+	var last error
+	for _, level := range usageLevels(so) {
+		u := newUsage(os.GetDB(), so.Organization, level[0], level[1])
+		err := updateRecord(u, func() error {
+			u.add(-so.Size, -1, 0, 0)
+			return nil
+		})
+		if err != nil && !db.IsErrNotFound(err) {
+			last = err
+		}
+	}
+	return last
+}
+
+// Recompute the usage of an organization from a scan of its objects
+func ReconcileUsage(d db.DB, org string) ([]*Usage, error) {
+	totals := map[string]*Usage{}
+	existing, err := orgUsage(d, org)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range existing {
+		totals[string(u.GetPrimaryKey())] = newUsage(d, org, u.Scope, u.Name)
+	}
+	err = (&ObjectQuery{Organization: org}).Each(d, func(so *StoredObject) error {
+		for _, level := range usageLevels(so) {
+			u := newUsage(d, org, level[0], level[1])
+			key := string(u.GetPrimaryKey())
+			if t, ok := totals[key]; ok {
+				u = t
+			} else {
+				totals[key] = u
+			}
+			u.Bytes += so.Size
+			u.Objects++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	usage := []*Usage{}
+	for _, t := range totals {
+		u := newUsage(d, org, t.Scope, t.Name)
+		err := upsertRecord(u, u.reset, func() error {
+			u.reset()
+			u.Bytes, u.Objects = t.Bytes, t.Objects
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	sort.Sort(usageSlice(usage))
+	return usage, nil
+}
+
+// Usage of one level with the quota that applies to it
+type UsageInfo struct {
+	Scope           string
+	Name            string
+	Bytes           int64
+	Objects         int64
+	ReservedBytes   int64
+	ReservedObjects int64
+	Quota           registry.Quota
+}
+
+type usageHandler struct {
+	db     db.DB
+	prefix string
+	key    []byte
+}
+
+// Token that gives access to the usage of an organization
+func UsageToken(key []byte, org string) string {
+	m := hmac.New(sha256.New, key)
+	io.WriteString(m, org)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Serve usage as JSON to requests carrying the UsageToken of the organization
+func UsageHandler(d db.DB, prefix string, key []byte) http.Handler {
+	return &usageHandler{d, prefix, key}
+}
+
+func (h *usageHandler) authorized(r *http.Request, org string) bool {
+	auth := r.Header.Get("Authorization")
+	if len(h.key) == 0 || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return hmac.Equal([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(UsageToken(h.key, org)))
+}
+
+func (h *usageHandler) info(u *Usage) (*UsageInfo, error) {
+	q, err := getQuota(h.db, u.Organization, u.Scope, u.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &UsageInfo{u.Scope, u.Name, u.Bytes, u.Objects, u.ReservedBytes, u.ReservedObjects, q}, nil
+}
+
+func (h *usageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, h.prefix), "/")
+	if !h.authorized(r, parts[0]) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var out interface{}
+	switch {
+	case len(parts) == 1 && len(parts[0]) > 0:
+		usage, err := orgUsage(h.db, parts[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		infos := []*UsageInfo{}
+		for _, u := range usage {
+			info, err := h.info(u)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			infos = append(infos, info)
+		}
+		out = infos
+	case len(parts) == 3:
+		u, err := getUsage(h.db, parts[0], parts[1], parts[2])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if out, err = h.info(u); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
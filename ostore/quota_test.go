@@ -0,0 +1,118 @@
+package ostore
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/acasajus/menac/registry"
+)
+
+func TestUsageAdd(t *testing.T) {
+	u := &Usage{Bytes: 10, Objects: 1, ReservedBytes: 5, ReservedObjects: 1}
+	u.add(5, 1, -5, -1)
+	if u.Bytes != 15 || u.Objects != 2 || u.ReservedBytes != 0 || u.ReservedObjects != 0 {
+		t.Errorf("Unexpected usage %+v", u)
+	}
+	u.add(-20, -3, -1, -1)
+	if u.Bytes != 0 || u.Objects != 0 || u.ReservedBytes != 0 || u.ReservedObjects != 0 {
+		t.Errorf("Usage went below zero %+v", u)
+	}
+}
+
+func checkUsage(t *testing.T, os *ObjectStore, scope, name string, bytes, objects int64) {
+	u, err := getUsage(getDB(), os.Organization, scope, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Bytes != bytes || u.Objects != objects || u.ReservedBytes != 0 || u.ReservedObjects != 0 {
+		t.Errorf("[%s %s] Unexpected usage %+v, want %d bytes and %d objects", scope, name, u, bytes, objects)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	if err := RegisterIndexes(getDB()); err != nil {
+		t.Fatal(err)
+	}
+	os := getDummyStore()
+	o := &registry.Organization{Handle: os.Organization}
+	if err := getDB().GetRecord([]byte(o.Handle), o); err != nil {
+		t.Fatal(err)
+	}
+	g, err := o.CreateGroup("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetQuota(registry.Quota{Bytes: 20})
+	if err := g.Store(); err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(data string) (*StoredObject, error) {
+		so := newDummyObject(os, []byte(data))
+		return so, os.PutObject(so, bytes.NewReader([]byte(data)), int64(len(data)))
+	}
+	first, err := put("ten bytes!")
+	if err != nil {
+		t.Fatalf("Cannot put object: %s", err)
+	}
+	if _, err := put("fifteen bytes!!"); err != ErrQuotaExceeded {
+		t.Errorf("Put over the group quota returned %v", err)
+	}
+	for _, scope := range [][2]string{{USAGE_ORG, os.Organization}, {USAGE_GROUP, "group"}, {USAGE_USER, "user"}} {
+		checkUsage(t, os, scope[0], scope[1], 10, 1)
+	}
+	if _, err := put("ten bytes!"); err != nil {
+		t.Errorf("Cannot put a second object within the quota: %s", err)
+	}
+	checkUsage(t, os, USAGE_GROUP, "group", 20, 2)
+	if err := os.DeleteObject(first); err != nil {
+		t.Fatal(err)
+	}
+	checkUsage(t, os, USAGE_GROUP, "group", 10, 1)
+
+	//Reconcile fixes drifted counters
+	u := newUsage(getDB(), os.Organization, USAGE_USER, "user")
+	if err := updateRecord(u, func() error { u.add(1000, 5, 7, 1); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReconcileUsage(getDB(), os.Organization); err != nil {
+		t.Fatalf("Cannot reconcile: %s", err)
+	}
+	checkUsage(t, os, USAGE_USER, "user", 10, 1)
+
+	key := []byte("key")
+	h := UsageHandler(getDB(), "/usage/", key)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/usage/"+os.Organization+"/group/group", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Request without token answered %d", w.Code)
+	}
+	get := func(path, org string) *http.Request {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer "+UsageToken(key, org))
+		return r
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, get("/usage/"+os.Organization+"/group/group", "other"))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Request with the token of another organization answered %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, get("/usage/"+os.Organization+"/group/group", os.Organization))
+	info := &UsageInfo{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Cannot get usage: %d %v", w.Code, err)
+	}
+	if info.Bytes != 10 || info.Quota.Bytes != 20 {
+		t.Errorf("Unexpected usage info %+v", info)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, get("/usage/"+os.Organization, os.Organization))
+	infos := []*UsageInfo{}
+	if err := json.NewDecoder(w.Body).Decode(&infos); err != nil || len(infos) != 3 {
+		t.Errorf("Unexpected organization usage %v: %v", infos, err)
+	}
+}
@@ -0,0 +1,641 @@
+package ostore
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acasajus/menac/db"
+)
+
+const (
+	STORE_TYPE_REPLICATED = "replicated"
+
+	//Config options of replicated stores. Members are names of other stores
+	REPLICATED_PRIMARY    = "primary"
+	REPLICATED_REPLICAS   = "replicas"
+	REPLICATED_TIER_STORE = "tier_store"
+	REPLICATED_TIER_DAYS  = "tier_after_days"
+
+	REPLICATION_WORKERS    = 4
+	REPLICATION_QUEUE_SIZE = 1024
+	//A member that failed is only read from as a last resort for this long
+	REPLICA_RETRY_AFTER = 30 * time.Second
+)
+
+var (
+	ErrNotReplicated = errors.New("Store is not replicated")
+
+	replicationStats = expvar.NewMap("ostore.replication")
+)
+
+func init() {
+	RegisterLogicalBackend(STORE_TYPE_REPLICATED, []ConfigField{
+		{Name: REPLICATED_PRIMARY, Required: true},
+		{Name: REPLICATED_REPLICAS},
+		{Name: REPLICATED_TIER_STORE},
+		{Name: REPLICATED_TIER_DAYS},
+	}, newReplicatedStore)
+}
+
+// Members of a replicated store holding a blob
+type BlobLocations struct {
+	db.Record
+
+	Organization string `db:"indexed"`
+	StoreName    string
+	Type         string
+	Hash         string
+	Stores       []string
+	//Tiering age counts from here
+	FirstSeen time.Time
+}
+
+func (l *BlobLocations) GetPrimaryKey() []byte {
+	return []byte(fmt.Sprintf("%s:%s:%s/%s", l.Organization, l.StoreName, l.Type, l.Hash))
+}
+
+func (l *BlobLocations) Validate() error {
+	if len(l.Organization) == 0 {
+		return errors.New("Empty organization handle")
+	}
+	if len(l.StoreName) == 0 {
+		return errors.New("Empty store name")
+	}
+	if len(l.Hash) == 0 {
+		return errors.New("Empty hash")
+	}
+	return nil
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *BlobLocations) has(name string) bool {
+	return containsName(l.Stores, name)
+}
+
+func (l *BlobLocations) object() *StoredObject {
+	return &StoredObject{Type: l.Type, Hash: l.Hash}
+}
+
+type replication struct {
+	so     *StoredObject
+	target string
+}
+
+// Store that writes to a primary and replicates and tiers the data in the background
+type ReplicatedStore struct {
+	db           db.DB
+	organization string
+	name         string
+	primary      string
+	replicas     []string
+	tierStore    string
+	tierAfter    time.Duration
+
+	lock   sync.Mutex
+	failed map[string]time.Time
+	queue  chan replication
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func splitNames(s string) []string {
+	names := []string{}
+	for _, n := range strings.Split(s, ",") {
+		if n = strings.TrimSpace(n); len(n) > 0 {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+func newReplicatedStore(os *ObjectStore, config map[string]string) (Store, error) {
+	rs := &ReplicatedStore{
+		db:           os.GetDB(),
+		organization: os.Organization,
+		name:         os.Name,
+		primary:      config[REPLICATED_PRIMARY],
+		replicas:     splitNames(config[REPLICATED_REPLICAS]),
+		tierStore:    config[REPLICATED_TIER_STORE],
+		failed:       make(map[string]time.Time),
+		queue:        make(chan replication, REPLICATION_QUEUE_SIZE),
+		stop:         make(chan struct{}),
+	}
+	seen := map[string]bool{os.Name: true}
+	for _, name := range rs.members() {
+		if seen[name] {
+			return nil, fmt.Errorf("Store %s is used twice or by itself", name)
+		}
+		seen[name] = true
+	}
+	if days, ok := config[REPLICATED_TIER_DAYS]; ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("Invalid %s %s", REPLICATED_TIER_DAYS, days)
+		}
+		if len(rs.tierStore) == 0 {
+			return nil, fmt.Errorf("Missing %s for tiering", REPLICATED_TIER_STORE)
+		}
+		rs.tierAfter = time.Duration(n) * 24 * time.Hour
+	} else if len(rs.tierStore) > 0 {
+		return nil, fmt.Errorf("Missing %s for tiering", REPLICATED_TIER_DAYS)
+	}
+	for i := 0; i < REPLICATION_WORKERS; i++ {
+		rs.wg.Add(1)
+		go rs.worker()
+	}
+	return rs, nil
+}
+
+// Stop the replication workers. Queued copies are dropped, Repair makes them
+func (rs *ReplicatedStore) Close() error {
+	close(rs.stop)
+	rs.wg.Wait()
+	return nil
+}
+
+// Names of the member stores in read order
+func (rs *ReplicatedStore) members() []string {
+	names := append([]string{rs.primary}, rs.replicas...)
+	if len(rs.tierStore) > 0 && !containsName(names, rs.tierStore) {
+		names = append(names, rs.tierStore)
+	}
+	return names
+}
+
+func (rs *ReplicatedStore) member(name string) (Store, error) {
+	os := &ObjectStore{Organization: rs.organization, Name: name}
+	if err := rs.db.GetRecord(os.GetPrimaryKey(), os); err != nil {
+		return nil, fmt.Errorf("Cannot get member store %s: %s", name, err)
+	}
+	if os.Type == STORE_TYPE_REPLICATED {
+		return nil, fmt.Errorf("Member store %s is replicated too", name)
+	}
+	return os.Open()
+}
+
+// Where a blob should be, tiering it off the primary once old enough
+func (rs *ReplicatedStore) expected(l *BlobLocations, now time.Time) []string {
+	if rs.tierAfter == 0 || now.Sub(l.FirstSeen) < rs.tierAfter {
+		return append([]string{rs.primary}, rs.replicas...)
+	}
+	names := append([]string{}, rs.replicas...)
+	if !containsName(names, rs.tierStore) {
+		names = append(names, rs.tierStore)
+	}
+	return names
+}
+
+func (rs *ReplicatedStore) markFailed(name string, err error) {
+	replicationStats.Add("failovers", 1)
+	log.Printf("ostore: Replica %s of %s failed: %s", name, rs.name, err)
+	rs.lock.Lock()
+	rs.failed[name] = time.Now()
+	rs.lock.Unlock()
+}
+
+// Members to read a blob from. Members that failed recently go last
+func (rs *ReplicatedStore) readOrder(so *StoredObject) []string {
+	names := rs.members()
+	if l, err := rs.getLocations(so); err == nil {
+		held := []string{}
+		for _, n := range names {
+			if l.has(n) {
+				held = append(held, n)
+			}
+		}
+		names = held
+	}
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	healthy, failed := []string{}, []string{}
+	for _, n := range names {
+		if t, ok := rs.failed[n]; ok && time.Since(t) < REPLICA_RETRY_AFTER {
+			failed = append(failed, n)
+		} else {
+			healthy = append(healthy, n)
+		}
+	}
+	return append(healthy, failed...)
+}
+
+// Call fn with each member holding the blob until one succeeds
+func (rs *ReplicatedStore) read(so *StoredObject, fn func(Store) error) error {
+	last := ErrNotExists
+	for _, name := range rs.readOrder(so) {
+		st, err := rs.member(name)
+		if err == nil {
+			err = fn(st)
+		}
+		switch err {
+		case nil:
+			return nil
+		case ErrNotExists:
+			continue
+		}
+		rs.markFailed(name, err)
+		last = err
+	}
+	return last
+}
+
+func (rs *ReplicatedStore) locationsFor(so *StoredObject) *BlobLocations {
+	return rs.db.LinkRecordToDB(&BlobLocations{
+		Organization: rs.organization,
+		StoreName:    rs.name,
+		Type:         so.Type,
+		Hash:         so.Hash,
+	}).(*BlobLocations)
+}
+
+func (rs *ReplicatedStore) getLocations(so *StoredObject) (*BlobLocations, error) {
+	l := rs.locationsFor(so)
+	if err := rs.db.GetRecord(l.GetPrimaryKey(), l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (rs *ReplicatedStore) addLocation(so *StoredObject, name string) error {
+	l := rs.locationsFor(so)
+	return upsertRecord(l, func() {
+		l.Stores = nil
+		l.FirstSeen = time.Now()
+	}, func() error {
+		if !l.has(name) {
+			l.Stores = append(l.Stores, name)
+		}
+		return nil
+	})
+}
+
+func (rs *ReplicatedStore) removeLocation(so *StoredObject, name string) error {
+	l := rs.locationsFor(so)
+	err := updateRecord(l, func() error {
+		kept := []string{}
+		for _, s := range l.Stores {
+			if s != name {
+				kept = append(kept, s)
+			}
+		}
+		l.Stores = kept
+		return nil
+	})
+	if db.IsErrNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Members holding the blob of an object
+func (rs *ReplicatedStore) Locations(so *StoredObject) ([]string, error) {
+	l, err := rs.getLocations(so)
+	if err != nil {
+		if db.IsErrNotFound(err) {
+			return nil, ErrNotExists
+		}
+		return nil, err
+	}
+	return l.Stores, nil
+}
+
+// Members holding the blob of an object of a replicated store
+func (os *ObjectStore) Locations(so *StoredObject) ([]string, error) {
+	st, err := os.Open()
+	if err != nil {
+		return nil, err
+	}
+	rs, ok := uncached(st).(*ReplicatedStore)
+	if !ok {
+		return nil, ErrNotReplicated
+	}
+	return rs.Locations(so)
+}
+
+func (rs *ReplicatedStore) worker() {
+	defer rs.wg.Done()
+	for {
+		select {
+		case r := <-rs.queue:
+			if err := rs.copyTo(r.so, r.target); err != nil {
+				replicationStats.Add("errors", 1)
+				log.Printf("ostore: Cannot replicate %s to %s: %s", r.so.getPath(), r.target, err)
+			}
+		case <-rs.stop:
+			return
+		}
+	}
+}
+
+// Copy a blob from any member holding it and record the new location
+func (rs *ReplicatedStore) copyTo(so *StoredObject, target string) error {
+	dst, err := rs.member(target)
+	if err != nil {
+		return err
+	}
+	r, err := rs.Open(so)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	err = dst.Put(&StoredObject{Type: so.Type, Hash: so.Hash}, r, r.Info().Size)
+	if err != nil && err != ErrAlreadyExists {
+		return err
+	}
+	replicationStats.Add("copies", 1)
+	return rs.addLocation(so, target)
+}
+
+// Queue the copies to the replicas, leaving them to Repair if the queue is full
+func (rs *ReplicatedStore) replicate(so *StoredObject) {
+	for _, name := range rs.replicas {
+		select {
+		case rs.queue <- replication{&StoredObject{Type: so.Type, Hash: so.Hash}, name}:
+		default:
+			replicationStats.Add("dropped", 1)
+		}
+	}
+}
+
+// Write to the primary and record the location for the blob to be replicated
+func (rs *ReplicatedStore) Put(so *StoredObject, data io.Reader, length int64) error {
+	st, err := rs.member(rs.primary)
+	if err != nil {
+		return err
+	}
+	switch err := st.Put(so, data, length); err {
+	case nil:
+	case ErrAlreadyExists:
+		if _, serr := st.Stat(so); serr != nil {
+			return err
+		}
+		if lerr := rs.addLocation(so, rs.primary); lerr != nil {
+			rs.locationFailed(so, lerr)
+		}
+		return err
+	default:
+		return err
+	}
+	if err := rs.addLocation(so, rs.primary); err != nil {
+		rs.locationFailed(so, err)
+		return err
+	}
+	rs.replicate(so)
+	return nil
+}
+
+// The blob is in the primary but not recorded
+func (rs *ReplicatedStore) locationFailed(so *StoredObject, err error) {
+	replicationStats.Add("location_errors", 1)
+	log.Printf("ostore: Cannot record %s in %s: %s", so.getPath(), rs.primary, err)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Only falls back to another member if nothing was written yet
+func (rs *ReplicatedStore) Get(so *StoredObject, data io.Writer) error {
+	cw := &countingWriter{w: data}
+	var failed error
+	err := rs.read(so, func(st Store) error {
+		err := st.Get(so, cw)
+		if err != nil && cw.n > 0 {
+			failed = err
+			return nil
+		}
+		return err
+	})
+	if failed != nil {
+		return failed
+	}
+	return err
+}
+
+func (rs *ReplicatedStore) Open(so *StoredObject) (ObjectReader, error) {
+	var r ObjectReader
+	err := rs.read(so, func(st Store) (err error) {
+		r, err = st.Open(so)
+		return err
+	})
+	return r, err
+}
+
+func (rs *ReplicatedStore) Stat(so *StoredObject) (*ObjectInfo, error) {
+	var info *ObjectInfo
+	err := rs.read(so, func(st Store) (err error) {
+		info, err = st.Stat(so)
+		return err
+	})
+	return info, err
+}
+
+// Merge the listings of all the members
+func (rs *ReplicatedStore) List(prefix, cursor string, limit int) (*ListPage, error) {
+	pages := []*ListPage{}
+	for _, name := range rs.members() {
+		st, err := rs.member(name)
+		if err != nil {
+			return nil, err
+		}
+		page, err := st.List(prefix, cursor, limit)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+	}
+	return mergeListPages(pages, listLimit(limit)), nil
+}
+
+// Merge pages listed from the same cursor
+func mergeListPages(pages []*ListPage, limit int) *ListPage {
+	seen := map[string]bool{}
+	merged := &ListPage{Objects: []ListEntry{}}
+	more := false
+	next := ""
+	for _, p := range pages {
+		for _, e := range p.Objects {
+			if !seen[e.Key()] {
+				seen[e.Key()] = true
+				merged.Objects = append(merged.Objects, e)
+			}
+		}
+		if len(p.Next) > 0 {
+			more = true
+			if len(next) == 0 || p.Next < next {
+				next = p.Next
+			}
+		}
+	}
+	sort.Sort(listEntrySlice(merged.Objects))
+	if len(merged.Objects) > limit {
+		merged.Objects = merged.Objects[:limit]
+		more = true
+	}
+	switch {
+	case !more:
+	case len(merged.Objects) > 0:
+		merged.Next = merged.Objects[len(merged.Objects)-1].Key()
+	default:
+		merged.Next = next
+	}
+	return merged
+}
+
+type listEntrySlice []ListEntry
+
+func (s listEntrySlice) Len() int           { return len(s) }
+func (s listEntrySlice) Less(i, j int) bool { return s[i].Key() < s[j].Key() }
+func (s listEntrySlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Delete the blob from every member, wherever it is recorded to be
+func (rs *ReplicatedStore) Delete(so *StoredObject) error {
+	found := false
+	for _, name := range rs.members() {
+		st, err := rs.member(name)
+		if err != nil {
+			return err
+		}
+		switch err := st.Delete(so); err {
+		case nil:
+			found = true
+		case ErrNotExists:
+		default:
+			return err
+		}
+	}
+	l, err := rs.getLocations(so)
+	if err == nil {
+		_, err = rs.db.DeleteRecord(l)
+	}
+	if err != nil && !db.IsErrNotFound(err) {
+		return err
+	}
+	if !found {
+		return ErrNotExists
+	}
+	return nil
+}
+
+// What a repair did, or would have done in dry run mode
+type RepairReport struct {
+	//Copies made, as "type/hash > store"
+	Replicated []string
+	//Blob keys moved off the primary
+	Tiered []string
+	Errors []string
+}
+
+func (r *RepairReport) addError(format string, args ...interface{}) {
+	replicationStats.Add("errors", 1)
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// Copy and tier every blob to the members it should be in
+func (rs *ReplicatedStore) Repair(now time.Time, dryRun bool) *RepairReport {
+	report := &RepairReport{}
+	locations := []*BlobLocations{}
+	for sr := range rs.db.Search(&BlobLocations{}, "Organization", rs.organization) {
+		if sr.Error != nil {
+			report.addError("Cannot search blob locations: %s", sr.Error)
+			return report
+		}
+		l, ok := sr.Record.(*BlobLocations)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected struct type came out of the pipe %#v", sr.Record))
+		}
+		if l.StoreName == rs.name {
+			locations = append(locations, l)
+		}
+	}
+	for _, l := range locations {
+		rs.repair(l, now, dryRun, report)
+	}
+	return report
+}
+
+func (rs *ReplicatedStore) repair(l *BlobLocations, now time.Time, dryRun bool, report *RepairReport) {
+	so := l.object()
+	key := so.getPath()
+	held := []string{}
+	//Locations that lost the data do not count
+	for _, name := range l.Stores {
+		st, err := rs.member(name)
+		if err == nil {
+			_, err = st.Stat(so)
+		}
+		switch err {
+		case nil:
+			held = append(held, name)
+		case ErrNotExists:
+			if dryRun {
+				continue
+			}
+			if err := rs.removeLocation(so, name); err != nil {
+				report.addError("Cannot update locations of %s: %s", key, err)
+				return
+			}
+		default:
+			report.addError("Cannot stat %s in %s: %s", key, name, err)
+			return
+		}
+	}
+	expected := rs.expected(l, now)
+	complete := true
+	for _, name := range expected {
+		if containsName(held, name) {
+			continue
+		}
+		if !dryRun {
+			if err := rs.copyTo(so, name); err != nil {
+				report.addError("Cannot copy %s to %s: %s", key, name, err)
+				complete = false
+				continue
+			}
+		}
+		replicationStats.Add("repaired", 1)
+		report.Replicated = append(report.Replicated, key+" > "+name)
+	}
+	if !complete || containsName(expected, rs.primary) || !containsName(held, rs.primary) {
+		return
+	}
+	if !dryRun {
+		//Readers stop going to the primary before the data is gone
+		if err := rs.removeLocation(so, rs.primary); err != nil {
+			report.addError("Cannot update locations of %s: %s", key, err)
+			return
+		}
+		st, err := rs.member(rs.primary)
+		if err == nil {
+			err = st.Delete(so)
+		}
+		if err != nil && err != ErrNotExists {
+			report.addError("Cannot remove %s from %s: %s", key, rs.primary, err)
+			return
+		}
+	}
+	replicationStats.Add("tiered", 1)
+	report.Tiered = append(report.Tiered, key)
+}
@@ -0,0 +1,178 @@
+package ostore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMergeListPages(t *testing.T) {
+	entry := func(hash string) ListEntry {
+		return ListEntry{Type: "t", Hash: hash}
+	}
+	tests := []struct {
+		pages []*ListPage
+		limit int
+
+		keys []string
+		next string
+	}{
+		{[]*ListPage{{Objects: []ListEntry{}}, {Objects: []ListEntry{}}}, 10, []string{}, ""},
+		{[]*ListPage{
+			{Objects: []ListEntry{entry("a"), entry("c")}},
+			{Objects: []ListEntry{entry("b"), entry("c")}},
+		}, 10, []string{"t/a", "t/b", "t/c"}, ""},
+		{[]*ListPage{
+			{Objects: []ListEntry{entry("a"), entry("c")}, Next: "t/c"},
+			{Objects: []ListEntry{entry("b"), entry("d")}, Next: "t/d"},
+		}, 2, []string{"t/a", "t/b"}, "t/b"},
+		{[]*ListPage{
+			{Objects: []ListEntry{entry("a")}},
+			{Objects: []ListEntry{}, Next: "t/z"},
+		}, 2, []string{"t/a"}, "t/a"},
+		{[]*ListPage{{Objects: []ListEntry{}, Next: "t/z"}}, 2, []string{}, "t/z"},
+	}
+	for i, tt := range tests {
+		page := mergeListPages(tt.pages, tt.limit)
+		keys := []string{}
+		for _, e := range page.Objects {
+			keys = append(keys, e.Key())
+		}
+		if len(keys) != len(tt.keys) {
+			t.Errorf("#%d: keys = %v, want %v", i, keys, tt.keys)
+			continue
+		}
+		for j := range keys {
+			if keys[j] != tt.keys[j] {
+				t.Errorf("#%d: keys = %v, want %v", i, keys, tt.keys)
+				break
+			}
+		}
+		if page.Next != tt.next {
+			t.Errorf("#%d: next = %q, want %q", i, page.Next, tt.next)
+		}
+	}
+}
+
+func waitForLocations(t *testing.T, rs *ReplicatedStore, so *StoredObject, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		locs, err := rs.Locations(so)
+		if err != nil {
+			t.Fatalf("Cannot get locations: %s", err)
+		}
+		if len(locs) >= n || time.Now().After(deadline) {
+			return locs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicatedStore(t *testing.T) {
+	if err := RegisterIndexes(getDB()); err != nil {
+		t.Fatal(err)
+	}
+	os := getDummyStore()
+	members := map[string]Store{}
+	for _, name := range []string{"hot", "warm", "cold"} {
+		m := getDB().LinkRecordToDB(&ObjectStore{Organization: os.Organization, Name: name, Type: STORE_TYPE_MEM}).(*ObjectStore)
+		if err := m.Create(); err != nil {
+			t.Fatal(err)
+		}
+		st, err := m.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		members[name] = st
+	}
+	os.Name = "logical"
+	os.Type = STORE_TYPE_REPLICATED
+	os.Config = map[string]string{
+		REPLICATED_PRIMARY:    "hot",
+		REPLICATED_REPLICAS:   "warm",
+		REPLICATED_TIER_STORE: "cold",
+		REPLICATED_TIER_DAYS:  "1",
+	}
+	if err := os.Create(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := st.(*ReplicatedStore)
+
+	data := []byte("replicated sandbox")
+	so := newDummyObject(os, data)
+	if err := os.PutObject(so, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Cannot put object: %s", err)
+	}
+	if locs := waitForLocations(t, rs, so, 2); len(locs) != 2 {
+		t.Fatalf("Object was not replicated: %v", locs)
+	}
+	if _, err := members["warm"].Stat(so); err != nil {
+		t.Errorf("Replica has no copy: %v", err)
+	}
+	if err := st.Put(&StoredObject{Type: so.Type, Hash: so.Hash}, bytes.NewReader(data), int64(len(data))); err != ErrAlreadyExists {
+		t.Errorf("Put of a stored blob returned %v", err)
+	}
+	if locs := waitForLocations(t, rs, so, 2); len(locs) != 2 {
+		t.Errorf("Put of a stored blob changed the locations: %v", locs)
+	}
+
+	//Reads fall back to the replica and repair copies the data back
+	if err := members["hot"].Delete(so); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := st.Get(so, buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Cannot read from the replica: %v", err)
+	}
+	r := rs.Repair(time.Now(), false)
+	if len(r.Errors) > 0 {
+		t.Errorf("Unexpected repair errors %v", r.Errors)
+	}
+	if len(r.Replicated) != 1 || r.Replicated[0] != so.getPath()+" > hot" {
+		t.Errorf("Unexpected copies %v", r.Replicated)
+	}
+	if len(r.Tiered) != 0 {
+		t.Errorf("New blob was tiered %v", r.Tiered)
+	}
+	if _, err := members["hot"].Stat(so); err != nil {
+		t.Errorf("Primary copy was not repaired: %v", err)
+	}
+
+	//Old blobs move from the primary to the tier store
+	later := time.Now().Add(48 * time.Hour)
+	if r := rs.Repair(later, true); len(r.Tiered) != 1 {
+		t.Errorf("Dry run would tier %v", r.Tiered)
+	}
+	if _, err := members["hot"].Stat(so); err != nil {
+		t.Errorf("Dry run removed the primary copy: %v", err)
+	}
+	r = rs.Repair(later, false)
+	if len(r.Errors) > 0 {
+		t.Errorf("Unexpected repair errors %v", r.Errors)
+	}
+	if len(r.Tiered) != 1 || r.Tiered[0] != so.getPath() {
+		t.Errorf("Unexpected tiered blobs %v", r.Tiered)
+	}
+	if _, err := members["hot"].Stat(so); err != ErrNotExists {
+		t.Errorf("Tiered blob is still in the primary: %v", err)
+	}
+	if _, err := members["cold"].Stat(so); err != nil {
+		t.Errorf("Tiered blob is not in the tier store: %v", err)
+	}
+	if locs, _ := rs.Locations(so); len(locs) != 2 || containsName(locs, "hot") {
+		t.Errorf("Unexpected locations after tiering %v", locs)
+	}
+
+	if err := os.DeleteObject(so); err != nil {
+		t.Fatalf("Cannot delete object: %s", err)
+	}
+	for name, m := range members {
+		if _, err := m.Stat(so); err != ErrNotExists {
+			t.Errorf("Blob was not deleted from %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package s3gw
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+
+	"github.com/acasajus/menac/ostore"
+)
+
+// Error in the form S3 clients understand
+type s3Error struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errAccessDenied            = &s3Error{"AccessDenied", "Access Denied", http.StatusForbidden}
+	errAuthMalformed           = &s3Error{"AuthorizationHeaderMalformed", "The authorization header is malformed", http.StatusBadRequest}
+	errBadDigest               = &s3Error{"BadDigest", "The Content-MD5 you specified did not match what we received", http.StatusBadRequest}
+	errBucketExists            = &s3Error{"BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it", http.StatusConflict}
+	errEntityTooLarge          = &s3Error{"EntityTooLarge", "Your proposed upload exceeds the maximum allowed size", http.StatusBadRequest}
+	errExpiredRequest          = &s3Error{"AccessDenied", "Request has expired", http.StatusForbidden}
+	errIncompleteBody          = &s3Error{"IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header", http.StatusBadRequest}
+	errInternal                = &s3Error{"InternalError", "We encountered an internal error. Please try again", http.StatusInternalServerError}
+	errInvalidAccessKeyId      = &s3Error{"InvalidAccessKeyId", "The access key Id you provided does not exist in our records", http.StatusForbidden}
+	errInvalidArgument         = &s3Error{"InvalidArgument", "Invalid argument", http.StatusBadRequest}
+	errInvalidContentSha256    = &s3Error{"XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match what was computed", http.StatusBadRequest}
+	errInvalidDigest           = &s3Error{"InvalidDigest", "The Content-MD5 you specified is not valid", http.StatusBadRequest}
+	errInvalidPart             = &s3Error{"InvalidPart", "One or more of the specified parts could not be found", http.StatusBadRequest}
+	errInvalidPartOrder        = &s3Error{"InvalidPartOrder", "The list of parts was not in ascending order", http.StatusBadRequest}
+	errMalformedXML            = &s3Error{"MalformedXML", "The XML you provided was not well-formed", http.StatusBadRequest}
+	errMethodNotAllowed        = &s3Error{"MethodNotAllowed", "The specified method is not allowed against this resource", http.StatusMethodNotAllowed}
+	errMissingContentLength    = &s3Error{"MissingContentLength", "You must provide the Content-Length HTTP header", http.StatusLengthRequired}
+	errMissingGroup            = &s3Error{"InvalidArgument", "No group given and the user has no default group", http.StatusBadRequest}
+	errNoSuchBucket            = &s3Error{"NoSuchBucket", "The specified bucket does not exist", http.StatusNotFound}
+	errNoSuchKey               = &s3Error{"NoSuchKey", "The specified key does not exist", http.StatusNotFound}
+	errNoSuchUpload            = &s3Error{"NoSuchUpload", "The specified upload does not exist", http.StatusNotFound}
+	errNotImplemented          = &s3Error{"NotImplemented", "A header or query you provided implies functionality that is not implemented", http.StatusNotImplemented}
+	errQuotaExceeded           = &s3Error{"QuotaExceeded", "Storage quota exceeded", http.StatusForbidden}
+	errRequestNotReadyYet      = &s3Error{"AccessDenied", "Request is not valid yet", http.StatusForbidden}
+	errRequestTimeTooSkewed    = &s3Error{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large", http.StatusForbidden}
+	errSignatureDoesNotMatch   = &s3Error{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided", http.StatusForbidden}
+	errMissingSecurityHeader   = &s3Error{"MissingSecurityHeader", "Your request is missing a required header", http.StatusBadRequest}
+	errKeyTooLong              = &s3Error{"KeyTooLongError", "Your key is too long", http.StatusBadRequest}
+	errUnsupportedBucketCreate = &s3Error{"AccessDenied", "Buckets are object stores and are created by organization administrators", http.StatusForbidden}
+)
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestId string
+}
+
+// Map errors coming from the object store and the body readers to S3 ones.
+// Anything unknown is logged and reported as an internal error
+func toS3Error(err error) *s3Error {
+	switch err {
+	case nil:
+		return nil
+	case ostore.ErrQuotaExceeded:
+		return errQuotaExceeded
+	case ostore.ErrNotExists:
+		return errNoSuchKey
+	case ostore.ErrAccessDenied:
+		return errAccessDenied
+	case ostore.ErrInvalidGrant:
+		return errInvalidArgument
+	case ostore.ErrHashMismatch, ostore.ErrLengthMismatch:
+		return errBadDigest
+	case errPayloadHash:
+		return errInvalidContentSha256
+	case errChunkSig:
+		return errSignatureDoesNotMatch
+	case errBadChunk:
+		return errIncompleteBody
+	}
+	if e, ok := err.(*s3Error); ok {
+		return e
+	}
+	log.Printf("s3gw: %s", err)
+	return errInternal
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e := toS3Error(err)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.Status)
+	if r.Method == "HEAD" {
+		return
+	}
+	writeXMLBody(w, &errorResponse{Code: e.Code, Message: e.Message, Resource: r.URL.Path, RequestId: w.Header().Get("X-Amz-Request-Id")})
+}
+
+func writeXMLBody(w http.ResponseWriter, v interface{}) {
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("s3gw: Cannot write response: %s", err)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	writeXMLBody(w, v)
+}
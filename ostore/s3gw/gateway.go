@@ -0,0 +1,371 @@
+// Package s3gw serves menac object stores through an S3 compatible HTTP API.
+// Every store of an organization is a bucket and requests are authenticated
+// with SigV4 using the access keys of registry users.
+package s3gw
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/acasajus/menac/db"
+	"github.com/acasajus/menac/ostore"
+	"github.com/acasajus/menac/registry"
+)
+
+const (
+	DEFAULT_REGION = "us-east-1"
+	//Signed requests are accepted this long before and after their date
+	MAX_SKEW = 15 * time.Minute
+	//Type of the objects created through the gateway
+	OBJECT_TYPE  = "s3"
+	GROUP_HEADER = "X-Menac-Group"
+	GRANT_HEADER = "X-Menac-Grant"
+	MAX_KEY_LEN  = 1024
+	S3_XMLNS     = "http://s3.amazonaws.com/doc/2006-03-01/"
+)
+
+type Gateway struct {
+	db db.DB
+	//Region reported to clients asking for the bucket location
+	Region  string
+	MaxSkew time.Duration
+	//Directory uploads are spooled to before being stored. Empty uses the
+	//default temporary directory
+	TempDir string
+}
+
+func New(d db.DB) *Gateway {
+	return &Gateway{db: d, Region: DEFAULT_REGION, MaxSkew: MAX_SKEW}
+}
+
+// Authenticated request with the bucket and key it targets
+type request struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	query  url.Values
+	sig    *signature
+	key    *registry.AccessKey
+	org    *registry.Organization
+	user   *registry.User
+	bucket string
+	name   string
+	//Loaded the first time it is needed
+	principal *ostore.Principal
+}
+
+func newRequestId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return strings.ToUpper(hex.EncodeToString(id))
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Amz-Request-Id", newRequestId())
+	w.Header().Set("Server", "menac")
+	req, err := g.authenticate(w, r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := g.route(req); err != nil {
+		writeError(w, r, err)
+	}
+}
+
+// Check the signature and find who made the request
+func (g *Gateway) authenticate(w http.ResponseWriter, r *http.Request) (*request, error) {
+	sig, err := parseSignature(r)
+	if err != nil {
+		return nil, errAuthMalformed
+	}
+	if sig == nil {
+		return nil, errAccessDenied
+	}
+	key, err := registry.GetAccessKey(g.db, sig.Credential.KeyId)
+	if err != nil {
+		if db.IsErrNotFound(err) {
+			return nil, errInvalidAccessKeyId
+		}
+		return nil, err
+	}
+	if e := sig.verify(r, key.Secret, time.Now(), g.MaxSkew); e != nil {
+		return nil, e
+	}
+	org := &registry.Organization{Handle: key.Organization}
+	if err := g.db.GetRecord([]byte(org.Handle), org); err != nil {
+		if db.IsErrNotFound(err) {
+			return nil, errInvalidAccessKeyId
+		}
+		return nil, err
+	}
+	user, err := org.GetUser(key.User)
+	if err != nil {
+		if db.IsErrNotFound(err) {
+			return nil, errInvalidAccessKeyId
+		}
+		return nil, err
+	}
+	req := &request{w: w, r: r, query: r.URL.Query(), sig: sig, key: key, org: org, user: user}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	req.bucket = parts[0]
+	if len(parts) == 2 {
+		req.name = parts[1]
+	}
+	return req, nil
+}
+
+func (g *Gateway) route(req *request) error {
+	method := req.r.Method
+	switch {
+	case len(req.bucket) == 0:
+		if method != "GET" {
+			return errMethodNotAllowed
+		}
+		return g.listBuckets(req)
+	case len(req.name) == 0:
+		return g.routeBucket(req, method)
+	}
+	if len(req.name) > MAX_KEY_LEN {
+		return errKeyTooLong
+	}
+	os, err := g.store(req)
+	if err != nil {
+		return err
+	}
+	uploadId := req.query.Get("uploadId")
+	switch method {
+	case "PUT":
+		if len(req.r.Header.Get("X-Amz-Copy-Source")) > 0 {
+			return errNotImplemented
+		}
+		if queryHas(req.query, "acl") {
+			return g.putACL(req, os)
+		}
+		if len(uploadId) > 0 {
+			return g.uploadPart(req, os, uploadId)
+		}
+		return g.putObject(req, os)
+	case "GET":
+		if len(uploadId) > 0 {
+			return g.listParts(req, os, uploadId)
+		}
+		if queryHas(req.query, "acl") {
+			return errNotImplemented
+		}
+		return g.getObject(req, os)
+	case "HEAD":
+		return g.getObject(req, os)
+	case "DELETE":
+		if len(uploadId) > 0 {
+			return g.abortUpload(req, os, uploadId)
+		}
+		return g.deleteObject(req, os)
+	case "POST":
+		if queryHas(req.query, "uploads") {
+			return g.initiateUpload(req, os)
+		}
+		if len(uploadId) > 0 {
+			return g.completeUpload(req, os, uploadId)
+		}
+		return errNotImplemented
+	}
+	return errMethodNotAllowed
+}
+
+func (g *Gateway) routeBucket(req *request, method string) error {
+	os, err := g.store(req)
+	switch {
+	case method == "PUT" && err == errNoSuchBucket:
+		return errUnsupportedBucketCreate
+	case err != nil:
+		return err
+	}
+	switch method {
+	case "HEAD":
+		return nil
+	case "POST":
+		if queryHas(req.query, "delete") {
+			return g.deleteObjects(req, os)
+		}
+		return errNotImplemented
+	case "PUT":
+		return errBucketExists
+	case "DELETE":
+		return errUnsupportedBucketCreate
+	case "GET":
+	default:
+		return errMethodNotAllowed
+	}
+	switch {
+	case queryHas(req.query, "location"):
+		region := g.Region
+		if region == DEFAULT_REGION {
+			//S3 reports its original region as empty
+			region = ""
+		}
+		writeXML(req.w, &locationResponse{Xmlns: S3_XMLNS, Region: region})
+		return nil
+	case queryHas(req.query, "uploads"):
+		return g.listUploads(req, os)
+	case req.query.Get("list-type") == "2":
+		return g.listObjectsV2(req, os)
+	}
+	for _, unsupported := range []string{"acl", "policy", "versioning", "versions", "lifecycle", "cors", "tagging", "website", "logging", "notification", "replication", "encryption"} {
+		if queryHas(req.query, unsupported) {
+			return errNotImplemented
+		}
+	}
+	return g.listObjectsV1(req, os)
+}
+
+// Whether a subresource like ?uploads is in the query, with or without value
+func queryHas(q url.Values, key string) bool {
+	_, ok := q[key]
+	return ok
+}
+
+// Store the request bucket maps to
+func (g *Gateway) store(req *request) (*ostore.ObjectStore, error) {
+	os, err := ostore.GetObjectStore(req.org, req.bucket)
+	if err != nil {
+		if db.IsErrNotFound(err) {
+			return nil, errNoSuchBucket
+		}
+		return nil, err
+	}
+	return os, nil
+}
+
+// Group new objects are created in. The user has to be a member of it or an
+// administrator of the organization
+func (g *Gateway) group(req *request) (string, error) {
+	name := req.r.Header.Get(GROUP_HEADER)
+	if len(name) == 0 {
+		name = req.user.DefaultGroup
+	}
+	if len(name) == 0 {
+		return "", errMissingGroup
+	}
+	if _, err := req.org.GetGroup(name); err != nil {
+		if db.IsErrNotFound(err) {
+			return "", errAccessDenied
+		}
+		return "", err
+	}
+	p, err := g.principal(req)
+	if err != nil {
+		return "", err
+	}
+	if !p.CanCreate(name) {
+		return "", errAccessDenied
+	}
+	return name, nil
+}
+
+// Permissions of the user making the request
+func (g *Gateway) principal(req *request) (*ostore.Principal, error) {
+	if req.principal == nil {
+		p, err := ostore.NewPrincipal(req.org, req.user.Handle)
+		if err != nil {
+			return nil, err
+		}
+		req.principal = p
+	}
+	return req.principal, nil
+}
+
+// Fail unless the user has perm on the object the name points to, if any
+func (g *Gateway) checkName(req *request, os *ostore.ObjectStore, name string, perm ostore.Permission) error {
+	so, err := os.Resolve(name)
+	if err == ostore.ErrNotExists {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	p, err := g.principal(req)
+	if err != nil {
+		return err
+	}
+	return p.Check(so, perm)
+}
+
+// ACL of the objects created by the request
+func (g *Gateway) acl(req *request) ([]string, error) {
+	acl := []string{}
+	switch req.r.Header.Get("X-Amz-Acl") {
+	case "", "private":
+	case "public-read":
+		acl = append(acl, ostore.GRANT_PUBLIC_READ)
+	default:
+		return nil, errNotImplemented
+	}
+	for _, h := range req.r.Header[http.CanonicalHeaderKey(GRANT_HEADER)] {
+		for _, s := range strings.Split(h, ",") {
+			gr, err := ostore.ParseGrant(strings.TrimSpace(s))
+			if err != nil {
+				return nil, errInvalidArgument
+			}
+			acl = append(acl, gr.String())
+		}
+	}
+	return acl, nil
+}
+
+type locationResponse struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Region  string   `xml:",chardata"`
+}
+
+type owner struct {
+	ID          string
+	DisplayName string
+}
+
+type bucketEntry struct {
+	Name         string
+	CreationDate string
+}
+
+type listBucketsResponse struct {
+	XMLName xml.Name      `xml:"ListAllMyBucketsResult"`
+	Xmlns   string        `xml:"xmlns,attr"`
+	Owner   owner         `xml:"Owner"`
+	Buckets []bucketEntry `xml:"Buckets>Bucket"`
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func (g *Gateway) listBuckets(req *request) error {
+	resp := &listBucketsResponse{
+		Xmlns:   S3_XMLNS,
+		Owner:   owner{req.user.Handle, req.user.Name},
+		Buckets: []bucketEntry{},
+	}
+	for sr := range g.db.ScanRecords(&ostore.ObjectStore{}) {
+		if sr.Error != nil {
+			return sr.Error
+		}
+		os, ok := sr.Record.(*ostore.ObjectStore)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected struct type came out of the pipe %#v", sr.Record))
+		}
+		if os.Organization == req.org.Handle {
+			resp.Buckets = append(resp.Buckets, bucketEntry{os.Name, s3Time(os.GetCreatedAt())})
+		}
+	}
+	sortBuckets(resp.Buckets)
+	writeXML(req.w, resp)
+	return nil
+}
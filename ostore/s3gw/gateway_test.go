@@ -0,0 +1,420 @@
+package s3gw
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/acasajus/menac/db"
+	"github.com/acasajus/menac/ostore"
+	"github.com/acasajus/menac/registry"
+)
+
+var gdb db.DB
+
+func getDB() db.DB {
+	if gdb == nil {
+		d, err := db.NewTestDB("127.0.0.1", 3000)
+		if err != nil {
+			panic(err)
+		}
+		for _, register := range []func(db.DB) error{ostore.RegisterIndexes, registry.RegisterIndexes, RegisterIndexes} {
+			if err := register(d); err != nil {
+				panic(err)
+			}
+		}
+		gdb = d
+	}
+	return gdb
+}
+
+// Organization with a user in group "group", an access key for it and a
+// memory store as bucket "bucket"
+func getTestGateway(t *testing.T) (*Gateway, *registry.AccessKey) {
+	o := registry.NewOrg(getDB())
+	o.Handle = "s3org:" + time.Now().Format(time.RFC3339Nano)
+	if err := o.Create(); err != nil {
+		t.Fatal(err)
+	}
+	u := newTestUser(t, o, "user", "group")
+	g, err := o.CreateGroup("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.AddUsers(u.Handle)
+	if err := g.Store(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.CreateGroup("other"); err != nil {
+		t.Fatal(err)
+	}
+	os := ostore.NewObjectStore(o)
+	os.Name = "bucket"
+	os.Type = ostore.STORE_TYPE_MEM
+	if err := os.Create(); err != nil {
+		t.Fatal(err)
+	}
+	k, err := u.NewAccessKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(getDB()), k
+}
+
+func newTestUser(t *testing.T, o *registry.Organization, handle, group string) *registry.User {
+	u := o.NewUser()
+	u.Handle = handle
+	u.Name = handle
+	u.SetPassword("secret")
+	u.Email = []string{"s3@" + handle}
+	u.DefaultGroup = group
+	if err := u.Create(); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func getTestOrg(t *testing.T, handle string) *registry.Organization {
+	o := registry.NewOrg(getDB())
+	if err := getDB().GetRecord([]byte(handle), o); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// Sign a request the way S3 clients do, with the hash of the payload
+func newSignedRequest(k *registry.AccessKey, method, target string, body []byte) *http.Request {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	now := time.Now().UTC()
+	s := &signature{
+		Credential:    &credential{k.Id, now.Format(SIGV4_DAY_FORMAT), DEFAULT_REGION, SIGV4_SERVICE},
+		SignedHeaders: []string{"host", "x-amz-content-sha256", "x-amz-date"},
+		Date:          now,
+		PayloadHash:   sha256Hex(string(body)),
+	}
+	r.Header.Set("X-Amz-Date", s.amzDate())
+	r.Header.Set("X-Amz-Content-Sha256", s.PayloadHash)
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		SIGV4_ALGORITHM, k.Id, s.Credential.scope(), strings.Join(s.SignedHeaders, ";"), s.compute(r, k.Secret)))
+	return r
+}
+
+func serve(g *Gateway, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	return w
+}
+
+func errorCode(w *httptest.ResponseRecorder) string {
+	e := &errorResponse{}
+	xml.Unmarshal(w.Body.Bytes(), e)
+	return e.Code
+}
+
+func TestGatewayAuth(t *testing.T) {
+	g, k := getTestGateway(t)
+	r := httptest.NewRequest("GET", "/bucket/key", nil)
+	if w := serve(g, r); errorCode(w) != "AccessDenied" {
+		t.Errorf("Anonymous request got %d %s", w.Code, w.Body)
+	}
+	r = newSignedRequest(k, "GET", "/bucket", nil)
+	r.URL.RawQuery = "list-type=2"
+	if w := serve(g, r); errorCode(w) != "SignatureDoesNotMatch" {
+		t.Errorf("Modified request got %d %s", w.Code, w.Body)
+	}
+	other := *k
+	other.Id = "UNKNOWNKEY"
+	if w := serve(g, newSignedRequest(&other, "GET", "/", nil)); errorCode(w) != "InvalidAccessKeyId" {
+		t.Errorf("Unknown key got %d %s", w.Code, w.Body)
+	}
+	w := serve(g, newSignedRequest(k, "GET", "/", nil))
+	buckets := &listBucketsResponse{}
+	if err := xml.Unmarshal(w.Body.Bytes(), buckets); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Cannot list buckets: %d %s", w.Code, w.Body)
+	}
+	if len(buckets.Buckets) != 1 || buckets.Buckets[0].Name != "bucket" {
+		t.Errorf("Unexpected buckets %v", buckets.Buckets)
+	}
+	if w := serve(g, newSignedRequest(k, "GET", "/nobucket/key", nil)); errorCode(w) != "NoSuchBucket" {
+		t.Errorf("Missing bucket got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestGatewayObjects(t *testing.T) {
+	g, k := getTestGateway(t)
+	for _, key := range []string{"a/1", "a/2", "b", "c/d/e"} {
+		r := newSignedRequest(k, "PUT", "/bucket/"+key, []byte("data of "+key))
+		r.Header.Set("Content-Type", "text/plain")
+		r.Header.Set("X-Amz-Meta-Origin", "test")
+		if w := serve(g, r); w.Code != http.StatusOK || len(w.Header().Get("ETag")) == 0 {
+			t.Fatalf("[%s] Cannot put: %d %s", key, w.Code, w.Body)
+		}
+	}
+	r := newSignedRequest(k, "PUT", "/bucket/b", []byte("replaced"))
+	if w := serve(g, r); w.Code != http.StatusOK {
+		t.Fatalf("Cannot replace: %d %s", w.Code, w.Body)
+	}
+	r = newSignedRequest(k, "PUT", "/bucket/forbidden", []byte("data"))
+	r.Header.Set(GROUP_HEADER, "other")
+	if w := serve(g, r); errorCode(w) != "AccessDenied" {
+		t.Errorf("Put in a group of another user got %d %s", w.Code, w.Body)
+	}
+
+	w := serve(g, newSignedRequest(k, "GET", "/bucket/a/1", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "data of a/1" {
+		t.Errorf("Unexpected object %d %q", w.Code, w.Body)
+	}
+	if w.Header().Get("Content-Type") != "text/plain" || w.Header().Get("X-Amz-Meta-Origin") != "test" || w.Header().Get("Last-Modified") == "" {
+		t.Errorf("Unexpected headers %v", w.Header())
+	}
+	r = newSignedRequest(k, "GET", "/bucket/a/1", nil)
+	r.Header.Set("Range", "bytes=5-6")
+	if w := serve(g, r); w.Code != http.StatusPartialContent || w.Body.String() != "of" {
+		t.Errorf("Unexpected range %d %q", w.Code, w.Body)
+	}
+	if w := serve(g, newSignedRequest(k, "GET", "/bucket/b", nil)); w.Body.String() != "replaced" {
+		t.Errorf("Object was not replaced: %q", w.Body)
+	}
+	if w := serve(g, newSignedRequest(k, "HEAD", "/bucket/missing", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("Missing object got %d", w.Code)
+	}
+
+	for i, c := range []struct {
+		query    string
+		keys     []string
+		prefixes []string
+	}{
+		{"list-type=2", []string{"a/1", "a/2", "b", "c/d/e"}, nil},
+		{"list-type=2&delimiter=/", []string{"b"}, []string{"a/", "c/"}},
+		{"list-type=2&prefix=a/", []string{"a/1", "a/2"}, nil},
+		{"prefix=c/&delimiter=/", nil, []string{"c/d/"}},
+	} {
+		r := newSignedRequest(k, "GET", "/bucket?"+c.query, nil)
+		w := serve(g, r)
+		resp := &listObjectsV2Response{}
+		if err := xml.Unmarshal(w.Body.Bytes(), resp); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("#%d: Cannot list: %d %s", i, w.Code, w.Body)
+		}
+		keys, prefixes := []string{}, []string{}
+		for _, e := range resp.Contents {
+			keys = append(keys, e.Key)
+		}
+		for _, p := range resp.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(append([]string{}, c.keys...)) || fmt.Sprint(prefixes) != fmt.Sprint(append([]string{}, c.prefixes...)) {
+			t.Errorf("#%d: Unexpected listing %v %v", i, keys, prefixes)
+		}
+	}
+
+	//Page through the keys one at a time
+	keys := []string{}
+	token := ""
+	for {
+		r := newSignedRequest(k, "GET", "/bucket?list-type=2&max-keys=1&continuation-token="+token, nil)
+		resp := &listObjectsV2Response{}
+		if err := xml.Unmarshal(serve(g, r).Body.Bytes(), resp); err != nil || len(resp.Contents) != 1 {
+			t.Fatalf("Cannot list page: %v %v", resp, err)
+		}
+		keys = append(keys, resp.Contents[0].Key)
+		if !resp.IsTruncated {
+			break
+		}
+		token = resp.NextContinuationToken
+	}
+	if len(keys) != 4 {
+		t.Errorf("Unexpected pages %v", keys)
+	}
+
+	if w := serve(g, newSignedRequest(k, "DELETE", "/bucket/a/1", nil)); w.Code != http.StatusNoContent {
+		t.Errorf("Cannot delete: %d %s", w.Code, w.Body)
+	}
+	if w := serve(g, newSignedRequest(k, "DELETE", "/bucket/a/1", nil)); w.Code != http.StatusNoContent {
+		t.Errorf("Deleting twice got %d %s", w.Code, w.Body)
+	}
+	if w := serve(g, newSignedRequest(k, "GET", "/bucket/a/1", nil)); errorCode(w) != "NoSuchKey" {
+		t.Errorf("Deleted object got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestGatewayMultipart(t *testing.T) {
+	g, k := getTestGateway(t)
+	w := serve(g, newSignedRequest(k, "POST", "/bucket/big?uploads", nil))
+	initiated := &initiateResponse{}
+	if err := xml.Unmarshal(w.Body.Bytes(), initiated); err != nil || len(initiated.UploadId) == 0 {
+		t.Fatalf("Cannot initiate upload: %d %s", w.Code, w.Body)
+	}
+	target := "/bucket/big?uploadId=" + initiated.UploadId
+	parts := []string{strings.Repeat("x", 1000), strings.Repeat("y", 10)}
+	etags := []string{}
+	for i, p := range parts {
+		r := newSignedRequest(k, "PUT", fmt.Sprintf("%s&partNumber=%d", target, i+1), []byte(p))
+		w := serve(g, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("#%d: Cannot upload part: %d %s", i, w.Code, w.Body)
+		}
+		etags = append(etags, w.Header().Get("ETag"))
+	}
+	listed := &listPartsResponse{}
+	if err := xml.Unmarshal(serve(g, newSignedRequest(k, "GET", target, nil)).Body.Bytes(), listed); err != nil || len(listed.Parts) != 2 {
+		t.Errorf("Unexpected parts %v %v", listed, err)
+	}
+
+	complete := &bytes.Buffer{}
+	complete.WriteString("<CompleteMultipartUpload>")
+	for i := len(etags) - 1; i >= 0; i-- {
+		fmt.Fprintf(complete, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, etags[i])
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+	if w := serve(g, newSignedRequest(k, "POST", target, complete.Bytes())); errorCode(w) != "InvalidPartOrder" {
+		t.Errorf("Parts out of order got %d %s", w.Code, w.Body)
+	}
+	complete.Reset()
+	complete.WriteString("<CompleteMultipartUpload>")
+	for i, etag := range etags {
+		fmt.Fprintf(complete, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, etag)
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+	w = serve(g, newSignedRequest(k, "POST", target, complete.Bytes()))
+	completed := &completeResponse{}
+	if err := xml.Unmarshal(w.Body.Bytes(), completed); err != nil || !strings.HasSuffix(completed.ETag, "-2\"") {
+		t.Fatalf("Cannot complete upload: %d %s", w.Code, w.Body)
+	}
+	w = serve(g, newSignedRequest(k, "GET", "/bucket/big", nil))
+	if w.Body.String() != strings.Join(parts, "") || w.Header().Get("ETag") != completed.ETag {
+		t.Errorf("Unexpected object %d %q", w.Code, w.Body)
+	}
+	if w := serve(g, newSignedRequest(k, "GET", target, nil)); errorCode(w) != "NoSuchUpload" {
+		t.Errorf("Completed upload is still there: %d %s", w.Code, w.Body)
+	}
+	os, err := ostore.GetObjectStore(getTestOrg(t, k.Organization), "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, err := os.Objects(ostore.ObjectQuery{Type: PART_OBJECT_TYPE})
+	if err != nil || len(left) != 0 {
+		t.Errorf("Parts were not removed: %v %v", left, err)
+	}
+}
+
+func TestGatewayStreamingPut(t *testing.T) {
+	g, k := getTestGateway(t)
+	data := strings.Repeat("z", 3000)
+	now := time.Now().UTC()
+	s := &signature{
+		Credential:    &credential{k.Id, now.Format(SIGV4_DAY_FORMAT), DEFAULT_REGION, SIGV4_SERVICE},
+		SignedHeaders: []string{"host", "x-amz-content-sha256", "x-amz-date", "x-amz-decoded-content-length"},
+		Date:          now,
+		PayloadHash:   STREAMING_PAYLOAD,
+	}
+	r := httptest.NewRequest("PUT", "/bucket/streamed", nil)
+	r.Header.Set("X-Amz-Date", s.amzDate())
+	r.Header.Set("X-Amz-Content-Sha256", STREAMING_PAYLOAD)
+	r.Header.Set("X-Amz-Decoded-Content-Length", fmt.Sprint(len(data)))
+	s.Signature = s.compute(r, k.Secret)
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		SIGV4_ALGORITHM, k.Id, s.Credential.scope(), strings.Join(s.SignedHeaders, ";"), s.Signature))
+	//Sign the chunks with the reader that verifies them
+	body := &bytes.Buffer{}
+	signer := newChunkedBody(nil, k.Secret, s)
+	for _, chunk := range []string{data[:2000], data[2000:], ""} {
+		signer.h.Reset()
+		io.WriteString(signer.h, chunk)
+		sig := signer.chunkSignature()
+		signer.prevSig = sig
+		fmt.Fprintf(body, "%x;chunk-signature=%s\r\n%s\r\n", len(chunk), sig, chunk)
+	}
+	r.Body = ioutil.NopCloser(body)
+	if w := serve(g, r); w.Code != http.StatusOK {
+		t.Fatalf("Cannot put streamed object: %d %s", w.Code, w.Body)
+	}
+	if w := serve(g, newSignedRequest(k, "GET", "/bucket/streamed", nil)); w.Body.String() != data {
+		t.Errorf("Unexpected object of %d bytes", w.Body.Len())
+	}
+}
+
+func TestGatewayACL(t *testing.T) {
+	g, k := getTestGateway(t)
+	for key, acl := range map[string]string{"private": "", "shared": "", "public": "public-read"} {
+		r := newSignedRequest(k, "PUT", "/bucket/"+key, []byte("data of "+key))
+		r.Header.Set("X-Amz-Acl", acl)
+		if key == "shared" {
+			r.Header.Set(GRANT_HEADER, "user:reader:r")
+		}
+		if w := serve(g, r); w.Code != http.StatusOK {
+			t.Fatalf("[%s] Cannot put: %d %s", key, w.Code, w.Body)
+		}
+	}
+	o := getTestOrg(t, k.Organization)
+	u := newTestUser(t, o, "reader", "other")
+	other, err := o.GetGroup("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.AddUsers(u.Handle)
+	if err := other.Store(); err != nil {
+		t.Fatal(err)
+	}
+	rk, err := u.NewAccessKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range []struct {
+		method, key string
+		denied      bool
+	}{
+		{"GET", "private", true},
+		{"GET", "shared", false},
+		{"HEAD", "public", false},
+		{"PUT", "shared", true},
+		{"DELETE", "shared", true},
+		{"PUT", "new", false},
+	} {
+		w := serve(g, newSignedRequest(rk, c.method, "/bucket/"+c.key, []byte("data")))
+		if denied := w.Code == http.StatusForbidden; denied != c.denied {
+			t.Errorf("#%d: %s %s by another user got %d %s", i, c.method, c.key, w.Code, w.Body)
+		}
+	}
+	resp := &listObjectsV2Response{}
+	if err := xml.Unmarshal(serve(g, newSignedRequest(rk, "GET", "/bucket?list-type=2", nil)).Body.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, e := range resp.Contents {
+		keys = append(keys, e.Key)
+	}
+	if fmt.Sprint(keys) != "[new public shared]" {
+		t.Errorf("Unexpected listing of another user %v", keys)
+	}
+
+	r := newSignedRequest(rk, "PUT", "/bucket/private?acl", nil)
+	r.Header.Set(GRANT_HEADER, "user:reader:rwd")
+	if w := serve(g, r); w.Code != http.StatusForbidden {
+		t.Errorf("Another user changed the ACL: %d %s", w.Code, w.Body)
+	}
+	r = newSignedRequest(k, "PUT", "/bucket/private?acl", nil)
+	r.Header.Set(GRANT_HEADER, "group:other:rd")
+	if w := serve(g, r); w.Code != http.StatusOK {
+		t.Errorf("Cannot change the ACL: %d %s", w.Code, w.Body)
+	}
+	if w := serve(g, newSignedRequest(rk, "GET", "/bucket/private", nil)); w.Code != http.StatusOK {
+		t.Errorf("Group grant was not applied: %d %s", w.Code, w.Body)
+	}
+
+	//Organization administrators can do anything
+	other.AddProperties(ostore.PROP_ORG_ADMIN)
+	if err := other.Store(); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(g, newSignedRequest(rk, "PUT", "/bucket/shared", []byte("data"))); w.Code != http.StatusOK {
+		t.Errorf("Administrator cannot replace: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,265 @@
+package s3gw
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/acasajus/menac/db"
+	"github.com/acasajus/menac/ostore"
+)
+
+const (
+	LIST_MAX_KEYS = 1000
+	//Sorts after any UTF-8 byte, so listing from a common prefix plus this
+	//skips every key under it
+	LIST_PREFIX_END = "\xff"
+)
+
+type bucketSlice []bucketEntry
+
+func (s bucketSlice) Len() int           { return len(s) }
+func (s bucketSlice) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s bucketSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func sortBuckets(b []bucketEntry) {
+	sort.Sort(bucketSlice(b))
+}
+
+type listEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+	Owner        *owner `xml:",omitempty"`
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+// Keys and common prefixes of one listing page. Next is where the following
+// page starts, exclusive
+type listing struct {
+	Contents  []listEntry
+	Prefixes  []commonPrefix
+	Truncated bool
+	Next      string
+	//Last key or prefix returned
+	Last string
+}
+
+// Go through the names of a store collapsing common prefixes like S3 does
+func listNames(os *ostore.ObjectStore, p *ostore.Principal, prefix, delimiter, cursor string, maxKeys int) (*listing, error) {
+	l := &listing{Contents: []listEntry{}, Prefixes: []commonPrefix{}}
+	lastPrefix := ""
+	count := 0
+	for {
+		page, err := os.Names(prefix, cursor, LIST_MAX_KEYS)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range page.Names {
+			cp := ""
+			if len(delimiter) > 0 {
+				if i := strings.Index(n.Name[len(prefix):], delimiter); i >= 0 {
+					cp = n.Name[:len(prefix)+i+len(delimiter)]
+				}
+			}
+			if len(cp) > 0 && cp == lastPrefix {
+				continue
+			}
+			if count == maxKeys {
+				l.Truncated = true
+				return l, nil
+			}
+			if len(cp) > 0 {
+				lastPrefix = cp
+				l.Prefixes = append(l.Prefixes, commonPrefix{cp})
+				l.Last, l.Next = cp, cp+LIST_PREFIX_END
+				count++
+				continue
+			}
+			so, err := os.GetObject(n.ObjectId)
+			if err != nil {
+				if db.IsErrNotFound(err) || err == ostore.ErrNotExists {
+					//Its object expired or is being replaced
+					continue
+				}
+				return nil, err
+			}
+			if p.Check(so, ostore.PERM_READ) != nil {
+				continue
+			}
+			l.Contents = append(l.Contents, listEntry{
+				Key:          n.Name,
+				LastModified: s3Time(so.GetCreatedAt()),
+				ETag:         quoteETag(so.Metadata[META_ETAG]),
+				Size:         so.Size,
+				StorageClass: "STANDARD",
+			})
+			l.Last, l.Next = n.Name, n.Name
+			count++
+		}
+		if len(page.Next) == 0 {
+			return l, nil
+		}
+		cursor = page.Next
+	}
+}
+
+func maxKeys(q url.Values) (int, error) {
+	v := q.Get("max-keys")
+	if len(v) == 0 {
+		return LIST_MAX_KEYS, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errInvalidArgument
+	}
+	if n > LIST_MAX_KEYS {
+		n = LIST_MAX_KEYS
+	}
+	return n, nil
+}
+
+// Keys are URL encoded in the response if the client asks for it
+func encodeKeys(l *listing, encoding string) {
+	if encoding != "url" {
+		return
+	}
+	for i := range l.Contents {
+		l.Contents[i].Key = url.QueryEscape(l.Contents[i].Key)
+	}
+	for i := range l.Prefixes {
+		l.Prefixes[i].Prefix = url.QueryEscape(l.Prefixes[i].Prefix)
+	}
+}
+
+type listObjectsV2Response struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	EncodingType          string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	Contents              []listEntry
+	CommonPrefixes        []commonPrefix
+}
+
+func (g *Gateway) listObjectsV2(req *request, os *ostore.ObjectStore) error {
+	q := req.query
+	max, err := maxKeys(q)
+	if err != nil {
+		return err
+	}
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	cursor := q.Get("start-after")
+	token := q.Get("continuation-token")
+	if len(token) > 0 {
+		raw, err := base64.URLEncoding.DecodeString(token)
+		if err != nil {
+			return errInvalidArgument
+		}
+		cursor = string(raw)
+	}
+	p, err := g.principal(req)
+	if err != nil {
+		return err
+	}
+	l, err := listNames(os, p, prefix, delimiter, cursor, max)
+	if err != nil {
+		return err
+	}
+	resp := &listObjectsV2Response{
+		Xmlns:             S3_XMLNS,
+		Name:              os.Name,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           max,
+		KeyCount:          len(l.Contents) + len(l.Prefixes),
+		IsTruncated:       l.Truncated,
+		EncodingType:      q.Get("encoding-type"),
+		ContinuationToken: token,
+		StartAfter:        q.Get("start-after"),
+	}
+	if l.Truncated {
+		resp.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(l.Next))
+	}
+	if q.Get("fetch-owner") == "true" {
+		for i := range l.Contents {
+			l.Contents[i].Owner = &owner{req.user.Handle, req.user.Name}
+		}
+	}
+	encodeKeys(l, resp.EncodingType)
+	resp.Contents, resp.CommonPrefixes = l.Contents, l.Prefixes
+	writeXML(req.w, resp)
+	return nil
+}
+
+type listObjectsV1Response struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Xmlns          string   `xml:"xmlns,attr"`
+	Name           string
+	Prefix         string
+	Marker         string
+	NextMarker     string `xml:",omitempty"`
+	Delimiter      string `xml:",omitempty"`
+	MaxKeys        int
+	IsTruncated    bool
+	EncodingType   string `xml:",omitempty"`
+	Contents       []listEntry
+	CommonPrefixes []commonPrefix
+}
+
+func (g *Gateway) listObjectsV1(req *request, os *ostore.ObjectStore) error {
+	q := req.query
+	max, err := maxKeys(q)
+	if err != nil {
+		return err
+	}
+	prefix, delimiter, marker := q.Get("prefix"), q.Get("delimiter"), q.Get("marker")
+	cursor := marker
+	//Markers are plain keys, a common prefix as marker skips all its keys
+	if len(delimiter) > 0 && strings.HasSuffix(marker, delimiter) && strings.HasPrefix(marker, prefix) {
+		cursor = marker + LIST_PREFIX_END
+	}
+	p, err := g.principal(req)
+	if err != nil {
+		return err
+	}
+	l, err := listNames(os, p, prefix, delimiter, cursor, max)
+	if err != nil {
+		return err
+	}
+	resp := &listObjectsV1Response{
+		Xmlns:        S3_XMLNS,
+		Name:         os.Name,
+		Prefix:       prefix,
+		Marker:       marker,
+		Delimiter:    delimiter,
+		MaxKeys:      max,
+		IsTruncated:  l.Truncated,
+		EncodingType: q.Get("encoding-type"),
+	}
+	if l.Truncated && len(delimiter) > 0 {
+		resp.NextMarker = l.Last
+	}
+	encodeKeys(l, resp.EncodingType)
+	if len(resp.NextMarker) > 0 && resp.EncodingType == "url" {
+		resp.NextMarker = url.QueryEscape(resp.NextMarker)
+	}
+	resp.Contents, resp.CommonPrefixes = l.Contents, l.Prefixes
+	writeXML(req.w, resp)
+	return nil
+}
@@ -0,0 +1,502 @@
+package s3gw
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/acasajus/menac/db"
+	"github.com/acasajus/menac/ostore"
+)
+
+const (
+	//Type of the objects keeping the parts of an upload until it completes.
+	//They expire with the upload so the GC removes abandoned ones
+	PART_OBJECT_TYPE = "s3-part"
+	META_UPLOAD_ID   = "UploadId"
+	META_PART_NUMBER = "PartNumber"
+	//Largest part, like S3
+	MAX_PART_SIZE = 5 * 1024 * 1024 * 1024
+)
+
+// S3 multipart upload in progress. Each part is kept as an object of its own
+type MultipartUpload struct {
+	db.Record
+
+	Id           string
+	Organization string `db:"indexed"`
+	StoreName    string
+	Name         string
+	User         string
+	Group        string
+	Metadata     map[string]string
+	//ACL of the object once completed
+	ACL []string
+}
+
+func (u *MultipartUpload) GetPrimaryKey() []byte {
+	return []byte(fmt.Sprintf("%s:%s", u.Organization, u.Id))
+}
+
+func (u *MultipartUpload) Validate() error {
+	if len(u.Organization) == 0 {
+		return errors.New("Empty organization handle")
+	}
+	if len(u.Id) == 0 {
+		return errors.New("Empty upload id")
+	}
+	if len(u.StoreName) == 0 {
+		return errors.New("Empty store name")
+	}
+	if len(u.Name) == 0 {
+		return errors.New("Empty name")
+	}
+	return nil
+}
+
+// Create the indexes used to find the uploads of an organization
+func RegisterIndexes(d db.DB) error {
+	if err := d.RegisterIndexes(&MultipartUpload{}); err != nil && !db.IsErrIndexExists(err) {
+		return err
+	}
+	return nil
+}
+
+func newUploadId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+func partObjectId(uploadId string, n int) string {
+	return fmt.Sprintf("%s.%05d", uploadId, n)
+}
+
+func (g *Gateway) getUpload(req *request, os *ostore.ObjectStore, id string) (*MultipartUpload, error) {
+	u := &MultipartUpload{Organization: os.Organization, Id: id}
+	if err := g.db.GetRecord(u.GetPrimaryKey(), u); err != nil {
+		if db.IsErrNotFound(err) {
+			return nil, errNoSuchUpload
+		}
+		return nil, err
+	}
+	//Parts are gone once the upload expires
+	if u.StoreName != os.Name || u.Name != req.name || time.Since(u.GetCreatedAt()) > ostore.UPLOAD_EXPIRY {
+		return nil, errNoSuchUpload
+	}
+	if err := g.checkUpload(req, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Uploads are only seen by the user that initiated them and administrators
+func (g *Gateway) checkUpload(req *request, u *MultipartUpload) error {
+	if u.User == req.user.Handle {
+		return nil
+	}
+	p, err := g.principal(req)
+	if err != nil {
+		return err
+	}
+	if !p.Admin() {
+		return errAccessDenied
+	}
+	return nil
+}
+
+// Uploaded parts sorted by number
+func (g *Gateway) uploadParts(os *ostore.ObjectStore, u *MultipartUpload) ([]*ostore.StoredObject, error) {
+	parts, err := os.Objects(ostore.ObjectQuery{Type: PART_OBJECT_TYPE, Metadata: map[string]string{META_UPLOAD_ID: u.Id}})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(partSlice(parts))
+	return parts, nil
+}
+
+type partSlice []*ostore.StoredObject
+
+func (p partSlice) Len() int           { return len(p) }
+func (p partSlice) Less(i, j int) bool { return p[i].Id < p[j].Id }
+func (p partSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Remove the parts and the record of an upload
+func (g *Gateway) dropUpload(os *ostore.ObjectStore, u *MultipartUpload) error {
+	parts, err := g.uploadParts(os, u)
+	if err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if err := os.DeleteObject(p); err != nil && !db.IsErrNotFound(err) {
+			return err
+		}
+	}
+	_, err = g.db.DeleteRecord(u)
+	return err
+}
+
+type initiateResponse struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+func (g *Gateway) initiateUpload(req *request, os *ostore.ObjectStore) error {
+	group, err := g.group(req)
+	if err != nil {
+		return err
+	}
+	acl, err := g.acl(req)
+	if err != nil {
+		return err
+	}
+	if err := g.checkName(req, os, req.name, ostore.PERM_WRITE); err != nil {
+		return err
+	}
+	u := g.db.LinkRecordToDB(&MultipartUpload{
+		Id:           newUploadId(),
+		Organization: os.Organization,
+		StoreName:    os.Name,
+		Name:         req.name,
+		User:         req.user.Handle,
+		Group:        group,
+		Metadata:     objectMetadata(req.r.Header),
+		ACL:          acl,
+	}).(*MultipartUpload)
+	if err := g.db.CreateNewRecord(u); err != nil {
+		return err
+	}
+	writeXML(req.w, &initiateResponse{Xmlns: S3_XMLNS, Bucket: os.Name, Key: req.name, UploadId: u.Id})
+	return nil
+}
+
+func partNumber(v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > ostore.UPLOAD_MAX_PARTS {
+		return 0, errInvalidArgument
+	}
+	return n, nil
+}
+
+func (g *Gateway) uploadPart(req *request, os *ostore.ObjectStore, uploadId string) error {
+	n, err := partNumber(req.query.Get("partNumber"))
+	if err != nil {
+		return err
+	}
+	u, err := g.getUpload(req, os, uploadId)
+	if err != nil {
+		return err
+	}
+	data, err := g.spool(req, MAX_PART_SIZE)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	part := g.newObject(req, os, u.Group, map[string]string{
+		META_UPLOAD_ID:   u.Id,
+		META_PART_NUMBER: strconv.Itoa(n),
+		META_ETAG:        data.etag(),
+	})
+	part.Id = partObjectId(u.Id, n)
+	part.User = u.User
+	part.Type = PART_OBJECT_TYPE
+	part.Hash = data.hash
+	part.Expiration = u.GetCreatedAt().Add(ostore.UPLOAD_EXPIRY)
+	//Uploading a part again replaces it
+	if old, err := os.GetObject(part.Id); err == nil {
+		if err := os.DeleteObject(old); err != nil {
+			return err
+		}
+	} else if !db.IsErrNotFound(err) && err != ostore.ErrNotExists {
+		return err
+	}
+	if err := os.PutObject(part, data, data.size); err != nil {
+		return err
+	}
+	req.w.Header().Set("ETag", quoteETag(data.etag()))
+	return nil
+}
+
+type partEntry struct {
+	PartNumber   int
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+type listPartsResponse struct {
+	XMLName              xml.Name `xml:"ListPartsResult"`
+	Xmlns                string   `xml:"xmlns,attr"`
+	Bucket               string
+	Key                  string
+	UploadId             string
+	PartNumberMarker     int
+	NextPartNumberMarker int
+	MaxParts             int
+	IsTruncated          bool
+	Parts                []partEntry `xml:"Part"`
+}
+
+func (g *Gateway) listParts(req *request, os *ostore.ObjectStore, uploadId string) error {
+	u, err := g.getUpload(req, os, uploadId)
+	if err != nil {
+		return err
+	}
+	marker := 0
+	if v := req.query.Get("part-number-marker"); len(v) > 0 {
+		if marker, err = strconv.Atoi(v); err != nil {
+			return errInvalidArgument
+		}
+	}
+	max, err := maxKeys(map[string][]string{"max-keys": req.query["max-parts"]})
+	if err != nil {
+		return err
+	}
+	parts, err := g.uploadParts(os, u)
+	if err != nil {
+		return err
+	}
+	resp := &listPartsResponse{Xmlns: S3_XMLNS, Bucket: os.Name, Key: u.Name, UploadId: u.Id, PartNumberMarker: marker, MaxParts: max}
+	for _, p := range parts {
+		n, _ := strconv.Atoi(p.Metadata[META_PART_NUMBER])
+		if n <= marker {
+			continue
+		}
+		if len(resp.Parts) == max {
+			resp.IsTruncated = true
+			break
+		}
+		resp.Parts = append(resp.Parts, partEntry{n, s3Time(p.GetCreatedAt()), quoteETag(p.Metadata[META_ETAG]), p.Size})
+		resp.NextPartNumberMarker = n
+	}
+	writeXML(req.w, resp)
+	return nil
+}
+
+type uploadEntry struct {
+	Key       string
+	UploadId  string
+	Initiator owner
+	Owner     owner
+	Initiated string
+}
+
+type listUploadsResponse struct {
+	XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+	Xmlns       string   `xml:"xmlns,attr"`
+	Bucket      string
+	Prefix      string
+	MaxUploads  int
+	IsTruncated bool
+	Uploads     []uploadEntry `xml:"Upload"`
+}
+
+type uploadSlice []uploadEntry
+
+func (s uploadSlice) Len() int { return len(s) }
+func (s uploadSlice) Less(i, j int) bool {
+	if s[i].Key != s[j].Key {
+		return s[i].Key < s[j].Key
+	}
+	return s[i].Initiated < s[j].Initiated
+}
+func (s uploadSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// Uploads in progress in a bucket. Paging is not supported, every upload is
+// returned at once
+func (g *Gateway) listUploads(req *request, os *ostore.ObjectStore) error {
+	prefix := req.query.Get("prefix")
+	resp := &listUploadsResponse{Xmlns: S3_XMLNS, Bucket: os.Name, Prefix: prefix, MaxUploads: LIST_MAX_KEYS}
+	for sr := range g.db.Search(&MultipartUpload{}, "Organization", os.Organization) {
+		if sr.Error != nil {
+			return sr.Error
+		}
+		u, ok := sr.Record.(*MultipartUpload)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected struct type came out of the pipe %#v", sr.Record))
+		}
+		if u.StoreName != os.Name || len(u.Name) < len(prefix) || u.Name[:len(prefix)] != prefix {
+			continue
+		}
+		if time.Since(u.GetCreatedAt()) > ostore.UPLOAD_EXPIRY || g.checkUpload(req, u) != nil {
+			continue
+		}
+		who := owner{u.User, u.User}
+		resp.Uploads = append(resp.Uploads, uploadEntry{u.Name, u.Id, who, who, s3Time(u.GetCreatedAt())})
+	}
+	sort.Sort(uploadSlice(resp.Uploads))
+	writeXML(req.w, resp)
+	return nil
+}
+
+func (g *Gateway) abortUpload(req *request, os *ostore.ObjectStore, uploadId string) error {
+	u, err := g.getUpload(req, os, uploadId)
+	if err != nil {
+		return err
+	}
+	if err := g.dropUpload(os, u); err != nil {
+		return err
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeResponse struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+// Parts read one after the other, each opened only when the previous one is
+// exhausted
+type partsReader struct {
+	st      ostore.Store
+	parts   []*ostore.StoredObject
+	current ostore.ObjectReader
+}
+
+func (pr *partsReader) Read(p []byte) (int, error) {
+	for {
+		if pr.current == nil {
+			if len(pr.parts) == 0 {
+				return 0, io.EOF
+			}
+			r, err := pr.st.Open(pr.parts[0])
+			if err != nil {
+				return 0, err
+			}
+			pr.current, pr.parts = r, pr.parts[1:]
+		}
+		n, err := pr.current.Read(p)
+		if err == io.EOF {
+			pr.current.Close()
+			pr.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (pr *partsReader) Close() error {
+	if pr.current != nil {
+		return pr.current.Close()
+	}
+	return nil
+}
+
+// Create the object from the parts listed by the client
+func (g *Gateway) completeUpload(req *request, os *ostore.ObjectStore, uploadId string) error {
+	u, err := g.getUpload(req, os, uploadId)
+	if err != nil {
+		return err
+	}
+	complete := &completeRequest{}
+	if err := g.readXML(req, complete); err != nil {
+		return err
+	}
+	//The name may point to another object since the upload started
+	if err := g.checkName(req, os, u.Name, ostore.PERM_WRITE); err != nil {
+		return err
+	}
+	if len(complete.Parts) == 0 {
+		return errMalformedXML
+	}
+	uploaded, err := g.uploadParts(os, u)
+	if err != nil {
+		return err
+	}
+	byNumber := map[int]*ostore.StoredObject{}
+	for _, p := range uploaded {
+		n, _ := strconv.Atoi(p.Metadata[META_PART_NUMBER])
+		byNumber[n] = p
+	}
+	parts := []*ostore.StoredObject{}
+	etags := md5.New()
+	var size int64
+	for i, cp := range complete.Parts {
+		if i > 0 && cp.PartNumber <= complete.Parts[i-1].PartNumber {
+			return errInvalidPartOrder
+		}
+		p, ok := byNumber[cp.PartNumber]
+		if !ok || p.Metadata[META_ETAG] != unquoteETag(cp.ETag) {
+			return errInvalidPart
+		}
+		raw, err := hex.DecodeString(p.Metadata[META_ETAG])
+		if err != nil {
+			return errInvalidPart
+		}
+		etags.Write(raw)
+		parts = append(parts, p)
+		size += p.Size
+	}
+	st, err := os.Open()
+	if err != nil {
+		return err
+	}
+	pr := &partsReader{st: st, parts: parts}
+	hr := ostore.NewHashReader(pr)
+	_, err = io.Copy(ioutil.Discard, hr)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(etags.Sum(nil)), len(parts))
+	meta := map[string]string{}
+	for k, v := range u.Metadata {
+		meta[k] = v
+	}
+	meta[META_ETAG] = etag
+	so := g.newObject(req, os, u.Group, meta)
+	so.User = u.User
+	so.Hash = hr.HexDigest()
+	so.ACL = u.ACL
+	pr = &partsReader{st: st, parts: parts}
+	err = os.PutObject(so, pr, size)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	if err := g.setName(os, u.Name, so); err != nil {
+		return err
+	}
+	if err := g.dropUpload(os, u); err != nil {
+		//Left over parts expire with the upload
+		log.Printf("s3gw: Cannot remove parts of upload %s: %s", u.Id, err)
+	}
+	writeXML(req.w, &completeResponse{
+		Xmlns:    S3_XMLNS,
+		Location: "/" + os.Name + "/" + u.Name,
+		Bucket:   os.Name,
+		Key:      u.Name,
+		ETag:     quoteETag(etag),
+	})
+	return nil
+}
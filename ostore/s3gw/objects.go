@@ -0,0 +1,343 @@
+package s3gw
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/acasajus/menac/ostore"
+)
+
+const (
+	//Largest object accepted in a single PUT, like S3
+	MAX_PUT_SIZE = 5 * 1024 * 1024 * 1024
+	//Metadata key the ETag of an object is kept under. The rest of the keys
+	//are the headers returned with the object
+	META_ETAG = "ETag"
+	//Keys in a multi object delete request
+	MAX_DELETE_KEYS = 1000
+)
+
+// Headers kept with an object and returned when it is read
+var storedHeaders = []string{"Content-Type", "Content-Encoding", "Content-Disposition", "Content-Language", "Cache-Control", "Expires"}
+
+func objectMetadata(h http.Header) map[string]string {
+	meta := map[string]string{}
+	for _, k := range storedHeaders {
+		if v := h.Get(k); len(v) > 0 {
+			meta[k] = v
+		}
+	}
+	for k, v := range h {
+		if strings.HasPrefix(k, "X-Amz-Meta-") && len(v) > 0 {
+			meta[k] = v[0]
+		}
+	}
+	return meta
+}
+
+func quoteETag(etag string) string {
+	return "\"" + etag + "\""
+}
+
+func unquoteETag(etag string) string {
+	return strings.Trim(strings.TrimSpace(etag), "\"")
+}
+
+// Request body copied to a temporary file, with the hash the object store
+// needs to reference it and the MD5 S3 clients expect as ETag
+type spooled struct {
+	*os.File
+	size int64
+	hash string
+	md5  []byte
+}
+
+func (s *spooled) Close() error {
+	s.File.Close()
+	return os.Remove(s.File.Name())
+}
+
+func (s *spooled) etag() string {
+	return hex.EncodeToString(s.md5)
+}
+
+// Read the whole body of a request, checking it against its signature and its
+// Content-MD5 if there is one
+func (g *Gateway) spool(req *request, maxSize int64) (*spooled, error) {
+	body, length, err := signedBody(req.r, req.sig, req.key.Secret)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		return nil, errMissingContentLength
+	}
+	if length > maxSize {
+		return nil, errEntityTooLarge
+	}
+	var expectedMD5 []byte
+	if v := req.r.Header.Get("Content-MD5"); len(v) > 0 {
+		if expectedMD5, err = base64.StdEncoding.DecodeString(v); err != nil || len(expectedMD5) != md5.Size {
+			return nil, errInvalidDigest
+		}
+	}
+	f, err := ioutil.TempFile(g.TempDir, "s3gw-")
+	if err != nil {
+		return nil, err
+	}
+	s := &spooled{File: f}
+	hr, err := ostore.NewMultiHashReader(io.LimitReader(body, length), ostore.HASH_SHA512, ostore.HASH_MD5)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if _, err := io.Copy(f, hr); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if hr.Size() != length {
+		s.Close()
+		return nil, errIncompleteBody
+	}
+	s.size, s.hash, s.md5 = hr.Size(), hr.Hash(ostore.HASH_SHA512), hr.Sum(ostore.HASH_MD5)
+	if expectedMD5 != nil && !bytes.Equal(expectedMD5, s.md5) {
+		s.Close()
+		return nil, errBadDigest
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Object for the data of a request, owned by its user
+func (g *Gateway) newObject(req *request, os *ostore.ObjectStore, group string, meta map[string]string) *ostore.StoredObject {
+	so := os.NewObject()
+	so.User = req.user.Handle
+	so.Group = group
+	so.Type = OBJECT_TYPE
+	so.Metadata = meta
+	return so
+}
+
+// Point the request key to a new object and delete the ones the store does
+// not retain anymore
+func (g *Gateway) setName(os *ostore.ObjectStore, name string, so *ostore.StoredObject) error {
+	released, err := os.SetName(name, so)
+	if err != nil {
+		os.DeleteObject(so)
+		return err
+	}
+	for _, old := range released {
+		if err := os.DeleteObject(old); err != nil {
+			log.Printf("s3gw: Cannot delete replaced object %s: %s", old.Id, err)
+		}
+	}
+	return nil
+}
+
+func (g *Gateway) putObject(req *request, os *ostore.ObjectStore) error {
+	group, err := g.group(req)
+	if err != nil {
+		return err
+	}
+	acl, err := g.acl(req)
+	if err != nil {
+		return err
+	}
+	if err := g.checkName(req, os, req.name, ostore.PERM_WRITE); err != nil {
+		return err
+	}
+	data, err := g.spool(req, MAX_PUT_SIZE)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	so := g.newObject(req, os, group, objectMetadata(req.r.Header))
+	so.Hash = data.hash
+	so.Metadata[META_ETAG] = data.etag()
+	so.ACL = acl
+	if err := os.PutObject(so, data, data.size); err != nil {
+		return err
+	}
+	if err := g.setName(os, req.name, so); err != nil {
+		return err
+	}
+	req.w.Header().Set("ETag", quoteETag(data.etag()))
+	return nil
+}
+
+// Serve GET and HEAD. Ranges and conditional requests are handled by
+// http.ServeContent. Prior versions are read with ?versionId
+func (g *Gateway) getObject(req *request, os *ostore.ObjectStore) error {
+	so, err := g.resolve(req, os)
+	if err != nil {
+		return err
+	}
+	p, err := g.principal(req)
+	if err != nil {
+		return err
+	}
+	if err := p.Check(so, ostore.PERM_READ); err != nil {
+		return err
+	}
+	st, err := os.Open()
+	if err != nil {
+		return err
+	}
+	r, err := st.Open(so)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := req.w.Header()
+	for k, v := range so.Metadata {
+		if k == META_ETAG {
+			v = quoteETag(v)
+		}
+		h.Set(k, v)
+	}
+	if len(h.Get("Content-Type")) == 0 {
+		h.Set("Content-Type", "binary/octet-stream")
+	}
+	h.Set("Accept-Ranges", "bytes")
+	http.ServeContent(req.w, req.r, "", so.GetCreatedAt(), r)
+	return nil
+}
+
+func (g *Gateway) resolve(req *request, os *ostore.ObjectStore) (*ostore.StoredObject, error) {
+	if !queryHas(req.query, "versionId") {
+		return os.Resolve(req.name)
+	}
+	version, err := strconv.ParseInt(req.query.Get("versionId"), 10, 64)
+	if err != nil || version < 1 {
+		return nil, errInvalidArgument
+	}
+	so, err := os.ResolveVersion(req.name, version)
+	if err == ostore.ErrDeleteMarker {
+		req.w.Header().Set("X-Amz-Delete-Marker", "true")
+		return nil, errMethodNotAllowed
+	}
+	return so, err
+}
+
+// Remove a name and the objects the store does not retain anymore. Deleting
+// what does not exist succeeds, as in S3
+func (g *Gateway) deleteName(req *request, os *ostore.ObjectStore, name string) error {
+	if err := g.checkName(req, os, name, ostore.PERM_DELETE); err != nil {
+		return err
+	}
+	released, err := os.Unname(name)
+	if err != nil && err != ostore.ErrNotExists {
+		return err
+	}
+	for _, so := range released {
+		if err := os.DeleteObject(so); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace the ACL of the object a name points to with the one in the request
+// headers. Only the owner of the object and administrators can
+func (g *Gateway) putACL(req *request, os *ostore.ObjectStore) error {
+	acl, err := g.acl(req)
+	if err != nil {
+		return err
+	}
+	so, err := os.Resolve(req.name)
+	if err != nil {
+		return err
+	}
+	p, err := g.principal(req)
+	if err != nil {
+		return err
+	}
+	if !p.Owns(so) {
+		return errAccessDenied
+	}
+	return os.SetACL(so, acl)
+}
+
+func (g *Gateway) deleteObject(req *request, os *ostore.ObjectStore) error {
+	if err := g.deleteName(req, os, req.name); err != nil {
+		return err
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type deleteRequest struct {
+	Quiet   bool
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type deletedEntry struct {
+	Key string
+}
+
+type deleteErrorEntry struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+type deleteResponse struct {
+	XMLName xml.Name           `xml:"DeleteResult"`
+	Xmlns   string             `xml:"xmlns,attr"`
+	Deleted []deletedEntry     `xml:"Deleted"`
+	Errors  []deleteErrorEntry `xml:"Error"`
+}
+
+// Read a small XML request body checking its signature
+func (g *Gateway) readXML(req *request, v interface{}) error {
+	body, err := g.spool(req, 1024*1024)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := xml.NewDecoder(body).Decode(v); err != nil {
+		return errMalformedXML
+	}
+	return nil
+}
+
+func (g *Gateway) deleteObjects(req *request, os *ostore.ObjectStore) error {
+	//S3 requires a Content-MD5 for this one
+	if len(req.r.Header.Get("Content-MD5")) == 0 && req.sig.PayloadHash == UNSIGNED_PAYLOAD {
+		return errMissingSecurityHeader
+	}
+	del := &deleteRequest{}
+	if err := g.readXML(req, del); err != nil {
+		return err
+	}
+	if len(del.Objects) > MAX_DELETE_KEYS {
+		return errMalformedXML
+	}
+	resp := &deleteResponse{Xmlns: S3_XMLNS}
+	for _, o := range del.Objects {
+		if err := g.deleteName(req, os, o.Key); err != nil {
+			e := toS3Error(err)
+			resp.Errors = append(resp.Errors, deleteErrorEntry{o.Key, e.Code, e.Message})
+			continue
+		}
+		if !del.Quiet {
+			resp.Deleted = append(resp.Deleted, deletedEntry{o.Key})
+		}
+	}
+	writeXML(req.w, resp)
+	return nil
+}
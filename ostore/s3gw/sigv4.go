@@ -0,0 +1,447 @@
+package s3gw
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SIGV4_ALGORITHM    = "AWS4-HMAC-SHA256"
+	SIGV4_CHUNK_ALG    = "AWS4-HMAC-SHA256-PAYLOAD"
+	SIGV4_SERVICE      = "s3"
+	SIGV4_TERMINATOR   = "aws4_request"
+	SIGV4_TIME_FORMAT  = "20060102T150405Z"
+	SIGV4_DAY_FORMAT   = "20060102"
+	SIGV4_MAX_EXPIRES  = 7 * 24 * 60 * 60
+	UNSIGNED_PAYLOAD   = "UNSIGNED-PAYLOAD"
+	STREAMING_PAYLOAD  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	EMPTY_PAYLOAD_HASH = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	MAX_CHUNK_SIZE     = 16 * 1024 * 1024
+)
+
+var (
+	errMalformedAuth = errors.New("Malformed authorization")
+	errChunkSig      = errors.New("Chunk signature does not match")
+	errBadChunk      = errors.New("Malformed chunk")
+	errPayloadHash   = errors.New("Payload hash does not match")
+)
+
+// Scope the signing key is derived for
+type credential struct {
+	KeyId   string
+	Day     string
+	Region  string
+	Service string
+}
+
+func parseCredential(s string) (*credential, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 5 || parts[4] != SIGV4_TERMINATOR || len(parts[0]) == 0 {
+		return nil, errMalformedAuth
+	}
+	return &credential{parts[0], parts[1], parts[2], parts[3]}, nil
+}
+
+func (c *credential) scope() string {
+	return strings.Join([]string{c.Day, c.Region, c.Service, SIGV4_TERMINATOR}, "/")
+}
+
+// What a request was signed with, from its Authorization header or from the
+// query of a presigned URL
+type signature struct {
+	Credential    *credential
+	SignedHeaders []string
+	Signature     string
+	Date          time.Time
+	//Seconds a presigned URL is valid for, 0 for header signatures
+	Expires     int
+	PayloadHash string
+}
+
+func (s *signature) presigned() bool {
+	return s.Expires > 0
+}
+
+func (s *signature) amzDate() string {
+	return s.Date.Format(SIGV4_TIME_FORMAT)
+}
+
+// Parse the signature of a request. Requests without any come back as nil
+func parseSignature(r *http.Request) (*signature, error) {
+	if auth := r.Header.Get("Authorization"); len(auth) > 0 {
+		return parseAuthHeader(r, auth)
+	}
+	if r.URL.Query().Get("X-Amz-Algorithm") != "" {
+		return parsePresigned(r)
+	}
+	return nil, nil
+}
+
+func parseAuthHeader(r *http.Request, auth string) (*signature, error) {
+	if !strings.HasPrefix(auth, SIGV4_ALGORITHM+" ") {
+		return nil, errMalformedAuth
+	}
+	s := &signature{}
+	for _, field := range strings.Split(auth[len(SIGV4_ALGORITHM)+1:], ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return nil, errMalformedAuth
+		}
+		switch kv[0] {
+		case "Credential":
+			c, err := parseCredential(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			s.Credential = c
+		case "SignedHeaders":
+			s.SignedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			s.Signature = kv[1]
+		}
+	}
+	if s.Credential == nil || len(s.SignedHeaders) == 0 || len(s.Signature) == 0 {
+		return nil, errMalformedAuth
+	}
+	var err error
+	if d := r.Header.Get("X-Amz-Date"); len(d) > 0 {
+		s.Date, err = time.Parse(SIGV4_TIME_FORMAT, d)
+	} else {
+		s.Date, err = http.ParseTime(r.Header.Get("Date"))
+	}
+	if err != nil {
+		return nil, errMalformedAuth
+	}
+	s.PayloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if len(s.PayloadHash) == 0 {
+		return nil, errMalformedAuth
+	}
+	return s, nil
+}
+
+func parsePresigned(r *http.Request) (*signature, error) {
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != SIGV4_ALGORITHM {
+		return nil, errMalformedAuth
+	}
+	c, err := parseCredential(q.Get("X-Amz-Credential"))
+	if err != nil {
+		return nil, err
+	}
+	s := &signature{
+		Credential:    c,
+		SignedHeaders: strings.Split(q.Get("X-Amz-SignedHeaders"), ";"),
+		Signature:     q.Get("X-Amz-Signature"),
+		PayloadHash:   UNSIGNED_PAYLOAD,
+	}
+	if s.Date, err = time.Parse(SIGV4_TIME_FORMAT, q.Get("X-Amz-Date")); err != nil {
+		return nil, errMalformedAuth
+	}
+	if s.Expires, err = strconv.Atoi(q.Get("X-Amz-Expires")); err != nil || s.Expires < 1 || s.Expires > SIGV4_MAX_EXPIRES {
+		return nil, errMalformedAuth
+	}
+	if len(s.Signature) == 0 {
+		return nil, errMalformedAuth
+	}
+	return s, nil
+}
+
+// Percent encode the way SigV4 expects: everything but unreserved characters,
+// and slashes too unless they separate path segments
+func awsEscape(s string, path bool) string {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', path && c == '/':
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func canonicalQuery(r *http.Request, presigned bool) string {
+	pairs := []string{}
+	for k, vs := range r.URL.Query() {
+		if presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func canonicalHeaderValue(r *http.Request, name string) string {
+	var values []string
+	switch name {
+	case "host":
+		values = []string{r.Host}
+	case "content-length":
+		//Go takes it out of the header map for some requests
+		if v := r.Header.Get("Content-Length"); len(v) > 0 {
+			values = []string{v}
+		} else {
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		}
+	case "transfer-encoding":
+		values = []string{strings.Join(r.TransferEncoding, ",")}
+	default:
+		values = r.Header[http.CanonicalHeaderKey(name)]
+	}
+	trimmed := make([]string, len(values))
+	for i, v := range values {
+		trimmed[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(trimmed, ",")
+}
+
+func canonicalRequest(r *http.Request, s *signature) string {
+	path := r.URL.Path
+	if len(path) == 0 {
+		path = "/"
+	}
+	headers := &bytes.Buffer{}
+	for _, h := range s.SignedHeaders {
+		fmt.Fprintf(headers, "%s:%s\n", h, canonicalHeaderValue(r, h))
+	}
+	return strings.Join([]string{
+		r.Method,
+		awsEscape(path, true),
+		canonicalQuery(r, s.presigned()),
+		headers.String(),
+		strings.Join(s.SignedHeaders, ";"),
+		s.PayloadHash,
+	}, "\n")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+func signingKey(secret string, c *credential) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), c.Day)
+	k = hmacSHA256(k, c.Region)
+	k = hmacSHA256(k, c.Service)
+	return hmacSHA256(k, SIGV4_TERMINATOR)
+}
+
+// Signature the request should carry if it was signed with the secret
+func (s *signature) compute(r *http.Request, secret string) string {
+	toSign := strings.Join([]string{
+		SIGV4_ALGORITHM,
+		s.amzDate(),
+		s.Credential.scope(),
+		sha256Hex(canonicalRequest(r, s)),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(signingKey(secret, s.Credential), toSign))
+}
+
+// Check the signature of a request against the secret of its access key
+func (s *signature) verify(r *http.Request, secret string, now time.Time, maxSkew time.Duration) *s3Error {
+	if s.Credential.Service != SIGV4_SERVICE || s.Credential.Day != s.Date.Format(SIGV4_DAY_FORMAT) {
+		return errAuthMalformed
+	}
+	signed := false
+	for _, h := range s.SignedHeaders {
+		signed = signed || h == "host"
+	}
+	if !signed {
+		return errAuthMalformed
+	}
+	if s.presigned() {
+		if now.Before(s.Date.Add(-maxSkew)) {
+			return errRequestNotReadyYet
+		}
+		if now.After(s.Date.Add(time.Duration(s.Expires) * time.Second)) {
+			return errExpiredRequest
+		}
+	} else if d := now.Sub(s.Date); d > maxSkew || d < -maxSkew {
+		return errRequestTimeTooSkewed
+	}
+	if !hmac.Equal([]byte(s.compute(r, secret)), []byte(s.Signature)) {
+		return errSignatureDoesNotMatch
+	}
+	return nil
+}
+
+// Body checked against the payload hash it was signed with once it is fully
+// read
+type hashedBody struct {
+	r        io.Reader
+	h        hash.Hash
+	expected string
+}
+
+func (b *hashedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(b.h.Sum(nil)) != b.expected {
+		return n, errPayloadHash
+	}
+	return n, err
+}
+
+// Body sent with aws-chunked encoding. Every chunk is signed with the
+// signature of the previous one, starting with the one of the request
+type chunkedBody struct {
+	r       *bufio.Reader
+	key     []byte
+	s       *signature
+	prevSig string
+
+	remaining int64
+	chunkSig  string
+	h         hash.Hash
+	done      bool
+}
+
+func newChunkedBody(r io.Reader, secret string, s *signature) *chunkedBody {
+	return &chunkedBody{
+		r:       bufio.NewReader(r),
+		key:     signingKey(secret, s.Credential),
+		s:       s,
+		prevSig: s.Signature,
+		h:       sha256.New(),
+	}
+}
+
+func (b *chunkedBody) readLine() (string, error) {
+	line, err := b.r.ReadSlice('\n')
+	if err != nil {
+		if err == io.EOF || err == bufio.ErrBufferFull {
+			return "", errBadChunk
+		}
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errBadChunk
+	}
+	return string(line[:len(line)-2]), nil
+}
+
+// Read the header of the next chunk: <hex size>;chunk-signature=<sig>
+func (b *chunkedBody) nextChunk() error {
+	line, err := b.readLine()
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(line, ";", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[1], "chunk-signature=") {
+		return errBadChunk
+	}
+	size, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil || size < 0 || size > MAX_CHUNK_SIZE {
+		return errBadChunk
+	}
+	b.remaining = size
+	b.chunkSig = strings.TrimPrefix(parts[1], "chunk-signature=")
+	b.h.Reset()
+	return nil
+}
+
+// Signature of the data hashed so far, chained to the previous one
+func (b *chunkedBody) chunkSignature() string {
+	toSign := strings.Join([]string{
+		SIGV4_CHUNK_ALG,
+		b.s.amzDate(),
+		b.s.Credential.scope(),
+		b.prevSig,
+		EMPTY_PAYLOAD_HASH,
+		hex.EncodeToString(b.h.Sum(nil)),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(b.key, toSign))
+}
+
+// Verify the chunk just read and skip the CRLF after its data
+func (b *chunkedBody) endChunk() error {
+	sig := b.chunkSignature()
+	if !hmac.Equal([]byte(sig), []byte(b.chunkSig)) {
+		return errChunkSig
+	}
+	b.prevSig = sig
+	if line, err := b.readLine(); err != nil || len(line) > 0 {
+		return errBadChunk
+	}
+	return nil
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	for !b.done && b.remaining == 0 {
+		if err := b.nextChunk(); err != nil {
+			return 0, err
+		}
+		if b.remaining > 0 {
+			break
+		}
+		//The last chunk is empty and signed like the rest
+		if err := b.endChunk(); err != nil {
+			return 0, err
+		}
+		b.done = true
+	}
+	if b.done {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.r.Read(p)
+	b.h.Write(p[:n])
+	b.remaining -= int64(n)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, err
+	}
+	if b.remaining == 0 {
+		if err := b.endChunk(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Body of a signed request that fails while being read if it does not match
+// its signature. Also returns the length of the decoded data, -1 if unknown
+func signedBody(r *http.Request, s *signature, secret string) (io.Reader, int64, error) {
+	switch s.PayloadHash {
+	case UNSIGNED_PAYLOAD:
+		return r.Body, r.ContentLength, nil
+	case STREAMING_PAYLOAD:
+		length, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil || length < 0 {
+			return nil, -1, errMissingContentLength
+		}
+		return newChunkedBody(r.Body, secret, s), length, nil
+	}
+	if _, err := hex.DecodeString(s.PayloadHash); err != nil || len(s.PayloadHash) != sha256.Size*2 {
+		return nil, -1, errInvalidContentSha256
+	}
+	return &hashedBody{r.Body, sha256.New(), s.PayloadHash}, r.ContentLength, nil
+}
@@ -1,7 +1,11 @@
 package ostore
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -19,8 +23,23 @@ const (
 	S3_SECRET_KEY   = "secret_key"
 	S3_ENDPOINT_URL = "endpoint"
 	S3_BUCKET       = "bucket_name"
+
+	//S3 only keeps user headers with this prefix
+	S3_META_PREFIX = "X-Amz-Meta-"
 )
 
+func init() {
+	RegisterBackend(STORE_TYPE_S3, []ConfigField{
+		{Name: S3_ACCES_KEY, Required: true},
+		{Name: S3_SECRET_KEY, Required: true},
+		{Name: S3_ENDPOINT_URL, Required: true},
+		{Name: S3_BUCKET, Required: true},
+	}, func(c map[string]string) (Store, error) {
+		s := &S3Store{}
+		return s, s.Initialize(c)
+	})
+}
+
 func (s *S3Store) Initialize(c map[string]string) error {
 	auth, err := aws.GetAuth(c[S3_ACCES_KEY], c[S3_SECRET_KEY])
 	if err != nil {
@@ -45,24 +64,37 @@ func (s *S3Store) Initialize(c map[string]string) error {
 func (s *S3Store) Put(so *StoredObject, data io.Reader, length int64) error {
 	path := so.getPath()
 	_, err := s.bucket.Head(path)
-	if err != nil && !strings.Contains(err.Error(), "404") {
+	if err == nil {
+		return ErrAlreadyExists
+	}
+	if !strings.Contains(err.Error(), "404") {
+		return err
+	}
+	hr, err := NewVerifyingHashReader(data, so.dataHash())
+	if err != nil {
 		return err
 	}
-	hr := NewHashReader(data)
 	headers := map[string][]string{}
 	if so.Expiration.After(time.Now()) {
 		headers["X-Expiration"] = []string{so.Expiration.Format(time.RFC3339)}
 	}
 	for k, v := range so.Metadata {
-		headers["X-Object-"+k] = []string{v}
+		headers[S3_META_PREFIX+k] = []string{v}
 	}
 	if err := s.bucket.PutReaderHeader(path, hr, length, headers, s3.Private); err != nil {
+		if hr.Size() < length {
+			return ErrLengthMismatch
+		}
+		return err
+	}
+	if err := checkLength(hr, length); err != nil {
+		s.bucket.Del(path)
 		return err
 	}
-	if hr.HexDigest() != so.Hash {
+	if err := hr.Verify(so.dataHash()); err != nil {
 		//TODO: Do somethign wit del's error
 		s.bucket.Del(path)
-		return ErrHashMismatch
+		return err
 	}
 	return nil
 }
@@ -79,6 +111,118 @@ func (s *S3Store) Get(so *StoredObject, data io.Writer) error {
 	return err
 }
 
+func s3ObjectInfo(resp *http.Response) *ObjectInfo {
+	info := &ObjectInfo{Size: resp.ContentLength, Metadata: map[string]string{}}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	for k, v := range resp.Header {
+		if strings.HasPrefix(k, S3_META_PREFIX) && len(v) > 0 {
+			info.Metadata[k[len(S3_META_PREFIX):]] = v[0]
+		}
+	}
+	return info
+}
+
+func (s *S3Store) Stat(so *StoredObject) (*ObjectInfo, error) {
+	resp, err := s.bucket.Head(so.getPath())
+	if err != nil {
+		if strings.Contains(err.Error(), "404") {
+			return nil, ErrNotExists
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+	return s3ObjectInfo(resp), nil
+}
+
+// Reads are done with ranged GETs starting at the current offset. The
+// request is only sent on the first Read after opening or seeking
+type s3Reader struct {
+	bucket *s3.Bucket
+	path   string
+	info   *ObjectInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Info() *ObjectInfo {
+	return r.info
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.info.Size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		rng := fmt.Sprintf("bytes=%d-", r.offset)
+		resp, err := r.bucket.GetResponseWithHeaders(r.path, map[string][]string{"Range": {rng}})
+		if err != nil {
+			if strings.Contains(err.Error(), "404") {
+				return 0, ErrNotExists
+			}
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := seekPosition(r.offset, r.info.Size, offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	if pos != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = pos
+	return pos, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+func (s *S3Store) Open(so *StoredObject) (ObjectReader, error) {
+	info, err := s.Stat(so)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Reader{bucket: s.bucket, path: so.getPath(), info: info}, nil
+}
+
+func (s *S3Store) SignedURL(so *StoredObject, expires time.Time) (string, error) {
+	return s.bucket.SignedURL(so.getPath(), expires), nil
+}
+
+func (s *S3Store) List(prefix, cursor string, limit int) (*ListPage, error) {
+	limit = listLimit(limit)
+	resp, err := s.bucket.List(prefix, "", cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	page := &ListPage{Objects: []ListEntry{}}
+	for _, k := range resp.Contents {
+		typ, hash, ok := parseObjectKey(k.Key)
+		if !ok {
+			continue
+		}
+		modTime, _ := time.Parse(time.RFC3339Nano, k.LastModified)
+		page.Objects = append(page.Objects, ListEntry{Type: typ, Hash: hash, Size: k.Size, ModTime: modTime})
+	}
+	if resp.IsTruncated && len(resp.Contents) > 0 {
+		page.Next = resp.Contents[len(resp.Contents)-1].Key
+	}
+	return page, nil
+}
+
 func (s *S3Store) Delete(so *StoredObject) error {
 	err := s.bucket.Del(so.getPath())
 	if err != nil && strings.Contains(err.Error(), "404") {
@@ -86,3 +230,114 @@ func (s *S3Store) Delete(so *StoredObject) error {
 	}
 	return err
 }
+
+func (s *S3Store) multi(so *StoredObject, uploadId string) *s3.Multi {
+	return &s3.Multi{Bucket: s.bucket, Key: so.getPath(), UploadId: uploadId}
+}
+
+func s3UploadError(err error) error {
+	if strings.Contains(err.Error(), "NoSuchUpload") || strings.Contains(err.Error(), "404") {
+		return ErrUnknownUpload
+	}
+	return err
+}
+
+// The library can't send headers when starting a multipart upload so these
+// objects have no metadata in the backend
+func (s *S3Store) InitiateUpload(so *StoredObject) (string, error) {
+	m, err := s.bucket.InitMulti(so.getPath(), "application/octet-stream", s3.Private)
+	if err != nil {
+		return "", err
+	}
+	return m.UploadId, nil
+}
+
+// PutPart needs to seek over the part, so it is spooled to a temporary file
+func (s *S3Store) UploadPart(so *StoredObject, uploadId string, n int, data io.Reader, length int64) error {
+	if err := checkPartNumber(n); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile("", "s3part-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	written, err := io.Copy(f, data)
+	if err != nil {
+		return err
+	}
+	if written != length {
+		return ErrLengthMismatch
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = s.multi(so, uploadId).PutPart(n, f)
+	if err != nil {
+		return s3UploadError(err)
+	}
+	return nil
+}
+
+func (s *S3Store) ListParts(so *StoredObject, uploadId string) ([]UploadPart, error) {
+	parts, err := s.multi(so, uploadId).ListParts()
+	if err != nil {
+		return nil, s3UploadError(err)
+	}
+	list := make([]UploadPart, 0, len(parts))
+	for _, p := range parts {
+		list = append(list, UploadPart{N: p.N, Size: p.Size})
+	}
+	return list, nil
+}
+
+// S3 does not know about SHA-512 so the assembled object is read back to
+// verify it, and deleted if it does not match
+func (s *S3Store) CompleteUpload(so *StoredObject, uploadId string, length int64) error {
+	path := so.getPath()
+	if _, err := s.bucket.Head(path); err == nil {
+		return ErrAlreadyExists
+	} else if !strings.Contains(err.Error(), "404") {
+		return err
+	}
+	m := s.multi(so, uploadId)
+	parts, err := m.ListParts()
+	if err != nil {
+		return s3UploadError(err)
+	}
+	if len(parts) == 0 {
+		return ErrNoParts
+	}
+	if err := m.Complete(parts); err != nil {
+		return s3UploadError(err)
+	}
+	r, err := s.bucket.GetReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	hr, err := NewVerifyingHashReader(r, so.dataHash())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, hr); err != nil {
+		return err
+	}
+	if hr.Size() != length {
+		s.bucket.Del(path)
+		return ErrLengthMismatch
+	}
+	if err := hr.Verify(so.dataHash()); err != nil {
+		s.bucket.Del(path)
+		return err
+	}
+	return nil
+}
+
+func (s *S3Store) AbortUpload(so *StoredObject, uploadId string) error {
+	if err := s.multi(so, uploadId).Abort(); err != nil {
+		return s3UploadError(err)
+	}
+	return nil
+}
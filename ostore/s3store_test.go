@@ -1,9 +1,10 @@
-package ostore
+package ostore_test
 
 import (
-	"bytes"
 	"testing"
-	"time"
+
+	"github.com/acasajus/menac/ostore"
+	"github.com/acasajus/menac/ostore/storetest"
 )
 
 const (
@@ -14,75 +15,38 @@ const (
 
 func getS3InitParams() map[string]string {
 	return map[string]string{
-		S3_ACCES_KEY:    TEST_ACCESS_KEY,
-		S3_SECRET_KEY:   TEST_SECRET_KEY,
-		S3_ENDPOINT_URL: TEST_ENDPOINT_URL,
-		S3_BUCKET:       "menac_s3_store",
+		ostore.S3_ACCES_KEY:    TEST_ACCESS_KEY,
+		ostore.S3_SECRET_KEY:   TEST_SECRET_KEY,
+		ostore.S3_ENDPOINT_URL: TEST_ENDPOINT_URL,
+		ostore.S3_BUCKET:       "menac_s3_store",
 	}
 }
 
-func TestS3StoreGetPutDelete(t *testing.T) {
-	st := &S3Store{}
+func TestS3Store(t *testing.T) {
+	st := &ostore.S3Store{}
 	if err := st.Initialize(getS3InitParams()); err != nil {
-		t.Fatal("Unexpected error: %s", err)
+		t.Fatalf("Unexpected error: %s", err)
 	}
-	runTestStoreGetPutDelete("S3Store", st, t)
+	storetest.RunStoreTests(t, "S3Store", st)
 }
 
 func TestS3StoreInitialize(t *testing.T) {
 	initParams := getS3InitParams()
-	st := &S3Store{}
+	st := &ostore.S3Store{}
 	//Make sure bucket is there
 	if err := st.Initialize(initParams); err != nil {
-		t.Fatal("Unexpected error: %s", err)
+		t.Fatalf("Unexpected error: %s", err)
 	}
 	//Delete
-	if err := st.bucket.DelBucket(); err != nil {
+	if err := st.DelBucket(); err != nil {
 		t.Errorf("Could not delete bucket: %s", err)
 	}
 	//Create bucket
 	if err := st.Initialize(initParams); err != nil {
-		t.Fatal("Unexpected error: %s", err)
+		t.Fatalf("Unexpected error: %s", err)
 	}
 	//Init if bucket is there
 	if err := st.Initialize(initParams); err != nil {
-		t.Fatal("Unexpected error: %s", err)
-	}
-}
-
-func runTestStoreGetPutDelete(name string, st Store, t *testing.T) {
-	so := &StoredObject{
-		Hash:       "INVALID",
-		Type:       "test",
-		Expiration: time.Now().Add(time.Hour),
-	}
-	//MAke sure object is not in the store
-	if err := st.Delete(so); err != nil && err != ErrNotExists {
-		t.Fatalf("[%s] Cannot delete data from store: %s", name, err)
-	}
-	byteData := []byte(HASH_TEST_DATA)
-	if err := st.Put(so, bytes.NewBufferString(HASH_TEST_DATA), int64(len(byteData))); err != ErrHashMismatch {
-		if err == nil {
-			t.Fatalf("[%s] Could write data with incorrect hash!", name)
-		} else {
-			t.Fatalf("[%s] Cannot write to store: %s", name, err)
-		}
-	}
-	out := &bytes.Buffer{}
-	if err := st.Get(so, out); err != ErrNotExists {
-		t.Fatalf("[%s] Cannot get data from store: %s", name, err)
-	}
-	so.Hash = HASH_EXPECTED
-	if err := st.Put(so, bytes.NewBufferString(HASH_TEST_DATA), int64(len(byteData))); err != nil {
-		t.Fatalf("[%s] Cannot write to store: %s", name, err)
-	}
-	if err := st.Get(so, out); err != nil {
-		t.Fatalf("[%s] Cannot get data from store: %s", name, err)
-	}
-	if !bytes.Equal(out.Bytes(), byteData) {
-		t.Errorf("[%s] Out data differs from in data", name)
-	}
-	if err := st.Delete(so); err != nil {
-		t.Fatalf("[%s] Cannot delete data from store: %s", name, err)
+		t.Fatalf("Unexpected error: %s", err)
 	}
 }
@@ -0,0 +1,388 @@
+package ostore
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/acasajus/menac/db"
+)
+
+const (
+	SCRUB_INTERVAL = time.Hour
+	//Blobs verified more recently than this are skipped
+	SCRUB_MAX_AGE = 30 * 24 * time.Hour
+	//Bytes per second read from the stores
+	SCRUB_RATE = 16 * 1024 * 1024
+	//Type under which corrupt data is kept, by the hash of what was found
+	SCRUB_QUARANTINE_TYPE = "quarantine"
+)
+
+var scrubStats = expvar.NewMap("ostore.scrub")
+
+// What a scrub did, or would have done in dry run mode, on a store
+type ScrubReport struct {
+	Store    string
+	DryRun   bool
+	Verified int
+	//Blob keys whose data did not match, with where it was quarantined
+	Corrupt []string
+	//Blob keys restored from a replica
+	Repaired []string
+	Missing  []string
+	Errors   []string
+}
+
+func (r *ScrubReport) String() string {
+	return fmt.Sprintf("%s: %d verified, %d corrupt, %d repaired, %d missing, %d errors (dry run %v)",
+		r.Store, r.Verified, len(r.Corrupt), len(r.Repaired), len(r.Missing), len(r.Errors), r.DryRun)
+}
+
+func (r *ScrubReport) addError(format string, args ...interface{}) {
+	scrubStats.Add("errors", 1)
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// Keeps the average throughput of all the readers sharing it under a rate
+type throttle struct {
+	lock  sync.Mutex
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+// Account for n bytes and sleep until they are within the rate
+func (t *throttle) wait(n int) {
+	if t.rate <= 0 {
+		return
+	}
+	t.lock.Lock()
+	t.n += int64(n)
+	due := time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second))
+	t.lock.Unlock()
+	if wait := due - time.Since(t.start); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if tr.t.rate > 0 && int64(len(p)) > tr.t.rate {
+		p = p[:tr.t.rate]
+	}
+	n, err := tr.r.Read(p)
+	tr.t.wait(n)
+	return n, err
+}
+
+// Errors meaning the data is there but is not what was stored
+func isCorruption(err error) bool {
+	switch err {
+	case ErrHashMismatch, ErrLengthMismatch, ErrCorruptData, ErrNotTransformed, gzip.ErrChecksum, gzip.ErrHeader:
+		return true
+	}
+	_, ok := err.(flate.CorruptInputError)
+	return ok
+}
+
+// Periodically reads the stored blobs back and checks them against their hash
+type Scrubber struct {
+	db       db.DB
+	leader   Leadership
+	Interval time.Duration
+	MaxAge   time.Duration
+	//Bytes per second, 0 disables the limit
+	Rate   int64
+	DryRun bool
+
+	lock       sync.Mutex
+	lastReport []*ScrubReport
+	stop       chan struct{}
+}
+
+// Leader may be nil if there is a single node running the scrubber
+func NewScrubber(d db.DB, leader Leadership) *Scrubber {
+	return &Scrubber{
+		db:       d,
+		leader:   leader,
+		Interval: SCRUB_INTERVAL,
+		MaxAge:   SCRUB_MAX_AGE,
+		Rate:     SCRUB_RATE,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (s *Scrubber) Start() {
+	go s.loop()
+}
+
+func (s *Scrubber) Stop() {
+	close(s.stop)
+}
+
+func (s *Scrubber) loop() {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s.leader != nil && !s.leader.IsLeader() {
+				continue
+			}
+			reports, err := s.Run()
+			if err != nil {
+				log.Printf("ostore: Scrub failed: %s", err)
+				continue
+			}
+			for _, r := range reports {
+				log.Printf("ostore: Scrub %s", r)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Reports of the last run
+func (s *Scrubber) LastReport() []*ScrubReport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastReport
+}
+
+// Blobs due for verification, by store primary key
+func (s *Scrubber) dueBlobs(now time.Time) (map[string][]*Blob, error) {
+	due := map[string][]*Blob{}
+	for sr := range s.db.ScanRecords(&Blob{}) {
+		if sr.Error != nil {
+			return nil, sr.Error
+		}
+		b, ok := sr.Record.(*Blob)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected struct type came out of the pipe %#v", sr.Record))
+		}
+		if now.Sub(b.Verified) < s.MaxAge {
+			continue
+		}
+		key := fmt.Sprintf("%s:%s", b.Organization, b.StoreName)
+		due[key] = append(due[key], b)
+	}
+	return due, nil
+}
+
+// Scrub all the stores once
+func (s *Scrubber) Run() ([]*ScrubReport, error) {
+	scrubStats.Add("runs", 1)
+	now := time.Now()
+	due, err := s.dueBlobs(now)
+	if err != nil {
+		return nil, err
+	}
+	t := newThrottle(s.Rate)
+	reports := []*ScrubReport{}
+	for _, blobs := range due {
+		os := &ObjectStore{Organization: blobs[0].Organization, Name: blobs[0].StoreName}
+		if err := s.db.GetRecord(os.GetPrimaryKey(), os); err != nil {
+			report := &ScrubReport{Store: string(os.GetPrimaryKey()), DryRun: s.DryRun}
+			report.addError("Cannot get store: %s", err)
+			reports = append(reports, report)
+			continue
+		}
+		reports = append(reports, s.scrubBlobs(os, blobs, now, t))
+	}
+	s.lock.Lock()
+	s.lastReport = reports
+	s.lock.Unlock()
+	return reports, nil
+}
+
+// Scrub the blobs of a store that are due
+func (s *Scrubber) ScrubStore(os *ObjectStore, now time.Time) *ScrubReport {
+	due, err := s.dueBlobs(now)
+	if err != nil {
+		report := &ScrubReport{Store: string(os.GetPrimaryKey()), DryRun: s.DryRun}
+		report.addError("Cannot scan blobs: %s", err)
+		return report
+	}
+	return s.scrubBlobs(os, due[string(os.GetPrimaryKey())], now, newThrottle(s.Rate))
+}
+
+func (s *Scrubber) scrubBlobs(os *ObjectStore, blobs []*Blob, now time.Time, t *throttle) *ScrubReport {
+	report := &ScrubReport{Store: string(os.GetPrimaryKey()), DryRun: s.DryRun}
+	st, err := os.Open()
+	if err != nil {
+		report.addError("Cannot open store: %s", err)
+		return report
+	}
+	for _, b := range blobs {
+		var intact bool
+		if rs, ok := uncached(st).(*ReplicatedStore); ok {
+			intact = s.scrubReplicas(rs, b, t, report)
+		} else {
+			intact = s.scrubBlob(st, b, t, report)
+		}
+		if !intact || s.DryRun {
+			continue
+		}
+		err := b.update(func(b *Blob) error {
+			b.Verified = now
+			return nil
+		})
+		if err != nil && !db.IsErrNotFound(err) {
+			report.addError("Cannot record verification of %s: %s", b.getPath(), err)
+		}
+	}
+	return report
+}
+
+// Read the data back through a HashReader and compare it with the blob
+func verifyBlob(st Store, b *Blob, t *throttle) error {
+	r, err := st.Open(&StoredObject{Type: b.Type, Hash: b.Hash})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	hr, err := NewVerifyingHashReader(&throttledReader{r, t}, b.Hash)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, hr); err != nil {
+		return err
+	}
+	scrubStats.Add("bytes", hr.Size())
+	if hr.Size() != b.Size {
+		return ErrLengthMismatch
+	}
+	return hr.Verify(b.Hash)
+}
+
+// Whether the blob is intact. Corrupt data is quarantined
+func (s *Scrubber) scrubBlob(st Store, b *Blob, t *throttle, report *ScrubReport) bool {
+	st = uncached(st)
+	err := verifyBlob(st, b, t)
+	switch {
+	case err == nil:
+		scrubStats.Add("verified", 1)
+		report.Verified++
+		return true
+	case err == ErrNotExists:
+		scrubStats.Add("missing", 1)
+		report.Missing = append(report.Missing, b.getPath())
+		return false
+	case !isCorruption(err):
+		report.addError("Cannot verify %s: %s", b.getPath(), err)
+		return false
+	}
+	scrubStats.Add("corrupt", 1)
+	where := SCRUB_QUARANTINE_TYPE
+	if !s.DryRun {
+		cause := err
+		if where, err = quarantine(st, &StoredObject{Type: b.Type, Hash: b.Hash}); err != nil {
+			report.addError("Cannot quarantine %s: %s", b.getPath(), err)
+			return false
+		}
+		log.Printf("ostore: Blob %s is corrupt (%s), quarantined as %s", b.getPath(), cause, where)
+	}
+	report.Corrupt = append(report.Corrupt, b.getPath()+" > "+where)
+	return false
+}
+
+// Verify each copy of a replicated blob and copy corrupt ones again from a
+// replica that is intact
+func (s *Scrubber) scrubReplicas(rs *ReplicatedStore, b *Blob, t *throttle, report *ScrubReport) bool {
+	so := &StoredObject{Type: b.Type, Hash: b.Hash}
+	locations, err := rs.Locations(so)
+	if err != nil {
+		if err == ErrNotExists {
+			report.Missing = append(report.Missing, b.getPath())
+		} else {
+			report.addError("Cannot get locations of %s: %s", b.getPath(), err)
+		}
+		return false
+	}
+	bad := []string{}
+	good, repaired := 0, 0
+	for _, name := range locations {
+		st, err := rs.member(name)
+		if err != nil {
+			report.addError("Cannot open replica %s: %s", name, err)
+			continue
+		}
+		before := len(report.Corrupt)
+		if s.scrubBlob(st, b, t, report) {
+			good++
+			continue
+		}
+		if len(report.Corrupt) > before {
+			bad = append(bad, name)
+		}
+	}
+	for _, name := range bad {
+		if s.DryRun {
+			continue
+		}
+		if err := rs.removeLocation(so, name); err != nil {
+			report.addError("Cannot update locations of %s: %s", b.getPath(), err)
+			continue
+		}
+		if good == 0 {
+			continue
+		}
+		if err := rs.copyTo(so, name); err != nil {
+			report.addError("Cannot repair %s in %s: %s", b.getPath(), name, err)
+			continue
+		}
+		scrubStats.Add("repaired", 1)
+		repaired++
+		report.Repaired = append(report.Repaired, b.getPath()+" > "+name)
+	}
+	return good > 0 && good+repaired == len(locations)
+}
+
+// Move the raw data of an object to the quarantine type
+func quarantine(st Store, so *StoredObject) (string, error) {
+	if ts, ok := st.(*TransformStore); ok {
+		st = ts.Inner()
+	}
+	r, err := st.Open(so)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	tmp, err := ioutil.TempFile("", "ostore-quarantine-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hr := NewHashReader(r)
+	if _, err := io.Copy(tmp, hr); err != nil {
+		return "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	q := &StoredObject{Type: SCRUB_QUARANTINE_TYPE, Hash: hr.HexDigest()}
+	if err := st.Put(q, tmp, hr.Size()); err != nil && err != ErrAlreadyExists {
+		return "", err
+	}
+	if err := st.Delete(so); err != nil && err != ErrNotExists {
+		return "", err
+	}
+	return q.getPath(), nil
+}
@@ -0,0 +1,139 @@
+package ostore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	th := newThrottle(10000)
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, &throttledReader{bytes.NewReader(make([]byte, 3000)), th})
+	if err != nil || n != 3000 {
+		t.Fatalf("Read %d bytes: %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Reading 3000 bytes at 10000/s took %s", elapsed)
+	}
+	start = time.Now()
+	io.Copy(ioutil.Discard, &throttledReader{bytes.NewReader(make([]byte, 1<<20)), newThrottle(0)})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Unlimited read took %s", elapsed)
+	}
+}
+
+func corruptMemBlob(t *testing.T, st Store, so *StoredObject) {
+	ms := st.(*MemStore)
+	obj, err := ms.get(so)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.lock.Lock()
+	obj.data = append([]byte{}, obj.data...)
+	obj.data[0] ^= 0xff
+	ms.lock.Unlock()
+}
+
+func TestScrubStore(t *testing.T) {
+	os := getDummyStore()
+	st, err := os.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("scrubbed sandbox")
+	good := newDummyObject(os, data)
+	if err := os.PutObject(good, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	other := []byte("rotten sandbox")
+	bad := newDummyObject(os, other)
+	if err := os.PutObject(bad, bytes.NewReader(other), int64(len(other))); err != nil {
+		t.Fatal(err)
+	}
+	corruptMemBlob(t, st, bad)
+
+	s := NewScrubber(getDB(), nil)
+	s.Rate = 0
+	for _, dryRun := range []bool{true, false} {
+		s.DryRun = dryRun
+		r := s.ScrubStore(os, time.Now())
+		if len(r.Errors) > 0 {
+			t.Errorf("[dry run %v] Unexpected errors %v", dryRun, r.Errors)
+		}
+		if r.Verified != 1 {
+			t.Errorf("[dry run %v] Verified %d blobs instead of 1", dryRun, r.Verified)
+		}
+		if len(r.Corrupt) != 1 {
+			t.Errorf("[dry run %v] Unexpected corrupt blobs %v", dryRun, r.Corrupt)
+		}
+	}
+	if _, err := st.Stat(bad); err != ErrNotExists {
+		t.Errorf("Corrupt blob was not quarantined: %v", err)
+	}
+	page, err := st.List(SCRUB_QUARANTINE_TYPE+"/", "", 0)
+	if err != nil || len(page.Objects) != 1 {
+		t.Errorf("Quarantined data was not kept: %v %v", page, err)
+	}
+	blob := os.blobFor(good)
+	if err := getDB().GetRecord(blob.GetPrimaryKey(), blob); err != nil {
+		t.Fatal(err)
+	}
+	if blob.Verified.IsZero() {
+		t.Error("Verification time was not recorded")
+	}
+	if r := s.ScrubStore(os, time.Now()); r.Verified != 0 {
+		t.Errorf("Recently verified blobs were scrubbed again: %s", r)
+	}
+}
+
+func TestScrubReplicated(t *testing.T) {
+	os := getDummyStore()
+	members := map[string]Store{}
+	for _, name := range []string{"a", "b"} {
+		m := getDB().LinkRecordToDB(&ObjectStore{Organization: os.Organization, Name: name, Type: STORE_TYPE_MEM}).(*ObjectStore)
+		if err := m.Create(); err != nil {
+			t.Fatal(err)
+		}
+		st, err := m.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		members[name] = st
+	}
+	os.Name = "replicated"
+	os.Type = STORE_TYPE_REPLICATED
+	os.Config = map[string]string{REPLICATED_PRIMARY: "a", REPLICATED_REPLICAS: "b"}
+	if err := os.Create(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("replicated scrubbed sandbox")
+	so := newDummyObject(os, data)
+	if err := os.PutObject(so, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if locs := waitForLocations(t, st.(*ReplicatedStore), so, 2); len(locs) != 2 {
+		t.Fatalf("Object was not replicated: %v", locs)
+	}
+	corruptMemBlob(t, members["a"], so)
+
+	s := NewScrubber(getDB(), nil)
+	s.Rate = 0
+	r := s.ScrubStore(os, time.Now())
+	if len(r.Errors) > 0 {
+		t.Errorf("Unexpected errors %v", r.Errors)
+	}
+	if len(r.Corrupt) != 1 || len(r.Repaired) != 1 || r.Repaired[0] != so.getPath()+" > a" {
+		t.Errorf("Unexpected scrub result %s: %v %v", r, r.Corrupt, r.Repaired)
+	}
+	buf := &bytes.Buffer{}
+	if err := members["a"].Get(so, buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Primary copy was not repaired: %v", err)
+	}
+}
@@ -3,16 +3,119 @@ package ostore
 import (
 	"errors"
 	"io"
+	"strings"
+	"time"
+)
+
+const (
+	//Page size used when List is called without a limit
+	STORE_LIST_LIMIT = 1000
 )
 
 var (
-	ErrHashMismatch  = errors.New("Stored Object's expected hash did not match real hash")
-	ErrNotExists     = errors.New("Object does not exist")
-	ErrAlreadyExists = errors.New("Object already exists")
+	ErrHashMismatch   = errors.New("Stored Object's expected hash did not match real hash")
+	ErrLengthMismatch = errors.New("Stored Object's length did not match the declared length")
+	ErrNotExists      = errors.New("Object does not exist")
+	ErrAlreadyExists  = errors.New("Object already exists")
+	ErrInvalidSeek    = errors.New("Seek to an invalid position")
 )
 
+// Backends store blobs by type and hash. The storetest package checks the
+// behaviour all of them must share
 type Store interface {
 	Put(*StoredObject, io.Reader, int64) error
 	Get(*StoredObject, io.Writer) error
+	Open(*StoredObject) (ObjectReader, error)
+	Stat(*StoredObject) (*ObjectInfo, error)
+	List(prefix, cursor string, limit int) (*ListPage, error)
 	Delete(*StoredObject) error
 }
+
+type ListEntry struct {
+	Type    string
+	Hash    string
+	Size    int64
+	ModTime time.Time
+}
+
+// One page of a store listing. Pass Next as cursor to get the following page
+type ListPage struct {
+	Objects []ListEntry
+	Next    string
+}
+
+// Key of an object in listings
+func (e *ListEntry) Key() string {
+	return e.Type + "/" + e.Hash
+}
+
+func listLimit(limit int) int {
+	if limit <= 0 {
+		return STORE_LIST_LIMIT
+	}
+	return limit
+}
+
+// Split a listing key into type and hash
+func parseObjectKey(key string) (string, string, bool) {
+	i := strings.LastIndex(key, "/")
+	if i < 1 || i == len(key)-1 {
+		return "", "", false
+	}
+	return key[:i], key[i+1:], true
+}
+
+// Whether any key starting with dirKey can be part of the listing
+func listMayContain(dirKey, prefix, cursor string) bool {
+	if !strings.HasPrefix(dirKey, prefix) && !strings.HasPrefix(prefix, dirKey) {
+		return false
+	}
+	return cursor <= dirKey || strings.HasPrefix(cursor, dirKey)
+}
+
+func listIncludes(key, prefix, cursor string) bool {
+	return key > cursor && strings.HasPrefix(key, prefix)
+}
+
+// What the backend knows about a stored blob
+type ObjectInfo struct {
+	Size     int64
+	ModTime  time.Time
+	Metadata map[string]string
+}
+
+// Seekable stream over a stored blob. Backends only fetch the data that is
+// actually read
+type ObjectReader interface {
+	io.ReadSeeker
+	io.Closer
+	Info() *ObjectInfo
+}
+
+// Compute the absolute position for a Seek on an object of the given size
+func seekPosition(current, size, offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += current
+	case io.SeekEnd:
+		offset += size
+	default:
+		return current, ErrInvalidSeek
+	}
+	if offset < 0 {
+		return current, ErrInvalidSeek
+	}
+	return offset, nil
+}
+
+// Check that the reader had exactly length bytes. Backends that stop reading
+// at the declared length need the extra read to detect longer inputs
+func checkLength(hr *HashReader, length int64) error {
+	if hr.Size() == length {
+		if n, _ := hr.Read(make([]byte, 1)); n == 0 {
+			return nil
+		}
+	}
+	return ErrLengthMismatch
+}
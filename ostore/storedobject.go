@@ -1,6 +1,8 @@
 package ostore
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"time"
@@ -8,19 +10,40 @@ import (
 	"github.com/acasajus/menac/db"
 )
 
+// Logical handle to a blob. Several objects can share the same blob, which
+// is only removed from the store once none of them points to it
 type StoredObject struct {
 	db.Record
 
-	User         string
-	Group        string
-	Organization string
+	Id           string
+	User         string `db:"indexed"`
+	Group        string `db:"indexed"`
+	Organization string `db:"indexed"`
 	StoreName    string
 	Expiration   time.Time
-	Type         string
-	Hash         string
+	Type         string `db:"indexed"`
+	Hash         string `db:"indexed"`
+	Size         int64
 	Metadata     map[string]string
+	//Grants on top of what the owner, group and organization get. See
+	//Principal
+	ACL []string
 
 	store *ObjectStore
+	//Hash of the bytes handed to the backend when a wrapper transforms them
+	rawHash string
+}
+
+func newObjectId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+func (so *StoredObject) GetPrimaryKey() []byte {
+	return []byte(fmt.Sprintf("%s:%s", so.Organization, so.Id))
 }
 
 func (so *StoredObject) Create() error {
@@ -35,6 +58,9 @@ func (so *StoredObject) Validate() error {
 	if len(so.Organization) == 0 {
 		return errors.New("Empty organization handle")
 	}
+	if len(so.Id) == 0 {
+		return errors.New("Empty object id")
+	}
 	if len(so.User) == 0 {
 		return errors.New("Empty user")
 	}
@@ -47,9 +73,25 @@ func (so *StoredObject) Validate() error {
 	if len(so.Hash) == 0 {
 		return errors.New("Empty hash")
 	}
+	if _, _, err := ParseHash(so.Hash); err != nil {
+		return err
+	}
+	for _, s := range so.ACL {
+		if _, err := ParseGrant(s); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Hash the backend has to verify the received data against
+func (so *StoredObject) dataHash() string {
+	if len(so.rawHash) > 0 {
+		return so.rawHash
+	}
+	return so.Hash
+}
+
 func (so *StoredObject) getPath() string {
 	return fmt.Sprintf("%s/%s", so.Type, so.Hash)
 }
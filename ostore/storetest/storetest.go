@@ -0,0 +1,367 @@
+// Package storetest checks that ostore.Store implementations follow the
+// semantics every backend has to share
+package storetest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/acasajus/menac/ostore"
+)
+
+const (
+	TEST_OBJECT_TYPE = "storetest"
+	TEST_OBJECT_SIZE = 64 * 1024
+	TEST_CONCURRENCY = 8
+	TEST_LIST_TYPE   = "storetest-list"
+	TEST_LIST_SIZE   = 5
+	//Smallest part S3 accepts except for the last one
+	TEST_PART_SIZE = 5 * 1024 * 1024
+)
+
+// Create an object with random data and the StoredObject describing it
+func NewTestObject(size int) (*ostore.StoredObject, []byte) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+	h := sha512.Sum512(data)
+	so := &ostore.StoredObject{
+		Type:       TEST_OBJECT_TYPE,
+		Hash:       hex.EncodeToString(h[:]),
+		Expiration: time.Now().Add(time.Hour),
+		Metadata:   map[string]string{"Test": "true"},
+	}
+	return so, data
+}
+
+// Run all the checks against a store
+func RunStoreTests(t *testing.T, name string, st ostore.Store) {
+	testMissing(t, name, st)
+	testPutGetDelete(t, name, st)
+	testOpenStat(t, name, st)
+	testList(t, name, st)
+	testHashMismatch(t, name, st)
+	testPrefixedHash(t, name, st)
+	testLengthMismatch(t, name, st)
+	testConcurrentPut(t, name, st)
+	if ms, ok := st.(ostore.MultipartStore); ok {
+		testMultipart(t, name, st, ms)
+	}
+}
+
+func testMissing(t *testing.T, name string, st ostore.Store) {
+	so, _ := NewTestObject(16)
+	if err := st.Get(so, &bytes.Buffer{}); err != ostore.ErrNotExists {
+		t.Errorf("[%s] Get of a missing object returned %v instead of ErrNotExists", name, err)
+	}
+	if _, err := st.Open(so); err != ostore.ErrNotExists {
+		t.Errorf("[%s] Open of a missing object returned %v instead of ErrNotExists", name, err)
+	}
+	if _, err := st.Stat(so); err != ostore.ErrNotExists {
+		t.Errorf("[%s] Stat of a missing object returned %v instead of ErrNotExists", name, err)
+	}
+	if err := st.Delete(so); err != ostore.ErrNotExists {
+		t.Errorf("[%s] Delete of a missing object returned %v instead of ErrNotExists", name, err)
+	}
+}
+
+func testPutGetDelete(t *testing.T, name string, st ostore.Store) {
+	so, data := NewTestObject(TEST_OBJECT_SIZE)
+	if err := st.Put(so, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("[%s] Cannot write to store: %s", name, err)
+	}
+	out := &bytes.Buffer{}
+	if err := st.Get(so, out); err != nil {
+		t.Fatalf("[%s] Cannot get data from store: %s", name, err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("[%s] Out data differs from in data", name)
+	}
+	if err := st.Put(so, bytes.NewReader(data), int64(len(data))); err != ostore.ErrAlreadyExists {
+		t.Errorf("[%s] Duplicate put returned %v instead of ErrAlreadyExists", name, err)
+	}
+	if err := st.Delete(so); err != nil {
+		t.Fatalf("[%s] Cannot delete data from store: %s", name, err)
+	}
+	if err := st.Get(so, &bytes.Buffer{}); err != ostore.ErrNotExists {
+		t.Errorf("[%s] Get after delete returned %v instead of ErrNotExists", name, err)
+	}
+	if err := st.Delete(so); err != ostore.ErrNotExists {
+		t.Errorf("[%s] Second delete returned %v instead of ErrNotExists", name, err)
+	}
+}
+
+func testOpenStat(t *testing.T, name string, st ostore.Store) {
+	so, data := NewTestObject(TEST_OBJECT_SIZE)
+	if err := st.Put(so, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("[%s] Cannot write to store: %s", name, err)
+	}
+	defer st.Delete(so)
+	info, err := st.Stat(so)
+	if err != nil {
+		t.Fatalf("[%s] Cannot stat object: %s", name, err)
+	}
+	if info.Size != int64(len(data)) || info.ModTime.IsZero() {
+		t.Errorf("[%s] Unexpected object info %+v", name, info)
+	}
+	r, err := st.Open(so)
+	if err != nil {
+		t.Fatalf("[%s] Cannot open object: %s", name, err)
+	}
+	defer r.Close()
+	if r.Info().Size != int64(len(data)) {
+		t.Errorf("[%s] Reader has size %d instead of %d", name, r.Info().Size, len(data))
+	}
+	head := make([]byte, 10)
+	if _, err := io.ReadFull(r, head); err != nil || !bytes.Equal(head, data[:10]) {
+		t.Errorf("[%s] Cannot read the head of the object: %v", name, err)
+	}
+	tests := []struct {
+		offset int64
+		whence int
+
+		wpos int64
+	}{
+		{100, io.SeekStart, 100},
+		{-50, io.SeekCurrent, 50},
+		{-10, io.SeekEnd, int64(len(data)) - 10},
+		{0, io.SeekEnd, int64(len(data))},
+		{0, io.SeekStart, 0},
+	}
+	for i, tt := range tests {
+		pos, err := r.Seek(tt.offset, tt.whence)
+		if err != nil || pos != tt.wpos {
+			t.Errorf("[%s] #%d: Seek returned %d (%v) instead of %d", name, i, pos, err, tt.wpos)
+			continue
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(out, data[pos:]) {
+			t.Errorf("[%s] #%d: Data read from %d differs from in data (%v)", name, i, pos, err)
+		}
+		//Leave the reader at the position the next seek is relative to
+		r.Seek(pos, io.SeekStart)
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("[%s] Could seek before the start of the object", name)
+	}
+}
+
+func testList(t *testing.T, name string, st ostore.Store) {
+	hashes := []string{}
+	for i := 0; i < TEST_LIST_SIZE; i++ {
+		so, data := NewTestObject(16 + i)
+		so.Type = TEST_LIST_TYPE
+		if err := st.Put(so, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("[%s] Cannot write to store: %s", name, err)
+		}
+		defer st.Delete(so)
+		hashes = append(hashes, so.Hash)
+	}
+	sort.Strings(hashes)
+	//An object of another type must not show up
+	other, data := NewTestObject(16)
+	if err := st.Put(other, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("[%s] Cannot write to store: %s", name, err)
+	}
+	defer st.Delete(other)
+
+	listed := []string{}
+	cursor := ""
+	for pages := 0; pages <= TEST_LIST_SIZE; pages++ {
+		page, err := st.List(TEST_LIST_TYPE+"/", cursor, 2)
+		if err != nil {
+			t.Fatalf("[%s] Cannot list objects: %s", name, err)
+		}
+		if len(page.Objects) > 2 {
+			t.Errorf("[%s] Page has %d objects with a limit of 2", name, len(page.Objects))
+		}
+		for _, e := range page.Objects {
+			if e.Type != TEST_LIST_TYPE || e.Size < 16 {
+				t.Errorf("[%s] Unexpected entry %+v", name, e)
+			}
+			listed = append(listed, e.Hash)
+		}
+		if cursor = page.Next; len(cursor) == 0 {
+			break
+		}
+	}
+	if strings.Join(listed, ",") != strings.Join(hashes, ",") {
+		t.Errorf("[%s] Listed %v instead of %v", name, listed, hashes)
+	}
+
+	page, err := st.List(TEST_LIST_TYPE+"/"+hashes[0][:6], "", 0)
+	if err != nil {
+		t.Fatalf("[%s] Cannot list objects: %s", name, err)
+	}
+	if len(page.Objects) != 1 || page.Objects[0].Hash != hashes[0] {
+		t.Errorf("[%s] Listing by hash prefix returned %+v", name, page.Objects)
+	}
+}
+
+func testHashMismatch(t *testing.T, name string, st ostore.Store) {
+	so, data := NewTestObject(TEST_OBJECT_SIZE)
+	_, other := NewTestObject(TEST_OBJECT_SIZE)
+	if err := st.Put(so, bytes.NewReader(other), int64(len(other))); err != ostore.ErrHashMismatch {
+		t.Errorf("[%s] Put with wrong data returned %v instead of ErrHashMismatch", name, err)
+	}
+	if err := st.Get(so, &bytes.Buffer{}); err != ostore.ErrNotExists {
+		t.Errorf("[%s] Object with hash mismatch was not cleaned up: %v", name, err)
+	}
+	//The failed put must not block a good one
+	if err := st.Put(so, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Errorf("[%s] Cannot write to store after a hash mismatch: %s", name, err)
+	}
+	st.Delete(so)
+}
+
+// Objects declaring a hash other than SHA-512 are verified with its algorithm
+func testPrefixedHash(t *testing.T, name string, st ostore.Store) {
+	so, data := NewTestObject(TEST_OBJECT_SIZE)
+	h := sha256.Sum256(data)
+	so.Hash = ostore.FormatHash(ostore.HASH_SHA256, h[:])
+	_, other := NewTestObject(TEST_OBJECT_SIZE)
+	if err := st.Put(so, bytes.NewReader(other), int64(len(other))); err != ostore.ErrHashMismatch {
+		t.Errorf("[%s] Put with wrong data for a SHA-256 hash returned %v instead of ErrHashMismatch", name, err)
+	}
+	if err := st.Put(so, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("[%s] Cannot write object with a SHA-256 hash: %s", name, err)
+	}
+	defer st.Delete(so)
+	buf := &bytes.Buffer{}
+	if err := st.Get(so, buf); err != nil {
+		t.Fatalf("[%s] Cannot read object with a SHA-256 hash: %s", name, err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("[%s] Object with a SHA-256 hash came back different", name)
+	}
+}
+
+func testLengthMismatch(t *testing.T, name string, st ostore.Store) {
+	so, data := NewTestObject(TEST_OBJECT_SIZE)
+	for _, length := range []int64{int64(len(data)) - 1, int64(len(data)) + 1} {
+		err := st.Put(so, bytes.NewReader(data), length)
+		if err != ostore.ErrLengthMismatch {
+			t.Errorf("[%s] Put with length %d for %d bytes returned %v instead of ErrLengthMismatch", name, length, len(data), err)
+		}
+		if err := st.Get(so, &bytes.Buffer{}); err != ostore.ErrNotExists {
+			t.Errorf("[%s] Object with length mismatch was not cleaned up: %v", name, err)
+			st.Delete(so)
+		}
+	}
+}
+
+// Only one of the puts may store the object. The rest must either fail with
+// ErrAlreadyExists or have written the very same data
+func testConcurrentPut(t *testing.T, name string, st ostore.Store) {
+	so, data := NewTestObject(TEST_OBJECT_SIZE)
+	errs := make(chan error, TEST_CONCURRENCY)
+	wg := sync.WaitGroup{}
+	for i := 0; i < TEST_CONCURRENCY; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- st.Put(so, bytes.NewReader(data), int64(len(data)))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	stored := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			stored++
+		case ostore.ErrAlreadyExists:
+		default:
+			t.Errorf("[%s] Concurrent put failed: %s", name, err)
+		}
+	}
+	if stored == 0 {
+		t.Errorf("[%s] None of the concurrent puts stored the object", name)
+	}
+	out := &bytes.Buffer{}
+	if err := st.Get(so, out); err != nil {
+		t.Fatalf("[%s] Cannot get concurrently written object: %s", name, err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("[%s] Concurrently written object is corrupt", name)
+	}
+	if err := st.Delete(so); err != nil {
+		t.Errorf("[%s] Cannot delete data from store: %s", name, err)
+	}
+}
+
+func testMultipart(t *testing.T, name string, st ostore.Store, ms ostore.MultipartStore) {
+	so, data := NewTestObject(2*TEST_PART_SIZE + 100)
+	id, err := ms.InitiateUpload(so)
+	if err != nil {
+		t.Fatalf("[%s] Cannot initiate upload: %s", name, err)
+	}
+	chunks := [][]byte{data[:TEST_PART_SIZE], data[TEST_PART_SIZE : 2*TEST_PART_SIZE], data[2*TEST_PART_SIZE:]}
+	if err := ms.UploadPart(so, id, 1, bytes.NewReader(chunks[0]), int64(len(chunks[0]))+1); err != ostore.ErrLengthMismatch {
+		t.Errorf("[%s] Part with wrong length returned %v instead of ErrLengthMismatch", name, err)
+	}
+	if err := ms.UploadPart(so, id, 0, bytes.NewReader(chunks[0]), int64(len(chunks[0]))); err != ostore.ErrInvalidPart {
+		t.Errorf("[%s] Part 0 returned %v instead of ErrInvalidPart", name, err)
+	}
+	//Out of order and with a part uploaded twice
+	for _, n := range []int{3, 1, 2, 1} {
+		if err := ms.UploadPart(so, id, n, bytes.NewReader(chunks[n-1]), int64(len(chunks[n-1]))); err != nil {
+			t.Fatalf("[%s] Cannot upload part %d: %s", name, n, err)
+		}
+	}
+	parts, err := ms.ListParts(so, id)
+	if err != nil {
+		t.Fatalf("[%s] Cannot list parts: %s", name, err)
+	}
+	if len(parts) != 3 {
+		t.Errorf("[%s] Listed %d parts instead of 3", name, len(parts))
+	}
+	for _, p := range parts {
+		if p.N < 1 || p.N > 3 || p.Size != int64(len(chunks[p.N-1])) {
+			t.Errorf("[%s] Unexpected part %+v", name, p)
+		}
+	}
+	if err := ms.CompleteUpload(so, id, int64(len(data))); err != nil {
+		t.Fatalf("[%s] Cannot complete upload: %s", name, err)
+	}
+	out := &bytes.Buffer{}
+	if err := st.Get(so, out); err != nil {
+		t.Fatalf("[%s] Cannot get assembled object: %s", name, err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("[%s] Assembled object differs from in data", name)
+	}
+	if err := st.Delete(so); err != nil {
+		t.Errorf("[%s] Cannot delete assembled object: %s", name, err)
+	}
+
+	//Parts that don't add up to the object
+	id, err = ms.InitiateUpload(so)
+	if err != nil {
+		t.Fatalf("[%s] Cannot initiate upload: %s", name, err)
+	}
+	if err := ms.UploadPart(so, id, 1, bytes.NewReader(chunks[2]), int64(len(chunks[2]))); err != nil {
+		t.Fatalf("[%s] Cannot upload part: %s", name, err)
+	}
+	if err := ms.CompleteUpload(so, id, int64(len(chunks[2]))); err != ostore.ErrHashMismatch {
+		t.Errorf("[%s] Completing with wrong data returned %v instead of ErrHashMismatch", name, err)
+	}
+	if _, err := st.Stat(so); err != ostore.ErrNotExists {
+		t.Errorf("[%s] Object with hash mismatch was not cleaned up: %v", name, err)
+	}
+	ms.AbortUpload(so, id)
+	if parts, err := ms.ListParts(so, id); err == nil && len(parts) > 0 {
+		t.Errorf("[%s] Aborted upload still has %d parts", name, len(parts))
+	}
+}
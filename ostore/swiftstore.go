@@ -1,8 +1,14 @@
 package ostore
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ncw/swift"
@@ -11,6 +17,7 @@ import (
 type SwiftStore struct {
 	conn          *swift.Connection
 	containerName string
+	tempURLKey    string
 }
 
 const (
@@ -22,8 +29,34 @@ const (
 	SWIFT_STORAGE_URL = "storage_url"
 	SWIFT_AUTH_TOKEN  = "auth_token"
 	SWIFT_CONTAINER   = "container"
+	//Key set as X-Account-Meta-Temp-URL-Key in the account. Presigned
+	//downloads are served by swift itself when it is there
+	SWIFT_TEMP_URL_KEY = "temp_url_key"
+
+	//Swift only keeps user headers with this prefix
+	SWIFT_META_PREFIX = "X-Object-Meta-"
+	//Multipart uploads keep their parts here
+	SWIFT_SEGMENTS_SUFFIX = "_segments"
+	SWIFT_MANIFEST_HEADER = "X-Object-Manifest"
 )
 
+func init() {
+	RegisterBackend(STORE_TYPE_SWIFT, []ConfigField{
+		{Name: SWIFT_AUTH_URL},
+		{Name: SWIFT_USER_NAME},
+		{Name: SWIFT_API_KEY},
+		{Name: SWIFT_TENANT},
+		{Name: SWIFT_TENANT_ID},
+		{Name: SWIFT_STORAGE_URL},
+		{Name: SWIFT_AUTH_TOKEN},
+		{Name: SWIFT_CONTAINER, Required: true},
+		{Name: SWIFT_TEMP_URL_KEY},
+	}, func(c map[string]string) (Store, error) {
+		s := &SwiftStore{}
+		return s, s.Initialize(c)
+	})
+}
+
 func (s *SwiftStore) Initialize(c map[string]string) error {
 	if _, ok := c[SWIFT_CONTAINER]; !ok {
 		return errors.New("No container defined")
@@ -37,18 +70,15 @@ func (s *SwiftStore) Initialize(c map[string]string) error {
 		StorageUrl: c[SWIFT_STORAGE_URL],
 		AuthToken:  c[SWIFT_AUTH_TOKEN],
 	}
+	s.containerName = c[SWIFT_CONTAINER]
+	s.tempURLKey = c[SWIFT_TEMP_URL_KEY]
 
-	if s.conn.Authenticated() {
-		return nil
-	}
-	if err := s.conn.Authenticate(); err != nil {
-		return err
+	if !s.conn.Authenticated() {
+		if err := s.conn.Authenticate(); err != nil {
+			return err
+		}
 	}
-	if err := s.conn.ContainerCreate(c[SWIFT_CONTAINER], nil); err != nil {
-		return err
-	}
-	s.containerName = c[SWIFT_CONTAINER]
-	return nil
+	return s.conn.ContainerCreate(s.containerName, nil)
 }
 
 func (s *SwiftStore) Put(so *StoredObject, data io.Reader, length int64) error {
@@ -57,7 +87,7 @@ func (s *SwiftStore) Put(so *StoredObject, data io.Reader, length int64) error {
 	case swift.ObjectNotFound:
 		break
 	case nil:
-		return nil
+		return ErrAlreadyExists
 	default:
 		return err
 	}
@@ -66,16 +96,23 @@ func (s *SwiftStore) Put(so *StoredObject, data io.Reader, length int64) error {
 		headers["X-Expiration"] = so.Expiration.Format(time.RFC3339)
 	}
 	for k, v := range so.Metadata {
-		headers["X-Object-"+k] = v
+		headers[SWIFT_META_PREFIX+k] = v
+	}
+	hr, err := NewVerifyingHashReader(data, so.dataHash())
+	if err != nil {
+		return err
 	}
-	hr := NewHashReader(data)
 	_, err = s.conn.ObjectPut(s.containerName, so.getPath(), hr, true, "", "application/octet-stream", swift.Headers(headers))
 	if err != nil {
 		return err
 	}
-	if hr.HexDigest() != so.Hash {
+	if err := checkLength(hr, length); err != nil {
+		s.Delete(so)
+		return err
+	}
+	if err := hr.Verify(so.dataHash()); err != nil {
 		s.Delete(so)
-		return ErrHashMismatch
+		return err
 	}
 	return nil
 }
@@ -88,10 +125,223 @@ func (s *SwiftStore) Get(so *StoredObject, data io.Writer) error {
 	return err
 }
 
+func (s *SwiftStore) Stat(so *StoredObject) (*ObjectInfo, error) {
+	obj, headers, err := s.conn.Object(s.containerName, so.getPath())
+	if err != nil {
+		if err == swift.ObjectNotFound {
+			return nil, ErrNotExists
+		}
+		return nil, err
+	}
+	return &ObjectInfo{Size: obj.Bytes, ModTime: obj.LastModified, Metadata: headers.ObjectMetadata()}, nil
+}
+
+type swiftReader struct {
+	*swift.ObjectOpenFile
+	info *ObjectInfo
+}
+
+func (r *swiftReader) Info() *ObjectInfo {
+	return r.info
+}
+
+// The hash is not checked by the swift library since it can't be computed
+// once the reader seeks
+func (s *SwiftStore) Open(so *StoredObject) (ObjectReader, error) {
+	f, headers, err := s.conn.ObjectOpen(s.containerName, so.getPath(), false, nil)
+	if err != nil {
+		if err == swift.ObjectNotFound {
+			return nil, ErrNotExists
+		}
+		return nil, err
+	}
+	size, err := f.Length()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	info := &ObjectInfo{Size: size, Metadata: headers.ObjectMetadata()}
+	info.ModTime, _ = http.ParseTime(headers["Last-Modified"])
+	return &swiftReader{f, info}, nil
+}
+
+// Swift TempURL for the object, if the store has a temp URL key
+func (s *SwiftStore) SignedURL(so *StoredObject, expires time.Time) (string, error) {
+	if len(s.tempURLKey) == 0 {
+		return "", ErrNoSignedURL
+	}
+	return s.conn.ObjectTempUrl(s.containerName, so.getPath(), s.tempURLKey, "GET", expires), nil
+}
+
+func (s *SwiftStore) List(prefix, cursor string, limit int) (*ListPage, error) {
+	limit = listLimit(limit)
+	objs, err := s.conn.Objects(s.containerName, &swift.ObjectsOpts{Prefix: prefix, Marker: cursor, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	page := &ListPage{Objects: []ListEntry{}}
+	for _, obj := range objs {
+		typ, hash, ok := parseObjectKey(obj.Name)
+		if !ok {
+			continue
+		}
+		page.Objects = append(page.Objects, ListEntry{Type: typ, Hash: hash, Size: obj.Bytes, ModTime: obj.LastModified})
+	}
+	if len(objs) == limit {
+		page.Next = objs[len(objs)-1].Name
+	}
+	return page, nil
+}
+
+// Objects assembled from an upload also get their segments removed
 func (s *SwiftStore) Delete(so *StoredObject) error {
-	err := s.conn.ObjectDelete(s.containerName, so.getPath())
+	_, headers, err := s.conn.Object(s.containerName, so.getPath())
+	if err == nil {
+		err = s.conn.ObjectDelete(s.containerName, so.getPath())
+	}
 	if err == swift.ObjectNotFound {
+		return ErrNotExists
+	}
+	if err != nil {
+		return err
+	}
+	manifest, ok := headers[SWIFT_MANIFEST_HEADER]
+	if !ok {
 		return nil
 	}
-	return err
+	prefix := strings.TrimPrefix(manifest, s.segmentsContainer()+"/")
+	if prefix == manifest {
+		return fmt.Errorf("Unexpected manifest %s", manifest)
+	}
+	return s.deleteSegments(prefix)
+}
+
+func (s *SwiftStore) segmentsContainer() string {
+	return s.containerName + SWIFT_SEGMENTS_SUFFIX
+}
+
+func segmentsPrefix(so *StoredObject, uploadId string) string {
+	return fmt.Sprintf("%s/%s/", so.getPath(), uploadId)
+}
+
+func (s *SwiftStore) deleteSegments(prefix string) error {
+	names, err := s.conn.ObjectNames(s.segmentsContainer(), &swift.ObjectsOpts{Prefix: prefix})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := s.conn.ObjectDelete(s.segmentsContainer(), name); err != nil && err != swift.ObjectNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parts are uploaded as segments of a dynamic large object
+func (s *SwiftStore) InitiateUpload(so *StoredObject) (string, error) {
+	if err := s.conn.ContainerCreate(s.segmentsContainer(), nil); err != nil {
+		return "", err
+	}
+	return newObjectId(), nil
+}
+
+func (s *SwiftStore) UploadPart(so *StoredObject, uploadId string, n int, data io.Reader, length int64) error {
+	if err := checkPartNumber(n); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s%05d", segmentsPrefix(so, uploadId), n)
+	hr := NewHashReader(data)
+	_, err := s.conn.ObjectPut(s.segmentsContainer(), name, hr, true, "", "application/octet-stream", nil)
+	if err != nil {
+		return err
+	}
+	if err := checkLength(hr, length); err != nil {
+		s.conn.ObjectDelete(s.segmentsContainer(), name)
+		return err
+	}
+	return nil
+}
+
+func (s *SwiftStore) ListParts(so *StoredObject, uploadId string) ([]UploadPart, error) {
+	prefix := segmentsPrefix(so, uploadId)
+	objs, err := s.conn.Objects(s.segmentsContainer(), &swift.ObjectsOpts{Prefix: prefix})
+	if err != nil {
+		if err == swift.ContainerNotFound {
+			return nil, ErrUnknownUpload
+		}
+		return nil, err
+	}
+	parts := make([]UploadPart, 0, len(objs))
+	for _, obj := range objs {
+		n, err := strconv.Atoi(obj.Name[len(prefix):])
+		if err != nil {
+			continue
+		}
+		parts = append(parts, UploadPart{N: n, Size: obj.Bytes})
+	}
+	return parts, nil
+}
+
+func (s *SwiftStore) OpenPart(so *StoredObject, uploadId string, n int) (io.ReadCloser, error) {
+	name := fmt.Sprintf("%s%05d", segmentsPrefix(so, uploadId), n)
+	f, _, err := s.conn.ObjectOpen(s.segmentsContainer(), name, false, nil)
+	if err == swift.ObjectNotFound {
+		return nil, ErrInvalidPart
+	}
+	return f, err
+}
+
+// The manifest is written with the object metadata and the assembled object
+// is read back to verify it
+func (s *SwiftStore) CompleteUpload(so *StoredObject, uploadId string, length int64) error {
+	path := so.getPath()
+	_, _, err := s.conn.Object(s.containerName, path)
+	switch err {
+	case swift.ObjectNotFound:
+		break
+	case nil:
+		return ErrAlreadyExists
+	default:
+		return err
+	}
+	parts, err := s.ListParts(so, uploadId)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return ErrNoParts
+	}
+	headers := swift.Headers{SWIFT_MANIFEST_HEADER: s.segmentsContainer() + "/" + segmentsPrefix(so, uploadId)}
+	for k, v := range so.Metadata {
+		headers[SWIFT_META_PREFIX+k] = v
+	}
+	_, err = s.conn.ObjectPut(s.containerName, path, &bytes.Buffer{}, false, "", "application/octet-stream", headers)
+	if err != nil {
+		return err
+	}
+	f, _, err := s.conn.ObjectOpen(s.containerName, path, false, nil)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hr, err := NewVerifyingHashReader(f, so.dataHash())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, hr); err != nil {
+		return err
+	}
+	if hr.Size() != length {
+		s.Delete(so)
+		return ErrLengthMismatch
+	}
+	if err := hr.Verify(so.dataHash()); err != nil {
+		s.Delete(so)
+		return err
+	}
+	return nil
+}
+
+func (s *SwiftStore) AbortUpload(so *StoredObject, uploadId string) error {
+	return s.deleteSegments(segmentsPrefix(so, uploadId))
 }
@@ -1,6 +1,11 @@
-package ostore
+package ostore_test
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/acasajus/menac/ostore"
+	"github.com/acasajus/menac/ostore/storetest"
+)
 
 const (
 	TEST_SWIFT_USER      = "test:tester"
@@ -11,17 +16,17 @@ const (
 
 func getSwiftInitParams() map[string]string {
 	return map[string]string{
-		SWIFT_AUTH_URL:  TEST_SWIFT_AUTH_URL,
-		SWIFT_USER_NAME: TEST_SWIFT_USER,
-		SWIFT_API_KEY:   TEST_SWIFT_PASS,
-		SWIFT_CONTAINER: TEST_SWIFT_CONTAINER,
+		ostore.SWIFT_AUTH_URL:  TEST_SWIFT_AUTH_URL,
+		ostore.SWIFT_USER_NAME: TEST_SWIFT_USER,
+		ostore.SWIFT_API_KEY:   TEST_SWIFT_PASS,
+		ostore.SWIFT_CONTAINER: TEST_SWIFT_CONTAINER,
 	}
 }
 
-func TestSwiftStoreGetPutDelete(t *testing.T) {
-	st := &SwiftStore{}
+func TestSwiftStore(t *testing.T) {
+	st := &ostore.SwiftStore{}
 	if err := st.Initialize(getSwiftInitParams()); err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
-	runTestStoreGetPutDelete("SwiftStore", st, t)
+	storetest.RunStoreTests(t, "SwiftStore", st)
 }
@@ -0,0 +1,429 @@
+package ostore
+
+import (
+	"expvar"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	//Most bytes accounted for at once, so waits are short and even
+	TRANSFER_CHUNK = 64 * 1024
+	//Directions of a transfer. Each one has its own slots per backend
+	TRANSFER_READ  = "read"
+	TRANSFER_WRITE = "write"
+)
+
+var (
+	transferStats = expvar.NewMap("ostore.transfers")
+	//Active and queued transfers and bytes moved by backend, as
+	//<org>:<store>.<metric>
+	transferBackendStats = expvar.NewMap("ostore.transfer_backends")
+	//Bytes moved by organization
+	transferOrgStats = expvar.NewMap("ostore.transfer_orgs")
+)
+
+// Bytes per second with bursts of up to one second worth of them. Waits are
+// reserved, so concurrent users are served in the order they asked
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.rate = rate
+}
+
+// Take n tokens and return how long to wait until they are available
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// Slots of one backend in one direction, served round robin between users
+type transferQueue struct {
+	name string
+
+	lock    sync.Mutex
+	free    int
+	users   []string
+	waiting map[string][]chan struct{}
+}
+
+func newTransferQueue(name string, slots int) *transferQueue {
+	return &transferQueue{name: name, free: slots, waiting: map[string][]chan struct{}{}}
+}
+
+func (q *transferQueue) acquire(user string) {
+	q.lock.Lock()
+	if q.free > 0 && len(q.users) == 0 {
+		q.free--
+		q.lock.Unlock()
+		q.started()
+		return
+	}
+	ch := make(chan struct{})
+	if len(q.waiting[user]) == 0 {
+		q.users = append(q.users, user)
+	}
+	q.waiting[user] = append(q.waiting[user], ch)
+	q.lock.Unlock()
+	transferStats.Add("queued", 1)
+	transferBackendStats.Add(q.name+".queued", 1)
+	<-ch
+	transferStats.Add("queued", -1)
+	transferBackendStats.Add(q.name+".queued", -1)
+	q.started()
+}
+
+func (q *transferQueue) started() {
+	transferStats.Add("active", 1)
+	transferBackendStats.Add(q.name+".active", 1)
+}
+
+// Hand the slot to the next user in turn, or free it
+func (q *transferQueue) release() {
+	transferStats.Add("active", -1)
+	transferBackendStats.Add(q.name+".active", -1)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.users) == 0 {
+		q.free++
+		return
+	}
+	user := q.users[0]
+	q.users = q.users[1:]
+	chs := q.waiting[user]
+	if len(chs) > 1 {
+		q.waiting[user] = chs[1:]
+		q.users = append(q.users, user)
+	} else {
+		delete(q.waiting, user)
+	}
+	close(chs[0])
+}
+
+type TransferLimits struct {
+	//Bytes per second moved by all the stores of the node. 0 disables it
+	Rate int64
+	//Bytes per second moved by the stores of each organization. 0 disables it
+	OrgRate int64
+	//Transfers running at once in each direction per store. 0 disables it
+	Concurrency int
+}
+
+// Throttles the data moved in and out of the backends of the node
+type TransferManager struct {
+	limits TransferLimits
+	global *tokenBucket
+
+	lock   sync.Mutex
+	orgs   map[string]*tokenBucket
+	queues map[string]*transferQueue
+}
+
+func NewTransferManager(limits TransferLimits) *TransferManager {
+	return &TransferManager{
+		limits: limits,
+		global: newTokenBucket(limits.Rate),
+		orgs:   map[string]*tokenBucket{},
+		queues: map[string]*transferQueue{},
+	}
+}
+
+// Override the bandwidth of one organization. 0 disables its limit
+func (tm *TransferManager) SetOrgRate(org string, rate int64) {
+	tm.orgBucket(org).setRate(rate)
+}
+
+func (tm *TransferManager) orgBucket(org string) *tokenBucket {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	b, ok := tm.orgs[org]
+	if !ok {
+		b = newTokenBucket(tm.limits.OrgRate)
+		tm.orgs[org] = b
+	}
+	return b
+}
+
+// Queue of the transfers of a store in one direction, nil if unlimited
+func (tm *TransferManager) queue(backend, direction string) *transferQueue {
+	if tm.limits.Concurrency <= 0 {
+		return nil
+	}
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	key := backend + "." + direction
+	q, ok := tm.queues[key]
+	if !ok {
+		q = newTransferQueue(key, tm.limits.Concurrency)
+		tm.queues[key] = q
+	}
+	return q
+}
+
+// Wait until n bytes of org fit within the limits
+func (tm *TransferManager) wait(org string, n int) {
+	now := time.Now()
+	wait := tm.global.reserve(n, now)
+	if w := tm.orgBucket(org).reserve(n, now); w > wait {
+		wait = w
+	}
+	if wait > 0 {
+		transferStats.Add("throttled_ns", int64(wait))
+		time.Sleep(wait)
+	}
+}
+
+var (
+	transferManagerLock sync.RWMutex
+	transferManager     *TransferManager
+)
+
+// Throttle the stores opened from now on. Call it before any store is opened,
+// stores already open keep the manager they had. nil disables throttling
+func SetTransferManager(tm *TransferManager) {
+	transferManagerLock.Lock()
+	defer transferManagerLock.Unlock()
+	transferManager = tm
+}
+
+func getTransferManager() *TransferManager {
+	transferManagerLock.RLock()
+	defer transferManagerLock.RUnlock()
+	return transferManager
+}
+
+// Backend wrapped by the transfer manager
+type TransferStore struct {
+	inner   Store
+	tm      *TransferManager
+	org     string
+	backend string
+}
+
+func NewTransferStore(inner Store, tm *TransferManager, org, backend string) *TransferStore {
+	return &TransferStore{inner: inner, tm: tm, org: org, backend: backend}
+}
+
+func (ts *TransferStore) Inner() Store {
+	return ts.inner
+}
+
+// Take a slot for a transfer of the user. The returned function gives it back
+func (ts *TransferStore) start(direction, user string) func() {
+	q := ts.tm.queue(ts.backend, direction)
+	if q == nil {
+		return func() {}
+	}
+	q.acquire(user)
+	once := sync.Once{}
+	return func() { once.Do(q.release) }
+}
+
+// Account n bytes, waiting for them if over the limits
+func (ts *TransferStore) account(direction string, n int) {
+	ts.tm.wait(ts.org, n)
+	transferStats.Add("bytes_"+direction, int64(n))
+	transferBackendStats.Add(ts.backend+".bytes_"+direction, int64(n))
+	transferOrgStats.Add(ts.org, int64(n))
+}
+
+type transferReader struct {
+	r         io.Reader
+	ts        *TransferStore
+	direction string
+}
+
+func (tr *transferReader) Read(p []byte) (int, error) {
+	if len(p) > TRANSFER_CHUNK {
+		p = p[:TRANSFER_CHUNK]
+	}
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		tr.ts.account(tr.direction, n)
+	}
+	return n, err
+}
+
+type transferWriter struct {
+	w  io.Writer
+	ts *TransferStore
+}
+
+func (tw *transferWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > TRANSFER_CHUNK {
+			chunk = chunk[:TRANSFER_CHUNK]
+		}
+		tw.ts.account(TRANSFER_READ, len(chunk))
+		n, err := tw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Reader of an open blob. It keeps its slot until closed
+type transferObjectReader struct {
+	ObjectReader
+	tr      *transferReader
+	release func()
+}
+
+func (r *transferObjectReader) Read(p []byte) (int, error) {
+	return r.tr.Read(p)
+}
+
+func (r *transferObjectReader) Close() error {
+	r.release()
+	return r.ObjectReader.Close()
+}
+
+func (ts *TransferStore) Put(so *StoredObject, data io.Reader, length int64) error {
+	defer ts.start(TRANSFER_WRITE, so.User)()
+	return ts.inner.Put(so, &transferReader{data, ts, TRANSFER_WRITE}, length)
+}
+
+func (ts *TransferStore) Get(so *StoredObject, data io.Writer) error {
+	defer ts.start(TRANSFER_READ, so.User)()
+	return ts.inner.Get(so, &transferWriter{data, ts})
+}
+
+func (ts *TransferStore) Open(so *StoredObject) (ObjectReader, error) {
+	release := ts.start(TRANSFER_READ, so.User)
+	r, err := ts.inner.Open(so)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &transferObjectReader{r, &transferReader{r, ts, TRANSFER_READ}, release}, nil
+}
+
+func (ts *TransferStore) Stat(so *StoredObject) (*ObjectInfo, error) {
+	return ts.inner.Stat(so)
+}
+
+func (ts *TransferStore) List(prefix, cursor string, limit int) (*ListPage, error) {
+	return ts.inner.List(prefix, cursor, limit)
+}
+
+func (ts *TransferStore) Delete(so *StoredObject) error {
+	return ts.inner.Delete(so)
+}
+
+func (ts *TransferStore) Close() error {
+	if cl, ok := ts.inner.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+func (ts *TransferStore) InitiateUpload(so *StoredObject) (string, error) {
+	ms, ok := ts.inner.(MultipartStore)
+	if !ok {
+		return "", ErrNoMultipart
+	}
+	return ms.InitiateUpload(so)
+}
+
+func (ts *TransferStore) UploadPart(so *StoredObject, uploadId string, n int, data io.Reader, length int64) error {
+	ms, ok := ts.inner.(MultipartStore)
+	if !ok {
+		return ErrNoMultipart
+	}
+	defer ts.start(TRANSFER_WRITE, so.User)()
+	return ms.UploadPart(so, uploadId, n, &transferReader{data, ts, TRANSFER_WRITE}, length)
+}
+
+func (ts *TransferStore) ListParts(so *StoredObject, uploadId string) ([]UploadPart, error) {
+	ms, ok := ts.inner.(MultipartStore)
+	if !ok {
+		return nil, ErrNoMultipart
+	}
+	return ms.ListParts(so, uploadId)
+}
+
+// Parts read back count against the read rate but take no transfer slot,
+// since all the parts of an upload are open at once
+func (ts *TransferStore) OpenPart(so *StoredObject, uploadId string, n int) (io.ReadCloser, error) {
+	po, ok := ts.inner.(partOpener)
+	if !ok {
+		return nil, ErrUnverifiedParts
+	}
+	r, err := po.OpenPart(so, uploadId, n)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&transferReader{r, ts, TRANSFER_READ}, r}, nil
+}
+
+// Parts are assembled by the backend, nothing goes through the link
+func (ts *TransferStore) CompleteUpload(so *StoredObject, uploadId string, length int64) error {
+	ms, ok := ts.inner.(MultipartStore)
+	if !ok {
+		return ErrNoMultipart
+	}
+	return ms.CompleteUpload(so, uploadId, length)
+}
+
+func (ts *TransferStore) AbortUpload(so *StoredObject, uploadId string) error {
+	ms, ok := ts.inner.(MultipartStore)
+	if !ok {
+		return ErrNoMultipart
+	}
+	return ms.AbortUpload(so, uploadId)
+}
+
+// Downloads from signed URLs go straight to the backend and are not throttled
+func (ts *TransferStore) SignedURL(so *StoredObject, expires time.Time) (string, error) {
+	signer, ok := ts.inner.(URLSigner)
+	if !ok {
+		return "", ErrNoSignedURL
+	}
+	return signer.SignedURL(so, expires)
+}
+
+// The backend under the transfer manager, to find out what it supports
+func untransferred(st Store) Store {
+	if ts, ok := st.(*TransferStore); ok {
+		return ts.inner
+	}
+	return st
+}
+
+// The backend under the cache and the transfer manager
+func unwrap(st Store) Store {
+	return untransferred(uncached(st))
+}
@@ -0,0 +1,117 @@
+package ostore_test
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/acasajus/menac/ostore"
+	"github.com/acasajus/menac/ostore/storetest"
+)
+
+func TestTransferStore(t *testing.T) {
+	tm := ostore.NewTransferManager(ostore.TransferLimits{Rate: 1 << 30, OrgRate: 1 << 30, Concurrency: 2})
+	st := ostore.NewTransferStore(ostore.NewMemStore(), tm, "org", "org:transfer")
+	storetest.RunStoreTests(t, "TransferStore", st)
+}
+
+func TestTransferRate(t *testing.T) {
+	const rate = 256 * 1024
+	for i, tt := range []ostore.TransferLimits{{Rate: rate}, {OrgRate: rate}, {Rate: rate, OrgRate: 1 << 30}} {
+		tm := ostore.NewTransferManager(tt)
+		st := ostore.NewTransferStore(ostore.NewMemStore(), tm, "org", "org:rate"+strconv.Itoa(i))
+		//The first second worth of data is a burst, the second one has to wait
+		so, data := storetest.NewTestObject(2 * rate)
+		start := time.Now()
+		if err := st.Put(so, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if d := time.Since(start); d < 900*time.Millisecond || d > 3*time.Second {
+			t.Errorf("#%d: Upload took %s instead of about a second", i, d)
+		}
+	}
+	//Other organizations have their own limit
+	tm := ostore.NewTransferManager(ostore.TransferLimits{OrgRate: rate})
+	tm.SetOrgRate("fast", 0)
+	st := ostore.NewTransferStore(ostore.NewMemStore(), tm, "fast", "fast:rate")
+	so, data := storetest.NewTestObject(4 * rate)
+	start := time.Now()
+	if err := st.Put(so, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Unlimited organization was throttled for %s", d)
+	}
+}
+
+// Store whose uploads wait to be let through, recording the user of each one
+type gatedStore struct {
+	ostore.Store
+	gate chan struct{}
+	lock sync.Mutex
+	puts []string
+}
+
+func (gs *gatedStore) Put(so *ostore.StoredObject, data io.Reader, length int64) error {
+	gs.lock.Lock()
+	gs.puts = append(gs.puts, so.User)
+	gs.lock.Unlock()
+	<-gs.gate
+	return gs.Store.Put(so, data, length)
+}
+
+func queuedTransfers() int64 {
+	v := expvar.Get("ostore.transfers").(*expvar.Map).Get("queued")
+	if v == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(v.String(), 10, 64)
+	return n
+}
+
+func TestTransferFairQueue(t *testing.T) {
+	gs := &gatedStore{Store: ostore.NewMemStore(), gate: make(chan struct{})}
+	tm := ostore.NewTransferManager(ostore.TransferLimits{Concurrency: 1})
+	st := ostore.NewTransferStore(gs, tm, "org", "org:fair")
+	wg := sync.WaitGroup{}
+	put := func(user string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			so, data := storetest.NewTestObject(16)
+			so.User = user
+			if err := st.Put(so, bytes.NewReader(data), int64(len(data))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	//One upload of a runs and three more queue, then one of b
+	queued := queuedTransfers()
+	for i, user := range []string{"a", "a", "a", "a", "b"} {
+		put(user)
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			gs.lock.Lock()
+			running := len(gs.puts)
+			gs.lock.Unlock()
+			if running == 1 && queuedTransfers() == queued+int64(i) {
+				break
+			}
+		}
+	}
+	if n := queuedTransfers() - queued; n != 4 {
+		t.Fatalf("%d uploads queued instead of 4", n)
+	}
+	for i := 0; i < 5; i++ {
+		gs.gate <- struct{}{}
+	}
+	wg.Wait()
+	expected := []string{"a", "a", "b", "a", "a"}
+	if !reflect.DeepEqual(gs.puts, expected) {
+		t.Errorf("Uploads ran in order %v instead of %v", gs.puts, expected)
+	}
+}
@@ -0,0 +1,439 @@
+package ostore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	COMPRESSION_NONE = ""
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+	ENCRYPTION_NONE  = ""
+	ENCRYPTION_AES   = "aes-256-gcm"
+
+	//Store config options handled by the wrapper instead of the backend
+	STORE_COMPRESSION    = "compression"
+	STORE_ENCRYPTION_KEY = "encryption_key"
+
+	//Metadata keys describing how the data is kept
+	META_COMPRESSION = "Ostore-Compression"
+	META_ENCRYPTION  = "Ostore-Encryption"
+
+	TRANSFORM_MAGIC      = "MNCT"
+	TRANSFORM_MAX_HEADER = 64 * 1024
+)
+
+var ErrNotTransformed = errors.New("Stored data has no transform header")
+
+type TransformOptions struct {
+	Compression string
+	//Hex encoded 32 byte organization key. Empty disables encryption
+	Key string
+}
+
+func (to TransformOptions) Enabled() bool {
+	return to.Compression != COMPRESSION_NONE || len(to.Key) > 0
+}
+
+// Header written before the data so blobs are self describing
+type transformHeader struct {
+	Compression string `json:",omitempty"`
+	Encryption  string `json:",omitempty"`
+	WrappedKey  []byte `json:",omitempty"`
+	NoncePrefix []byte `json:",omitempty"`
+	//Logical size of the object
+	Size int64
+}
+
+func (h *transformHeader) metadata() map[string]string {
+	md := map[string]string{}
+	if h.Compression != COMPRESSION_NONE {
+		md[META_COMPRESSION] = h.Compression
+	}
+	if h.Encryption != ENCRYPTION_NONE {
+		md[META_ENCRYPTION] = h.Encryption
+	}
+	return md
+}
+
+// Store wrapper that compresses and/or encrypts the data before it reaches the backend
+type TransformStore struct {
+	inner       Store
+	compression string
+	key         []byte
+}
+
+func NewTransformStore(inner Store, opts TransformOptions) (*TransformStore, error) {
+	ts := &TransformStore{inner: inner}
+	switch opts.Compression {
+	case COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_ZSTD:
+		ts.compression = opts.Compression
+	default:
+		return nil, fmt.Errorf("Unknown compression %s", opts.Compression)
+	}
+	if len(opts.Key) > 0 {
+		key, err := hex.DecodeString(opts.Key)
+		if err != nil || len(key) != GCM_KEY_SIZE {
+			return nil, fmt.Errorf("Encryption key must be %d hex encoded bytes", GCM_KEY_SIZE)
+		}
+		ts.key = key
+	}
+	return ts, nil
+}
+
+func (ts *TransformStore) Inner() Store {
+	return ts.inner
+}
+
+func writeTransformHeader(w io.Writer, h *transformHeader) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBufferString(TRANSFORM_MAGIC)
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func readTransformHeader(r io.Reader) (*transformHeader, error) {
+	pre := make([]byte, len(TRANSFORM_MAGIC)+4)
+	if _, err := io.ReadFull(r, pre); err != nil {
+		return nil, ErrNotTransformed
+	}
+	if string(pre[:len(TRANSFORM_MAGIC)]) != TRANSFORM_MAGIC {
+		return nil, ErrNotTransformed
+	}
+	size := binary.BigEndian.Uint32(pre[len(TRANSFORM_MAGIC):])
+	if size > TRANSFORM_MAX_HEADER {
+		return nil, ErrCorruptData
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, ErrCorruptData
+	}
+	h := &transformHeader{}
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, ErrCorruptData
+	}
+	return h, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Chain of writers applying the transforms. Closing it flushes every stage
+func (ts *TransformStore) encoder(w io.Writer, h *transformHeader) (io.WriteCloser, error) {
+	closers := []io.Closer{}
+	if len(ts.key) > 0 {
+		dataKey := randomBytes(GCM_KEY_SIZE)
+		wrapped, err := wrapKey(ts.key, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		h.Encryption = ENCRYPTION_AES
+		h.WrappedKey = wrapped
+		h.NoncePrefix = randomBytes(GCM_PREFIX_SIZE)
+		if err := writeTransformHeader(w, h); err != nil {
+			return nil, err
+		}
+		gw, err := newGCMWriter(w, dataKey, h.NoncePrefix)
+		if err != nil {
+			return nil, err
+		}
+		w = gw
+		closers = append(closers, gw)
+	} else if err := writeTransformHeader(w, h); err != nil {
+		return nil, err
+	}
+	switch h.Compression {
+	case COMPRESSION_GZIP:
+		zw := gzip.NewWriter(w)
+		w = zw
+		closers = append(closers, zw)
+	case COMPRESSION_ZSTD:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+		closers = append(closers, zw)
+	}
+	return &chainWriter{w, closers}, nil
+}
+
+type chainWriter struct {
+	io.Writer
+	//Outermost last
+	closers []io.Closer
+}
+
+func (cw *chainWriter) Close() error {
+	for i := len(cw.closers) - 1; i >= 0; i-- {
+		if err := cw.closers[i].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type chainReader struct {
+	io.Reader
+	closers []func()
+}
+
+func (cr *chainReader) Close() error {
+	for _, c := range cr.closers {
+		c()
+	}
+	return nil
+}
+
+// Reader of the logical data from the stored bytes. The header is read first
+func (ts *TransformStore) decoder(r io.Reader) (*transformHeader, *chainReader, error) {
+	h, err := readTransformHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	cr := &chainReader{Reader: r}
+	switch h.Encryption {
+	case ENCRYPTION_NONE:
+	case ENCRYPTION_AES:
+		if len(ts.key) == 0 {
+			return nil, nil, errors.New("Object is encrypted and the store has no key")
+		}
+		dataKey, err := unwrapKey(ts.key, h.WrappedKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if cr.Reader, err = newGCMReader(cr.Reader, dataKey, h.NoncePrefix); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, fmt.Errorf("Unknown encryption %s", h.Encryption)
+	}
+	switch h.Compression {
+	case COMPRESSION_NONE:
+	case COMPRESSION_GZIP:
+		zr, err := gzip.NewReader(cr.Reader)
+		if err != nil {
+			return nil, nil, ErrCorruptData
+		}
+		cr.Reader = zr
+		cr.closers = append(cr.closers, func() { zr.Close() })
+	case COMPRESSION_ZSTD:
+		zr, err := zstd.NewReader(cr.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		cr.Reader = zr
+		cr.closers = append(cr.closers, zr.Close)
+	default:
+		return nil, nil, fmt.Errorf("Unknown compression %s", h.Compression)
+	}
+	return h, cr, nil
+}
+
+// Transformed into a temporary file first since backends need its length and hash
+func (ts *TransformStore) Put(so *StoredObject, data io.Reader, length int64) error {
+	tmp, err := ioutil.TempFile("", "ostore-transform-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	rawHash := sha512.New()
+	h := &transformHeader{Compression: ts.compression, Size: length}
+	enc, err := ts.encoder(io.MultiWriter(tmp, rawHash), h)
+	if err != nil {
+		return err
+	}
+	hr, err := NewVerifyingHashReader(data, so.Hash)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(enc, hr); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	if hr.Size() != length {
+		return ErrLengthMismatch
+	}
+	if err := hr.Verify(so.Hash); err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	raw := *so
+	raw.rawHash = hex.EncodeToString(rawHash.Sum(nil))
+	raw.Metadata = copyMetadata(so.Metadata)
+	if raw.Metadata == nil {
+		raw.Metadata = map[string]string{}
+	}
+	for k, v := range h.metadata() {
+		raw.Metadata[k] = v
+	}
+	return ts.inner.Put(&raw, tmp, size)
+}
+
+// The logical hash is verified once all the data has been written
+func (ts *TransformStore) Get(so *StoredObject, data io.Writer) error {
+	r, err := ts.inner.Open(so)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h, dec, err := ts.decoder(r)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	hr, err := NewVerifyingHashReader(dec, so.Hash)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(data, hr); err != nil {
+		return err
+	}
+	if hr.Size() != h.Size || hr.Verify(so.Hash) != nil {
+		return ErrCorruptData
+	}
+	return nil
+}
+
+// Backend metadata plus the transform settings
+func (ts *TransformStore) Stat(so *StoredObject) (*ObjectInfo, error) {
+	r, err := ts.inner.Open(so)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	h, err := readTransformHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return transformInfo(r.Info(), h), nil
+}
+
+func transformInfo(raw *ObjectInfo, h *transformHeader) *ObjectInfo {
+	info := &ObjectInfo{Size: h.Size, ModTime: raw.ModTime, Metadata: copyMetadata(raw.Metadata)}
+	if info.Metadata == nil {
+		info.Metadata = map[string]string{}
+	}
+	for k, v := range h.metadata() {
+		info.Metadata[k] = v
+	}
+	return info
+}
+
+// Transformed streams can't seek, so decode again or discard to get there
+type transformReader struct {
+	ts     *TransformStore
+	so     *StoredObject
+	info   *ObjectInfo
+	raw    ObjectReader
+	dec    *chainReader
+	pos    int64
+	offset int64
+}
+
+func (ts *TransformStore) Open(so *StoredObject) (ObjectReader, error) {
+	tr := &transformReader{ts: ts, so: so}
+	if err := tr.reopen(); err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+func (tr *transformReader) reopen() error {
+	tr.Close()
+	raw, err := tr.ts.inner.Open(tr.so)
+	if err != nil {
+		return err
+	}
+	h, dec, err := tr.ts.decoder(raw)
+	if err != nil {
+		raw.Close()
+		return err
+	}
+	tr.raw, tr.dec, tr.pos = raw, dec, 0
+	tr.info = transformInfo(raw.Info(), h)
+	return nil
+}
+
+func (tr *transformReader) Info() *ObjectInfo {
+	return tr.info
+}
+
+func (tr *transformReader) Read(p []byte) (int, error) {
+	if tr.offset >= tr.info.Size {
+		return 0, io.EOF
+	}
+	if tr.dec == nil || tr.pos > tr.offset {
+		if err := tr.reopen(); err != nil {
+			return 0, err
+		}
+	}
+	if tr.pos < tr.offset {
+		n, err := io.CopyN(ioutil.Discard, tr.dec, tr.offset-tr.pos)
+		tr.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := tr.dec.Read(p)
+	tr.pos += int64(n)
+	tr.offset = tr.pos
+	return n, err
+}
+
+func (tr *transformReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := seekPosition(tr.offset, tr.info.Size, offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	tr.offset = pos
+	return pos, nil
+}
+
+func (tr *transformReader) Close() error {
+	if tr.raw == nil {
+		return nil
+	}
+	tr.dec.Close()
+	err := tr.raw.Close()
+	tr.raw, tr.dec = nil, nil
+	return err
+}
+
+// Sizes are the ones of the transformed data
+func (ts *TransformStore) List(prefix, cursor string, limit int) (*ListPage, error) {
+	return ts.inner.List(prefix, cursor, limit)
+}
+
+func (ts *TransformStore) Delete(so *StoredObject) error {
+	return ts.inner.Delete(so)
+}
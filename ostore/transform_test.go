@@ -0,0 +1,80 @@
+package ostore_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/acasajus/menac/ostore"
+	"github.com/acasajus/menac/ostore/storetest"
+)
+
+var testKey = hex.EncodeToString(bytes.Repeat([]byte{7}, ostore.GCM_KEY_SIZE))
+
+func TestTransformStore(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ostore.TransformOptions
+	}{
+		{"gzip", ostore.TransformOptions{Compression: ostore.COMPRESSION_GZIP}},
+		{"zstd", ostore.TransformOptions{Compression: ostore.COMPRESSION_ZSTD}},
+		{"aes", ostore.TransformOptions{Key: testKey}},
+		{"gzip+aes", ostore.TransformOptions{Compression: ostore.COMPRESSION_GZIP, Key: testKey}},
+	}
+	for _, tt := range tests {
+		st, err := ostore.NewTransformStore(ostore.NewMemStore(), tt.opts)
+		if err != nil {
+			t.Fatalf("[%s] Cannot create store: %s", tt.name, err)
+		}
+		storetest.RunStoreTests(t, "TransformStore "+tt.name, st)
+	}
+}
+
+func TestTransformStoreOptions(t *testing.T) {
+	tests := []struct {
+		opts ostore.TransformOptions
+
+		werr bool
+	}{
+		{ostore.TransformOptions{Compression: "lzma"}, true},
+		{ostore.TransformOptions{Key: "nothex"}, true},
+		{ostore.TransformOptions{Key: testKey[:10]}, true},
+		{ostore.TransformOptions{Compression: ostore.COMPRESSION_ZSTD, Key: testKey}, false},
+	}
+	for i, tt := range tests {
+		_, err := ostore.NewTransformStore(ostore.NewMemStore(), tt.opts)
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %v", i, err, tt.werr)
+		}
+	}
+}
+
+func TestTransformStoreEncryption(t *testing.T) {
+	mem := ostore.NewMemStore()
+	st, _ := ostore.NewTransformStore(mem, ostore.TransformOptions{Key: testKey})
+	so, data := storetest.NewTestObject(3 * ostore.GCM_CHUNK_SIZE)
+	if err := st.Put(so, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	raw := &bytes.Buffer{}
+	if err := mem.Get(so, raw); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw.Bytes(), data[:64]) {
+		t.Error("Backend got plain text data")
+	}
+	info, err := st.Stat(so)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Metadata[ostore.META_ENCRYPTION] != ostore.ENCRYPTION_AES {
+		t.Errorf("Encryption is not recorded in the metadata %v", info.Metadata)
+	}
+
+	otherKey := hex.EncodeToString(bytes.Repeat([]byte{8}, ostore.GCM_KEY_SIZE))
+	other, _ := ostore.NewTransformStore(mem, ostore.TransformOptions{Key: otherKey})
+	if err := other.Get(so, &bytes.Buffer{}); err != ostore.ErrCorruptData {
+		t.Errorf("Get with another key returned %v", err)
+	}
+
+}
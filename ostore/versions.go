@@ -0,0 +1,362 @@
+package ostore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/acasajus/menac/db"
+)
+
+const (
+	//MaxVersions of stores that keep every version
+	VERSIONS_UNLIMITED = -1
+)
+
+var ErrDeleteMarker = errors.New("Version is a delete marker")
+
+// One version of a name. Versions are numbered from 1 and numbers are not
+// reused while the name exists. A version without object is a delete marker
+type ObjectVersion struct {
+	db.Record
+
+	Organization string `db:"indexed"`
+	StoreName    string
+	Name         string
+	//Primary key of the ObjectName, to find all the versions of a name
+	NameKey  string `db:"indexed"`
+	Version  int64
+	ObjectId string `db:"indexed"`
+	Created  time.Time
+}
+
+func (v *ObjectVersion) GetPrimaryKey() []byte {
+	return []byte(fmt.Sprintf("%s@%d", v.NameKey, v.Version))
+}
+
+func (v *ObjectVersion) Validate() error {
+	if len(v.Organization) == 0 {
+		return errors.New("Empty organization handle")
+	}
+	if len(v.StoreName) == 0 {
+		return errors.New("Empty store name")
+	}
+	if len(v.Name) == 0 {
+		return errors.New("Empty name")
+	}
+	if v.Version < 1 {
+		return errors.New("Invalid version number")
+	}
+	return nil
+}
+
+func (v *ObjectVersion) DeleteMarker() bool {
+	return len(v.ObjectId) == 0
+}
+
+// Newest first
+type objectVersionSlice []*ObjectVersion
+
+func (s objectVersionSlice) Len() int           { return len(s) }
+func (s objectVersionSlice) Less(i, j int) bool { return s[i].Version > s[j].Version }
+func (s objectVersionSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (os *ObjectStore) versionFor(name string, version int64) *ObjectVersion {
+	return os.GetDB().LinkRecordToDB(&ObjectVersion{
+		Organization: os.Organization,
+		StoreName:    os.Name,
+		Name:         name,
+		NameKey:      string(os.nameFor(name).GetPrimaryKey()),
+		Version:      version,
+	}).(*ObjectVersion)
+}
+
+// Versions of a name, newest first. The list is empty for names that never
+// existed and for names created before versioning that did not change since
+func (os *ObjectStore) Versions(name string) ([]*ObjectVersion, error) {
+	versions := []*ObjectVersion{}
+	key := string(os.nameFor(name).GetPrimaryKey())
+	for sr := range os.GetDB().Search(&ObjectVersion{}, "NameKey", key) {
+		if sr.Error != nil {
+			return nil, sr.Error
+		}
+		v, ok := sr.Record.(*ObjectVersion)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected struct type came out of the pipe %#v", sr.Record))
+		}
+		versions = append(versions, v)
+	}
+	sort.Sort(objectVersionSlice(versions))
+	return versions, nil
+}
+
+func (os *ObjectStore) getVersion(name string, version int64) (*ObjectVersion, error) {
+	v := os.versionFor(name, version)
+	if err := os.GetDB().GetRecord(v.GetPrimaryKey(), v); err != nil {
+		if db.IsErrNotFound(err) {
+			return nil, ErrNotExists
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+// Object of a version of a name. Fails with ErrDeleteMarker if the name was
+// deleted in that version and with ErrNotExists if the version is not retained
+func (os *ObjectStore) ResolveVersion(name string, version int64) (*StoredObject, error) {
+	v, err := os.getVersion(name, version)
+	if err != nil {
+		return nil, err
+	}
+	if v.DeleteMarker() {
+		return nil, ErrDeleteMarker
+	}
+	so, err := os.namedObject(&ObjectName{ObjectId: v.ObjectId})
+	if err != nil {
+		return nil, err
+	}
+	if so == nil {
+		return nil, ErrNotExists
+	}
+	return so, nil
+}
+
+// Point the name to the object, or mark it deleted if objectId is empty, as a
+// new version and apply the retention of the store
+func (os *ObjectStore) newVersion(name, objectId string) ([]*StoredObject, error) {
+	n := os.nameFor(name)
+	previous := ""
+	err := upsertRecord(n, func() { n.ObjectId, n.Version = "", 0 }, func() error {
+		previous = n.ObjectId
+		n.ObjectId = objectId
+		n.Version++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	v := os.versionFor(name, n.Version)
+	v.ObjectId = objectId
+	v.Created = time.Now()
+	if err := os.GetDB().CreateNewRecord(v); err != nil {
+		return nil, err
+	}
+	//Names from before versioning have no record for the replaced object
+	released := []string{}
+	if n.Version == 1 && len(previous) > 0 {
+		released = append(released, previous)
+	}
+	pruned, err := os.prune(name, time.Now(), released...)
+	if err != nil {
+		return nil, err
+	}
+	return os.unreferenced(pruned)
+}
+
+// Split the versions, newest first, in the ones retained and the ones past the limits
+func (os *ObjectStore) retention(versions []*ObjectVersion, now time.Time) ([]*ObjectVersion, []*ObjectVersion) {
+	keep, drop := []*ObjectVersion{}, []*ObjectVersion{}
+	for i, v := range versions {
+		switch {
+		case i == 0:
+			keep = append(keep, v)
+		case os.MaxVersions != VERSIONS_UNLIMITED && int64(len(keep)) >= os.MaxVersions:
+			drop = append(drop, v)
+		case os.VersionDays > 0 && now.Sub(versions[i-1].Created) > time.Duration(os.VersionDays)*24*time.Hour:
+			drop = append(drop, v)
+		default:
+			keep = append(keep, v)
+		}
+	}
+	//A delete marker with nothing behind it is not worth keeping
+	if len(keep) == 1 && keep[0].DeleteMarker() {
+		drop = append(drop, keep[0])
+		keep = keep[:0]
+	}
+	return keep, drop
+}
+
+// Remove the versions of a name past the retention
+func (os *ObjectStore) prune(name string, now time.Time, released ...string) ([]string, error) {
+	versions, err := os.Versions(name)
+	if err != nil {
+		return nil, err
+	}
+	keep, drop := os.retention(versions, now)
+	for _, v := range drop {
+		deleted, err := os.GetDB().DeleteRecord(v)
+		if err != nil {
+			return nil, err
+		}
+		//Concurrent prunes release each version only once
+		if deleted && !v.DeleteMarker() {
+			released = append(released, v.ObjectId)
+		}
+	}
+	if len(keep) == 0 {
+		n, err := os.getName(name)
+		switch {
+		case err == ErrNotExists:
+		case err != nil:
+			return nil, err
+		case n.Deleted():
+			//Fails if the name was set again meanwhile
+			if _, err := os.GetDB().DeleteRecord(n); err != nil && !db.IsErrGeneration(err) {
+				return nil, err
+			}
+		}
+	}
+	return released, nil
+}
+
+// Objects with the given ids that no name or retained version of the store
+// points to anymore. The same object can be set under several names
+func (os *ObjectStore) unreferenced(ids []string) ([]*StoredObject, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	checked := map[string]bool{}
+	objs := []*StoredObject{}
+	for _, id := range ids {
+		if checked[id] {
+			continue
+		}
+		checked[id] = true
+		referenced, err := os.objectReferenced(id)
+		if err != nil {
+			return nil, err
+		}
+		if referenced {
+			continue
+		}
+		so, err := os.namedObject(&ObjectName{ObjectId: id})
+		if err != nil {
+			return nil, err
+		}
+		if so != nil {
+			objs = append(objs, so)
+		}
+	}
+	return objs, nil
+}
+
+// Whether any name or retained version of the store points to the object
+func (os *ObjectStore) objectReferenced(id string) (bool, error) {
+	referenced := false
+	//Results are drained so the searches are not left blocked
+	for sr := range os.GetDB().Search(&ObjectName{}, "ObjectId", id) {
+		if sr.Error != nil {
+			return false, sr.Error
+		}
+		n, ok := sr.Record.(*ObjectName)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected struct type came out of the pipe %#v", sr.Record))
+		}
+		if n.Organization == os.Organization && n.StoreName == os.Name {
+			referenced = true
+		}
+	}
+	if referenced {
+		return true, nil
+	}
+	for sr := range os.GetDB().Search(&ObjectVersion{}, "ObjectId", id) {
+		if sr.Error != nil {
+			return false, sr.Error
+		}
+		v, ok := sr.Record.(*ObjectVersion)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected struct type came out of the pipe %#v", sr.Record))
+		}
+		if v.Organization == os.Organization && v.StoreName == os.Name {
+			referenced = true
+		}
+	}
+	return referenced, nil
+}
+
+// Remove one version of a name
+func (os *ObjectStore) DeleteVersion(name string, version int64) ([]*StoredObject, error) {
+	v, err := os.getVersion(name, version)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := os.GetDB().DeleteRecord(v)
+	if err != nil || !deleted {
+		return nil, err
+	}
+	versions, err := os.Versions(name)
+	if err != nil {
+		return nil, err
+	}
+	n := os.nameFor(name)
+	err = updateRecord(n, func() error {
+		if n.Version != version {
+			//Not the current version
+			return nil
+		}
+		n.ObjectId = ""
+		if len(versions) > 0 {
+			n.ObjectId = versions[0].ObjectId
+		}
+		return nil
+	})
+	if err != nil && !db.IsErrNotFound(err) {
+		return nil, err
+	}
+	if _, err := os.prune(name, time.Now()); err != nil {
+		return nil, err
+	}
+	if v.DeleteMarker() {
+		return nil, nil
+	}
+	return os.unreferenced([]string{v.ObjectId})
+}
+
+// Apply the retention of the store to every name. Returns the versions removed as name@version
+func (os *ObjectStore) ExpireVersions(now time.Time, dryRun bool) ([]string, error) {
+	names := map[string]bool{}
+	for sr := range os.GetDB().Search(&ObjectVersion{}, "Organization", os.Organization) {
+		if sr.Error != nil {
+			return nil, sr.Error
+		}
+		v, ok := sr.Record.(*ObjectVersion)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected struct type came out of the pipe %#v", sr.Record))
+		}
+		if v.StoreName == os.Name {
+			names[v.Name] = true
+		}
+	}
+	expired := []string{}
+	for name := range names {
+		versions, err := os.Versions(name)
+		if err != nil {
+			return expired, err
+		}
+		_, drop := os.retention(versions, now)
+		if len(drop) == 0 {
+			continue
+		}
+		if !dryRun {
+			ids, err := os.prune(name, now)
+			if err != nil {
+				return expired, err
+			}
+			objs, err := os.unreferenced(ids)
+			if err != nil {
+				return expired, err
+			}
+			for _, so := range objs {
+				if err := os.deleteObject(so, EVENT_EXPIRE); err != nil {
+					return expired, err
+				}
+			}
+		}
+		for _, v := range drop {
+			expired = append(expired, fmt.Sprintf("%s@%d", name, v.Version))
+		}
+	}
+	sort.Strings(expired)
+	return expired, nil
+}
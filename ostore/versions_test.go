@@ -0,0 +1,165 @@
+package ostore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestVersionRetention(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	//Newest first, each one replaced the next a day after it was created
+	versions := []*ObjectVersion{
+		{Version: 4, ObjectId: "d", Created: now.Add(-1 * day)},
+		{Version: 3, ObjectId: "c", Created: now.Add(-2 * day)},
+		{Version: 2, ObjectId: "b", Created: now.Add(-3 * day)},
+		{Version: 1, ObjectId: "a", Created: now.Add(-4 * day)},
+	}
+	for i, test := range []struct {
+		max, days int64
+		keep      int
+	}{
+		{0, 0, 1},
+		{2, 0, 2},
+		{VERSIONS_UNLIMITED, 0, 4},
+		{VERSIONS_UNLIMITED, 2, 3},
+		{2, 3, 2},
+		{VERSIONS_UNLIMITED, 1, 2},
+	} {
+		os := &ObjectStore{MaxVersions: test.max, VersionDays: test.days}
+		keep, drop := os.retention(versions, now)
+		if len(keep) != test.keep || len(keep)+len(drop) != len(versions) {
+			t.Errorf("#%d: Kept %d versions and dropped %d instead of keeping %d", i, len(keep), len(drop), test.keep)
+			continue
+		}
+		for j, v := range keep {
+			if v != versions[j] {
+				t.Errorf("#%d: Kept version %d instead of %d", i, v.Version, versions[j].Version)
+			}
+		}
+	}
+	//A lone delete marker is dropped along with the name
+	os := &ObjectStore{}
+	if keep, drop := os.retention([]*ObjectVersion{{Version: 5, Created: now}}, now); len(keep) != 0 || len(drop) != 1 {
+		t.Errorf("Lone delete marker was kept %v", keep)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	if err := RegisterIndexes(getDB()); err != nil {
+		t.Fatal(err)
+	}
+	os := getDummyStore()
+	os.MaxVersions = 3
+	if err := os.Create(); err != nil {
+		t.Fatal(err)
+	}
+	objs := []*StoredObject{}
+	for _, d := range []string{"first", "second", "third", "fourth"} {
+		so := newDummyObject(os, []byte(d))
+		if err := os.PutObject(so, bytes.NewReader([]byte(d)), int64(len(d))); err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, so)
+	}
+	for i, so := range objs[:3] {
+		released, err := os.SetName("name", so)
+		if err != nil || len(released) != 0 {
+			t.Fatalf("#%d: Unexpected set %v %v", i, released, err)
+		}
+	}
+	if so, err := os.ResolveVersion("name", 1); err != nil || so.Id != objs[0].Id {
+		t.Errorf("Unexpected first version %v %v", so, err)
+	}
+	//The fourth version pushes out the first
+	released, err := os.SetName("name", objs[3])
+	if err != nil || len(released) != 1 || released[0].Id != objs[0].Id {
+		t.Errorf("Unexpected released objects %v %v", released, err)
+	}
+	if _, err := os.ResolveVersion("name", 1); err != ErrNotExists {
+		t.Errorf("Version past the retention was resolved: %v", err)
+	}
+
+	if released, err := os.Unname("name"); err != nil || len(released) != 1 || released[0].Id != objs[1].Id {
+		t.Errorf("Unexpected released objects on delete %v %v", released, err)
+	}
+	if _, err := os.Resolve("name"); err != ErrNotExists {
+		t.Errorf("Deleted name was resolved: %v", err)
+	}
+	if _, err := os.ResolveVersion("name", 5); err != ErrDeleteMarker {
+		t.Errorf("Delete marker was resolved: %v", err)
+	}
+	if page, err := os.Names("", "", 10); err != nil || len(page.Names) != 0 {
+		t.Errorf("Deleted name was listed %v %v", page, err)
+	}
+	versions, err := os.Versions("name")
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("Unexpected versions %v %v", versions, err)
+	}
+	for i, v := range versions {
+		if v.Version != int64(5-i) {
+			t.Errorf("#%d: Unexpected version %d", i, v.Version)
+		}
+	}
+
+	//Removing the delete marker brings the name back
+	if released, err := os.DeleteVersion("name", 5); err != nil || len(released) != 0 {
+		t.Errorf("Unexpected delete marker removal %v %v", released, err)
+	}
+	if so, err := os.Resolve("name"); err != nil || so.Id != objs[3].Id {
+		t.Errorf("Name was not restored: %v %v", so, err)
+	}
+	if released, err := os.DeleteVersion("name", 3); err != nil || len(released) != 1 || released[0].Id != objs[2].Id {
+		t.Errorf("Unexpected version removal %v %v", released, err)
+	}
+
+	os.MaxVersions = 0
+	expired, err := os.ExpireVersions(time.Now(), false)
+	if err != nil || len(expired) != 0 {
+		t.Errorf("Unexpected expired versions %v %v", expired, err)
+	}
+	if _, err := os.SetName("name", objs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err := os.Versions("name"); err != nil || len(versions) != 1 || versions[0].Version != 6 {
+		t.Errorf("Unexpected versions after lowering the retention %v %v", versions, err)
+	}
+}
+
+func TestVersionsSharedObject(t *testing.T) {
+	if err := RegisterIndexes(getDB()); err != nil {
+		t.Fatal(err)
+	}
+	os := getDummyStore()
+	os.MaxVersions = 1
+	if err := os.Create(); err != nil {
+		t.Fatal(err)
+	}
+	objs := []*StoredObject{}
+	for _, d := range []string{"shared", "other"} {
+		so := newDummyObject(os, []byte(d))
+		if err := os.PutObject(so, bytes.NewReader([]byte(d)), int64(len(d))); err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, so)
+	}
+	for _, name := range []string{"one", "two"} {
+		if _, err := os.SetName(name, objs[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//Still pointed to by the other name
+	if released, err := os.SetName("one", objs[1]); err != nil || len(released) != 0 {
+		t.Errorf("Unexpected released objects %v %v", released, err)
+	}
+	if _, err := os.ExpireVersions(time.Now(), false); err != nil {
+		t.Fatal(err)
+	}
+	if so, err := os.Resolve("two"); err != nil || so.Id != objs[0].Id {
+		t.Errorf("Shared object was deleted: %v %v", so, err)
+	}
+	if released, err := os.Unname("two"); err != nil || len(released) != 1 || released[0].Id != objs[0].Id {
+		t.Errorf("Unexpected released objects once unreferenced %v %v", released, err)
+	}
+}
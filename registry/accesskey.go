@@ -0,0 +1,119 @@
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/acasajus/menac/db"
+)
+
+const (
+	ACCESS_KEY_ID_LEN     = 20
+	ACCESS_KEY_SECRET_LEN = 30
+	//Access key ids are upper case letters and digits, like the AWS ones
+	ACCESS_KEY_ALPHABET = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+)
+
+// Credentials a user signs requests to the S3 gateway with. The secret is
+// kept as is since request signatures are computed with it
+type AccessKey struct {
+	db.Record
+
+	Id           string `db:"pk"`
+	Secret       string
+	Organization string `db:"indexed"`
+	User         string
+}
+
+func (k *AccessKey) Validate() error {
+	if len(k.Id) == 0 {
+		return errors.New("Empty access key id")
+	}
+	if len(k.Secret) == 0 {
+		return errors.New("Empty secret")
+	}
+	if len(k.Organization) == 0 {
+		return errors.New("Organization is empty")
+	}
+	if len(k.User) == 0 {
+		return errors.New("User is empty")
+	}
+	return nil
+}
+
+func newAccessKeyId() string {
+	b := make([]byte, ACCESS_KEY_ID_LEN)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = ACCESS_KEY_ALPHABET[int(b[i])%len(ACCESS_KEY_ALPHABET)]
+	}
+	return string(b)
+}
+
+func newAccessKeySecret() string {
+	b := make([]byte, ACCESS_KEY_SECRET_LEN)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// Issue a new access key for the user. The secret is only readable from the
+// returned record
+func (u *User) NewAccessKey() (*AccessKey, error) {
+	k := u.GetDB().LinkRecordToDB(&AccessKey{
+		Id:           newAccessKeyId(),
+		Secret:       newAccessKeySecret(),
+		Organization: u.Organization,
+		User:         u.Handle,
+	}).(*AccessKey)
+	if err := k.GetDB().CreateNewRecord(k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (u *User) AccessKeys() ([]*AccessKey, error) {
+	keys := make([]*AccessKey, 0)
+	for sr := range u.GetDB().Search(&AccessKey{}, "Organization", u.Organization) {
+		if sr.Error != nil {
+			return nil, sr.Error
+		}
+		k, ok := sr.Record.(*AccessKey)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected struct type came out of the pipe %#v", sr.Record))
+		}
+		if k.User == u.Handle {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func GetAccessKey(d db.DB, id string) (*AccessKey, error) {
+	k := &AccessKey{Id: id}
+	if err := d.GetRecord([]byte(id), k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *AccessKey) Delete() error {
+	_, err := k.GetDB().DeleteRecord(k)
+	return err
+}
+
+// Create the indexes used to look up users and access keys. Safe to call on
+// every start
+func RegisterIndexes(d db.DB) error {
+	for _, r := range []db.RecordObject{&User{}, &AccessKey{}} {
+		if err := d.RegisterIndexes(r); err != nil && !db.IsErrIndexExists(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -15,6 +15,9 @@ type Group struct {
 	Share        int
 	Properties   []string
 	Organization string
+	//Object store quota shared by the objects of the group
+	QuotaBytes   int64
+	QuotaObjects int64
 
 	org *Organization `db:"-"`
 }
@@ -30,7 +33,7 @@ func (g *Group) Validate() error {
 	if len(g.Organization) == 0 {
 		return errors.New("Organization is empty")
 	}
-	return nil
+	return g.GetQuota().Validate()
 }
 
 func (g *Group) AddUsers(users ...string) {
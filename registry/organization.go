@@ -12,6 +12,9 @@ type Organization struct {
 
 	Handle string `db:"pk"`
 	Groups []string
+	//Object store quota of the whole organization
+	QuotaBytes   int64
+	QuotaObjects int64
 }
 
 func NewOrg(db db.DB) *Organization {
@@ -30,7 +33,7 @@ func (o *Organization) Validate() error {
 	if len(o.Handle) == 0 {
 		return errors.New("Empty organization handle")
 	}
-	return nil
+	return o.GetQuota().Validate()
 }
 
 func (o *Organization) NewUser() *User {
@@ -0,0 +1,51 @@
+package registry
+
+import "errors"
+
+// Limits on what can be kept in the object stores. Zero means no limit
+type Quota struct {
+	Bytes   int64
+	Objects int64
+}
+
+func (q Quota) Validate() error {
+	if q.Bytes < 0 || q.Objects < 0 {
+		return errors.New("Negative quota")
+	}
+	return nil
+}
+
+// Whether adding to the current usage stays within the quota
+func (q Quota) Allows(bytes, objects, addBytes, addObjects int64) bool {
+	if q.Bytes > 0 && bytes+addBytes > q.Bytes {
+		return false
+	}
+	if q.Objects > 0 && objects+addObjects > q.Objects {
+		return false
+	}
+	return true
+}
+
+func (o *Organization) GetQuota() Quota {
+	return Quota{o.QuotaBytes, o.QuotaObjects}
+}
+
+func (o *Organization) SetQuota(q Quota) {
+	o.QuotaBytes, o.QuotaObjects = q.Bytes, q.Objects
+}
+
+func (g *Group) GetQuota() Quota {
+	return Quota{g.QuotaBytes, g.QuotaObjects}
+}
+
+func (g *Group) SetQuota(q Quota) {
+	g.QuotaBytes, g.QuotaObjects = q.Bytes, q.Objects
+}
+
+func (u *User) GetQuota() Quota {
+	return Quota{u.QuotaBytes, u.QuotaObjects}
+}
+
+func (u *User) SetQuota(q Quota) {
+	u.QuotaBytes, u.QuotaObjects = q.Bytes, q.Objects
+}
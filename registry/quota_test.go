@@ -0,0 +1,28 @@
+package registry
+
+import "testing"
+
+func TestQuotaAllows(t *testing.T) {
+	tests := []struct {
+		quota             Quota
+		bytes, objects    int64
+		addBytes, addObjs int64
+
+		allowed bool
+	}{
+		{Quota{}, 1 << 40, 1 << 20, 1, 1, true},
+		{Quota{Bytes: 10}, 5, 100, 5, 1, true},
+		{Quota{Bytes: 10}, 5, 100, 6, 1, false},
+		{Quota{Objects: 2}, 0, 1, 100, 1, true},
+		{Quota{Objects: 2}, 0, 2, 0, 1, false},
+		{Quota{Bytes: 10, Objects: 2}, 10, 0, 0, 1, true},
+	}
+	for i, tt := range tests {
+		if got := tt.quota.Allows(tt.bytes, tt.objects, tt.addBytes, tt.addObjs); got != tt.allowed {
+			t.Errorf("#%d: Allows = %v, want %v", i, got, tt.allowed)
+		}
+	}
+	if err := (Quota{Bytes: -1}).Validate(); err == nil {
+		t.Error("Negative quota is valid")
+	}
+}
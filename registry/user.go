@@ -23,6 +23,11 @@ type User struct {
 	Name         string
 	Password     []byte
 	Organization string `db:"indexed"`
+	//Group objects are created in when none is given
+	DefaultGroup string
+	//Object store quota of the objects owned by the user
+	QuotaBytes   int64
+	QuotaObjects int64
 }
 
 func (u *User) GetPrimaryKey() []byte {
@@ -45,7 +50,7 @@ func (u *User) Validate() error {
 	if len(u.Email) == 0 {
 		return errors.New("Email is empty")
 	}
-	return nil
+	return u.GetQuota().Validate()
 }
 
 func (u *User) Create() error {
@@ -60,3 +60,45 @@ func TestUserPassword(t *testing.T) {
 		t.Fatal("Different passwords match")
 	}
 }
+
+func TestUserAccessKeys(t *testing.T) {
+	if err := RegisterIndexes(getDB()); err != nil {
+		t.Fatal(err)
+	}
+	o := getDummyOrg()
+	u := o.NewUser()
+	u.Handle = "keyuser"
+	u.Email = []string{"key@user"}
+	u.Name = "Key User"
+	u.SetPassword("secret")
+	if err := u.Create(); err != nil {
+		t.Fatal(err)
+	}
+	k, err := u.NewAccessKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(k.Id) != ACCESS_KEY_ID_LEN || len(k.Secret) == 0 {
+		t.Errorf("Invalid access key %#v", k)
+	}
+	k2, err := GetAccessKey(getDB(), k.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k2.Secret != k.Secret || k2.User != u.Handle || k2.Organization != o.Handle {
+		t.Errorf("Access keys differ %#v %#v", k, k2)
+	}
+	keys, err := u.AccessKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Id != k.Id {
+		t.Errorf("Unexpected access keys %v", keys)
+	}
+	if err := k.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetAccessKey(getDB(), k.Id); err != db.ERR_NO_EXIST {
+		t.Errorf("Deleted access key is still there: %v", err)
+	}
+}
@@ -1,26 +1,204 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/acasajus/menac/coord"
+	pb "github.com/acasajus/menac/coord/proto"
+	"github.com/acasajus/menac/db"
+	"github.com/acasajus/menac/ostore"
+	"github.com/acasajus/menac/ostore/s3gw"
+	"github.com/acasajus/menac/registry"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 )
 
+// Where presigned object URLs are served in the HTTP API
+const PRESIGNED_PATH = "/ostore/presigned/"
+
+const (
+	//Lease of the roles served by the node
+	ANNOUNCE_TTL = 30 * time.Second
+	//Announcements wait this long for a leader before retrying
+	ANNOUNCE_TIMEOUT     = 10 * time.Second
+	ANNOUNCE_MAX_BACKOFF = time.Minute
+)
+
+func connectDB(namespace, addr string) (db.DB, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	return db.NewDB(namespace, host, port)
+}
+
+// Announce the roles until it succeeds. Without a leader proposals never
+// complete, so each attempt has a deadline
+func announce(services *coord.ServiceRegistry, self *pb.PeerInfo) {
+	backoff := time.Second
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), ANNOUNCE_TIMEOUT)
+		err := services.Announce(ctx, self, ANNOUNCE_TTL)
+		cancel()
+		if err == nil {
+			return
+		}
+		log.Printf("Cannot announce roles, retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > ANNOUNCE_MAX_BACKOFF {
+			backoff = ANNOUNCE_MAX_BACKOFF
+		}
+	}
+}
+
 func main() {
 	svcAddr := flag.String("connect", "", "address to connect to")
 	port := flag.Int("port", 0, "Port to listen to")
+	dbFile := flag.String("db", "menac.db", "File where to store the coordination state")
+	learner := flag.Bool("learner", false, "Join as a non voting member")
+	bootstrap := flag.Bool("bootstrap", false, "Start a new cluster with this node as its only member. Ignored if the node already has state")
+	roles := flag.String("roles", "", "Comma separated list of roles served by this node")
+	aerospike := flag.String("aerospike", "", "host:port of the aerospike cluster. Enables the object store GC and scrubber")
+	namespace := flag.String("namespace", "menac", "Aerospike namespace")
+	gcDryRun := flag.Bool("gc-dry-run", false, "Only report what the object store GC would remove")
+	httpAddr := flag.String("http", "", "Address to serve the HTTP API at")
+	usageKey := flag.String("usage-key", "", "File with the key the usage API tokens of each organization are derived from. The API is only served if set")
+	s3Addr := flag.String("s3", "", "Address to serve the S3 compatible gateway at. Requires -aerospike")
+	presignKey := flag.String("presign-key", "", "File with the key presigned object URLs are signed with")
+	presignURL := flag.String("presign-url", "", "External URL of the HTTP API, used to build presigned object URLs")
+	scrubRate := flag.Int64("scrub-rate", ostore.SCRUB_RATE, "Bytes per second read by the object store scrubber. 0 disables the limit")
+	transferRate := flag.Int64("transfer-rate", 0, "Bytes per second moved by all the object store backends of the node. 0 disables the limit")
+	transferOrgRate := flag.Int64("transfer-org-rate", 0, "Bytes per second moved by the object store backends of each organization. 0 disables the limit")
+	transferConcurrency := flag.Int("transfer-concurrency", 0, "Uploads and downloads running at once per object store backend. 0 disables the limit")
+	webhook := flag.String("webhook", "", "URL object store events are posted to")
+	webhookKey := flag.String("webhook-key", "", "File with the key webhook deliveries are signed with")
+	webhookTypes := flag.String("webhook-types", "", "Comma separated list of the object types posted to the webhook. Empty posts all of them")
 	flag.Parse()
+	if *transferRate > 0 || *transferOrgRate > 0 || *transferConcurrency > 0 {
+		ostore.SetTransferManager(ostore.NewTransferManager(ostore.TransferLimits{
+			Rate:        *transferRate,
+			OrgRate:     *transferOrgRate,
+			Concurrency: *transferConcurrency,
+		}))
+	}
+	if *webhook != "" {
+		key, err := ioutil.ReadFile(*webhookKey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		filter := ostore.EventFilter{}
+		if *webhookTypes != "" {
+			filter.Types = strings.Split(*webhookTypes, ",")
+		}
+		ostore.Subscribe(filter, ostore.NewWebhookSubscriber(*webhook, bytes.TrimSpace(key)))
+	}
+	var d db.DB
+	if *aerospike != "" {
+		var err error
+		if d, err = connectDB(*namespace, *aerospike); err != nil {
+			log.Fatalln(err)
+		}
+		if err := ostore.RegisterIndexes(d); err != nil {
+			log.Fatalln(err)
+		}
+		if err := registry.RegisterIndexes(d); err != nil {
+			log.Fatalln(err)
+		}
+		if err := s3gw.RegisterIndexes(d); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	var presigner *ostore.Presigner
+	if d != nil && *presignKey != "" && *presignURL != "" {
+		key, err := ioutil.ReadFile(*presignKey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		base := strings.TrimSuffix(*presignURL, "/") + PRESIGNED_PATH
+		if presigner, err = ostore.NewPresigner(d, bytes.TrimSpace(key), base); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	var usage []byte
+	if *usageKey != "" {
+		key, err := ioutil.ReadFile(*usageKey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		usage = bytes.TrimSpace(key)
+	}
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args(), d, presigner, usage); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
+	storage, err := coord.CreateBoltStorage(*dbFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	mux := coord.NewCommandMux()
+	services := coord.NewServiceRegistry(mux)
+	var node *coord.Node
+	if *bootstrap {
+		if *svcAddr != "" {
+			log.Fatalln("-bootstrap and -connect are exclusive")
+		}
+		node, err = coord.NewBootstrapNode(storage, mux, lis.Addr().String())
+	} else {
+		node, err = coord.NewNode(storage, mux, nil)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	services.Attach(node)
+	if d != nil {
+		gc := ostore.NewGC(d, node)
+		gc.DryRun = *gcDryRun
+		gc.Start()
+		scrubber := ostore.NewScrubber(d, node)
+		scrubber.Rate = *scrubRate
+		scrubber.Start()
+	}
+	if *httpAddr != "" {
+		httpMux := http.NewServeMux()
+		if d != nil && len(usage) > 0 {
+			httpMux.Handle("/ostore/usage/", ostore.UsageHandler(d, "/ostore/usage/", usage))
+		}
+		if presigner != nil {
+			httpMux.Handle(PRESIGNED_PATH, presigner)
+		}
+		go func() {
+			log.Fatalln(http.ListenAndServe(*httpAddr, httpMux))
+		}()
+	}
+	if *s3Addr != "" {
+		if d == nil {
+			log.Fatalln("The S3 gateway needs -aerospike")
+		}
+		go func() {
+			log.Fatalln(http.ListenAndServe(*s3Addr, s3gw.New(d)))
+		}()
+	}
 	grpcServer := grpc.NewServer()
-	coord.RegisterServer(grpcServer)
-	node := NewNode()
+	coord.RegisterServer(grpcServer, node)
 
 	if *svcAddr != "" {
 		conn, err := grpc.Dial(*svcAddr)
@@ -28,7 +206,15 @@ func main() {
 			log.Fatalln(err)
 		}
 		defer conn.Close()
-		client := coord.NewClient(conn)
+		client := pb.NewCoordinateClient(conn)
+		self := &pb.PeerInfo{Id: node.Id(), Address: lis.Addr().String(), Learner: *learner}
+		if err := node.Join(context.Background(), client, self); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *roles != "" {
+		self := &pb.PeerInfo{Id: node.Id(), Address: lis.Addr().String(), Roles: strings.Split(*roles, ",")}
+		go announce(services, self)
 	}
 
 	log.Println("Listening at", lis.Addr())